@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"suite/suite/config"
+)
+
+// auditReportDir keeps the audit report of every provisioning run as evidence
+var auditReportDir = "/var/log/setupsuite/audit"
+
+// auditDocsURL is where the config blocks that fix a finding are documented
+const auditDocsURL = "https://github.com/FlubioStudios/SetupSuite#"
+
+// AuditStatus is the outcome of one audit check
+type AuditStatus string
+
+const (
+	AuditPass AuditStatus = "pass"
+	AuditFail AuditStatus = "fail"
+	// AuditSkip marks checks that do not apply to the host or could not run
+	AuditSkip AuditStatus = "skip"
+)
+
+// auditSeverityWeights weigh the checks in the score
+var auditSeverityWeights = map[string]int{"high": 3, "medium": 2, "low": 1}
+
+// auditCheck is one entry of the audit catalog
+type auditCheck struct {
+	ID          string
+	Title       string
+	Category    string
+	Severity    string // high, medium or low
+	Remediation string
+	Fix         string // SetupSuite config that fixes a failure, if any
+	FixAnchor   string // README section documenting Fix
+	run         func(a *auditContext) (AuditStatus, string)
+}
+
+// AuditResult is the outcome of one check with its evidence
+type AuditResult struct {
+	ID          string      `json:"id"`
+	Title       string      `json:"title"`
+	Category    string      `json:"category"`
+	Severity    string      `json:"severity"`
+	Status      AuditStatus `json:"status"`
+	Evidence    string      `json:"evidence"`
+	Remediation string      `json:"remediation,omitempty"`
+	Fix         string      `json:"fix,omitempty"`
+	FixURL      string      `json:"fix_url,omitempty"`
+}
+
+// AuditReport is the scored result of an audit
+type AuditReport struct {
+	Host    string        `json:"host"`
+	Distro  string        `json:"distro"`
+	Time    time.Time     `json:"time"`
+	Score   int           `json:"score"` // 0 to 100, weighted by severity
+	Passed  int           `json:"passed"`
+	Failed  int           `json:"failed"`
+	Skipped int           `json:"skipped"`
+	Results []AuditResult `json:"results"`
+}
+
+// auditCatalog lists the checks in report order
+var auditCatalog = []auditCheck{
+	{
+		ID: "ssh-root-login", Title: "SSH root login is disabled", Category: "ssh", Severity: "high",
+		Remediation: "Set PermitRootLogin no and log in as a user with sudo.",
+		Fix:         ".ssh{}", FixAnchor: "ssh-hardening",
+		run: func(a *auditContext) (AuditStatus, string) { return a.sshdSettingIs("permitrootlogin", "no") },
+	},
+	{
+		ID: "ssh-password-auth", Title: "SSH password authentication is disabled", Category: "ssh", Severity: "high",
+		Remediation: "Set PasswordAuthentication no and use keys or certificates.",
+		Fix:         ".ssh{}", FixAnchor: "ssh-hardening",
+		run: func(a *auditContext) (AuditStatus, string) { return a.sshdSettingIs("passwordauthentication", "no") },
+	},
+	{
+		ID: "ssh-empty-passwords", Title: "SSH refuses empty passwords", Category: "ssh", Severity: "high",
+		Remediation: "Set PermitEmptyPasswords no.",
+		Fix:         ".ssh{}", FixAnchor: "ssh-hardening",
+		run: func(a *auditContext) (AuditStatus, string) { return a.sshdSettingIs("permitemptypasswords", "no") },
+	},
+	{
+		ID: "ssh-max-auth-tries", Title: "SSH allows at most 4 authentication attempts", Category: "ssh", Severity: "medium",
+		Remediation: "Set MaxAuthTries 4 or lower.",
+		Fix:         ".ssh{} max_auth_tries: 3", FixAnchor: "ssh-hardening",
+		run: auditSSHMaxAuthTries,
+	},
+	{
+		ID: "ssh-x11-forwarding", Title: "SSH X11 forwarding is disabled", Category: "ssh", Severity: "low",
+		Remediation: "Set X11Forwarding no.",
+		Fix:         ".ssh{} x11_forwarding: false", FixAnchor: "ssh-hardening",
+		run: func(a *auditContext) (AuditStatus, string) { return a.sshdSettingIs("x11forwarding", "no") },
+	},
+	{
+		ID: "ssh-crypto", Title: "SSH offers no weak ciphers, MACs or key exchanges", Category: "ssh", Severity: "medium",
+		Remediation: "Remove CBC and 3DES ciphers, MD5 and SHA1 MACs and SHA1 key exchanges.",
+		Fix:         `.ssh{} crypto: "modern"`, FixAnchor: "ssh-hardening",
+		run: auditSSHCrypto,
+	},
+	{
+		ID: "world-writable", Title: "No world-writable files or directories without sticky bit", Category: "filesystem", Severity: "medium",
+		Remediation: "Remove the write bit for others (chmod o-w) or set the sticky bit on shared directories (chmod +t).",
+		run: func(a *auditContext) (AuditStatus, string) {
+			return auditPathList(a.filesystem().WorldWritable, "world-writable paths")
+		},
+	},
+	{
+		ID: "suid-binaries", Title: "No unexpected SUID or SGID binaries", Category: "filesystem", Severity: "medium",
+		Remediation: "Review each binary and remove the bit with chmod u-s,g-s unless it is needed.",
+		run:         auditSUIDBinaries,
+	},
+	{
+		ID: "unowned-files", Title: "Every file has an existing owner and group", Category: "filesystem", Severity: "medium",
+		Remediation: "Assign the files to an existing user and group with chown, or delete them.",
+		run: func(a *auditContext) (AuditStatus, string) {
+			return auditPathList(a.filesystem().Unowned, "files without owner or group")
+		},
+	},
+	{
+		ID: "uid0-accounts", Title: "Only root has UID 0", Category: "accounts", Severity: "high",
+		Remediation: "Give the other accounts a UID of their own or remove them.",
+		run:         auditUID0Accounts,
+	},
+	{
+		ID: "empty-passwords", Title: "No account has an empty password", Category: "accounts", Severity: "high",
+		Remediation: "Lock the accounts with passwd -l or set a password.",
+		Fix:         ".users{} lock_password: true", FixAnchor: "users",
+		run: auditEmptyPasswords,
+	},
+	{
+		ID: "password-policy", Title: "Password aging and quality are enforced", Category: "accounts", Severity: "low",
+		Remediation: "Set PASS_MAX_DAYS 365, PASS_MIN_DAYS 1 and PASS_WARN_AGE 7 in /etc/login.defs and minlen = 14 in /etc/security/pwquality.conf.",
+		run:         auditPasswordPolicy,
+	},
+	{
+		ID: "firewall-default-deny", Title: "The firewall drops incoming traffic by default", Category: "firewall", Severity: "high",
+		Remediation: "Enable the firewall with a deny policy for incoming traffic and allow only the needed ports.",
+		Fix:         ".firewall{}", FixAnchor: "firewall-rules",
+		run: auditFirewallDefaultDeny,
+	},
+	{
+		ID: "unattended-upgrades", Title: "Security updates are installed automatically", Category: "updates", Severity: "medium",
+		Remediation: "Install and enable unattended-upgrades (Debian, Ubuntu) or dnf-automatic (RHEL, Fedora).",
+		run:         auditUnattendedUpgrades,
+	},
+	{
+		ID: "listening-services", Title: "Only expected services listen on public addresses", Category: "network", Severity: "medium",
+		Remediation: "Bind internal services to 127.0.0.1, disable unneeded ones, or allow the port deliberately.",
+		Fix:         ".firewall{} or .services{}", FixAnchor: "firewall-rules",
+		run: auditListeningServices,
+	},
+	{
+		ID: "kernel-sysctl", Title: "Kernel and network parameters are hardened", Category: "kernel", Severity: "medium",
+		Remediation: "Set the listed parameters in /etc/sysctl.d and load them with sysctl --system.",
+		Fix:         ".sysctl{}", FixAnchor: "kernel-parameters",
+		run: auditSysctl,
+	},
+}
+
+// RunAudit runs the audit catalog against the host without changing
+// anything. cfg may be nil; with a config, listening ports and kernel
+// parameters are compared against it.
+func RunAudit(cfg *config.ServerConfig, facts *Facts) *AuditReport {
+	a := &auditContext{cfg: cfg, facts: facts}
+	report := &AuditReport{Time: time.Now().UTC()}
+	if facts != nil {
+		report.Host = facts.Hostname
+		report.Distro = strings.TrimSpace(facts.Distro.ID + " " + facts.Distro.Version)
+	}
+
+	for _, check := range auditCatalog {
+		status, evidence := check.run(a)
+		result := AuditResult{
+			ID:       check.ID,
+			Title:    check.Title,
+			Category: check.Category,
+			Severity: check.Severity,
+			Status:   status,
+			Evidence: evidence,
+		}
+		if status == AuditFail {
+			result.Remediation = check.Remediation
+			result.Fix = check.Fix
+			if check.FixAnchor != "" {
+				result.FixURL = auditDocsURL + check.FixAnchor
+			}
+		}
+		VerboseLogger.LogInfo("Audit %s %s: %s", status, check.ID, evidence)
+		report.Results = append(report.Results, result)
+	}
+	report.score()
+	return report
+}
+
+// score counts the results and weighs passed against failed checks.
+// Skipped checks do not count.
+func (r *AuditReport) score() {
+	r.Passed, r.Failed, r.Skipped = 0, 0, 0
+	passed, total := 0, 0
+	for _, result := range r.Results {
+		weight := auditSeverityWeights[result.Severity]
+		switch result.Status {
+		case AuditPass:
+			r.Passed++
+			passed += weight
+			total += weight
+		case AuditFail:
+			r.Failed++
+			total += weight
+		default:
+			r.Skipped++
+		}
+	}
+	r.Score = 100
+	if total > 0 {
+		r.Score = int(math.Round(100 * float64(passed) / float64(total)))
+	}
+}
+
+// Render formats the report as json, markdown or html
+func (r *AuditReport) Render(format string) (string, error) {
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(data) + "\n", nil
+	case "markdown", "md":
+		return r.markdown(), nil
+	case "html":
+		var b strings.Builder
+		if err := auditHTMLTemplate.Execute(&b, r); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+	return "", fmt.Errorf("unsupported report format %q (use json, markdown or html)", format)
+}
+
+func (r *AuditReport) markdown() string {
+	var b strings.Builder
+	b.WriteString("# SetupSuite Security Audit\n\n")
+	fmt.Fprintf(&b, "- Host: %s (%s)\n", r.Host, r.Distro)
+	fmt.Fprintf(&b, "- Time: %s\n", r.Time.Format(time.RFC3339))
+	fmt.Fprintf(&b, "- Score: **%d/100** (%d passed, %d failed, %d skipped)\n\n", r.Score, r.Passed, r.Failed, r.Skipped)
+
+	b.WriteString("| Status | Severity | Check | Evidence |\n")
+	b.WriteString("|--------|----------|-------|----------|\n")
+	for _, result := range r.Results {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", strings.ToUpper(string(result.Status)), result.Severity,
+			markdownCell(result.Title), markdownCell(result.Evidence))
+	}
+
+	if r.Failed == 0 {
+		return b.String()
+	}
+	b.WriteString("\n## Remediation\n")
+	for _, result := range r.Results {
+		if result.Status != AuditFail {
+			continue
+		}
+		fmt.Fprintf(&b, "\n### %s (%s)\n\n", result.Title, result.Severity)
+		fmt.Fprintf(&b, "%s\n", result.Remediation)
+		if result.Fix != "" {
+			fmt.Fprintf(&b, "\nSetupSuite fixes this with [`%s`](%s).\n", result.Fix, result.FixURL)
+		}
+	}
+	return b.String()
+}
+
+// markdownCell keeps text inside one table cell
+func markdownCell(text string) string {
+	text = strings.Replace(text, "|", "\\|", -1)
+	return strings.Replace(text, "\n", "<br>", -1)
+}
+
+var auditHTMLTemplate = template.Must(template.New("audit").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>SetupSuite Security Audit: {{.Host}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+.pass { color: #1a7f37; } .fail { color: #cf222e; font-weight: bold; } .skip { color: #6e7781; }
+</style>
+</head>
+<body>
+<h1>SetupSuite Security Audit</h1>
+<p>Host: {{.Host}} ({{.Distro}})<br>
+Time: {{.Time.Format "2006-01-02T15:04:05Z07:00"}}<br>
+Score: <strong>{{.Score}}/100</strong> ({{.Passed}} passed, {{.Failed}} failed, {{.Skipped}} skipped)</p>
+<table>
+<tr><th>Status</th><th>Severity</th><th>Check</th><th>Evidence</th><th>Remediation</th></tr>
+{{range .Results}}<tr>
+<td class="{{.Status}}">{{.Status}}</td>
+<td>{{.Severity}}</td>
+<td>{{.Title}}</td>
+<td>{{.Evidence}}</td>
+<td>{{.Remediation}}{{if .Fix}}<br>Fix: <a href="{{.FixURL}}"><code>{{.Fix}}</code></a>{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// SaveAuditReport writes the report as JSON to the audit directory and
+// returns its path
+func SaveAuditReport(report *AuditReport) (string, error) {
+	data, err := report.Render("json")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(auditReportDir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(auditReportDir, "audit-"+report.Time.Format("20060102-150405")+".json")
+	return path, ioutil.WriteFile(path, []byte(data), 0600)
+}
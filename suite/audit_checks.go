@@ -0,0 +1,673 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"suite/suite/config"
+)
+
+// Paths read by the audit, overridable in tests
+var (
+	auditScanRoot = "/"
+	groupPath     = "/etc/group"
+	loginDefsPath = "/etc/login.defs"
+	pwqualityPath = "/etc/security/pwquality.conf"
+	aptConfDir    = "/etc/apt/apt.conf.d"
+	procNetDir    = "/proc/net"
+)
+
+// auditSkipDirs are never scanned: pseudo filesystems and container storage,
+// whose image layers hold complete root filesystems
+var auditSkipDirs = []string{"/proc", "/sys", "/dev", "/run", "/var/lib/docker", "/var/lib/containers", "/snap"}
+
+// auditLocalFilesystems are the filesystem types scanned for files
+var auditLocalFilesystems = map[string]bool{
+	"ext2": true, "ext3": true, "ext4": true, "xfs": true, "btrfs": true,
+	"zfs": true, "f2fs": true, "jfs": true, "reiserfs": true,
+}
+
+// expectedSUIDBinaries are the SUID and SGID programs distributions ship
+var expectedSUIDBinaries = map[string]bool{
+	"passwd": true, "chsh": true, "chfn": true, "newgrp": true, "gpasswd": true,
+	"su": true, "sudo": true, "sudoedit": true, "mount": true, "umount": true,
+	"ping": true, "ping6": true, "pkexec": true, "crontab": true, "at": true,
+	"chage": true, "expiry": true, "wall": true, "write": true, "bsd-write": true,
+	"unix_chkpwd": true, "pam_timestamp_check": true, "ssh-keysign": true, "ssh-agent": true,
+	"dbus-daemon-launch-helper": true, "polkit-agent-helper-1": true,
+	"fusermount": true, "fusermount3": true, "newuidmap": true, "newgidmap": true,
+	"mount.nfs": true, "mount.cifs": true, "dotlockfile": true, "locate": true,
+	"plocate": true, "mlocate": true, "sg": true, "userhelper": true, "ksu": true,
+	"utempter": true, "Xorg.wrap": true, "staprun": true, "chromium-sandbox": true,
+	"snap-confine": true, "bbsuid": true, "busybox": true,
+}
+
+// suidBinDirs hold the expected binaries directly, suidLibDirs in package
+// subdirectories such as /usr/lib/openssh
+var (
+	suidBinDirs = []string{"/bin", "/sbin", "/usr/bin", "/usr/sbin"}
+	suidLibDirs = []string{"/lib/", "/lib64/", "/usr/lib/", "/usr/lib64/", "/usr/libexec/"}
+)
+
+// auditContext caches what several checks need
+type auditContext struct {
+	cfg   *config.ServerConfig
+	facts *Facts
+
+	sshd    map[string]string
+	sshdErr error
+	scanned *filesystemScan
+}
+
+// filesystemScan holds the findings of the single walk over local filesystems
+type filesystemScan struct {
+	WorldWritable []string
+	SUID          []string
+	Unowned       []string
+}
+
+// sshdEffective returns the effective sshd settings from sshd -T
+func (a *auditContext) sshdEffective() (map[string]string, error) {
+	if a.sshd == nil && a.sshdErr == nil {
+		sshd := "sshd"
+		if _, err := exec.LookPath(sshd); err != nil {
+			sshd = "/usr/sbin/sshd"
+		}
+		output, err := exec.Command(sshd, "-T").CombinedOutput()
+		if err != nil {
+			if detail := lastLine(string(output)); detail != "" {
+				err = fmt.Errorf("%s", detail)
+			}
+			a.sshdErr = fmt.Errorf("sshd -T failed: %v", err)
+		} else {
+			a.sshd = parseSSHDEffective(string(output))
+		}
+	}
+	return a.sshd, a.sshdErr
+}
+
+// parseSSHDEffective reads the lowercase "key value" lines of sshd -T
+func parseSSHDEffective(output string) map[string]string {
+	settings := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(fields) == 2 {
+			settings[strings.ToLower(fields[0])] = fields[1]
+		}
+	}
+	return settings
+}
+
+// sshdSettingIs checks one effective sshd setting
+func (a *auditContext) sshdSettingIs(key, want string) (AuditStatus, string) {
+	settings, err := a.sshdEffective()
+	if err != nil {
+		return AuditSkip, err.Error()
+	}
+	value, ok := settings[key]
+	if !ok {
+		return AuditSkip, fmt.Sprintf("sshd -T does not report %s", key)
+	}
+	if value != want {
+		return AuditFail, fmt.Sprintf("%s %s", key, value)
+	}
+	return AuditPass, fmt.Sprintf("%s %s", key, value)
+}
+
+func auditSSHMaxAuthTries(a *auditContext) (AuditStatus, string) {
+	settings, err := a.sshdEffective()
+	if err != nil {
+		return AuditSkip, err.Error()
+	}
+	tries, err := strconv.Atoi(settings["maxauthtries"])
+	if err != nil {
+		return AuditSkip, "sshd -T does not report maxauthtries"
+	}
+	if tries > 4 {
+		return AuditFail, fmt.Sprintf("maxauthtries %d", tries)
+	}
+	return AuditPass, fmt.Sprintf("maxauthtries %d", tries)
+}
+
+func auditSSHCrypto(a *auditContext) (AuditStatus, string) {
+	settings, err := a.sshdEffective()
+	if err != nil {
+		return AuditSkip, err.Error()
+	}
+	var weak []string
+	for _, key := range []string{"ciphers", "macs", "kexalgorithms"} {
+		for _, algorithm := range strings.Split(settings[key], ",") {
+			if weakSSHAlgorithm(key, algorithm) {
+				weak = append(weak, algorithm)
+			}
+		}
+	}
+	if len(weak) > 0 {
+		return AuditFail, "weak algorithms offered: " + strings.Join(weak, ", ")
+	}
+	return AuditPass, "no weak algorithms offered"
+}
+
+// weakSSHAlgorithm reports whether an algorithm of the given sshd -T list
+// is considered weak
+func weakSSHAlgorithm(list, algorithm string) bool {
+	switch list {
+	case "ciphers":
+		return strings.Contains(algorithm, "cbc") || strings.Contains(algorithm, "arcfour") || strings.Contains(algorithm, "3des")
+	case "macs":
+		return strings.Contains(algorithm, "md5") || strings.HasPrefix(algorithm, "hmac-sha1") || strings.HasPrefix(algorithm, "umac-64")
+	case "kexalgorithms":
+		return strings.HasSuffix(algorithm, "-sha1")
+	}
+	return false
+}
+
+// filesystem walks the local filesystems once for the file checks
+func (a *auditContext) filesystem() *filesystemScan {
+	if a.scanned == nil {
+		a.scanned = scanFilesystem(auditScanRoot, nonLocalMounts(), passwdIDs(passwdPath), passwdIDs(groupPath))
+	}
+	return a.scanned
+}
+
+// nonLocalMounts returns the mount points of network and pseudo filesystems
+func nonLocalMounts() map[string]bool {
+	skip := make(map[string]bool)
+	data, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return skip
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && !auditLocalFilesystems[fields[2]] {
+			skip[fields[1]] = true
+		}
+	}
+	// The root itself is scanned even if it is an overlay, as in containers
+	delete(skip, "/")
+	return skip
+}
+
+// passwdIDs returns the IDs in the third field of a passwd or group file
+func passwdIDs(path string) map[uint32]bool {
+	ids := make(map[uint32]bool)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+		if id, err := strconv.ParseUint(fields[2], 10, 32); err == nil {
+			ids[uint32(id)] = true
+		}
+	}
+	return ids
+}
+
+// scanFilesystem collects world-writable paths, SUID and SGID files and
+// files whose owner or group does not exist. Nil id sets skip the owner check.
+func scanFilesystem(root string, skipMounts map[string]bool, uids, gids map[uint32]bool) *filesystemScan {
+	scan := &filesystemScan{}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel := "/" + strings.TrimPrefix(strings.TrimPrefix(path, root), "/")
+		if info.IsDir() && path != root {
+			if skipMounts[rel] {
+				return filepath.SkipDir
+			}
+			for _, dir := range auditSkipDirs {
+				if rel == dir {
+					return filepath.SkipDir
+				}
+			}
+		}
+
+		mode := info.Mode()
+		switch {
+		case mode&os.ModeSymlink != 0:
+			// Symlinks are always 0777
+		case mode.IsDir() && mode.Perm()&0002 != 0 && mode&os.ModeSticky == 0:
+			scan.WorldWritable = append(scan.WorldWritable, rel)
+		case mode.IsRegular() && mode.Perm()&0002 != 0:
+			scan.WorldWritable = append(scan.WorldWritable, rel)
+		}
+		if mode.IsRegular() && mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			scan.SUID = append(scan.SUID, rel)
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && uids != nil && gids != nil {
+			if !uids[stat.Uid] || !gids[stat.Gid] {
+				scan.Unowned = append(scan.Unowned, rel)
+			}
+		}
+		return nil
+	})
+	return scan
+}
+
+// auditPathList fails if any path was found, listing the first ten
+func auditPathList(paths []string, what string) (AuditStatus, string) {
+	if len(paths) == 0 {
+		return AuditPass, "no " + what
+	}
+	return AuditFail, fmt.Sprintf("%d %s: %s", len(paths), what, shortList(paths, 10))
+}
+
+// shortList joins up to max entries and counts the rest
+func shortList(items []string, max int) string {
+	if len(items) <= max {
+		return strings.Join(items, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(items[:max], ", "), len(items)-max)
+}
+
+func auditSUIDBinaries(a *auditContext) (AuditStatus, string) {
+	var unexpected []string
+	all := a.filesystem().SUID
+	for _, path := range all {
+		if !expectedSUIDBinary(path) {
+			unexpected = append(unexpected, path)
+		}
+	}
+	if len(unexpected) > 0 {
+		return AuditFail, fmt.Sprintf("%d unexpected: %s", len(unexpected), shortList(unexpected, 10))
+	}
+	return AuditPass, fmt.Sprintf("%d SUID/SGID binaries, all shipped by the distribution", len(all))
+}
+
+// expectedSUIDBinary reports whether path is a distribution SUID program in
+// a system directory. A copy of su under /tmp or /home is not.
+func expectedSUIDBinary(path string) bool {
+	if !expectedSUIDBinaries[filepath.Base(path)] {
+		return false
+	}
+	dir := filepath.Dir(path)
+	for _, binDir := range suidBinDirs {
+		if dir == binDir {
+			return true
+		}
+	}
+	for _, libDir := range suidLibDirs {
+		if strings.HasPrefix(path, libDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func auditUID0Accounts(a *auditContext) (AuditStatus, string) {
+	data, err := ioutil.ReadFile(passwdPath)
+	if err != nil {
+		return AuditSkip, err.Error()
+	}
+	var others []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) >= 3 && fields[2] == "0" && fields[0] != "root" {
+			others = append(others, fields[0])
+		}
+	}
+	if len(others) > 0 {
+		return AuditFail, "UID 0: root, " + strings.Join(others, ", ")
+	}
+	return AuditPass, "UID 0: root"
+}
+
+func auditEmptyPasswords(a *auditContext) (AuditStatus, string) {
+	data, err := ioutil.ReadFile(shadowPath)
+	if err != nil {
+		return AuditSkip, err.Error()
+	}
+	var empty []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) >= 2 && fields[0] != "" && fields[1] == "" {
+			empty = append(empty, fields[0])
+		}
+	}
+	if len(empty) > 0 {
+		return AuditFail, "empty password: " + strings.Join(empty, ", ")
+	}
+	return AuditPass, "every account has a password or is locked"
+}
+
+func auditPasswordPolicy(a *auditContext) (AuditStatus, string) {
+	defs := readKeyValues(loginDefsPath, " \t")
+	quality := readKeyValues(pwqualityPath, "=")
+
+	var problems, evidence []string
+	limits := []struct {
+		key, file string
+		values    map[string]string
+		want      int
+		atMost    bool
+	}{
+		{"PASS_MAX_DAYS", "login.defs", defs, 365, true},
+		{"PASS_MIN_DAYS", "login.defs", defs, 1, false},
+		{"PASS_WARN_AGE", "login.defs", defs, 7, false},
+		{"minlen", "pwquality.conf", quality, 14, false},
+	}
+	for _, limit := range limits {
+		value, err := strconv.Atoi(limit.values[limit.key])
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s not set in %s", limit.key, limit.file))
+		case limit.atMost && value > limit.want, !limit.atMost && value < limit.want:
+			problems = append(problems, fmt.Sprintf("%s %d", limit.key, value))
+		default:
+			evidence = append(evidence, fmt.Sprintf("%s %d", limit.key, value))
+		}
+	}
+	if len(problems) > 0 {
+		return AuditFail, strings.Join(problems, ", ")
+	}
+	return AuditPass, strings.Join(evidence, ", ")
+}
+
+// readKeyValues reads "key<sep>value" lines, ignoring comments
+func readKeyValues(path, separators string) map[string]string {
+	values := make(map[string]string)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexAny(line, separators); i > 0 {
+			values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return values
+}
+
+func auditFirewallDefaultDeny(a *auditContext) (AuditStatus, string) {
+	backend := ""
+	if a.cfg != nil && a.cfg.SetupSecure != nil && a.cfg.SetupSecure.Firewall != nil {
+		backend = a.cfg.SetupSecure.Firewall.Backend
+	}
+	if backend == "" || backend == "auto" {
+		var err error
+		if backend, err = firewallBackend(); err != nil {
+			return AuditFail, err.Error()
+		}
+	}
+
+	switch backend {
+	case "ufw":
+		output, err := exec.Command("ufw", "status", "verbose").CombinedOutput()
+		if err != nil {
+			return AuditSkip, fmt.Sprintf("ufw status failed: %s", lastLine(string(output)))
+		}
+		if !ufwDeniesIncoming(string(output)) {
+			return AuditFail, "ufw is inactive or allows incoming traffic by default"
+		}
+		return AuditPass, "ufw denies incoming traffic by default"
+	case "firewalld":
+		zone, err := exec.Command("firewall-cmd", "--get-default-zone").Output()
+		if err != nil {
+			return AuditFail, "firewalld is not running"
+		}
+		name := strings.TrimSpace(string(zone))
+		target, err := exec.Command("firewall-cmd", "--permanent", "--zone="+name, "--get-target").Output()
+		if err != nil {
+			return AuditSkip, fmt.Sprintf("could not read the target of zone %s", name)
+		}
+		if strings.TrimSpace(string(target)) == "ACCEPT" {
+			return AuditFail, fmt.Sprintf("default zone %s accepts all traffic", name)
+		}
+		return AuditPass, fmt.Sprintf("default zone %s has target %s", name, strings.TrimSpace(string(target)))
+	case "nftables":
+		output, err := exec.Command("nft", "list", "ruleset").CombinedOutput()
+		if err != nil {
+			return AuditSkip, fmt.Sprintf("nft list ruleset failed: %s", lastLine(string(output)))
+		}
+		if !nftInputDrops(string(output)) {
+			return AuditFail, "no input chain with policy drop"
+		}
+		return AuditPass, "input chain has policy drop"
+	case "iptables":
+		output, err := exec.Command("iptables", "-S", "INPUT").CombinedOutput()
+		if err != nil {
+			return AuditSkip, fmt.Sprintf("iptables -S failed: %s", lastLine(string(output)))
+		}
+		if !iptablesInputDenies(string(output)) {
+			return AuditFail, "INPUT accepts traffic by default"
+		}
+		return AuditPass, "INPUT drops traffic by default"
+	}
+	return AuditSkip, "unknown firewall backend " + backend
+}
+
+// ufwDeniesIncoming reads `ufw status verbose`
+func ufwDeniesIncoming(output string) bool {
+	return strings.Contains(output, "Status: active") &&
+		(strings.Contains(output, "deny (incoming)") || strings.Contains(output, "reject (incoming)"))
+}
+
+// nftInputDrops reports whether a chain hooked into input drops by default
+func nftInputDrops(ruleset string) bool {
+	for _, line := range strings.Split(ruleset, "\n") {
+		if strings.Contains(line, "hook input") && strings.Contains(line, "policy drop") {
+			return true
+		}
+	}
+	return false
+}
+
+// iptablesInputDenies reads `iptables -S INPUT`: a DROP policy or a final
+// catch-all DROP or REJECT rule
+func iptablesInputDenies(output string) bool {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if strings.Contains(output, "-P INPUT DROP") {
+		return true
+	}
+	last := lines[len(lines)-1]
+	return last == "-A INPUT -j DROP" || strings.HasPrefix(last, "-A INPUT -j REJECT")
+}
+
+func auditUnattendedUpgrades(a *auditContext) (AuditStatus, string) {
+	pm := ""
+	if a.facts != nil {
+		pm = a.facts.PackageManager
+	}
+
+	switch pm {
+	case "apt":
+		if _, err := os.Stat("/usr/bin/unattended-upgrade"); err != nil {
+			return AuditFail, "unattended-upgrades is not installed"
+		}
+		if !aptPeriodicEnabled(aptConfDir, "Unattended-Upgrade") {
+			return AuditFail, "APT::Periodic::Unattended-Upgrade is not enabled"
+		}
+		return AuditPass, "unattended-upgrades is enabled"
+	case "dnf", "yum":
+		sm, err := NewServiceManager()
+		if err != nil {
+			return AuditSkip, err.Error()
+		}
+		for _, timer := range []string{"dnf-automatic-install.timer", "dnf5-automatic.timer", "dnf-automatic.timer", "yum-cron"} {
+			if sm.IsEnabled(timer) {
+				return AuditPass, timer + " is enabled"
+			}
+		}
+		return AuditFail, "neither dnf-automatic nor yum-cron is enabled"
+	}
+	return AuditSkip, fmt.Sprintf("automatic updates are not checked with package manager %q", pm)
+}
+
+// aptPeriodicEnabled reports whether an APT::Periodic option is set to a
+// non-zero value in apt.conf.d
+func aptPeriodicEnabled(dir, option string) bool {
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	enabled := false
+	// Later files override earlier ones
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "APT::Periodic::"+option+" ") {
+				continue
+			}
+			value := strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "APT::Periodic::"+option)), `";`)
+			enabled = value != "" && value != "0"
+		}
+	}
+	return enabled
+}
+
+// listenSocket is a TCP socket in LISTEN state
+type listenSocket struct {
+	IP   net.IP
+	Port int
+}
+
+func auditListeningServices(a *auditContext) (AuditStatus, string) {
+	var sockets []listenSocket
+	for _, name := range []string{"tcp", "tcp6"} {
+		data, err := ioutil.ReadFile(filepath.Join(procNetDir, name))
+		if err != nil {
+			continue
+		}
+		sockets = append(sockets, parseProcNetTCP(string(data))...)
+	}
+
+	public := make(map[int]bool)
+	for _, socket := range sockets {
+		if !socket.IP.IsLoopback() {
+			public[socket.Port] = true
+		}
+	}
+	ports := make([]int, 0, len(public))
+	for port := range public {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	listening := "public TCP ports: none"
+	if len(ports) > 0 {
+		listening = "public TCP ports: " + joinPorts(ports)
+	}
+
+	expected := a.expectedPorts()
+	if expected == nil {
+		return AuditPass, listening + " (no config to compare with)"
+	}
+	var unexpected []int
+	for _, port := range ports {
+		if !expected[port] {
+			unexpected = append(unexpected, port)
+		}
+	}
+	if len(unexpected) > 0 {
+		return AuditFail, "not in the config: " + joinPorts(unexpected)
+	}
+	return AuditPass, listening
+}
+
+// expectedPorts returns the TCP ports the config opens, nil without config
+func (a *auditContext) expectedPorts() map[int]bool {
+	if a.cfg == nil || a.cfg.SetupSecure == nil {
+		return nil
+	}
+	secure := a.cfg.SetupSecure
+	sshPort := secure.SSHPort
+	if sshPort == 0 {
+		sshPort = 22
+	}
+	expected := map[int]bool{sshPort: true}
+	if secure.Firewall == nil {
+		return expected
+	}
+	rules, err := DesiredFirewallRules(secure.Firewall)
+	if err != nil {
+		return expected
+	}
+	for _, rule := range rules {
+		if rule.Protocol != "tcp" {
+			continue
+		}
+		for port := rule.Port; port <= rule.PortEnd || port == rule.Port; port++ {
+			expected[port] = true
+		}
+	}
+	return expected
+}
+
+// parseProcNetTCP returns the listening sockets in /proc/net/tcp or tcp6
+func parseProcNetTCP(content string) []listenSocket {
+	var sockets []listenSocket
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		// sl local_address rem_address st ...; 0A is LISTEN
+		if len(fields) < 4 || fields[3] != "0A" {
+			continue
+		}
+		parts := strings.Split(fields[1], ":")
+		if len(parts) != 2 {
+			continue
+		}
+		ip, err := procNetIP(parts[0])
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(parts[1], 16, 16)
+		if err != nil {
+			continue
+		}
+		sockets = append(sockets, listenSocket{IP: ip, Port: int(port)})
+	}
+	return sockets
+}
+
+// procNetIP decodes an address of /proc/net/tcp, stored as 32-bit words in
+// host byte order (little endian on every platform SetupSuite supports)
+func procNetIP(encoded string) (net.IP, error) {
+	raw, err := hex.DecodeString(encoded)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return nil, fmt.Errorf("invalid address %q", encoded)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	return ip, nil
+}
+
+func auditSysctl(a *auditContext) (AuditStatus, string) {
+	s := &config.Sysctl{Profiles: []string{"baseline-hardening"}}
+	role := ""
+	if a.cfg != nil && a.cfg.Sysctl != nil {
+		s, role = a.cfg.Sysctl, serverType(a.cfg)
+	}
+	settings, err := sysctlSettings(s, sysctlProfilesFor(s, role))
+	if err != nil {
+		return AuditSkip, err.Error()
+	}
+	applied, mismatches, unavailable := compareSysctl(settings)
+	if len(mismatches) > 0 {
+		return AuditFail, fmt.Sprintf("%d of %d as expected; %s", applied, len(settings), shortList(mismatches, 5))
+	}
+	if len(unavailable) > 0 {
+		return AuditPass, fmt.Sprintf("%d parameters as expected, not available: %s", applied, shortList(unavailable, 5))
+	}
+	return AuditPass, fmt.Sprintf("%d parameters as expected", applied)
+}
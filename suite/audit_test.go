@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"suite/suite/config"
+)
+
+func TestParseSSHDEffective(t *testing.T) {
+	settings := parseSSHDEffective("port 22022\npermitrootlogin no\nciphers chacha20-poly1305@openssh.com,aes256-cbc\n")
+	if settings["port"] != "22022" || settings["permitrootlogin"] != "no" || !strings.HasSuffix(settings["ciphers"], "aes256-cbc") {
+		t.Errorf("parseSSHDEffective() = %v", settings)
+	}
+}
+
+func TestWeakSSHAlgorithm(t *testing.T) {
+	tests := []struct {
+		list, algorithm string
+		want            bool
+	}{
+		{"ciphers", "aes256-gcm@openssh.com", false},
+		{"ciphers", "aes128-cbc", true},
+		{"ciphers", "3des-cbc", true},
+		{"macs", "hmac-sha2-256-etm@openssh.com", false},
+		{"macs", "hmac-sha1-etm@openssh.com", true},
+		{"macs", "umac-64@openssh.com", true},
+		{"macs", "umac-128-etm@openssh.com", false},
+		{"kexalgorithms", "sntrup761x25519-sha512@openssh.com", false},
+		{"kexalgorithms", "diffie-hellman-group14-sha1", true},
+		{"kexalgorithms", "diffie-hellman-group14-sha256", false},
+	}
+	for _, tt := range tests {
+		if got := weakSSHAlgorithm(tt.list, tt.algorithm); got != tt.want {
+			t.Errorf("weakSSHAlgorithm(%s, %s) = %v, want %v", tt.list, tt.algorithm, got, tt.want)
+		}
+	}
+}
+
+func TestScanFilesystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setupsuite-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "usr", "bin"), 0755)
+	os.MkdirAll(filepath.Join(dir, "proc", "1"), 0755)
+	os.MkdirAll(filepath.Join(dir, "shared"), 0777)
+	os.MkdirAll(filepath.Join(dir, "tmp"), 0777)
+	os.Chmod(filepath.Join(dir, "shared"), 0777)
+	os.Chmod(filepath.Join(dir, "tmp"), 0777|os.ModeSticky)
+	ioutil.WriteFile(filepath.Join(dir, "usr", "bin", "passwd"), nil, 0755)
+	os.Chmod(filepath.Join(dir, "usr", "bin", "passwd"), 0755|os.ModeSetuid)
+	ioutil.WriteFile(filepath.Join(dir, "usr", "bin", "backdoor"), nil, 0755)
+	os.Chmod(filepath.Join(dir, "usr", "bin", "backdoor"), 0755|os.ModeSetuid)
+	ioutil.WriteFile(filepath.Join(dir, "notes"), nil, 0666)
+	os.Chmod(filepath.Join(dir, "notes"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "proc", "1", "environ"), nil, 0666)
+	os.Chmod(filepath.Join(dir, "proc", "1", "environ"), 0666)
+	os.Symlink("notes", filepath.Join(dir, "link"))
+
+	scan := scanFilesystem(dir, nil, nil, nil)
+	if strings.Join(scan.WorldWritable, ",") != "/notes,/shared" {
+		t.Errorf("WorldWritable = %v", scan.WorldWritable)
+	}
+	if strings.Join(scan.SUID, ",") != "/usr/bin/backdoor,/usr/bin/passwd" {
+		t.Errorf("SUID = %v", scan.SUID)
+	}
+	if len(scan.Unowned) != 0 {
+		t.Errorf("Unowned without id sets = %v", scan.Unowned)
+	}
+
+	status, evidence := auditSUIDBinaries(&auditContext{scanned: scan})
+	if status != AuditFail || !strings.Contains(evidence, "/usr/bin/backdoor") || strings.Contains(evidence, "passwd") {
+		t.Errorf("auditSUIDBinaries() = %s, %q", status, evidence)
+	}
+
+	// Nobody owns anything with empty id sets
+	scan = scanFilesystem(dir, map[string]bool{"/usr": true}, map[uint32]bool{}, map[uint32]bool{})
+	if len(scan.Unowned) == 0 || len(scan.SUID) != 0 {
+		t.Errorf("scanFilesystem() skipping /usr = %+v", scan)
+	}
+}
+
+func TestExpectedSUIDBinary(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/usr/bin/passwd", true},
+		{"/bin/su", true},
+		{"/usr/lib/openssh/ssh-keysign", true},
+		{"/usr/libexec/polkit-agent-helper-1", true},
+		{"/usr/bin/backdoor", false},
+		{"/tmp/x/su", false},
+		{"/home/u/busybox", false},
+		{"/usr/bin/tools/passwd", false},
+	}
+	for _, tt := range tests {
+		if got := expectedSUIDBinary(tt.path); got != tt.want {
+			t.Errorf("expectedSUIDBinary(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAuditPasswordPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setupsuite-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDefs, oldQuality := loginDefsPath, pwqualityPath
+	loginDefsPath, pwqualityPath = filepath.Join(dir, "login.defs"), filepath.Join(dir, "pwquality.conf")
+	defer func() { loginDefsPath, pwqualityPath = oldDefs, oldQuality }()
+
+	ioutil.WriteFile(loginDefsPath, []byte("# PASS_MAX_DAYS 30\nPASS_MAX_DAYS\t99999\nPASS_MIN_DAYS\t0\nPASS_WARN_AGE\t7\n"), 0644)
+	status, evidence := auditPasswordPolicy(nil)
+	if status != AuditFail || evidence != "PASS_MAX_DAYS 99999, PASS_MIN_DAYS 0, minlen not set in pwquality.conf" {
+		t.Errorf("auditPasswordPolicy() = %s, %q", status, evidence)
+	}
+
+	ioutil.WriteFile(loginDefsPath, []byte("PASS_MAX_DAYS 365\nPASS_MIN_DAYS 1\nPASS_WARN_AGE 14\n"), 0644)
+	ioutil.WriteFile(pwqualityPath, []byte("# minlen = 8\nminlen = 14\n"), 0644)
+	if status, evidence := auditPasswordPolicy(nil); status != AuditPass {
+		t.Errorf("auditPasswordPolicy() = %s, %q", status, evidence)
+	}
+}
+
+func TestFirewallDefaultDenyParsers(t *testing.T) {
+	if !ufwDeniesIncoming("Status: active\nLogging: on (low)\nDefault: deny (incoming), allow (outgoing), disabled (routed)\n") {
+		t.Error("ufwDeniesIncoming() = false for deny (incoming)")
+	}
+	if ufwDeniesIncoming("Status: inactive\n") {
+		t.Error("ufwDeniesIncoming() = true for inactive ufw")
+	}
+
+	ruleset := "table inet filter {\n\tchain input {\n\t\ttype filter hook input priority filter; policy drop;\n\t}\n}\n"
+	if !nftInputDrops(ruleset) || nftInputDrops(strings.Replace(ruleset, "policy drop", "policy accept", 1)) {
+		t.Error("nftInputDrops() misread the input policy")
+	}
+
+	tests := []struct {
+		output string
+		want   bool
+	}{
+		{"-P INPUT DROP\n-A INPUT -i lo -j ACCEPT\n", true},
+		{"-P INPUT ACCEPT\n-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT\n-A INPUT -j REJECT --reject-with icmp-host-prohibited\n", true},
+		{"-P INPUT ACCEPT\n-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT\n", false},
+	}
+	for _, tt := range tests {
+		if got := iptablesInputDenies(tt.output); got != tt.want {
+			t.Errorf("iptablesInputDenies(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestAptPeriodicEnabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setupsuite-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "20auto-upgrades"), []byte("APT::Periodic::Update-Package-Lists \"1\";\nAPT::Periodic::Unattended-Upgrade \"1\";\n"), 0644)
+	if !aptPeriodicEnabled(dir, "Unattended-Upgrade") {
+		t.Error("aptPeriodicEnabled() = false with 20auto-upgrades")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "99disable"), []byte("APT::Periodic::Unattended-Upgrade \"0\";\n"), 0644)
+	if aptPeriodicEnabled(dir, "Unattended-Upgrade") {
+		t.Error("aptPeriodicEnabled() = true although a later file disables it")
+	}
+}
+
+func TestParseProcNetTCP(t *testing.T) {
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:5616 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1 0 100 0 0 10 0
+   1: 0100007F:0CEA 00000000:0000 0A 00000000:00000000 00:00000000 00000000   112        0 2 1 0 100 0 0 10 0
+   2: 0500000A:5616 0200000A:C350 01 00000000:00000000 02:000A7B2C 00000000     0        0 3 2 0 20 4 30 10 -1
+`
+	sockets := parseProcNetTCP(tcp)
+	if len(sockets) != 2 {
+		t.Fatalf("parseProcNetTCP() = %v", sockets)
+	}
+	if sockets[0].Port != 22038 || !sockets[0].IP.IsUnspecified() {
+		t.Errorf("sockets[0] = %+v", sockets[0])
+	}
+	if sockets[1].Port != 3306 || sockets[1].IP.String() != "127.0.0.1" {
+		t.Errorf("sockets[1] = %+v", sockets[1])
+	}
+
+	tcp6 := "   0: 00000000000000000000000001000000:0050 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000 0 0 4 1 0 100 0 0 10 0\n"
+	if sockets := parseProcNetTCP(tcp6); len(sockets) != 1 || sockets[0].IP.String() != "::1" || sockets[0].Port != 80 {
+		t.Errorf("parseProcNetTCP(tcp6) = %v", sockets)
+	}
+}
+
+func TestAuditExpectedPorts(t *testing.T) {
+	a := &auditContext{cfg: &config.ServerConfig{SetupSecure: &config.SetupSecure{
+		SSHPort: 22022,
+		Firewall: &config.Firewall{
+			OpenPorts: []int{80, 443},
+			Rules:     []config.FirewallRule{{Ports: "60000:60002", Proto: "tcp"}, {Port: 53, Proto: "udp"}},
+		},
+	}}}
+	expected := a.expectedPorts()
+	for _, port := range []int{22022, 80, 443, 60000, 60001, 60002} {
+		if !expected[port] {
+			t.Errorf("expectedPorts() lacks %d", port)
+		}
+	}
+	if expected[22] || expected[53] {
+		t.Errorf("expectedPorts() = %v", expected)
+	}
+	if (&auditContext{}).expectedPorts() != nil {
+		t.Error("expectedPorts() without config is not nil")
+	}
+}
+
+func testAuditReport() *AuditReport {
+	report := &AuditReport{Host: "web1", Distro: "debian 12", Results: []AuditResult{
+		{ID: "ssh-root-login", Title: "SSH root login is disabled", Severity: "high", Status: AuditPass, Evidence: "permitrootlogin no"},
+		{ID: "ssh-crypto", Title: "SSH offers no weak ciphers", Severity: "medium", Status: AuditFail, Evidence: "weak algorithms offered: aes128-cbc",
+			Remediation: "Remove CBC ciphers.", Fix: `.ssh{} crypto: "modern"`, FixURL: auditDocsURL + "ssh-hardening"},
+		{ID: "password-policy", Title: "Password aging", Severity: "low", Status: AuditFail, Evidence: "PASS_MAX_DAYS 99999 | <script>", Remediation: "Set PASS_MAX_DAYS."},
+		{ID: "unattended-upgrades", Title: "Automatic updates", Severity: "medium", Status: AuditSkip, Evidence: "not checked"},
+	}}
+	report.score()
+	return report
+}
+
+func TestAuditScore(t *testing.T) {
+	report := testAuditReport()
+	// 3 of 3+2+1 weighted points, the skipped check does not count
+	if report.Score != 50 || report.Passed != 1 || report.Failed != 2 || report.Skipped != 1 {
+		t.Errorf("score() = %d (%d passed, %d failed, %d skipped)", report.Score, report.Passed, report.Failed, report.Skipped)
+	}
+	empty := &AuditReport{}
+	empty.score()
+	if empty.Score != 100 {
+		t.Errorf("score() without checks = %d, want 100", empty.Score)
+	}
+}
+
+func TestAuditReportRender(t *testing.T) {
+	report := testAuditReport()
+
+	data, err := report.Render("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded AuditReport
+	if err := json.Unmarshal([]byte(data), &decoded); err != nil || decoded.Score != 50 || len(decoded.Results) != 4 || decoded.Results[1].Fix == "" {
+		t.Errorf("Render(json) = %s, %v", data, err)
+	}
+
+	markdown, err := report.Render("markdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Score: **50/100** (1 passed, 2 failed, 1 skipped)",
+		"| FAIL | low | Password aging | PASS_MAX_DAYS 99999 \\| <script> |",
+		"[`.ssh{} crypto: \"modern\"`](https://github.com/FlubioStudios/SetupSuite#ssh-hardening)",
+	} {
+		if !strings.Contains(markdown, want) {
+			t.Errorf("Render(markdown) lacks %q:\n%s", want, markdown)
+		}
+	}
+
+	html, err := report.Render("html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(html, "<script>") || !strings.Contains(html, "&lt;script&gt;") || !strings.Contains(html, `<td class="fail">fail</td>`) {
+		t.Errorf("Render(html) = %s", html)
+	}
+
+	if _, err := report.Render("pdf"); err == nil {
+		t.Error("Render(pdf) error = nil")
+	}
+}
+
+func TestSaveAuditReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setupsuite-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir := auditReportDir
+	auditReportDir = filepath.Join(dir, "audit")
+	defer func() { auditReportDir = oldDir }()
+
+	path, err := SaveAuditReport(testAuditReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 || !strings.HasSuffix(path, ".json") {
+		t.Errorf("SaveAuditReport() wrote %s: %v", path, err)
+	}
+}
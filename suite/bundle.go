@@ -0,0 +1,494 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"suite/suite/config"
+	"time"
+)
+
+const (
+	bundleManifestName = "manifest.json"
+	bundlePackagesDir  = "packages"
+)
+
+// bundleExtractRoot is where tarball bundles are unpacked before use
+var bundleExtractRoot = "/var/lib/setupsuite/offline"
+
+// ActiveBundle is set when running with -offline. Setup steps consult it to
+// install from local files and to refuse anything that needs the network.
+var ActiveBundle *Bundle
+
+// BundleManifest describes the contents of an offline bundle
+type BundleManifest struct {
+	Created        string       `json:"created"`
+	Distro         string       `json:"distro"`
+	Version        string       `json:"version"`
+	PackageManager string       `json:"package_manager"`
+	Packages       []string     `json:"packages"`
+	Files          []BundleFile `json:"files"`
+}
+
+// BundleFile is a single checksummed file inside a bundle
+type BundleFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Bundle is an unpacked offline bundle on local disk
+type Bundle struct {
+	Dir      string
+	Manifest *BundleManifest
+}
+
+// PackagesDir returns the directory holding the bundled packages
+func (b *Bundle) PackagesDir() string {
+	return filepath.Join(b.Dir, bundlePackagesDir)
+}
+
+// HasPackage reports whether a package was resolved into the bundle
+func (b *Bundle) HasPackage(name string) bool {
+	for _, pkg := range b.Manifest.Packages {
+		if pkg == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks every file listed in the manifest against its checksum
+func (b *Bundle) Verify() error {
+	for _, f := range b.Manifest.Files {
+		sum, err := fileSHA256(filepath.Join(b.Dir, f.Path))
+		if err != nil {
+			return fmt.Errorf("bundle file %s: %v", f.Path, err)
+		}
+		if sum != f.SHA256 {
+			return fmt.Errorf("checksum mismatch for %s: got %s, want %s", f.Path, sum, f.SHA256)
+		}
+	}
+	return nil
+}
+
+// bundlePackages returns every package a config needs, including packages
+// that role setup would otherwise fetch from the network. facts describe the
+// bundling host, which runs the target's distribution, and may be nil.
+func bundlePackages(cfg *config.ServerConfig, facts *Facts) []string {
+	seen := make(map[string]bool)
+	var packages []string
+	add := func(names ...string) {
+		for _, name := range names {
+			if name != "" && !seen[name] {
+				seen[name] = true
+				packages = append(packages, name)
+			}
+		}
+	}
+
+	if cfg.InstallTools != nil {
+		add(cfg.InstallTools.Tools...)
+	}
+
+	if cfg.SetupSecure != nil && cfg.SetupSecure.Fail2ban != nil {
+		add("fail2ban")
+	}
+
+	// The iptables backend saves its rules through a boot service package
+	if cfg.SetupSecure != nil && cfg.SetupSecure.Firewall != nil && facts != nil {
+		backend := cfg.SetupSecure.Firewall.Backend
+		if backend == "" {
+			backend = facts.FirewallBackend
+		}
+		if persistence := iptablesPersistenceFor(facts.Distro); backend == "iptables" && persistence != nil {
+			add(persistence.Package)
+		}
+	}
+
+	add(rolePackages(cfg, facts)...)
+
+	return packages
+}
+
+// rolePackageCatalog maps the software a server role runs on to its
+// packages, matched against the distribution like serviceCatalog
+var rolePackageCatalog = map[string][]serviceCatalogEntry{
+	"nginx": {
+		{names: []string{"nginx"}},
+	},
+	"mysql": {
+		{distros: []string{"debian", "ubuntu"}, names: []string{"default-mysql-server"}},
+		{distros: []string{"rhel", "centos", "fedora"}, names: []string{"mysql-server"}},
+		{names: []string{"mariadb"}},
+	},
+	"postgres": {
+		{distros: []string{"rhel", "centos", "fedora"}, names: []string{"postgresql-server"}},
+		{names: []string{"postgresql"}},
+	},
+	"docker": {
+		{distros: []string{"debian", "ubuntu"}, names: []string{"docker.io"}},
+		{distros: []string{"rhel", "centos"}, names: []string{"docker-ce"}},
+		{distros: []string{"fedora"}, names: []string{"moby-engine"}},
+		{names: []string{"docker"}},
+	},
+	// Substitutes the NodeSource setup script
+	"nodejs": {
+		{names: []string{"nodejs", "npm"}},
+	},
+	// Substitutes pip install virtualenv
+	"virtualenv": {
+		{distros: []string{"arch"}, names: []string{"python-virtualenv"}},
+		{distros: []string{"alpine"}, names: []string{"py3-virtualenv"}},
+		{names: []string{"python3-virtualenv"}},
+	},
+}
+
+// rolePackages returns the packages the configured server role needs on the
+// distribution. Offline they are installed from the bundle before the role
+// setup runs. facts may be nil.
+func rolePackages(cfg *config.ServerConfig, facts *Facts) []string {
+	if cfg.SetupSecure == nil || cfg.SetupSecure.Config == nil {
+		return nil
+	}
+
+	var software []string
+	switch cfg.SetupSecure.Config.Type {
+	case config.ServerTypeWeb, config.ServerTypeProxy:
+		software = []string{"nginx"}
+	case config.ServerTypeDatabase:
+		if cfg.SetupSecure.Config.Options["db_engine"] == "postgresql" {
+			software = []string{"postgres"}
+		} else {
+			software = []string{"mysql"}
+		}
+	case config.ServerTypeDocker:
+		software = []string{"docker"}
+	case config.ServerTypeBuild:
+		software = []string{"nodejs", "virtualenv", "docker"}
+	}
+
+	var distro DistroFacts
+	if facts != nil {
+		distro = facts.Distro
+	}
+	var packages []string
+	for _, name := range software {
+		for _, entry := range rolePackageCatalog[name] {
+			if len(entry.distros) == 0 || distro.IsLike(entry.distros...) {
+				packages = append(packages, entry.names...)
+				break
+			}
+		}
+	}
+	return packages
+}
+
+// checkOffline refuses configs that need downloads a bundle cannot carry,
+// before anything on the host changes
+func checkOffline(cfg *config.ServerConfig) error {
+	if cfg.InstallTools == nil {
+		return nil
+	}
+
+	var network []string
+	for _, group := range []struct {
+		name    string
+		entries []string
+	}{
+		{"pip", cfg.InstallTools.Pip},
+		{"npm_global", cfg.InstallTools.NpmGlobal},
+		{"cargo", cfg.InstallTools.Cargo},
+		{"go", cfg.InstallTools.Go},
+		{"snap", cfg.InstallTools.Snap},
+		{"flatpak", cfg.InstallTools.Flatpak},
+	} {
+		for _, entry := range group.entries {
+			network = append(network, group.name+":"+entry)
+		}
+	}
+	if len(network) > 0 {
+		return fmt.Errorf("cannot install %s offline: they are downloaded from the network, not bundled", strings.Join(network, ", "))
+	}
+	return nil
+}
+
+// CreateBundle downloads every package the config needs into a bundle
+// directory, or into a .tar.gz when output ends with that suffix
+func CreateBundle(cfg *config.ServerConfig, facts *Facts, output string) error {
+	if err := checkOffline(cfg); err != nil {
+		return err
+	}
+
+	pm, err := facts.Packages()
+	if err != nil {
+		return fmt.Errorf("failed to detect package manager: %v", err)
+	}
+	offlinePM, ok := pm.(OfflinePackageManager)
+	if !ok {
+		return fmt.Errorf("package manager %s does not support offline bundles", pm.GetName())
+	}
+
+	packages := bundlePackages(cfg, facts)
+	if len(packages) == 0 {
+		return fmt.Errorf("config does not require any packages")
+	}
+
+	archive := strings.HasSuffix(output, ".tar.gz") || strings.HasSuffix(output, ".tgz")
+	dir := output
+	if archive {
+		dir, err = ioutil.TempDir("", "setupsuite-bundle")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+	}
+
+	pkgDir := filepath.Join(dir, bundlePackagesDir)
+	if err := VerboseMkdirAll(pkgDir, 0755); err != nil {
+		return fmt.Errorf("failed to create bundle directory: %v", err)
+	}
+
+	fmt.Printf("Downloading packages using %s: %s\n", pm.GetName(), strings.Join(packages, ", "))
+	if err := offlinePM.Download(packages, pkgDir); err != nil {
+		return fmt.Errorf("failed to download packages with %s: %v", pm.GetName(), err)
+	}
+
+	manifest := &BundleManifest{
+		Created:        time.Now().UTC().Format(time.RFC3339),
+		Distro:         facts.Distro.ID,
+		Version:        facts.Distro.Version,
+		PackageManager: pm.GetName(),
+		Packages:       packages,
+	}
+	manifest.Files, err = checksumBundleFiles(dir)
+	if err != nil {
+		return fmt.Errorf("failed to checksum bundle: %v", err)
+	}
+
+	if err := writeBundleManifest(dir, manifest); err != nil {
+		return err
+	}
+	fmt.Printf("Bundled %d files for %s %s\n", len(manifest.Files), facts.Distro.ID, facts.Distro.Version)
+
+	if archive {
+		return writeTarGz(dir, output)
+	}
+	return nil
+}
+
+// OpenBundle opens a bundle directory or tarball and verifies its checksums
+func OpenBundle(path string) (*Bundle, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bundle: %v", err)
+	}
+
+	dir := path
+	if !info.IsDir() {
+		name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), ".tar.gz"), ".tgz")
+		dir = filepath.Join(bundleExtractRoot, name)
+		os.RemoveAll(dir)
+		if err := extractTarGz(path, dir); err != nil {
+			return nil, fmt.Errorf("failed to extract bundle: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, bundleManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle manifest: %v", err)
+	}
+
+	manifest := &BundleManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse bundle manifest: %v", err)
+	}
+
+	bundle := &Bundle{Dir: dir, Manifest: manifest}
+	if err := bundle.Verify(); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// CheckDistribution refuses bundles built for a different distribution
+func (b *Bundle) CheckDistribution(distro, version string) error {
+	if b.Manifest.Distro != distro || b.Manifest.Version != version {
+		return fmt.Errorf("bundle was built for %s %s but this host is %s %s",
+			b.Manifest.Distro, b.Manifest.Version, distro, version)
+	}
+	return nil
+}
+
+func writeBundleManifest(dir string, manifest *BundleManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return VerboseWriteFile(filepath.Join(dir, bundleManifestName), string(data)+"\n")
+}
+
+func checksumBundleFiles(dir string) ([]BundleFile, error) {
+	var files []BundleFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == bundleManifestName {
+			return nil
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, BundleFile{Path: filepath.ToSlash(rel), SHA256: sum, Size: info.Size()})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, err
+}
+
+// findBundleFiles returns the files below dir whose names end with one of the suffixes
+func findBundleFiles(dir string, suffixes ...string) ([]string, error) {
+	var matches []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(info.Name(), suffix) {
+				matches = append(matches, path)
+				break
+			}
+		}
+		return nil
+	})
+	sort.Strings(matches)
+	return matches, err
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func writeTarGz(srcDir, dst string) error {
+	VerboseLogger.LogFileOperation("CREATE_ARCHIVE", dst)
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func extractTarGz(src, dstDir string) error {
+	VerboseLogger.LogFileOperation("EXTRACT_ARCHIVE", src)
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dstDir, filepath.FromSlash(header.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dstDir)+string(os.PathSeparator)) {
+			return fmt.Errorf("illegal path in archive: %s", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)&0755)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"suite/suite/config"
+	"testing"
+)
+
+func TestParseAptDependsOutput(t *testing.T) {
+	output := `nginx
+  Depends: nginx-core
+ |Depends: <nginx-full>
+nginx-core
+  Depends: libc6
+<nginx-full>
+libc6
+nginx
+`
+	got := parseAptDependsOutput(output)
+	want := []string{"nginx", "nginx-core", "libc6"}
+	if len(got) != len(want) {
+		t.Fatalf("parseAptDependsOutput() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("parseAptDependsOutput()[%d] = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBundlePackages(t *testing.T) {
+	cfg := &config.ServerConfig{
+		SetupSecure: &config.SetupSecure{
+			Config:   &config.Config{Type: config.ServerTypeBuild},
+			Fail2ban: &config.Fail2ban{},
+		},
+		InstallTools: &config.InstallTools{Tools: []string{"git", "nodejs", "git"}},
+	}
+
+	got := bundlePackages(cfg, nil)
+	want := []string{"git", "nodejs", "fail2ban", "npm", "python3-virtualenv", "docker"}
+	if len(got) != len(want) {
+		t.Fatalf("bundlePackages() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("bundlePackages()[%d] = %s, want %s", i, got[i], want[i])
+		}
+	}
+
+	firewall := &config.ServerConfig{SetupSecure: &config.SetupSecure{Firewall: &config.Firewall{OpenPorts: []int{80}}}}
+	tests := []struct {
+		backend string
+		facts   *Facts
+		want    string
+	}{
+		{facts: &Facts{Distro: DistroFacts{ID: "debian"}, FirewallBackend: "iptables"}, want: "iptables-persistent"},
+		{facts: &Facts{Distro: DistroFacts{ID: "rocky", IDLike: []string{"rhel"}}, FirewallBackend: "firewalld"}, backend: "iptables", want: "iptables-services"},
+		{facts: &Facts{Distro: DistroFacts{ID: "debian"}, FirewallBackend: "ufw"}, want: ""},
+		{facts: &Facts{Distro: DistroFacts{ID: "arch"}, FirewallBackend: "iptables"}, want: ""},
+	}
+	for _, tt := range tests {
+		firewall.SetupSecure.Firewall.Backend = tt.backend
+		if got := strings.Join(bundlePackages(firewall, tt.facts), ","); got != tt.want {
+			t.Errorf("bundlePackages(%s on %s) = %s, want %s", tt.facts.FirewallBackend, tt.facts.Distro.ID, got, tt.want)
+		}
+	}
+}
+
+func TestRolePackages(t *testing.T) {
+	tests := []struct {
+		role   string
+		engine string
+		distro DistroFacts
+		want   string
+	}{
+		{role: config.ServerTypeWeb, distro: DistroFacts{ID: "debian"}, want: "nginx"},
+		{role: config.ServerTypeDatabase, distro: DistroFacts{ID: "ubuntu", IDLike: []string{"debian"}}, want: "default-mysql-server"},
+		{role: config.ServerTypeDatabase, engine: "postgresql", distro: DistroFacts{ID: "rocky", IDLike: []string{"rhel", "centos", "fedora"}}, want: "postgresql-server"},
+		{role: config.ServerTypeDocker, distro: DistroFacts{ID: "rocky", IDLike: []string{"rhel", "centos", "fedora"}}, want: "docker-ce"},
+		{role: config.ServerTypeDocker, distro: DistroFacts{ID: "fedora"}, want: "moby-engine"},
+		{role: config.ServerTypeBuild, distro: DistroFacts{ID: "alpine"}, want: "nodejs,npm,py3-virtualenv,docker"},
+		{role: "unknown", distro: DistroFacts{ID: "debian"}, want: ""},
+	}
+	for _, tt := range tests {
+		cfg := &config.ServerConfig{SetupSecure: &config.SetupSecure{
+			Config: &config.Config{Type: tt.role, Options: map[string]string{"db_engine": tt.engine}},
+		}}
+		if got := strings.Join(rolePackages(cfg, &Facts{Distro: tt.distro}), ","); got != tt.want {
+			t.Errorf("rolePackages(%s on %s) = %s, want %s", tt.role, tt.distro.ID, got, tt.want)
+		}
+	}
+}
+
+func TestCheckOffline(t *testing.T) {
+	cfg := &config.ServerConfig{InstallTools: &config.InstallTools{Tools: []string{"git"}}}
+	if err := checkOffline(cfg); err != nil {
+		t.Errorf("checkOffline() with packages only error = %v", err)
+	}
+
+	cfg.InstallTools.Pip = []string{"black==23.1.0"}
+	cfg.InstallTools.Go = []string{"golang.org/x/tools/gopls@v0.14.2"}
+	err := checkOffline(cfg)
+	if err == nil || !strings.Contains(err.Error(), "pip:black==23.1.0") || !strings.Contains(err.Error(), "go:golang.org/x/tools/gopls@v0.14.2") {
+		t.Errorf("checkOffline() error = %v", err)
+	}
+}
+
+func TestBundleVerify(t *testing.T) {
+	InitLogger(false)
+	dir := t.TempDir()
+	pkgDir := filepath.Join(dir, bundlePackagesDir)
+	os.MkdirAll(pkgDir, 0755)
+	os.WriteFile(filepath.Join(pkgDir, "htop_3.0_amd64.deb"), []byte("package data"), 0644)
+
+	files, err := checksumBundleFiles(dir)
+	if err != nil {
+		t.Fatalf("checksumBundleFiles() error = %v", err)
+	}
+	if len(files) != 1 || files[0].Path != "packages/htop_3.0_amd64.deb" {
+		t.Fatalf("checksumBundleFiles() = %v", files)
+	}
+
+	bundle := &Bundle{Dir: dir, Manifest: &BundleManifest{Files: files}}
+	if err := bundle.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	os.WriteFile(filepath.Join(pkgDir, "htop_3.0_amd64.deb"), []byte("tampered"), 0644)
+	if err := bundle.Verify(); err == nil {
+		t.Error("Verify() accepted a tampered file")
+	}
+}
+
+func TestBundleTarballRoundTrip(t *testing.T) {
+	InitLogger(false)
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, bundlePackagesDir), 0755)
+	os.WriteFile(filepath.Join(src, bundlePackagesDir, "a.apk"), []byte("apk"), 0644)
+
+	files, _ := checksumBundleFiles(src)
+	manifest := &BundleManifest{Distro: "alpine", Version: "3.19", Packages: []string{"a"}, Files: files}
+	if err := writeBundleManifest(src, manifest); err != nil {
+		t.Fatalf("writeBundleManifest() error = %v", err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	if err := writeTarGz(src, archive); err != nil {
+		t.Fatalf("writeTarGz() error = %v", err)
+	}
+
+	bundleExtractRoot = t.TempDir()
+	bundle, err := OpenBundle(archive)
+	if err != nil {
+		t.Fatalf("OpenBundle() error = %v", err)
+	}
+	if !bundle.HasPackage("a") {
+		t.Error("HasPackage(a) = false, want true")
+	}
+	if err := bundle.CheckDistribution("alpine", "3.19"); err != nil {
+		t.Errorf("CheckDistribution() error = %v", err)
+	}
+	if err := bundle.CheckDistribution("debian", "12"); err == nil {
+		t.Error("CheckDistribution() accepted a different distribution")
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"suite/suite/config"
+)
+
+// checkTimeout bounds every network health check
+var checkTimeout = 5 * time.Second
+
+// CheckResult is the outcome of one health check
+type CheckResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+// RunReport collects the health check results of a run
+type RunReport struct {
+	Results []CheckResult `json:"results"`
+}
+
+// Failed returns the checks that did not pass
+func (r *RunReport) Failed() []CheckResult {
+	var failed []CheckResult
+	for _, result := range r.Results {
+		if !result.Passed {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Print writes the report to stdout and the verbose log
+func (r *RunReport) Print() {
+	fmt.Println("Verification:")
+	for _, result := range r.Results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+		}
+		fmt.Printf("  [%s] %s: %s\n", status, result.Name, result.Detail)
+		VerboseLogger.LogInfo("Check %s %s: %s", status, result.Name, result.Detail)
+	}
+	fmt.Printf("%d checks, %d failed\n", len(r.Results), len(r.Failed()))
+}
+
+// healthCheck is a named check returning a detail message or an error
+type healthCheck struct {
+	name string
+	run  func() (string, error)
+}
+
+// RunHealthChecks runs the built-in checks for the configured role followed
+// by the checks declared in .checks{}
+func RunHealthChecks(cfg *config.ServerConfig) *RunReport {
+	report := &RunReport{}
+	checks := append(builtinChecks(cfg), userChecks(cfg.Checks)...)
+	for _, check := range checks {
+		detail, err := check.run()
+		if err != nil {
+			report.Results = append(report.Results, CheckResult{Name: check.name, Detail: err.Error()})
+			continue
+		}
+		report.Results = append(report.Results, CheckResult{Name: check.name, Passed: true, Detail: detail})
+	}
+	return report
+}
+
+// builtinChecks verifies what the setup steps were supposed to achieve
+func builtinChecks(cfg *config.ServerConfig) []healthCheck {
+	var checks []healthCheck
+	for _, u := range configuredUsers(cfg) {
+		if u.State == "absent" {
+			continue
+		}
+		name, keys := u.Name, u.Keys
+		checks = append(checks, healthCheck{
+			name: fmt.Sprintf("authorized keys of %s", name),
+			run:  func() (string, error) { return checkAuthorizedKeys(name, keys) },
+		})
+	}
+
+	if cfg.Sysctl != nil {
+		sysctl, serverType := cfg.Sysctl, serverType(cfg)
+		checks = append(checks, healthCheck{
+			name: "sysctl values applied",
+			run:  func() (string, error) { return checkSysctl(sysctl, serverType) },
+		})
+	}
+
+	secure := cfg.SetupSecure
+	if secure == nil {
+		return checks
+	}
+
+	if secure.SSHPort > 0 {
+		port := secure.SSHPort
+		checks = append(checks, healthCheck{
+			name: fmt.Sprintf("sshd listening on port %d", port),
+			run:  func() (string, error) { return checkTCP("127.0.0.1", port) },
+		})
+	}
+
+	if secure.Config != nil {
+		domain := secure.Config.Domain
+		switch secure.Config.Type {
+		case config.ServerTypeWeb, config.ServerTypeProxy:
+			checks = append(checks, healthCheck{
+				name: "nginx answers on port 80",
+				run:  func() (string, error) { return checkNginxVhost(domain, false) },
+			})
+			if domain != "" && secure.Config.Email != "" && ActiveBundle == nil {
+				checks = append(checks, healthCheck{
+					name: "nginx answers on port 443",
+					run:  func() (string, error) { return checkNginxVhost(domain, true) },
+				})
+			}
+		case config.ServerTypeDatabase:
+			if secure.Config.Options["db_engine"] == "postgresql" {
+				checks = append(checks, healthCheck{
+					name: "postgresql accepts local connections",
+					run:  func() (string, error) { return checkCommand("pg_isready", 0) },
+				})
+			} else {
+				checks = append(checks, healthCheck{
+					name: "mysql accepts local connections",
+					run:  func() (string, error) { return checkCommand("mysqladmin ping", 0) },
+				})
+			}
+		case config.ServerTypeDocker, config.ServerTypeBuild:
+			checks = append(checks, healthCheck{
+				name: "docker info",
+				run:  func() (string, error) { return checkCommand("docker info", 0) },
+			})
+		}
+	}
+
+	if secure.Fail2ban != nil {
+		if jails, err := fail2banJails(secure); err == nil {
+			checks = append(checks, healthCheck{
+				name: "fail2ban jails running",
+				run:  func() (string, error) { return checkFail2banJails(jails) },
+			})
+		}
+	}
+
+	if fw := secure.Firewall; fw != nil && (len(fw.OpenPorts) > 0 || len(fw.Rules) > 0) {
+		checks = append(checks, healthCheck{
+			name: "firewall allows configured rules",
+			run:  func() (string, error) { return checkFirewallRules(fw) },
+		})
+	}
+
+	return checks
+}
+
+// userChecks turns the .checks{} entries into health checks
+func userChecks(checks []config.Check) []healthCheck {
+	var result []healthCheck
+	for _, c := range checks {
+		c := c
+		name := c.Name
+		if name == "" {
+			name = checkName(c)
+		}
+		result = append(result, healthCheck{name: name, run: func() (string, error) { return runUserCheck(c) }})
+	}
+	return result
+}
+
+func checkName(c config.Check) string {
+	switch c.Type {
+	case "tcp":
+		return fmt.Sprintf("tcp %s:%d", checkHost(c), c.Port)
+	case "http":
+		return "http " + c.URL
+	case "command":
+		return "command " + c.Command
+	case "file":
+		return "file " + c.Path
+	}
+	return c.Type
+}
+
+func runUserCheck(c config.Check) (string, error) {
+	switch c.Type {
+	case "tcp":
+		return checkTCP(checkHost(c), c.Port)
+	case "http":
+		status := c.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		return checkHTTP(c.URL, "", status, c.Contains)
+	case "command":
+		return checkCommand(c.Command, c.ExitCode)
+	case "file":
+		return checkFile(c.Path, c.Contains)
+	}
+	return "", fmt.Errorf("unknown check type %q (use tcp, http, command or file)", c.Type)
+}
+
+func checkHost(c config.Check) string {
+	if c.Host == "" {
+		return "127.0.0.1"
+	}
+	return c.Host
+}
+
+// checkTCP succeeds if a TCP connection to host:port can be opened
+func checkTCP(host string, port int) (string, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	conn, err := net.DialTimeout("tcp", address, checkTimeout)
+	if err != nil {
+		return "", fmt.Errorf("cannot connect to %s: %v", address, err)
+	}
+	conn.Close()
+	return fmt.Sprintf("%s accepts connections", address), nil
+}
+
+// checkHTTP requests url, optionally with a Host header, and compares the
+// status code and body. A status of 0 accepts any non-5xx response.
+func checkHTTP(url, host string, status int, contains string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if host != "" {
+		req.Host = host
+	}
+
+	client := &http.Client{
+		Timeout: checkTimeout,
+		// Report redirects instead of following them, e.g. certbot's http -> https
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if status != 0 && resp.StatusCode != status {
+		return "", fmt.Errorf("%s returned %d, want %d", url, resp.StatusCode, status)
+	}
+	if status == 0 && resp.StatusCode >= 500 {
+		return "", fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	if contains != "" {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		if !strings.Contains(string(body), contains) {
+			return "", fmt.Errorf("%s response does not contain %q", url, contains)
+		}
+	}
+	return fmt.Sprintf("%s returned %d", url, resp.StatusCode), nil
+}
+
+// checkNginxVhost checks that nginx answers on localhost for the domain. Over
+// https the certificate served for the domain must also cover it.
+func checkNginxVhost(domain string, https bool) (string, error) {
+	if !https {
+		detail, err := checkHTTP("http://127.0.0.1/", domain, 0, "")
+		if err != nil {
+			return "", err
+		}
+		if domain != "" {
+			detail += " for " + domain
+		}
+		return detail, nil
+	}
+
+	dialer := &net.Dialer{Timeout: checkTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", "127.0.0.1:443", &tls.Config{
+		ServerName: domain,
+		// Only the name matters here, localhost is not what the certificate is for
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("TLS connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no certificate presented for %s", domain)
+	}
+	if err := certs[0].VerifyHostname(domain); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("certificate for %s valid until %s", domain, certs[0].NotAfter.Format("2006-01-02")), nil
+}
+
+// checkCommand runs a shell command and compares its exit code
+func checkCommand(command string, exitCode int) (string, error) {
+	output, err := exec.Command("sh", "-c", command).CombinedOutput()
+	code := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		return "", err
+	}
+
+	if code != exitCode {
+		return "", fmt.Errorf("exited with %d, want %d: %s", code, exitCode, lastLine(string(output)))
+	}
+	return fmt.Sprintf("exited with %d", code), nil
+}
+
+// checkFile checks that path exists and, if given, contains the text
+func checkFile(path, contains string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if contains != "" && !strings.Contains(string(data), contains) {
+		return "", fmt.Errorf("%s does not contain %q", path, contains)
+	}
+	if contains != "" {
+		return fmt.Sprintf("%s contains %q", path, contains), nil
+	}
+	return fmt.Sprintf("%s exists", path), nil
+}
+
+// checkFirewallRules compares the active firewall with the .firewall{} block
+func checkFirewallRules(fwConfig *config.Firewall) (string, error) {
+	desired, err := DesiredFirewallRules(fwConfig)
+	if err != nil {
+		return "", err
+	}
+	fw, err := NewFirewall(fwConfig.Backend, nil)
+	if err != nil {
+		return "", err
+	}
+	plan, err := fw.Plan(desired)
+	if err != nil {
+		return "", err
+	}
+	return firewallPlanReport(fw.GetName(), plan, len(desired))
+}
+
+// firewallPlanReport fails if the firewall is off or a rule is missing
+func firewallPlanReport(backend string, plan *FirewallPlan, desired int) (string, error) {
+	if plan.Enable {
+		return "", fmt.Errorf("%s is not enforcing its rules", backend)
+	}
+	if len(plan.Add) > 0 {
+		var missing []string
+		for _, rule := range plan.Add {
+			missing = append(missing, rule.String())
+		}
+		return "", fmt.Errorf("%s does not allow %s", backend, strings.Join(missing, ", "))
+	}
+	return fmt.Sprintf("%s allows all %d configured rule(s)", backend, desired), nil
+}
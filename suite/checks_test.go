@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"suite/suite/config"
+)
+
+func TestCheckTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if _, err := checkTCP("127.0.0.1", port); err != nil {
+		t.Errorf("checkTCP() on open port error = %v", err)
+	}
+
+	listener.Close()
+	if _, err := checkTCP("127.0.0.1", port); err == nil {
+		t.Error("checkTCP() on closed port expected error")
+	}
+}
+
+func TestCheckHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			fmt.Fprint(w, "ok from "+r.Host)
+		case "/broken":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		host     string
+		status   int
+		contains string
+		wantErr  bool
+	}{
+		{name: "status matches", path: "/health", status: 200},
+		{name: "status differs", path: "/missing", status: 200, wantErr: true},
+		{name: "body contains", path: "/health", status: 200, contains: "ok"},
+		{name: "body missing text", path: "/health", status: 200, contains: "healthy", wantErr: true},
+		{name: "host header", path: "/health", host: "example.com", status: 200, contains: "example.com"},
+		{name: "any status accepts 404", path: "/missing"},
+		{name: "any status rejects 502", path: "/broken", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := checkHTTP(server.URL+tt.path, tt.host, tt.status, tt.contains)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkHTTP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckCommand(t *testing.T) {
+	tests := []struct {
+		command  string
+		exitCode int
+		wantErr  bool
+	}{
+		{command: "true", exitCode: 0},
+		{command: "false", exitCode: 0, wantErr: true},
+		{command: "exit 3", exitCode: 3},
+		{command: "exit 3", exitCode: 0, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		_, err := checkCommand(tt.command, tt.exitCode)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkCommand(%q, %d) error = %v, wantErr %v", tt.command, tt.exitCode, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setupsuite-checks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "motd")
+	ioutil.WriteFile(path, []byte("Authorized use only\n"), 0644)
+
+	if _, err := checkFile(path, ""); err != nil {
+		t.Errorf("checkFile() exists error = %v", err)
+	}
+	if _, err := checkFile(path, "Authorized use only"); err != nil {
+		t.Errorf("checkFile() contains error = %v", err)
+	}
+	if _, err := checkFile(path, "Welcome"); err == nil {
+		t.Error("checkFile() with missing text expected error")
+	}
+	if _, err := checkFile(filepath.Join(dir, "missing"), ""); err == nil {
+		t.Error("checkFile() on missing file expected error")
+	}
+}
+
+func TestRunHealthChecksUserChecks(t *testing.T) {
+	InitLogger(false)
+
+	cfg := &config.ServerConfig{
+		Checks: []config.Check{
+			{Type: "command", Command: "true"},
+			{Name: "always fails", Type: "command", Command: "false"},
+			{Type: "smtp"},
+		},
+	}
+
+	report := RunHealthChecks(cfg)
+	if len(report.Results) != 3 {
+		t.Fatalf("len(Results) = %d, want 3", len(report.Results))
+	}
+	if !report.Results[0].Passed || report.Results[0].Name != "command true" {
+		t.Errorf("Results[0] = %+v", report.Results[0])
+	}
+	if report.Results[1].Passed || report.Results[1].Name != "always fails" {
+		t.Errorf("Results[1] = %+v", report.Results[1])
+	}
+	if report.Results[2].Passed || !strings.Contains(report.Results[2].Detail, "unknown check type") {
+		t.Errorf("Results[2] = %+v", report.Results[2])
+	}
+	if len(report.Failed()) != 2 {
+		t.Errorf("len(Failed()) = %d, want 2", len(report.Failed()))
+	}
+}
+
+func TestBuiltinChecks(t *testing.T) {
+	cfg := &config.ServerConfig{
+		SetupSecure: &config.SetupSecure{
+			SSHPort:  2222,
+			Config:   &config.Config{Type: config.ServerTypeWeb, Domain: "example.com", Email: "admin@example.com"},
+			Firewall: &config.Firewall{OpenPorts: []int{2222, 80, 443}},
+		},
+	}
+
+	var names []string
+	for _, check := range builtinChecks(cfg) {
+		names = append(names, check.name)
+	}
+	want := []string{
+		"sshd listening on port 2222",
+		"nginx answers on port 80",
+		"nginx answers on port 443",
+		"firewall allows configured rules",
+	}
+	if strings.Join(names, "|") != strings.Join(want, "|") {
+		t.Errorf("builtinChecks() = %v, want %v", names, want)
+	}
+}
+
+func TestFirewallPlanReport(t *testing.T) {
+	if _, err := firewallPlanReport("ufw", &FirewallPlan{}, 2); err != nil {
+		t.Errorf("firewallPlanReport() error = %v", err)
+	}
+
+	plan := &FirewallPlan{Add: []FirewallRule{{Port: 443, Protocol: "tcp"}, {Port: 53, Protocol: "udp", Source: "10.0.0.0/8"}}}
+	_, err := firewallPlanReport("ufw", plan, 3)
+	if err == nil || err.Error() != "ufw does not allow 443/tcp, 53/udp from 10.0.0.0/8" {
+		t.Errorf("firewallPlanReport() error = %v", err)
+	}
+
+	_, err = firewallPlanReport("iptables", &FirewallPlan{Enable: true}, 1)
+	if err == nil || err.Error() != "iptables is not enforcing its rules" {
+		t.Errorf("firewallPlanReport() error = %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"suite/suite/config"
+	"time"
+)
+
+const defaultConfigPath = "/etc/setupsuite/config.sscfg"
+
+// isSubcommand reports whether the first argument selects a subcommand
+func isSubcommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "apply", "audit", "bundle", "confirm", "facts", "revert", "verify":
+		return true
+	}
+	return false
+}
+
+// runSubcommand dispatches `setupsuite <command> [options]`
+func runSubcommand(name string, args []string) {
+	switch name {
+	case "apply":
+		runApply(args)
+	case "audit":
+		runAudit(args)
+	case "bundle":
+		runBundle(args)
+	case "confirm":
+		runConfirm(args)
+	case "revert":
+		runRevert(args)
+	case "facts":
+		runFacts(args)
+	case "verify":
+		runVerify(args)
+	}
+}
+
+func runApply(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath, "Path to configuration file")
+	offline := fs.String("offline", "", "Install from a bundle directory or tarball instead of the network")
+	verbose := fs.Bool("verbose", false, "Enable verbose logging of all file operations and command outputs")
+	fs.Parse(args)
+
+	if err := InitLogger(*verbose); err != nil {
+		fmt.Printf("Warning: Could not initialize logging: %v\n", err)
+	}
+	defer CloseLogger()
+
+	if *offline != "" {
+		bundle, err := OpenBundle(*offline)
+		if err != nil {
+			fmt.Printf("Error opening offline bundle: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Offline mode: using bundle %s (%d packages)\n", bundle.Dir, len(bundle.Manifest.Packages))
+		ActiveBundle = bundle
+	}
+
+	fmt.Println("Starting Serversetup...")
+	execute(*configPath)
+}
+
+func runBundle(args []string) {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath, "Path to configuration file")
+	output := fs.String("output", "setupsuite-bundle.tar.gz", "Bundle directory, or a .tar.gz file")
+	verbose := fs.Bool("verbose", false, "Enable verbose logging of all file operations and command outputs")
+	fs.Parse(args)
+
+	if err := InitLogger(*verbose); err != nil {
+		fmt.Printf("Warning: Could not initialize logging: %v\n", err)
+	}
+	defer CloseLogger()
+
+	serverConfig, err := config.ReadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Error reading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	if serverConfig.HTTPProxy != nil {
+		ApplyProxyEnvironment(serverConfig.HTTPProxy)
+	}
+
+	facts, err := GatherFacts()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := CreateBundle(serverConfig, facts, *output); err != nil {
+		fmt.Printf("Bundle failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Offline bundle written to %s\n", *output)
+}
+
+func runFacts(args []string) {
+	fs := flag.NewFlagSet("facts", flag.ExitOnError)
+	verbose := fs.Bool("verbose", false, "Enable verbose logging of all file operations and command outputs")
+	fs.Parse(args)
+
+	if err := InitLogger(*verbose); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not initialize logging: %v\n", err)
+	}
+	defer CloseLogger()
+
+	facts, err := GatherFacts()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error gathering facts: %v\n", err)
+		os.Exit(1)
+	}
+
+	factsJSON, err := facts.JSON()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding facts: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(factsJSON)
+}
+
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath, "Path to configuration file")
+	verbose := fs.Bool("verbose", false, "Enable verbose logging of all file operations and command outputs")
+	fs.Parse(args)
+
+	if err := InitLogger(*verbose); err != nil {
+		fmt.Printf("Warning: Could not initialize logging: %v\n", err)
+	}
+	defer CloseLogger()
+
+	serverConfig, err := config.ReadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Error reading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	report := RunHealthChecks(serverConfig)
+	report.Print()
+	if len(report.Failed()) > 0 {
+		os.Exit(1)
+	}
+}
+
+func runAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath, "Path to configuration file, compared against if it exists")
+	format := fs.String("format", "markdown", "Report format: json, markdown or html")
+	output := fs.String("output", "", "Write the report to this file instead of stdout")
+	minScore := fs.Int("min-score", 0, "Exit with an error if the score is below this")
+	verbose := fs.Bool("verbose", false, "Enable verbose logging of all file operations and command outputs")
+	fs.Parse(args)
+
+	if err := InitLogger(*verbose); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not initialize logging: %v\n", err)
+	}
+	defer CloseLogger()
+
+	// The audit works without a config, it then only skips the comparison
+	var serverConfig *config.ServerConfig
+	if _, err := os.Stat(*configPath); err == nil {
+		if serverConfig, err = config.ReadConfig(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	facts, err := GatherFacts()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not gather all facts: %v\n", err)
+	}
+
+	report := RunAudit(serverConfig, facts)
+	rendered, err := report.Render(*format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *output == "" {
+		fmt.Print(rendered)
+	} else if err := ioutil.WriteFile(*output, []byte(rendered), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+		os.Exit(1)
+	} else {
+		fmt.Fprintf(os.Stderr, "Audit score %d/100, report written to %s\n", report.Score, *output)
+	}
+
+	if report.Score < *minScore {
+		os.Exit(1)
+	}
+}
+
+func runConfirm(args []string) {
+	fs := flag.NewFlagSet("confirm", flag.ExitOnError)
+	verbose := fs.Bool("verbose", false, "Enable verbose logging of all file operations and command outputs")
+	fs.Parse(args)
+
+	if err := InitLogger(*verbose); err != nil {
+		fmt.Printf("Warning: Could not initialize logging: %v\n", err)
+	}
+	defer CloseLogger()
+
+	safeApply, err := LoadSafeApply()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if safeApply == nil {
+		fmt.Println("Nothing to confirm")
+		return
+	}
+	facts, err := GatherFacts()
+	if err != nil {
+		fmt.Printf("Warning: Could not gather all facts: %v\n", err)
+	}
+	if err := safeApply.Confirm(facts); err != nil {
+		fmt.Printf("Confirm failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runRevert(args []string) {
+	fs := flag.NewFlagSet("revert", flag.ExitOnError)
+	id := fs.String("id", "", "Only revert the safe apply run with this ID")
+	after := fs.Duration("after", 0, "Wait this long before reverting")
+	verbose := fs.Bool("verbose", false, "Enable verbose logging of all file operations and command outputs")
+	fs.Parse(args)
+
+	if err := InitLogger(*verbose); err != nil {
+		fmt.Printf("Warning: Could not initialize logging: %v\n", err)
+	}
+	defer CloseLogger()
+
+	time.Sleep(*after)
+
+	safeApply, err := LoadSafeApply()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	// A timer of a confirmed run must not revert a later one
+	if safeApply == nil || (*id != "" && safeApply.ID != *id) {
+		fmt.Println("Nothing to revert")
+		return
+	}
+	facts, err := GatherFacts()
+	if err != nil {
+		fmt.Printf("Warning: Could not gather all facts: %v\n", err)
+	}
+	if err := safeApply.Revert(facts); err != nil {
+		fmt.Printf("Revert failed: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 func check(e error) {
@@ -54,6 +56,62 @@ func ReadConfig(configPath string) (*ServerConfig, error) {
 		return nil, fmt.Errorf("failed to parse config: %v", err)
 	}
 
+	if err := loadKeyFiles(serverConfig, filepath.Dir(config)); err != nil {
+		return nil, fmt.Errorf("failed to load ssh keys: %v", err)
+	}
+
 	fmt.Println("Configuration loaded successfully")
 	return serverConfig, nil
 }
+
+// loadKeyFiles replaces key entries that name a .pub file with the keys in
+// it and makes the host CA key path absolute
+func loadKeyFiles(cfg *ServerConfig, baseDir string) error {
+	for i := range cfg.Users {
+		keys, err := loadKeyList(cfg.Users[i].Keys, baseDir)
+		if err != nil {
+			return fmt.Errorf("user %s: %v", cfg.Users[i].Name, err)
+		}
+		cfg.Users[i].Keys = keys
+	}
+
+	if cfg.SetupSecure == nil || cfg.SetupSecure.SSHCA == nil {
+		return nil
+	}
+	ca := cfg.SetupSecure.SSHCA
+	keys, err := loadKeyList(ca.UserCAKeys, baseDir)
+	if err != nil {
+		return fmt.Errorf("ssh_ca: %v", err)
+	}
+	ca.UserCAKeys = keys
+	if ca.HostCAKey != "" && !filepath.IsAbs(ca.HostCAKey) {
+		ca.HostCAKey = filepath.Join(baseDir, ca.HostCAKey)
+	}
+	return nil
+}
+
+// loadKeyList reads the entries ending in .pub from files relative to baseDir
+func loadKeyList(entries []string, baseDir string) ([]string, error) {
+	var keys []string
+	for _, key := range entries {
+		if !strings.HasSuffix(key, ".pub") || strings.ContainsAny(key, " \t") {
+			keys = append(keys, key)
+			continue
+		}
+		path := key
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				keys = append(keys, line)
+			}
+		}
+	}
+	return keys, nil
+}
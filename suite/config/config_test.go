@@ -0,0 +1,53 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "keys"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"alice.pub":   "# laptop\nssh-ed25519 AAAA1 alice@laptop\n\nssh-ed25519 AAAA2 alice@desktop\n",
+		"user_ca.pub": "ssh-ed25519 AAAA3 user-ca\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, "keys", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &ServerConfig{
+		Users:       []User{{Name: "alice", Keys: []string{"ssh-rsa AAAA0 alice@old.pub", "keys/alice.pub"}}},
+		SetupSecure: &SetupSecure{SSHCA: &SSHCA{UserCAKeys: []string{"keys/user_ca.pub"}, HostCAKey: "keys/host_ca"}},
+	}
+	if err := loadKeyFiles(cfg, dir); err != nil {
+		t.Fatalf("loadKeyFiles() error = %v", err)
+	}
+	users := cfg.Users
+	want := []string{"ssh-rsa AAAA0 alice@old.pub", "ssh-ed25519 AAAA1 alice@laptop", "ssh-ed25519 AAAA2 alice@desktop"}
+	if len(users[0].Keys) != len(want) {
+		t.Fatalf("Keys = %q, want %q", users[0].Keys, want)
+	}
+	for i := range want {
+		if users[0].Keys[i] != want[i] {
+			t.Errorf("Keys[%d] = %q, want %q", i, users[0].Keys[i], want[i])
+		}
+	}
+
+	if ca := cfg.SetupSecure.SSHCA; len(ca.UserCAKeys) != 1 || ca.UserCAKeys[0] != "ssh-ed25519 AAAA3 user-ca" {
+		t.Errorf("UserCAKeys = %q", ca.UserCAKeys)
+	}
+	if got := cfg.SetupSecure.SSHCA.HostCAKey; got != filepath.Join(dir, "keys", "host_ca") {
+		t.Errorf("HostCAKey = %q, want it relative to the config", got)
+	}
+
+	missing := &ServerConfig{Users: []User{{Name: "bob", Keys: []string{"keys/bob.pub"}}}}
+	if err := loadKeyFiles(missing, dir); err == nil {
+		t.Error("expected an error for a missing key file")
+	}
+}
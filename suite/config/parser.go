@@ -30,6 +30,30 @@ func ParseConfig(content string) (*ServerConfig, error) {
 			installTools, nextIndex := parseInstallTools(lines, i)
 			config.InstallTools = installTools
 			i = nextIndex
+		} else if strings.HasPrefix(line, ".http_proxy{") {
+			httpProxy, nextIndex := parseHTTPProxy(lines, i)
+			config.HTTPProxy = httpProxy
+			i = nextIndex
+		} else if strings.HasPrefix(line, ".services{") {
+			services, nextIndex := parseServices(lines, i)
+			config.Services = services
+			i = nextIndex
+		} else if strings.HasPrefix(line, ".users{") {
+			users, nextIndex := parseUsers(lines, i)
+			config.Users = append(config.Users, users...)
+			i = nextIndex
+		} else if strings.HasPrefix(line, ".units{") {
+			units, nextIndex := parseUnits(lines, i)
+			config.Units = append(config.Units, units...)
+			i = nextIndex
+		} else if strings.HasPrefix(line, ".sysctl{") {
+			sysctl, nextIndex := parseSysctl(lines, i)
+			config.Sysctl = sysctl
+			i = nextIndex
+		} else if strings.HasPrefix(line, ".checks{") {
+			checks, nextIndex := parseChecks(lines, i)
+			config.Checks = append(config.Checks, checks...)
+			i = nextIndex
 		} else {
 			i++
 		}
@@ -70,6 +94,12 @@ func parseSetupSecure(lines []string, startIndex int) (*SetupSecure, int) {
 				if port, err := strconv.Atoi(value); err == nil {
 					setupSecure.SSHPort = port
 				}
+			case "ssh_safe_apply":
+				setupSecure.SSHSafeApply = value
+			case "ssh_confirm_timeout":
+				if minutes, err := strconv.Atoi(value); err == nil {
+					setupSecure.SSHConfirmTimeout = minutes
+				}
 			}
 		} else if strings.HasPrefix(line, ".configuration{") {
 			config, nextIndex := parseConfiguration(lines, i)
@@ -81,6 +111,21 @@ func parseSetupSecure(lines []string, startIndex int) (*SetupSecure, int) {
 			setupSecure.Firewall = firewall
 			i = nextIndex
 			continue
+		} else if strings.HasPrefix(line, ".ssh_ca{") {
+			sshCA, nextIndex := parseSSHCA(lines, i)
+			setupSecure.SSHCA = sshCA
+			i = nextIndex
+			continue
+		} else if strings.HasPrefix(line, ".fail2ban{") {
+			fail2ban, nextIndex := parseFail2ban(lines, i)
+			setupSecure.Fail2ban = fail2ban
+			i = nextIndex
+			continue
+		} else if strings.HasPrefix(line, ".ssh{") {
+			ssh, nextIndex := parseSSH(lines, i)
+			setupSecure.SSH = ssh
+			i = nextIndex
+			continue
 		}
 		i++
 	}
@@ -140,21 +185,19 @@ func parseFirewall(lines []string, startIndex int) (*Firewall, int) {
 			break
 		}
 
-		if strings.HasPrefix(line, "open_ports:") {
-			i++
-			// Parse array
-			for i < len(lines) {
-				arrayLine := strings.TrimSpace(lines[i])
-				if arrayLine == "]" {
-					break
+		if strings.HasPrefix(line, "backend:") {
+			firewall.Backend = cleanValue(strings.TrimPrefix(line, "backend:"))
+		} else if strings.HasPrefix(line, "rules:") {
+			var rules []FirewallRule
+			rules, i = parseFirewallRules(lines, i, strings.TrimSpace(strings.TrimPrefix(line, "rules:")))
+			firewall.Rules = append(firewall.Rules, rules...)
+		} else if strings.HasPrefix(line, "open_ports:") {
+			var ports []string
+			ports, i = parseStringList(lines, i, strings.TrimPrefix(line, "open_ports:"))
+			for _, portStr := range ports {
+				if port, err := strconv.Atoi(portStr); err == nil {
+					firewall.OpenPorts = append(firewall.OpenPorts, port)
 				}
-				if arrayLine != "[" && arrayLine != "" {
-					portStr := strings.Trim(arrayLine, ",")
-					if port, err := strconv.Atoi(portStr); err == nil {
-						firewall.OpenPorts = append(firewall.OpenPorts, port)
-					}
-				}
-				i++
 			}
 		}
 		i++
@@ -163,6 +206,236 @@ func parseFirewall(lines []string, startIndex int) (*Firewall, int) {
 	return firewall, i + 1
 }
 
+// parseFirewallRules reads a list of inline rule objects, one or more per
+// line, like { port: 3306, proto: "tcp", from: ["10.0.0.0/8"] }
+func parseFirewallRules(lines []string, i int, value string) ([]FirewallRule, int) {
+	text := value
+	depth := strings.Count(value, "[") - strings.Count(value, "]")
+	for depth > 0 && i+1 < len(lines) {
+		i++
+		line := strings.TrimSpace(lines[i])
+		text += " " + line
+		depth += strings.Count(line, "[") - strings.Count(line, "]")
+	}
+
+	text = strings.TrimSuffix(strings.TrimSpace(text), ",")
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "["), "]")
+
+	var rules []FirewallRule
+	for _, object := range splitTopLevel(text) {
+		object = strings.TrimSpace(object)
+		if !strings.HasPrefix(object, "{") || !strings.HasSuffix(object, "}") {
+			continue
+		}
+		rule := FirewallRule{}
+		for _, field := range splitTopLevel(object[1 : len(object)-1]) {
+			parts := strings.SplitN(field, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+
+			switch key {
+			case "port":
+				rule.Port, _ = strconv.Atoi(cleanValue(value))
+			case "ports":
+				rule.Ports = cleanValue(value)
+			case "proto":
+				rule.Proto = cleanValue(value)
+			case "from":
+				rule.From, _ = parseStringList(nil, 0, value)
+			case "limit":
+				rule.Limit = cleanValue(value)
+			case "family":
+				rule.Family = cleanValue(value)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, i
+}
+
+// splitTopLevel splits on commas that are outside quotes, brackets and braces
+func splitTopLevel(content string) []string {
+	var parts []string
+	var current strings.Builder
+	inQuotes := false
+	depth := 0
+
+	for _, r := range content {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case r == '[' || r == '{':
+			depth++
+		case r == ']' || r == '}':
+			depth--
+		case r == ',' && depth == 0:
+			if part := strings.TrimSpace(current.String()); part != "" {
+				parts = append(parts, part)
+			}
+			current.Reset()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	if part := strings.TrimSpace(current.String()); part != "" {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+func parseSSH(lines []string, startIndex int) (*SSH, int) {
+	ssh := &SSH{}
+	i := startIndex + 1
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line == "}" || line == "}," {
+			break
+		}
+
+		if strings.HasPrefix(line, ".match{") {
+			match, nextIndex := parseSSHMatch(lines, i)
+			ssh.Matches = append(ssh.Matches, match)
+			i = nextIndex
+			continue
+		}
+
+		if strings.Contains(line, ":") {
+			parts := strings.SplitN(line, ":", 2)
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+
+			switch key {
+			case "crypto":
+				ssh.Crypto = cleanValue(value)
+			case "max_auth_tries":
+				if tries, err := strconv.Atoi(cleanValue(value)); err == nil {
+					ssh.MaxAuthTries = tries
+				}
+			case "login_grace_time":
+				ssh.LoginGraceTime = cleanValue(value)
+			case "min_rsa_bits":
+				if bits, err := strconv.Atoi(cleanValue(value)); err == nil {
+					ssh.MinRSABits = bits
+				}
+			case "allow_users":
+				ssh.AllowUsers, i = parseStringList(lines, i, value)
+			case "allow_groups":
+				ssh.AllowGroups, i = parseStringList(lines, i, value)
+			case "x11_forwarding":
+				ssh.X11Forwarding = cleanValue(value) == "true"
+			}
+		}
+		i++
+	}
+
+	return ssh, i + 1
+}
+
+func parseSSHCA(lines []string, startIndex int) (*SSHCA, int) {
+	sshCA := &SSHCA{}
+	i := startIndex + 1
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line == "}" || line == "}," {
+			break
+		}
+
+		if strings.Contains(line, ":") {
+			parts := strings.SplitN(line, ":", 2)
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+
+			switch key {
+			case "user_ca_keys":
+				sshCA.UserCAKeys, i = parseStringList(lines, i, value)
+			case "host_ca_key":
+				sshCA.HostCAKey = cleanValue(value)
+			case "host_principals":
+				sshCA.HostPrincipals, i = parseStringList(lines, i, value)
+			case "host_cert_validity":
+				sshCA.HostCertValidity = cleanValue(value)
+			case "export_dir":
+				sshCA.ExportDir = cleanValue(value)
+			}
+		}
+		i++
+	}
+
+	return sshCA, i + 1
+}
+
+func parseFail2ban(lines []string, startIndex int) (*Fail2ban, int) {
+	fail2ban := &Fail2ban{}
+	i := startIndex + 1
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line == "}" || line == "}," {
+			break
+		}
+
+		if strings.Contains(line, ":") {
+			parts := strings.SplitN(line, ":", 2)
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+
+			switch key {
+			case "ban_time":
+				fail2ban.BanTime = cleanValue(value)
+			case "find_time":
+				fail2ban.FindTime = cleanValue(value)
+			case "max_retry":
+				if retries, err := strconv.Atoi(cleanValue(value)); err == nil {
+					fail2ban.MaxRetry = retries
+				}
+			case "ignore_ips":
+				fail2ban.IgnoreIPs, i = parseStringList(lines, i, value)
+			case "jails":
+				fail2ban.Jails, i = parseStringList(lines, i, value)
+			case "recidive_ban_time":
+				fail2ban.RecidiveBanTime = cleanValue(value)
+			}
+		}
+		i++
+	}
+
+	return fail2ban, i + 1
+}
+
+func parseSSHMatch(lines []string, startIndex int) (SSHMatch, int) {
+	match := SSHMatch{}
+	i := startIndex + 1
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line == "}" || line == "}," {
+			break
+		}
+
+		if strings.Contains(line, ":") {
+			parts := strings.SplitN(line, ":", 2)
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+
+			switch key {
+			case "criteria":
+				match.Criteria = cleanValue(value)
+			case "settings":
+				match.Settings, i = parseStringList(lines, i, value)
+			}
+		}
+		i++
+	}
+
+	return match, i + 1
+}
+
 func parseInstallTools(lines []string, startIndex int) (*InstallTools, int) {
 	installTools := &InstallTools{}
 	i := startIndex + 1
@@ -178,7 +451,7 @@ func parseInstallTools(lines []string, startIndex int) (*InstallTools, int) {
 			// Parse array
 			for i < len(lines) {
 				arrayLine := strings.TrimSpace(lines[i])
-				if arrayLine == "]" {
+				if arrayLine == "]" || arrayLine == "]," {
 					break
 				}
 				if arrayLine != "[" && arrayLine != "" {
@@ -197,6 +470,33 @@ func parseInstallTools(lines []string, startIndex int) (*InstallTools, int) {
 				}
 				i++
 			}
+		} else if strings.Contains(line, ":") {
+			parts := strings.SplitN(line, ":", 2)
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+
+			switch key {
+			case "lock_timeout":
+				if timeout, err := strconv.Atoi(cleanValue(value)); err == nil {
+					installTools.LockTimeout = timeout
+				}
+			case "scope":
+				installTools.Scope = cleanValue(value)
+			case "user":
+				installTools.User = cleanValue(value)
+			case "pip":
+				installTools.Pip, i = parseStringList(lines, i, value)
+			case "npm_global":
+				installTools.NpmGlobal, i = parseStringList(lines, i, value)
+			case "cargo":
+				installTools.Cargo, i = parseStringList(lines, i, value)
+			case "go":
+				installTools.Go, i = parseStringList(lines, i, value)
+			case "snap":
+				installTools.Snap, i = parseStringList(lines, i, value)
+			case "flatpak":
+				installTools.Flatpak, i = parseStringList(lines, i, value)
+			}
 		}
 		i++
 	}
@@ -204,6 +504,394 @@ func parseInstallTools(lines []string, startIndex int) (*InstallTools, int) {
 	return installTools, i + 1
 }
 
+func parseHTTPProxy(lines []string, startIndex int) (*HTTPProxy, int) {
+	httpProxy := &HTTPProxy{}
+	i := startIndex + 1
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line == "}" || line == "}," {
+			break
+		}
+
+		if strings.Contains(line, ":") {
+			parts := strings.SplitN(line, ":", 2)
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+
+			switch key {
+			case "http":
+				httpProxy.HTTP = cleanValue(value)
+			case "https":
+				httpProxy.HTTPS = cleanValue(value)
+			case "no_proxy":
+				var hosts []string
+				hosts, i = parseStringList(lines, i, value)
+				for _, host := range hosts {
+					// Accept both a list and a comma separated string
+					for _, h := range strings.Split(host, ",") {
+						if h = strings.TrimSpace(h); h != "" {
+							httpProxy.NoProxy = append(httpProxy.NoProxy, h)
+						}
+					}
+				}
+			}
+		}
+		i++
+	}
+
+	return httpProxy, i + 1
+}
+
+// parseSysctl reads the profiles list; every other key is a kernel parameter
+func parseSysctl(lines []string, startIndex int) (*Sysctl, int) {
+	sysctl := &Sysctl{}
+	// An empty .sysctl{} on one line selects the profiles of the server type
+	if strings.HasSuffix(strings.TrimSuffix(strings.TrimSpace(lines[startIndex]), ","), "}") {
+		return sysctl, startIndex + 1
+	}
+	i := startIndex + 1
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line == "}" || line == "}," {
+			break
+		}
+
+		if strings.Contains(line, ":") {
+			parts := strings.SplitN(line, ":", 2)
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+
+			if key == "profiles" {
+				sysctl.Profiles, i = parseStringList(lines, i, value)
+			} else {
+				if sysctl.Settings == nil {
+					sysctl.Settings = make(map[string]string)
+				}
+				sysctl.Settings[cleanValue(key)] = cleanValue(value)
+			}
+		}
+		i++
+	}
+
+	return sysctl, i + 1
+}
+
+func parseServices(lines []string, startIndex int) (*Services, int) {
+	services := &Services{}
+	i := startIndex + 1
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line == "}" || line == "}," {
+			break
+		}
+
+		if strings.Contains(line, ":") {
+			parts := strings.SplitN(line, ":", 2)
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+
+			switch key {
+			case "enable":
+				services.Enable, i = parseStringList(lines, i, value)
+			case "disable":
+				services.Disable, i = parseStringList(lines, i, value)
+			case "mask":
+				services.Mask, i = parseStringList(lines, i, value)
+			case "restart_on_change":
+				services.RestartOnChange, i = parseStringList(lines, i, value)
+			}
+		}
+		i++
+	}
+
+	return services, i + 1
+}
+
+func parseUsers(lines []string, startIndex int) ([]User, int) {
+	var users []User
+	i := startIndex + 1
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line == "}" || line == "}," {
+			break
+		}
+
+		if strings.HasPrefix(line, ".user{") {
+			user, nextIndex := parseUser(lines, i)
+			users = append(users, user)
+			i = nextIndex
+			continue
+		}
+		i++
+	}
+
+	return users, i + 1
+}
+
+func parseUser(lines []string, startIndex int) (User, int) {
+	user := User{}
+	i := startIndex + 1
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line == "}" || line == "}," {
+			break
+		}
+
+		if strings.Contains(line, ":") {
+			parts := strings.SplitN(line, ":", 2)
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+
+			switch key {
+			case "name":
+				user.Name = cleanValue(value)
+			case "keys":
+				user.Keys, i = parseStringList(lines, i, value)
+			case "groups":
+				user.Groups, i = parseStringList(lines, i, value)
+			case "shell":
+				user.Shell = cleanValue(value)
+			case "sudo":
+				user.Sudo = cleanValue(value)
+			case "sudo_commands":
+				user.SudoCommands, i = parseStringList(lines, i, value)
+			case "sudo_defaults":
+				user.SudoDefaults, i = parseStringList(lines, i, value)
+			case "principals":
+				user.Principals, i = parseStringList(lines, i, value)
+			case "state":
+				user.State = cleanValue(value)
+			case "uid":
+				user.UID, _ = strconv.Atoi(cleanValue(value))
+			case "gid":
+				user.GID, _ = strconv.Atoi(cleanValue(value))
+			case "system":
+				user.System = cleanValue(value) == "true"
+			case "lock_password":
+				user.LockPassword = cleanValue(value) == "true"
+			}
+		}
+		i++
+	}
+
+	return user, i + 1
+}
+
+func parseUnits(lines []string, startIndex int) ([]Unit, int) {
+	var units []Unit
+	i := startIndex + 1
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line == "}" || line == "}," {
+			break
+		}
+
+		if strings.HasPrefix(line, ".unit{") {
+			unit, nextIndex := parseUnit(lines, i)
+			units = append(units, unit)
+			i = nextIndex
+			continue
+		}
+		i++
+	}
+
+	return units, i + 1
+}
+
+func parseUnit(lines []string, startIndex int) (Unit, int) {
+	unit := Unit{}
+	i := startIndex + 1
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line == "}" || line == "}," {
+			break
+		}
+
+		if strings.Contains(line, ":") {
+			parts := strings.SplitN(line, ":", 2)
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+
+			switch key {
+			case "name":
+				unit.Name = cleanValue(value)
+			case "description":
+				unit.Description = cleanValue(value)
+			case "exec":
+				unit.Exec = cleanValue(value)
+			case "user":
+				unit.User = cleanValue(value)
+			case "group":
+				unit.Group = cleanValue(value)
+			case "working_directory":
+				unit.WorkingDirectory = cleanValue(value)
+			case "environment":
+				unit.Environment, i = parseStringList(lines, i, value)
+			case "after":
+				unit.After, i = parseStringList(lines, i, value)
+			case "restart":
+				unit.Restart = cleanValue(value)
+			case "restart_sec":
+				if sec, err := strconv.Atoi(cleanValue(value)); err == nil {
+					unit.RestartSec = sec
+				}
+			case "protect_system":
+				unit.ProtectSystem = cleanValue(value)
+			case "protect_home":
+				unit.ProtectHome = cleanValue(value)
+			case "no_new_privileges":
+				unit.NoNewPrivileges = cleanValue(value) == "true"
+			case "private_tmp":
+				unit.PrivateTmp = cleanValue(value) == "true"
+			case "read_write_paths":
+				unit.ReadWritePaths, i = parseStringList(lines, i, value)
+			}
+		}
+		i++
+	}
+
+	return unit, i + 1
+}
+
+func parseChecks(lines []string, startIndex int) ([]Check, int) {
+	var checks []Check
+	i := startIndex + 1
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line == "}" || line == "}," {
+			break
+		}
+
+		if strings.HasPrefix(line, ".check{") {
+			check, nextIndex := parseCheck(lines, i)
+			checks = append(checks, check)
+			i = nextIndex
+			continue
+		}
+		i++
+	}
+
+	return checks, i + 1
+}
+
+func parseCheck(lines []string, startIndex int) (Check, int) {
+	check := Check{}
+	i := startIndex + 1
+
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line == "}" || line == "}," {
+			break
+		}
+
+		if strings.Contains(line, ":") {
+			parts := strings.SplitN(line, ":", 2)
+			key := strings.TrimSpace(parts[0])
+			value := cleanValue(parts[1])
+
+			switch key {
+			case "name":
+				check.Name = value
+			case "type":
+				check.Type = value
+			case "host":
+				check.Host = value
+			case "port":
+				check.Port, _ = strconv.Atoi(value)
+			case "url":
+				check.URL = value
+			case "status":
+				check.Status, _ = strconv.Atoi(value)
+			case "command":
+				check.Command = value
+			case "exit_code":
+				check.ExitCode, _ = strconv.Atoi(value)
+			case "path":
+				check.Path = value
+			case "contains":
+				check.Contains = value
+			}
+		}
+		i++
+	}
+
+	return check, i + 1
+}
+
+// cleanValue strips surrounding whitespace, quotes and a trailing comma from a value
+func cleanValue(value string) string {
+	value = strings.Trim(value, " \t\r\n")
+	value = strings.TrimSuffix(value, ",")
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		value = value[1 : len(value)-1]
+	}
+	return value
+}
+
+// parseStringList parses the value of a key as a list of strings. The list may
+// be written inline (["a", "b"]), across several lines starting with "[", or
+// as a single value. It returns the list and the index of the last line consumed.
+func parseStringList(lines []string, i int, value string) ([]string, int) {
+	value = strings.TrimSuffix(strings.TrimSpace(value), ",")
+	if !strings.HasPrefix(value, "[") {
+		if v := cleanValue(value); v != "" {
+			return []string{v}, i
+		}
+		return nil, i
+	}
+
+	if strings.HasSuffix(value, "]") {
+		return splitInlineList(value[1 : len(value)-1]), i
+	}
+
+	var items []string
+	for i+1 < len(lines) {
+		i++
+		item := strings.TrimSpace(lines[i])
+		if item == "]" || item == "]," {
+			break
+		}
+		if v := cleanValue(item); v != "" {
+			items = append(items, v)
+		}
+	}
+	return items, i
+}
+
+// splitInlineList splits the contents of an inline list on commas outside quotes
+func splitInlineList(content string) []string {
+	var items []string
+	var current strings.Builder
+	inQuotes := false
+
+	for _, r := range content {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			current.WriteRune(r)
+		case r == ',' && !inQuotes:
+			if v := cleanValue(current.String()); v != "" {
+				items = append(items, v)
+			}
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if v := cleanValue(current.String()); v != "" {
+		items = append(items, v)
+	}
+	return items
+}
+
 // CreateDefaultConfig creates default configuration files for different server types
 func CreateDefaultConfig(serverType string, configPath string) error {
 	var configContent string
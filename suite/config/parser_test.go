@@ -128,6 +128,24 @@ func TestParseConfig(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "ssh safe apply",
+			content: `.setup_secure{
+	ssh_user: "user",
+	ssh_port: 22022,
+	ssh_safe_apply: "self-test",
+	ssh_confirm_timeout: 5
+}`,
+			wantErr: false,
+			check: func(t *testing.T, cfg *ServerConfig) {
+				if cfg.SetupSecure.SSHSafeApply != "self-test" {
+					t.Errorf("SSHSafeApply = %s, want self-test", cfg.SetupSecure.SSHSafeApply)
+				}
+				if cfg.SetupSecure.SSHConfirmTimeout != 5 {
+					t.Errorf("SSHConfirmTimeout = %d, want 5", cfg.SetupSecure.SSHConfirmTimeout)
+				}
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -245,3 +263,522 @@ func TestParseInstallTools(t *testing.T) {
 		})
 	}
 }
+
+func TestParseHTTPProxy(t *testing.T) {
+	tests := []struct {
+		name        string
+		lines       []string
+		wantHTTP    string
+		wantNoProxy []string
+	}{
+		{
+			name: "inline no_proxy list",
+			lines: []string{
+				".http_proxy{",
+				`	http: "http://proxy.corp:3128",`,
+				`	https: "http://proxy.corp:3128",`,
+				`	no_proxy: ["localhost", "127.0.0.1", ".corp.local"]`,
+				"}",
+			},
+			wantHTTP:    "http://proxy.corp:3128",
+			wantNoProxy: []string{"localhost", "127.0.0.1", ".corp.local"},
+		},
+		{
+			name: "multi-line no_proxy list",
+			lines: []string{
+				".http_proxy{",
+				`	http: "http://10.0.0.1:8080",`,
+				"	no_proxy: [",
+				`		"localhost",`,
+				`		"10.0.0.0/8"`,
+				"	]",
+				"}",
+			},
+			wantHTTP:    "http://10.0.0.1:8080",
+			wantNoProxy: []string{"localhost", "10.0.0.0/8"},
+		},
+		{
+			name: "comma separated no_proxy string",
+			lines: []string{
+				".http_proxy{",
+				`	http: "http://10.0.0.1:8080",`,
+				`	no_proxy: "localhost,127.0.0.1"`,
+				"}",
+			},
+			wantHTTP:    "http://10.0.0.1:8080",
+			wantNoProxy: []string{"localhost", "127.0.0.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpProxy, _ := parseHTTPProxy(tt.lines, 0)
+			if httpProxy.HTTP != tt.wantHTTP {
+				t.Errorf("HTTP = %s, want %s", httpProxy.HTTP, tt.wantHTTP)
+			}
+			if len(httpProxy.NoProxy) != len(tt.wantNoProxy) {
+				t.Fatalf("NoProxy = %v, want %v", httpProxy.NoProxy, tt.wantNoProxy)
+			}
+			for i, host := range tt.wantNoProxy {
+				if httpProxy.NoProxy[i] != host {
+					t.Errorf("NoProxy[%d] = %s, want %s", i, httpProxy.NoProxy[i], host)
+				}
+			}
+		})
+	}
+}
+
+func TestParseInstallToolsSecondary(t *testing.T) {
+	lines := []string{
+		".install_tools{",
+		"	tools: [",
+		`		"python3-pip"`,
+		"	],",
+		`	pip: ["virtualenv", "black==23.1.0"],`,
+		"	npm_global: [",
+		`		"typescript@5.3.2",`,
+		`		"@angular/cli"`,
+		"	],",
+		`	go: ["golang.org/x/tools/gopls@v0.14.2"],`,
+		`	scope: "user",`,
+		`	user: "buildadmin"`,
+		"}",
+	}
+
+	installTools, _ := parseInstallTools(lines, 0)
+	if len(installTools.Tools) != 1 || installTools.Tools[0] != "python3-pip" {
+		t.Errorf("Tools = %v, want [python3-pip]", installTools.Tools)
+	}
+	if len(installTools.Pip) != 2 || installTools.Pip[1] != "black==23.1.0" {
+		t.Errorf("Pip = %v", installTools.Pip)
+	}
+	if len(installTools.NpmGlobal) != 2 || installTools.NpmGlobal[1] != "@angular/cli" {
+		t.Errorf("NpmGlobal = %v", installTools.NpmGlobal)
+	}
+	if len(installTools.Go) != 1 {
+		t.Errorf("Go = %v", installTools.Go)
+	}
+	if installTools.Scope != "user" || installTools.User != "buildadmin" {
+		t.Errorf("Scope = %s, User = %s", installTools.Scope, installTools.User)
+	}
+}
+
+func TestParseServices(t *testing.T) {
+	content := `.services{
+	enable: ["chronyd"],
+	disable: [
+		"avahi-daemon",
+		"cups",
+		"rpcbind"
+	],
+	mask: ["bluetooth"],
+	restart_on_change: ["nginx=/etc/nginx"]
+}`
+
+	cfg, err := ParseConfig(content)
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	services := cfg.Services
+	if services == nil {
+		t.Fatal("Services is nil")
+	}
+	if len(services.Enable) != 1 || services.Enable[0] != "chronyd" {
+		t.Errorf("Enable = %v", services.Enable)
+	}
+	if len(services.Disable) != 3 || services.Disable[2] != "rpcbind" {
+		t.Errorf("Disable = %v", services.Disable)
+	}
+	if len(services.Mask) != 1 || services.Mask[0] != "bluetooth" {
+		t.Errorf("Mask = %v", services.Mask)
+	}
+	if len(services.RestartOnChange) != 1 || services.RestartOnChange[0] != "nginx=/etc/nginx" {
+		t.Errorf("RestartOnChange = %v", services.RestartOnChange)
+	}
+}
+
+func TestParseUnits(t *testing.T) {
+	content := `.units{
+	.unit{
+		name: "metrics-agent",
+		description: "In-house metrics agent",
+		exec: "/opt/metrics/agent --listen :9100",
+		user: "metrics",
+		working_directory: "/opt/metrics",
+		environment: [
+			"LOG_LEVEL=info",
+			"REGION=eu"
+		],
+		restart: "always",
+		restart_sec: 10,
+		protect_system: "strict",
+		no_new_privileges: true,
+		read_write_paths: ["/var/lib/metrics"]
+	}
+	.unit{
+		name: "queue-worker",
+		exec: "/usr/local/bin/worker"
+	}
+}`
+
+	cfg, err := ParseConfig(content)
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if len(cfg.Units) != 2 {
+		t.Fatalf("len(Units) = %d, want 2", len(cfg.Units))
+	}
+
+	unit := cfg.Units[0]
+	if unit.Name != "metrics-agent" || unit.Exec != "/opt/metrics/agent --listen :9100" {
+		t.Errorf("Name = %s, Exec = %s", unit.Name, unit.Exec)
+	}
+	if unit.User != "metrics" || unit.WorkingDirectory != "/opt/metrics" {
+		t.Errorf("User = %s, WorkingDirectory = %s", unit.User, unit.WorkingDirectory)
+	}
+	if len(unit.Environment) != 2 || unit.Environment[1] != "REGION=eu" {
+		t.Errorf("Environment = %v", unit.Environment)
+	}
+	if unit.Restart != "always" || unit.RestartSec != 10 {
+		t.Errorf("Restart = %s, RestartSec = %d", unit.Restart, unit.RestartSec)
+	}
+	if unit.ProtectSystem != "strict" || !unit.NoNewPrivileges || unit.PrivateTmp {
+		t.Errorf("ProtectSystem = %s, NoNewPrivileges = %v, PrivateTmp = %v", unit.ProtectSystem, unit.NoNewPrivileges, unit.PrivateTmp)
+	}
+	if len(unit.ReadWritePaths) != 1 {
+		t.Errorf("ReadWritePaths = %v", unit.ReadWritePaths)
+	}
+	if cfg.Units[1].Name != "queue-worker" || cfg.Units[1].Exec != "/usr/local/bin/worker" {
+		t.Errorf("second unit = %+v", cfg.Units[1])
+	}
+}
+
+func TestParseChecks(t *testing.T) {
+	content := `.checks{
+	.check{
+		name: "api",
+		type: "http",
+		url: "http://127.0.0.1:8080/health",
+		status: 204
+	}
+	.check{
+		type: "tcp",
+		port: 6379
+	}
+	.check{
+		name: "motd",
+		type: "file",
+		path: "/etc/motd",
+		contains: "Authorized use only"
+	}
+	.check{
+		type: "command",
+		command: "test -d /srv/app",
+		exit_code: 0
+	}
+}`
+
+	cfg, err := ParseConfig(content)
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if len(cfg.Checks) != 4 {
+		t.Fatalf("len(Checks) = %d, want 4", len(cfg.Checks))
+	}
+	if c := cfg.Checks[0]; c.Name != "api" || c.Type != "http" || c.URL != "http://127.0.0.1:8080/health" || c.Status != 204 {
+		t.Errorf("http check = %+v", c)
+	}
+	if c := cfg.Checks[1]; c.Type != "tcp" || c.Port != 6379 {
+		t.Errorf("tcp check = %+v", c)
+	}
+	if c := cfg.Checks[2]; c.Path != "/etc/motd" || c.Contains != "Authorized use only" {
+		t.Errorf("file check = %+v", c)
+	}
+	if c := cfg.Checks[3]; c.Command != "test -d /srv/app" {
+		t.Errorf("command check = %+v", c)
+	}
+}
+
+func TestParseFirewallRules(t *testing.T) {
+	lines := []string{
+		".firewall{",
+		"	open_ports: [",
+		"		22",
+		"	],",
+		"	rules: [",
+		`		{ port: 3306, proto: "tcp", from: ["10.0.0.0/8", "192.168.1.0/24"] },`,
+		`		{ ports: "60000:61000", proto: "udp" },`,
+		`		{ port: 22022, limit: "6/min" },`,
+		`		{ proto: "icmp", family: "ipv4" }`,
+		"	]",
+		"}",
+	}
+
+	firewall, _ := parseFirewall(lines, 0)
+	if len(firewall.OpenPorts) != 1 || firewall.OpenPorts[0] != 22 {
+		t.Errorf("OpenPorts = %v, want [22]", firewall.OpenPorts)
+	}
+	if len(firewall.Rules) != 4 {
+		t.Fatalf("len(Rules) = %d, want 4: %+v", len(firewall.Rules), firewall.Rules)
+	}
+
+	if r := firewall.Rules[0]; r.Port != 3306 || r.Proto != "tcp" || len(r.From) != 2 || r.From[1] != "192.168.1.0/24" {
+		t.Errorf("Rules[0] = %+v", r)
+	}
+	if r := firewall.Rules[1]; r.Ports != "60000:61000" || r.Proto != "udp" {
+		t.Errorf("Rules[1] = %+v", r)
+	}
+	if r := firewall.Rules[2]; r.Port != 22022 || r.Limit != "6/min" {
+		t.Errorf("Rules[2] = %+v", r)
+	}
+	if r := firewall.Rules[3]; r.Proto != "icmp" || r.Family != "ipv4" {
+		t.Errorf("Rules[3] = %+v", r)
+	}
+}
+
+func TestParseFirewallRulesInline(t *testing.T) {
+	lines := []string{
+		".firewall{",
+		`	backend: "nftables",`,
+		"	open_ports: [22, 80],",
+		`	rules: [{ port: 5432, from: "10.1.0.0/16" }, { port: 443 }]`,
+		"}",
+	}
+
+	firewall, _ := parseFirewall(lines, 0)
+	if firewall.Backend != "nftables" {
+		t.Errorf("Backend = %q, want nftables", firewall.Backend)
+	}
+	if len(firewall.OpenPorts) != 2 || firewall.OpenPorts[1] != 80 {
+		t.Errorf("OpenPorts = %v, want [22 80]", firewall.OpenPorts)
+	}
+	if len(firewall.Rules) != 2 {
+		t.Fatalf("len(Rules) = %d, want 2", len(firewall.Rules))
+	}
+	if r := firewall.Rules[0]; r.Port != 5432 || len(r.From) != 1 || r.From[0] != "10.1.0.0/16" {
+		t.Errorf("Rules[0] = %+v", r)
+	}
+	if firewall.Rules[1].Port != 443 {
+		t.Errorf("Rules[1] = %+v", firewall.Rules[1])
+	}
+}
+
+func TestParseSSH(t *testing.T) {
+	content := `.setup_secure{
+	ssh_port: 22022,
+	.ssh{
+		crypto: "modern",
+		max_auth_tries: 3,
+		login_grace_time: "30s",
+		min_rsa_bits: 4096,
+		allow_users: ["deploy", "admin"],
+		x11_forwarding: true,
+		.match{
+			criteria: "Address 10.0.0.0/8",
+			settings: [
+				"PasswordAuthentication yes",
+				"MaxAuthTries 6"
+			]
+		},
+		.match{
+			criteria: "User backup",
+			settings: ["ForceCommand internal-sftp"]
+		}
+	},
+	.firewall{
+		open_ports: [22022]
+	}
+}`
+	cfg, err := ParseConfig(content)
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	ssh := cfg.SetupSecure.SSH
+	if ssh == nil {
+		t.Fatal("SSH is nil")
+	}
+	if ssh.Crypto != "modern" || ssh.MaxAuthTries != 3 || ssh.LoginGraceTime != "30s" || ssh.MinRSABits != 4096 || !ssh.X11Forwarding {
+		t.Errorf("SSH = %+v", ssh)
+	}
+	if len(ssh.AllowUsers) != 2 || ssh.AllowUsers[1] != "admin" {
+		t.Errorf("AllowUsers = %v", ssh.AllowUsers)
+	}
+	if len(ssh.Matches) != 2 {
+		t.Fatalf("len(Matches) = %d, want 2", len(ssh.Matches))
+	}
+	if m := ssh.Matches[0]; m.Criteria != "Address 10.0.0.0/8" || len(m.Settings) != 2 || m.Settings[1] != "MaxAuthTries 6" {
+		t.Errorf("Matches[0] = %+v", m)
+	}
+	if m := ssh.Matches[1]; m.Criteria != "User backup" || len(m.Settings) != 1 {
+		t.Errorf("Matches[1] = %+v", m)
+	}
+	if cfg.SetupSecure.Firewall == nil || len(cfg.SetupSecure.Firewall.OpenPorts) != 1 {
+		t.Errorf("Firewall after .ssh{} = %+v", cfg.SetupSecure.Firewall)
+	}
+}
+
+func TestParseUsers(t *testing.T) {
+	content := `.users{
+	.user{
+		name: "alice",
+		keys: [
+			"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAlice alice@laptop",
+			"keys/alice-yubikey.pub"
+		],
+		groups: ["docker", "adm"],
+		shell: "/bin/zsh",
+		sudo: "nopasswd",
+		sudo_commands: ["/usr/bin/systemctl restart nginx"],
+		sudo_defaults: ["use_pty", "logfile=/var/log/sudo-alice.log"]
+	},
+	.user{
+		name: "bob",
+		state: "absent"
+	},
+	.user{
+		name: "backup",
+		uid: 990,
+		gid: 990,
+		system: true,
+		lock_password: true
+	}
+}
+.units{
+}`
+	cfg, err := ParseConfig(content)
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if len(cfg.Users) != 3 {
+		t.Fatalf("len(Users) = %d, want 3", len(cfg.Users))
+	}
+	alice := cfg.Users[0]
+	if alice.Name != "alice" || alice.Shell != "/bin/zsh" || alice.Sudo != "nopasswd" || alice.State != "" {
+		t.Errorf("Users[0] = %+v", alice)
+	}
+	if len(alice.Keys) != 2 || alice.Keys[1] != "keys/alice-yubikey.pub" {
+		t.Errorf("Keys = %v", alice.Keys)
+	}
+	if len(alice.Groups) != 2 || len(alice.SudoCommands) != 1 || len(alice.SudoDefaults) != 2 {
+		t.Errorf("Groups = %v, SudoCommands = %v, SudoDefaults = %v", alice.Groups, alice.SudoCommands, alice.SudoDefaults)
+	}
+	if bob := cfg.Users[1]; bob.Name != "bob" || bob.State != "absent" {
+		t.Errorf("Users[1] = %+v", bob)
+	}
+	if backup := cfg.Users[2]; backup.UID != 990 || backup.GID != 990 || !backup.System || !backup.LockPassword {
+		t.Errorf("Users[2] = %+v", backup)
+	}
+}
+
+func TestParseSSHCA(t *testing.T) {
+	content := `.setup_secure{
+	ssh_port: 22022,
+	.ssh_ca{
+		user_ca_keys: ["ca/user_ca.pub"],
+		host_ca_key: "ca/host_ca",
+		host_principals: [
+			"web1.example.com",
+			"10.0.0.5"
+		],
+		host_cert_validity: "+26w",
+		export_dir: "/root/host-keys"
+	},
+	.ssh{
+		crypto: "modern"
+	}
+}
+.users{
+	.user{
+		name: "alice",
+		principals: ["alice", "admins"]
+	}
+}`
+	cfg, err := ParseConfig(content)
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	ca := cfg.SetupSecure.SSHCA
+	if ca == nil {
+		t.Fatal("SSHCA is nil")
+	}
+	if len(ca.UserCAKeys) != 1 || ca.HostCAKey != "ca/host_ca" || len(ca.HostPrincipals) != 2 || ca.HostCertValidity != "+26w" || ca.ExportDir != "/root/host-keys" {
+		t.Errorf("SSHCA = %+v", ca)
+	}
+	if cfg.SetupSecure.SSH == nil || cfg.SetupSecure.SSH.Crypto != "modern" {
+		t.Errorf("SSH after .ssh_ca{} = %+v", cfg.SetupSecure.SSH)
+	}
+	if len(cfg.Users) != 1 || len(cfg.Users[0].Principals) != 2 {
+		t.Errorf("Users = %+v", cfg.Users)
+	}
+}
+
+func TestParseFail2ban(t *testing.T) {
+	content := `.setup_secure{
+	ssh_port: 22022,
+	.fail2ban{
+		ban_time: "2h",
+		find_time: "15m",
+		max_retry: 3,
+		ignore_ips: ["10.0.0.0/8", "192.0.2.10"],
+		jails: ["sshd", "recidive"],
+		recidive_ban_time: "4w"
+	},
+	.firewall{
+		open_ports: [22022]
+	}
+}`
+	cfg, err := ParseConfig(content)
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	f := cfg.SetupSecure.Fail2ban
+	if f == nil {
+		t.Fatal("Fail2ban is nil")
+	}
+	if f.BanTime != "2h" || f.FindTime != "15m" || f.MaxRetry != 3 || f.RecidiveBanTime != "4w" {
+		t.Errorf("Fail2ban = %+v", f)
+	}
+	if len(f.IgnoreIPs) != 2 || f.IgnoreIPs[1] != "192.0.2.10" || len(f.Jails) != 2 {
+		t.Errorf("Fail2ban lists = %+v", f)
+	}
+	if cfg.SetupSecure.Firewall == nil || len(cfg.SetupSecure.Firewall.OpenPorts) != 1 {
+		t.Errorf("Firewall after .fail2ban{} = %+v", cfg.SetupSecure.Firewall)
+	}
+}
+
+func TestParseSysctl(t *testing.T) {
+	content := `.sysctl{
+	profiles: ["baseline-hardening", "high-connections"],
+	vm.swappiness: 10,
+	"net.ipv4.ip_local_port_range": "20000 60999"
+}
+
+.http_proxy{
+	http: "http://proxy:3128"
+}`
+	cfg, err := ParseConfig(content)
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	s := cfg.Sysctl
+	if s == nil {
+		t.Fatal("Sysctl is nil")
+	}
+	if len(s.Profiles) != 2 || s.Profiles[1] != "high-connections" {
+		t.Errorf("Profiles = %v", s.Profiles)
+	}
+	if len(s.Settings) != 2 || s.Settings["vm.swappiness"] != "10" || s.Settings["net.ipv4.ip_local_port_range"] != "20000 60999" {
+		t.Errorf("Settings = %v", s.Settings)
+	}
+	if cfg.HTTPProxy == nil {
+		t.Error("HTTPProxy after .sysctl{} is nil")
+	}
+
+	cfg, err = ParseConfig(".sysctl{}\n.http_proxy{\n\thttp: \"http://proxy:3128\"\n}")
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if cfg.Sysctl == nil || len(cfg.Sysctl.Profiles) != 0 || cfg.HTTPProxy == nil {
+		t.Errorf("empty .sysctl{} = %+v, HTTPProxy = %+v", cfg.Sysctl, cfg.HTTPProxy)
+	}
+}
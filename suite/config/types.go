@@ -4,15 +4,70 @@ package config
 type ServerConfig struct {
 	SetupSecure  *SetupSecure  `json:"setup_secure"`
 	InstallTools *InstallTools `json:"install_tools"`
+	HTTPProxy    *HTTPProxy    `json:"http_proxy,omitempty"`
+	Services     *Services     `json:"services,omitempty"`
+	Users        []User        `json:"users,omitempty"`
+	Units        []Unit        `json:"units,omitempty"`
+	Checks       []Check       `json:"checks,omitempty"`
+	Sysctl       *Sysctl       `json:"sysctl,omitempty"`
 }
 
 // SetupSecure contains security and basic setup configuration
 type SetupSecure struct {
-	SSHUser    string    `json:"ssh_user"`
-	UserSSHRSA string    `json:"user_ssh_rsa"`
-	SSHPort    int       `json:"ssh_port"`
-	Config     *Config   `json:"configuration"`
-	Firewall   *Firewall `json:"firewall"`
+	SSHUser    string `json:"ssh_user"`
+	UserSSHRSA string `json:"user_ssh_rsa"`
+	SSHPort    int    `json:"ssh_port"`
+	// SSHSafeApply is "confirm" or "self-test" to revert the SSH and
+	// firewall changes unless they are confirmed in time
+	SSHSafeApply      string    `json:"ssh_safe_apply,omitempty"`
+	SSHConfirmTimeout int       `json:"ssh_confirm_timeout,omitempty"` // minutes, 10 if unset
+	Config            *Config   `json:"configuration"`
+	Firewall          *Firewall `json:"firewall"`
+	SSH               *SSH      `json:"ssh,omitempty"`
+	SSHCA             *SSHCA    `json:"ssh_ca,omitempty"`
+	Fail2ban          *Fail2ban `json:"fail2ban,omitempty"`
+}
+
+// SSH configures the sshd hardening beyond the port
+type SSH struct {
+	Crypto         string     `json:"crypto,omitempty"` // modern, intermediate or legacy, OpenSSH defaults if empty
+	MaxAuthTries   int        `json:"max_auth_tries,omitempty"`
+	LoginGraceTime string     `json:"login_grace_time,omitempty"` // e.g. "30s"
+	AllowUsers     []string   `json:"allow_users,omitempty"`
+	AllowGroups    []string   `json:"allow_groups,omitempty"` // sshuser if neither list is set
+	X11Forwarding  bool       `json:"x11_forwarding,omitempty"`
+	MinRSABits     int        `json:"min_rsa_bits,omitempty"` // shortest accepted RSA user key, 3072 if unset
+	Matches        []SSHMatch `json:"matches,omitempty"`
+}
+
+// SSHCA trusts an SSH certificate authority instead of individual keys
+type SSHCA struct {
+	// UserCAKeys are the CA public keys that sign user certificates. Entries
+	// ending in .pub name local key files, relative to the config file.
+	UserCAKeys []string `json:"user_ca_keys,omitempty"`
+	// HostCAKey is a CA private key on disk that signs the host keys
+	HostCAKey        string   `json:"host_ca_key,omitempty"`
+	HostPrincipals   []string `json:"host_principals,omitempty"`    // the hostname if empty
+	HostCertValidity string   `json:"host_cert_validity,omitempty"` // ssh-keygen -V, "+52w" if empty
+	ExportDir        string   `json:"export_dir,omitempty"`         // host keys and certificates for clients
+}
+
+// Fail2ban configures the fail2ban jails
+type Fail2ban struct {
+	BanTime  string `json:"ban_time,omitempty"`  // e.g. "1h", "1h" if empty
+	FindTime string `json:"find_time,omitempty"` // "10m" if empty
+	MaxRetry int    `json:"max_retry,omitempty"` // 5 if unset
+	// IgnoreIPs are addresses or CIDRs that are never banned, localhost always is
+	IgnoreIPs []string `json:"ignore_ips,omitempty"`
+	// Jails are sshd, recidive and the nginx jails of web and proxy servers if empty
+	Jails           []string `json:"jails,omitempty"`
+	RecidiveBanTime string   `json:"recidive_ban_time,omitempty"` // "1w" if empty
+}
+
+// SSHMatch is an sshd Match block
+type SSHMatch struct {
+	Criteria string   `json:"criteria"` // e.g. "Address 10.0.0.0/8"
+	Settings []string `json:"settings"` // e.g. "PasswordAuthentication yes"
 }
 
 // Config contains server type and specific configuration
@@ -57,12 +112,119 @@ type Upstream struct {
 
 // Firewall contains firewall configuration
 type Firewall struct {
-	OpenPorts []int `json:"open_ports"`
+	Backend   string         `json:"backend,omitempty"` // ufw, firewalld, iptables or nftables, detected if empty
+	OpenPorts []int          `json:"open_ports"`
+	Rules     []FirewallRule `json:"rules,omitempty"`
+}
+
+// FirewallRule allows incoming traffic beyond the plain TCP ports of OpenPorts
+type FirewallRule struct {
+	Port   int      `json:"port,omitempty"`
+	Ports  string   `json:"ports,omitempty"`  // range, e.g. "60000:61000"
+	Proto  string   `json:"proto,omitempty"`  // tcp (default), udp or icmp
+	From   []string `json:"from,omitempty"`   // source addresses or CIDRs, any if empty
+	Limit  string   `json:"limit,omitempty"`  // rate limit, e.g. "6/min"
+	Family string   `json:"family,omitempty"` // ipv4 or ipv6, both if empty
 }
 
 // InstallTools contains tools to be installed
 type InstallTools struct {
-	Tools []string `json:"tools"`
+	Tools       []string `json:"tools"`
+	LockTimeout int      `json:"lock_timeout,omitempty"` // seconds to wait for a package manager lock
+
+	// Secondary installers for tools that are not packaged by the distribution.
+	// Entries may pin a version: "black==23.1.0", "typescript@5.3.2",
+	// "ripgrep@13.0.0", "golang.org/x/tools/gopls@v0.14.2", "hugo@latest/stable"
+	Pip       []string `json:"pip,omitempty"`
+	NpmGlobal []string `json:"npm_global,omitempty"`
+	Cargo     []string `json:"cargo,omitempty"`
+	Go        []string `json:"go,omitempty"`
+	Snap      []string `json:"snap,omitempty"`
+	Flatpak   []string `json:"flatpak,omitempty"`
+	Scope     string   `json:"scope,omitempty"` // system (default) or user
+	User      string   `json:"user,omitempty"`  // user for the user scope
+}
+
+// HTTPProxy contains the corporate proxy used for all outbound traffic
+type HTTPProxy struct {
+	HTTP    string   `json:"http"`
+	HTTPS   string   `json:"https"`
+	NoProxy []string `json:"no_proxy,omitempty"`
+}
+
+// Sysctl sets kernel parameters through /etc/sysctl.d
+type Sysctl struct {
+	// Profiles are baseline-hardening, docker-host and high-connections,
+	// chosen from the server type if empty
+	Profiles []string `json:"profiles,omitempty"`
+	// Settings override the profiles, e.g. "vm.swappiness": "10"
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// Services contains the desired state of arbitrary system services
+type Services struct {
+	Enable  []string `json:"enable,omitempty"`
+	Disable []string `json:"disable,omitempty"`
+	Mask    []string `json:"mask,omitempty"`
+	// RestartOnChange entries have the form "service=path" and restart the
+	// service at the end of the run if SetupSuite changed a file under path
+	RestartOnChange []string `json:"restart_on_change,omitempty"`
+}
+
+// User is a login account managed by SetupSuite
+type User struct {
+	Name string `json:"name"`
+	// Keys are the exact contents of authorized_keys. Entries ending in .pub
+	// name local key files, relative to the config file.
+	Keys         []string `json:"keys,omitempty"`
+	Groups       []string `json:"groups,omitempty"`
+	Shell        string   `json:"shell,omitempty"`
+	Sudo         string   `json:"sudo,omitempty"`          // none (default), password or nopasswd
+	SudoCommands []string `json:"sudo_commands,omitempty"` // limits sudo to these commands
+	SudoDefaults []string `json:"sudo_defaults,omitempty"` // e.g. "use_pty", "logfile=/var/log/sudo.log"
+	Principals   []string `json:"principals,omitempty"`    // accepted certificate principals, the name if empty
+	State        string   `json:"state,omitempty"`         // present (default) or absent
+
+	UID          int  `json:"uid,omitempty"` // pinned on creation
+	GID          int  `json:"gid,omitempty"` // primary group under the user's name
+	System       bool `json:"system,omitempty"`
+	LockPassword bool `json:"lock_password,omitempty"`
+}
+
+// Unit describes a custom daemon installed as a systemd unit or OpenRC script
+type Unit struct {
+	Name             string   `json:"name"`
+	Description      string   `json:"description,omitempty"`
+	Exec             string   `json:"exec"`
+	User             string   `json:"user,omitempty"`
+	Group            string   `json:"group,omitempty"`
+	WorkingDirectory string   `json:"working_directory,omitempty"`
+	Environment      []string `json:"environment,omitempty"` // KEY=value
+	After            []string `json:"after,omitempty"`
+	Restart          string   `json:"restart,omitempty"` // no, on-failure (default), always
+	RestartSec       int      `json:"restart_sec,omitempty"`
+
+	// Hardening options, applied where the init system supports them
+	ProtectSystem   string   `json:"protect_system,omitempty"` // true, full, strict
+	ProtectHome     string   `json:"protect_home,omitempty"`   // true, read-only, tmpfs
+	NoNewPrivileges bool     `json:"no_new_privileges,omitempty"`
+	PrivateTmp      bool     `json:"private_tmp,omitempty"`
+	ReadWritePaths  []string `json:"read_write_paths,omitempty"`
+}
+
+// Check is a user defined health check run after setup and by `setupsuite verify`
+type Check struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // tcp, http, command, file
+
+	Host     string `json:"host,omitempty"` // tcp, defaults to 127.0.0.1
+	Port     int    `json:"port,omitempty"` // tcp
+	URL      string `json:"url,omitempty"`  // http
+	Status   int    `json:"status,omitempty"`
+	Command  string `json:"command,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+	Path     string `json:"path,omitempty"`     // file
+	Contains string `json:"contains,omitempty"` // http body or file content
 }
 
 // ServerType constants
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Facts describes the host SetupSuite runs on. It is gathered once per run
+// and handed to every setup step.
+type Facts struct {
+	Hostname        string          `json:"hostname"`
+	Distro          DistroFacts     `json:"distro"`
+	Kernel          string          `json:"kernel"`
+	Arch            string          `json:"arch"`
+	CPUCount        int             `json:"cpu_count"`
+	MemoryBytes     uint64          `json:"memory_bytes"`
+	Disks           []DiskFacts     `json:"disks"`
+	Virtualization  string          `json:"virtualization"`
+	Container       string          `json:"container"`
+	InitSystem      string          `json:"init_system"`
+	PackageManager  string          `json:"package_manager"`
+	FirewallBackend string          `json:"firewall_backend"`
+	Interfaces      []InterfaceFact `json:"interfaces"`
+	Users           []UserFact      `json:"users"`
+
+	// packageManager is the detected package manager, packageManagerErr
+	// why none was found
+	packageManager    PackageManager
+	packageManagerErr error
+}
+
+// DistroFacts identifies the distribution from /etc/os-release
+type DistroFacts struct {
+	ID       string   `json:"id"`
+	IDLike   []string `json:"id_like,omitempty"`
+	Name     string   `json:"name"`
+	Version  string   `json:"version"`
+	Codename string   `json:"codename,omitempty"`
+}
+
+// IsLike reports whether the distribution is id or derived from it
+func (d DistroFacts) IsLike(ids ...string) bool {
+	for _, id := range ids {
+		if d.ID == id {
+			return true
+		}
+		for _, like := range d.IDLike {
+			if like == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DiskFacts describes a mounted block device filesystem
+type DiskFacts struct {
+	Device     string `json:"device"`
+	MountPoint string `json:"mount_point"`
+	TotalBytes uint64 `json:"total_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"`
+}
+
+// InterfaceFact describes a network interface and its addresses
+type InterfaceFact struct {
+	Name      string   `json:"name"`
+	MAC       string   `json:"mac,omitempty"`
+	Up        bool     `json:"up"`
+	Addresses []string `json:"addresses"`
+}
+
+// UserFact is an account from /etc/passwd
+type UserFact struct {
+	Name  string `json:"name"`
+	UID   int    `json:"uid"`
+	GID   int    `json:"gid"`
+	Home  string `json:"home"`
+	Shell string `json:"shell"`
+}
+
+// User returns the account with the given name
+func (f *Facts) User(name string) (UserFact, bool) {
+	for _, u := range f.Users {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return UserFact{}, false
+}
+
+// Packages returns the package manager detected with the facts, or why
+// none could be detected
+func (f *Facts) Packages() (PackageManager, error) {
+	if f == nil {
+		return nil, fmt.Errorf("host facts were not gathered")
+	}
+	if f.packageManager == nil {
+		if f.packageManagerErr != nil {
+			return nil, f.packageManagerErr
+		}
+		return nil, fmt.Errorf("no supported package manager found")
+	}
+	return f.packageManager, nil
+}
+
+// JSON returns the facts as indented JSON
+func (f *Facts) JSON() (string, error) {
+	data, err := json.MarshalIndent(f, "", "  ")
+	return string(data), err
+}
+
+// GatherFacts collects the host facts. Individual probes that fail leave
+// their field empty rather than failing the whole run.
+func GatherFacts() (*Facts, error) {
+	facts := &Facts{
+		CPUCount: runtime.NumCPU(),
+		Arch:     runtime.GOARCH,
+	}
+
+	facts.Hostname, _ = os.Hostname()
+
+	osRelease, err := ReadOSRelease()
+	if err == nil {
+		facts.Distro = distroFromOSRelease(osRelease)
+	} else if id, version, derr := DetectDistribution(); derr == nil {
+		facts.Distro = DistroFacts{ID: id, Version: version}
+		osRelease = map[string]string{"ID": id}
+	} else {
+		return nil, fmt.Errorf("could not detect Linux distribution: %v", err)
+	}
+
+	if data, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		facts.Kernel = strings.TrimSpace(string(data))
+	}
+	if output, err := exec.Command("uname", "-m").Output(); err == nil {
+		facts.Arch = strings.TrimSpace(string(output))
+	}
+	if data, err := ioutil.ReadFile("/proc/meminfo"); err == nil {
+		facts.MemoryBytes = parseMeminfoTotal(string(data))
+	}
+	if output, err := exec.Command("df", "-P", "-k").Output(); err == nil {
+		facts.Disks = parseDfOutput(string(output))
+	}
+
+	facts.Virtualization = detectVirtualization()
+	facts.Container = detectContainer()
+	facts.InitSystem = detectInitSystem()
+
+	_, ostreeErr := os.Stat("/run/ostree-booted")
+	facts.packageManager, facts.packageManagerErr = selectPackageManager(osRelease, ostreeErr == nil, exec.LookPath)
+	if facts.packageManager != nil {
+		facts.PackageManager = facts.packageManager.GetName()
+	}
+	facts.FirewallBackend, _ = firewallBackend()
+
+	facts.Interfaces = gatherInterfaces()
+	if data, err := ioutil.ReadFile("/etc/passwd"); err == nil {
+		facts.Users = parsePasswd(string(data))
+	}
+
+	return facts, nil
+}
+
+func distroFromOSRelease(osRelease map[string]string) DistroFacts {
+	codename := osRelease["VERSION_CODENAME"]
+	if codename == "" {
+		codename = osRelease["UBUNTU_CODENAME"]
+	}
+	return DistroFacts{
+		ID:       osRelease["ID"],
+		IDLike:   strings.Fields(osRelease["ID_LIKE"]),
+		Name:     osRelease["NAME"],
+		Version:  osRelease["VERSION_ID"],
+		Codename: codename,
+	}
+}
+
+func parseMeminfoTotal(content string) uint64 {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		// MemTotal:       16302180 kB
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// parseDfOutput reads `df -P -k` and keeps filesystems backed by block devices
+func parseDfOutput(output string) []DiskFacts {
+	var disks []DiskFacts
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		total, _ := strconv.ParseUint(fields[1], 10, 64)
+		free, _ := strconv.ParseUint(fields[3], 10, 64)
+		disks = append(disks, DiskFacts{
+			Device:     fields[0],
+			MountPoint: fields[5],
+			TotalBytes: total * 1024,
+			FreeBytes:  free * 1024,
+		})
+	}
+	return disks
+}
+
+func parsePasswd(content string) []UserFact {
+	var users []UserFact
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		uid, _ := strconv.Atoi(fields[2])
+		gid, _ := strconv.Atoi(fields[3])
+		users = append(users, UserFact{Name: fields[0], UID: uid, GID: gid, Home: fields[5], Shell: fields[6]})
+	}
+	return users
+}
+
+// detectVirtualization returns the hypervisor, or "none" on bare metal
+func detectVirtualization() string {
+	if output, err := exec.Command("systemd-detect-virt", "--vm").Output(); err == nil {
+		return strings.TrimSpace(string(output))
+	}
+
+	if data, err := ioutil.ReadFile("/sys/class/dmi/id/sys_vendor"); err == nil {
+		if virt := virtualizationFromVendor(strings.TrimSpace(string(data))); virt != "" {
+			return virt
+		}
+	}
+	if data, err := ioutil.ReadFile("/proc/cpuinfo"); err == nil && strings.Contains(string(data), " hypervisor") {
+		return "vm-other"
+	}
+	return "none"
+}
+
+func virtualizationFromVendor(vendor string) string {
+	vendors := map[string]string{
+		"QEMU":                  "kvm",
+		"VMware, Inc.":          "vmware",
+		"Microsoft Corporation": "microsoft",
+		"innotek GmbH":          "oracle",
+		"Xen":                   "xen",
+		"Amazon EC2":            "amazon",
+		"Google":                "google",
+		"DigitalOcean":          "kvm",
+		"Hetzner":               "kvm",
+	}
+	return vendors[vendor]
+}
+
+// detectContainer returns the container runtime, or "none" outside containers
+func detectContainer() string {
+	if output, err := exec.Command("systemd-detect-virt", "--container").Output(); err == nil {
+		return strings.TrimSpace(string(output))
+	}
+
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return "docker"
+	}
+	if _, err := os.Stat("/run/.containerenv"); err == nil {
+		return "podman"
+	}
+	if data, err := ioutil.ReadFile("/proc/1/environ"); err == nil {
+		for _, env := range strings.Split(string(data), "\x00") {
+			if strings.HasPrefix(env, "container=") {
+				return strings.TrimPrefix(env, "container=")
+			}
+		}
+	}
+	if data, err := ioutil.ReadFile("/proc/1/cgroup"); err == nil {
+		return containerFromCgroup(string(data))
+	}
+	return "none"
+}
+
+func containerFromCgroup(content string) string {
+	switch {
+	case strings.Contains(content, "kubepods"):
+		return "kubernetes"
+	case strings.Contains(content, "docker"):
+		return "docker"
+	case strings.Contains(content, "lxc"):
+		return "lxc"
+	}
+	return "none"
+}
+
+// detectInitSystem identifies the init system running as pid 1
+func detectInitSystem() string {
+	if _, err := os.Stat("/run/systemd/system"); err == nil {
+		return "systemd"
+	}
+
+	comm := ""
+	if data, err := ioutil.ReadFile("/proc/1/comm"); err == nil {
+		comm = strings.TrimSpace(string(data))
+	}
+	_, openrcErr := os.Stat("/run/openrc")
+	_, runitErr := os.Stat("/run/runit")
+	_, s6Err := os.Stat("/run/s6")
+	return initSystemFromProbe(comm, openrcErr == nil, runitErr == nil, s6Err == nil)
+}
+
+func initSystemFromProbe(comm string, openrc, runit, s6 bool) string {
+	switch {
+	case comm == "systemd":
+		return "systemd"
+	case comm == "runit" || comm == "runit-init" || runit:
+		return "runit"
+	case strings.HasPrefix(comm, "s6-") || s6:
+		return "s6"
+	case comm == "openrc-init" || openrc:
+		return "openrc"
+	case comm == "init":
+		return "sysvinit"
+	}
+	return "unknown"
+}
+
+func gatherInterfaces() []InterfaceFact {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var facts []InterfaceFact
+	for _, iface := range ifaces {
+		fact := InterfaceFact{
+			Name: iface.Name,
+			MAC:  iface.HardwareAddr.String(),
+			Up:   iface.Flags&net.FlagUp != 0,
+		}
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				fact.Addresses = append(fact.Addresses, addr.String())
+			}
+		}
+		facts = append(facts, fact)
+	}
+	return facts
+}
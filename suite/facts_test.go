@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"suite/suite/config"
+	"testing"
+)
+
+func TestGatherFacts(t *testing.T) {
+	facts, err := GatherFacts()
+	if err != nil {
+		t.Logf("GatherFacts() error = %v (may be expected in some environments)", err)
+		return
+	}
+	if facts.CPUCount < 1 {
+		t.Errorf("CPUCount = %d, want at least 1", facts.CPUCount)
+	}
+	if _, err := facts.JSON(); err != nil {
+		t.Errorf("JSON() error = %v", err)
+	}
+	t.Logf("Detected %s %s, init %s, package manager %s", facts.Distro.ID, facts.Distro.Version, facts.InitSystem, facts.PackageManager)
+}
+
+func TestFactsPackages(t *testing.T) {
+	var missing *Facts
+	if _, err := missing.Packages(); err == nil {
+		t.Error("Packages() on nil facts returned no error")
+	}
+
+	// The detection error is kept, e.g. why an immutable system is refused
+	facts := &Facts{packageManagerErr: fmt.Errorf("NixOS is not supported")}
+	if _, err := facts.Packages(); err == nil || err.Error() != "NixOS is not supported" {
+		t.Errorf("Packages() error = %v", err)
+	}
+
+	facts = &Facts{packageManager: &AlpinePackageManager{}}
+	if pm, err := facts.Packages(); err != nil || pm.GetName() != "apk" {
+		t.Errorf("Packages() = %v, %v", pm, err)
+	}
+}
+
+func TestDistroFromOSRelease(t *testing.T) {
+	distro := distroFromOSRelease(map[string]string{
+		"ID":              "ubuntu",
+		"ID_LIKE":         "debian",
+		"NAME":            "Ubuntu",
+		"VERSION_ID":      "22.04",
+		"UBUNTU_CODENAME": "jammy",
+	})
+	if distro.Codename != "jammy" || distro.Version != "22.04" {
+		t.Errorf("distroFromOSRelease() = %+v", distro)
+	}
+	if !distro.IsLike("debian") || !distro.IsLike("ubuntu") || distro.IsLike("rhel") {
+		t.Errorf("IsLike() wrong for %+v", distro)
+	}
+}
+
+func TestFactParsers(t *testing.T) {
+	if got := parseMeminfoTotal("MemTotal:       2048 kB\nMemFree:  1024 kB\n"); got != 2048*1024 {
+		t.Errorf("parseMeminfoTotal() = %d", got)
+	}
+
+	df := `Filesystem     1024-blocks    Used Available Capacity Mounted on
+udev               4000000       0   4000000       0% /dev
+/dev/sda1         10000000 4000000   6000000      40% /
+tmpfs              1000000       0   1000000       0% /run
+`
+	disks := parseDfOutput(df)
+	if len(disks) != 1 || disks[0].MountPoint != "/" || disks[0].FreeBytes != 6000000*1024 {
+		t.Errorf("parseDfOutput() = %+v", disks)
+	}
+
+	users := parsePasswd("root:x:0:0:root:/root:/bin/bash\n# comment\nalice:x:1000:1000:Alice:/srv/alice:/bin/zsh\n")
+	if len(users) != 2 || users[1].Home != "/srv/alice" || users[1].UID != 1000 {
+		t.Errorf("parsePasswd() = %+v", users)
+	}
+}
+
+func TestInitSystemFromProbe(t *testing.T) {
+	tests := []struct {
+		comm   string
+		openrc bool
+		runit  bool
+		s6     bool
+		want   string
+	}{
+		{comm: "systemd", want: "systemd"},
+		{comm: "init", openrc: true, want: "openrc"},
+		{comm: "runit", want: "runit"},
+		{comm: "s6-svscan", want: "s6"},
+		{comm: "init", want: "sysvinit"},
+	}
+	for _, tt := range tests {
+		if got := initSystemFromProbe(tt.comm, tt.openrc, tt.runit, tt.s6); got != tt.want {
+			t.Errorf("initSystemFromProbe(%s) = %s, want %s", tt.comm, got, tt.want)
+		}
+	}
+}
+
+func TestContainerFromCgroup(t *testing.T) {
+	if got := containerFromCgroup("0::/kubepods/besteffort/pod1"); got != "kubernetes" {
+		t.Errorf("containerFromCgroup() = %s, want kubernetes", got)
+	}
+	if got := containerFromCgroup("0::/init.scope"); got != "none" {
+		t.Errorf("containerFromCgroup() = %s, want none", got)
+	}
+}
+
+func TestNginxSiteTemplate(t *testing.T) {
+	setup := &ServerSetup{
+		Config: &config.ServerConfig{},
+		Facts:  &Facts{Distro: DistroFacts{ID: "ubuntu", IDLike: []string{"debian"}}},
+	}
+	got, err := setup.renderTemplate("nginx-site", nginxSiteTemplate, "example.com")
+	if err != nil {
+		t.Fatalf("renderTemplate() error = %v", err)
+	}
+	if !strings.Contains(got, "server_name example.com www.example.com;") || !strings.Contains(got, "index.nginx-debian.html") {
+		t.Errorf("renderTemplate() = %s", got)
+	}
+
+	setup.Facts.Distro = DistroFacts{ID: "fedora"}
+	got, _ = setup.renderTemplate("nginx-site", nginxSiteTemplate, "example.com")
+	if strings.Contains(got, "index.nginx-debian.html") {
+		t.Errorf("renderTemplate() kept the Debian index on fedora: %s", got)
+	}
+}
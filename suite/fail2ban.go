@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"suite/suite/config"
+)
+
+// fail2banJailPath holds the jails SetupSuite manages; jail.d is read after
+// jail.conf and the distribution's own jail.d files
+var fail2banJailPath = "/etc/fail2ban/jail.d/setupsuite.local"
+
+// authLogPaths are the sshd log files fail2ban can read. Where none exists
+// sshd only logs to the journal.
+var authLogPaths = []string{"/var/log/auth.log", "/var/log/secure", "/var/log/messages"}
+
+// fail2banBanActions maps firewall backends to the banaction for port
+// specific jails and the one for recidive, which bans all ports
+var fail2banBanActions = map[string][2]string{
+	"ufw":       {"ufw", "ufw"},
+	"firewalld": {"firewallcmd-rich-rules", "firewallcmd-allports"},
+	"nftables":  {"nftables-multiport", "nftables-allports"},
+	"iptables":  {"iptables-multiport", "iptables-allports"},
+}
+
+// fail2banNginxJails protect nginx on web and proxy servers
+var fail2banNginxJails = []string{"nginx-http-auth", "nginx-botsearch", "nginx-limit-req"}
+
+// fail2banTimePattern matches fail2ban time abbreviations such as 10m, 1h or 1w
+var fail2banTimePattern = regexp.MustCompile(`^[0-9]+(s|m|h|d|w|mo|y)?$`)
+
+// ConfigureFail2ban writes the SetupSuite jails, checks them with
+// fail2ban-client -t and (re)starts fail2ban. It runs after the server role,
+// whose nginx logs the nginx jails watch.
+func ConfigureFail2ban(cfg *config.SetupSecure, facts *Facts) error {
+	fmt.Println("Configuring fail2ban")
+	VerboseLogger.LogInfo("Configuring fail2ban")
+
+	jails, err := fail2banJails(cfg)
+	if err != nil {
+		return err
+	}
+	if err := validateFail2ban(cfg.Fail2ban); err != nil {
+		return err
+	}
+
+	backend := ""
+	if cfg.Firewall != nil {
+		backend = cfg.Firewall.Backend
+	}
+	if backend == "" || backend == "auto" {
+		if backend, err = firewallBackend(); err != nil {
+			return fmt.Errorf("fail2ban needs a firewall to ban with: %v", err)
+		}
+	}
+	banActions, ok := fail2banBanActions[backend]
+	if !ok {
+		return fmt.Errorf("no fail2ban banaction for firewall backend %s", backend)
+	}
+
+	if _, err := exec.LookPath("fail2ban-client"); err != nil {
+		if err := InstallPackages(facts, []string{"fail2ban"}); err != nil {
+			return err
+		}
+	}
+
+	content := renderFail2banJails(cfg.Fail2ban, jails, banActions, cfg.SSHPort, sshdLogBackend(facts))
+	previous, readErr := ioutil.ReadFile(fail2banJailPath)
+	changed := readErr != nil || string(previous) != content
+	if changed {
+		if err := VerboseMkdirAll(filepath.Dir(fail2banJailPath), 0755); err != nil {
+			return err
+		}
+		if err := VerboseWriteFile(fail2banJailPath, content); err != nil {
+			return err
+		}
+		if output, err := exec.Command("fail2ban-client", "-t").CombinedOutput(); err != nil {
+			// Leave fail2ban running with the jails it had
+			if readErr == nil {
+				VerboseWriteFile(fail2banJailPath, string(previous))
+			} else {
+				os.Remove(fail2banJailPath)
+			}
+			return fmt.Errorf("fail2ban rejected the jails: %s", lastLine(string(output)))
+		}
+	}
+
+	sm, err := NewServiceManager()
+	if err != nil {
+		return err
+	}
+	service := ResolveService(facts, "fail2ban")
+	if changed && sm.IsActive(service) {
+		if err := RestartAndVerify(sm, service); err != nil {
+			return err
+		}
+	} else if err := EnableAndStart(sm, service); err != nil {
+		return err
+	}
+	fmt.Printf("fail2ban jails: %s (banaction %s)\n", strings.Join(jails, ", "), banActions[0])
+	return nil
+}
+
+// fail2banJails returns the configured jails, or sshd, recidive and for web
+// and proxy servers the nginx jails
+func fail2banJails(cfg *config.SetupSecure) ([]string, error) {
+	if len(cfg.Fail2ban.Jails) > 0 {
+		for _, jail := range cfg.Fail2ban.Jails {
+			if !isFail2banJail(jail) {
+				return nil, fmt.Errorf("unsupported fail2ban jail %q (use sshd, recidive, %s)", jail, strings.Join(fail2banNginxJails, ", "))
+			}
+		}
+		return cfg.Fail2ban.Jails, nil
+	}
+
+	jails := []string{"sshd"}
+	if cfg.Config != nil && (cfg.Config.Type == config.ServerTypeWeb || cfg.Config.Type == config.ServerTypeProxy) {
+		jails = append(jails, fail2banNginxJails...)
+	}
+	return append(jails, "recidive"), nil
+}
+
+func isFail2banJail(name string) bool {
+	if name == "sshd" || name == "recidive" {
+		return true
+	}
+	for _, jail := range fail2banNginxJails {
+		if name == jail {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFail2ban checks the times and allowlist, which would otherwise
+// only fail in fail2ban-client -t
+func validateFail2ban(f *config.Fail2ban) error {
+	for name, value := range map[string]string{"ban_time": f.BanTime, "find_time": f.FindTime, "recidive_ban_time": f.RecidiveBanTime} {
+		if value != "" && value != "-1" && !fail2banTimePattern.MatchString(value) {
+			return fmt.Errorf("fail2ban %s %q is not a time such as 10m, 1h or 1w", name, value)
+		}
+	}
+	if f.MaxRetry < 0 {
+		return fmt.Errorf("fail2ban max_retry must not be negative")
+	}
+	for _, ip := range f.IgnoreIPs {
+		if net.ParseIP(ip) == nil {
+			if _, _, err := net.ParseCIDR(ip); err != nil {
+				return fmt.Errorf("fail2ban ignore_ips entry %q is not an address or CIDR", ip)
+			}
+		}
+	}
+	return nil
+}
+
+// sshdLogBackend returns "systemd" where sshd only logs to the journal, as on
+// Debian 12 without rsyslog, and "auto" otherwise
+func sshdLogBackend(facts *Facts) string {
+	if facts == nil || facts.InitSystem != "systemd" {
+		return "auto"
+	}
+	for _, path := range authLogPaths {
+		if _, err := os.Stat(path); err == nil {
+			return "auto"
+		}
+	}
+	return "systemd"
+}
+
+// renderFail2banJails renders jail.d/setupsuite.local
+func renderFail2banJails(f *config.Fail2ban, jails []string, banActions [2]string, sshPort int, sshdBackend string) string {
+	banTime, findTime, maxRetry := f.BanTime, f.FindTime, f.MaxRetry
+	if banTime == "" {
+		banTime = "1h"
+	}
+	if findTime == "" {
+		findTime = "10m"
+	}
+	if maxRetry == 0 {
+		maxRetry = 5
+	}
+	recidiveBanTime := f.RecidiveBanTime
+	if recidiveBanTime == "" {
+		recidiveBanTime = "1w"
+	}
+
+	var b strings.Builder
+	b.WriteString(managedHeader)
+	b.WriteString("[DEFAULT]\n")
+	fmt.Fprintf(&b, "bantime = %s\n", banTime)
+	fmt.Fprintf(&b, "findtime = %s\n", findTime)
+	fmt.Fprintf(&b, "maxretry = %d\n", maxRetry)
+	fmt.Fprintf(&b, "ignoreip = %s\n", strings.Join(append([]string{"127.0.0.1/8", "::1"}, f.IgnoreIPs...), " "))
+	fmt.Fprintf(&b, "banaction = %s\n", banActions[0])
+	fmt.Fprintf(&b, "banaction_allports = %s\n", banActions[1])
+
+	for _, jail := range jails {
+		fmt.Fprintf(&b, "\n[%s]\nenabled = true\n", jail)
+		switch jail {
+		case "sshd":
+			port := "ssh"
+			if sshPort > 0 {
+				port = strconv.Itoa(sshPort)
+			}
+			fmt.Fprintf(&b, "port = %s\n", port)
+			if sshdBackend != "auto" {
+				fmt.Fprintf(&b, "backend = %s\n", sshdBackend)
+			}
+		case "recidive":
+			fmt.Fprintf(&b, "bantime = %s\n", recidiveBanTime)
+			b.WriteString("findtime = 1d\n")
+		default:
+			b.WriteString("port = http,https\n")
+		}
+	}
+	return b.String()
+}
+
+// checkFail2banJails verifies that fail2ban runs the expected jails
+func checkFail2banJails(jails []string) (string, error) {
+	output, err := exec.Command("fail2ban-client", "status").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("fail2ban-client status failed: %s", lastLine(string(output)))
+	}
+	active := parseFail2banJailList(string(output))
+	var missing []string
+	for _, jail := range jails {
+		if !active[jail] {
+			missing = append(missing, jail)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("jails not running: %s", strings.Join(missing, ", "))
+	}
+	return strings.Join(jails, ", "), nil
+}
+
+// parseFail2banJailList reads the "Jail list:" line of fail2ban-client status
+func parseFail2banJailList(output string) map[string]bool {
+	active := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		i := strings.Index(line, "Jail list:")
+		if i < 0 {
+			continue
+		}
+		for _, jail := range strings.Split(line[i+len("Jail list:"):], ",") {
+			if jail = strings.TrimSpace(jail); jail != "" {
+				active[jail] = true
+			}
+		}
+	}
+	return active
+}
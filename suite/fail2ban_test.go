@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"suite/suite/config"
+)
+
+func TestFail2banJails(t *testing.T) {
+	tests := []struct {
+		cfg     *config.SetupSecure
+		want    string
+		wantErr bool
+	}{
+		{
+			cfg:  &config.SetupSecure{Fail2ban: &config.Fail2ban{}},
+			want: "sshd,recidive",
+		},
+		{
+			cfg:  &config.SetupSecure{Fail2ban: &config.Fail2ban{}, Config: &config.Config{Type: config.ServerTypeProxy}},
+			want: "sshd,nginx-http-auth,nginx-botsearch,nginx-limit-req,recidive",
+		},
+		{
+			cfg:  &config.SetupSecure{Fail2ban: &config.Fail2ban{}, Config: &config.Config{Type: config.ServerTypeDatabase}},
+			want: "sshd,recidive",
+		},
+		{
+			cfg:  &config.SetupSecure{Fail2ban: &config.Fail2ban{Jails: []string{"sshd"}}, Config: &config.Config{Type: config.ServerTypeWeb}},
+			want: "sshd",
+		},
+		{
+			cfg:     &config.SetupSecure{Fail2ban: &config.Fail2ban{Jails: []string{"postfix"}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := fail2banJails(tt.cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("fail2banJails(%+v) error = %v, wantErr %v", tt.cfg.Fail2ban, err, tt.wantErr)
+			continue
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("fail2banJails(%+v) = %v, want %s", tt.cfg.Fail2ban, got, tt.want)
+		}
+	}
+}
+
+func TestValidateFail2ban(t *testing.T) {
+	tests := []struct {
+		f       config.Fail2ban
+		wantErr bool
+	}{
+		{f: config.Fail2ban{}},
+		{f: config.Fail2ban{BanTime: "2h", FindTime: "600", RecidiveBanTime: "-1", IgnoreIPs: []string{"10.0.0.0/8", "2001:db8::1"}}},
+		{f: config.Fail2ban{BanTime: "2 hours"}, wantErr: true},
+		{f: config.Fail2ban{MaxRetry: -1}, wantErr: true},
+		{f: config.Fail2ban{IgnoreIPs: []string{"office.example.com"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateFail2ban(&tt.f); (err != nil) != tt.wantErr {
+			t.Errorf("validateFail2ban(%+v) error = %v, wantErr %v", tt.f, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRenderFail2banJails(t *testing.T) {
+	f := &config.Fail2ban{MaxRetry: 3, IgnoreIPs: []string{"10.0.0.0/8"}}
+	got := renderFail2banJails(f, []string{"sshd", "nginx-http-auth", "recidive"}, fail2banBanActions["nftables"], 22022, "systemd")
+	want := `# Managed by SetupSuite. Changes are overwritten on the next run.
+[DEFAULT]
+bantime = 1h
+findtime = 10m
+maxretry = 3
+ignoreip = 127.0.0.1/8 ::1 10.0.0.0/8
+banaction = nftables-multiport
+banaction_allports = nftables-allports
+
+[sshd]
+enabled = true
+port = 22022
+backend = systemd
+
+[nginx-http-auth]
+enabled = true
+port = http,https
+
+[recidive]
+enabled = true
+bantime = 1w
+findtime = 1d
+`
+	if got != want {
+		t.Errorf("renderFail2banJails() = %q, want %q", got, want)
+	}
+
+	got = renderFail2banJails(&config.Fail2ban{BanTime: "1d"}, []string{"sshd"}, fail2banBanActions["ufw"], 0, "auto")
+	if !strings.Contains(got, "bantime = 1d\n") || !strings.Contains(got, "[sshd]\nenabled = true\nport = ssh\n") || strings.Contains(got, "backend") {
+		t.Errorf("renderFail2banJails() without ssh_port = %q", got)
+	}
+}
+
+func TestSSHDLogBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setupsuite-fail2ban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldPaths := authLogPaths
+	authLogPaths = []string{filepath.Join(dir, "auth.log")}
+	defer func() { authLogPaths = oldPaths }()
+
+	systemd := &Facts{InitSystem: "systemd"}
+	if got := sshdLogBackend(systemd); got != "systemd" {
+		t.Errorf("sshdLogBackend() without auth.log = %q, want systemd", got)
+	}
+	if got := sshdLogBackend(&Facts{InitSystem: "openrc"}); got != "auto" {
+		t.Errorf("sshdLogBackend() on openrc = %q, want auto", got)
+	}
+	ioutil.WriteFile(authLogPaths[0], nil, 0640)
+	if got := sshdLogBackend(systemd); got != "auto" {
+		t.Errorf("sshdLogBackend() with auth.log = %q, want auto", got)
+	}
+}
+
+func TestParseFail2banJailList(t *testing.T) {
+	output := "Status\n|- Number of jail:\t3\n`- Jail list:\tnginx-http-auth, recidive, sshd\n"
+	active := parseFail2banJailList(output)
+	if len(active) != 3 || !active["sshd"] || !active["nginx-http-auth"] {
+		t.Errorf("parseFail2banJailList() = %v", active)
+	}
+}
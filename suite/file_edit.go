@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// managedHeader opens every file SetupSuite generates
+const managedHeader = "# Managed by SetupSuite. Changes are overwritten on the next run.\n"
+
+// changedFiles records the files whose content SetupSuite changed this run
+var changedFiles = make(map[string]bool)
+
+// recordFileChange marks path as changed unless it already holds content
+func recordFileChange(path, content string) {
+	if data, err := ioutil.ReadFile(path); err == nil && string(data) == content {
+		return
+	}
+	changedFiles[filepath.Clean(path)] = true
+}
+
+// fileChangedUnder reports whether a file at or below path changed this run
+func fileChangedUnder(path string) bool {
+	path = filepath.Clean(path)
+	for changed := range changedFiles {
+		if changed == path || strings.HasPrefix(changed, path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateFile rewrites a file through fn, creating it if it does not exist
+func updateFile(path string, fn func(string) string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return VerboseWriteFile(path, fn(string(data)))
+}
+
+// setManagedBlock replaces the named SetupSuite block in content, appending it if missing
+func setManagedBlock(content, name, block string) string {
+	begin := "# BEGIN SetupSuite " + name
+	end := "# END SetupSuite " + name
+	managed := begin + "\n" + block + end + "\n"
+
+	startIdx := strings.Index(content, begin)
+	endIdx := strings.Index(content, end)
+	if startIdx >= 0 && endIdx > startIdx {
+		rest := content[endIdx+len(end):]
+		return content[:startIdx] + managed + strings.TrimPrefix(rest, "\n")
+	}
+
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content + managed
+}
+
+// prependManagedBlock replaces the named SetupSuite block in content, putting
+// it first if missing, for files where the first value of a setting wins
+func prependManagedBlock(content, name, block string) string {
+	if strings.Contains(content, "# BEGIN SetupSuite "+name+"\n") {
+		return setManagedBlock(content, name, block)
+	}
+	return setManagedBlock("", name, block) + content
+}
+
+// removeManagedBlock removes the named SetupSuite block from content
+func removeManagedBlock(content, name string) string {
+	begin := "# BEGIN SetupSuite " + name
+	end := "# END SetupSuite " + name
+
+	startIdx := strings.Index(content, begin)
+	endIdx := strings.Index(content, end)
+	if startIdx < 0 || endIdx < startIdx {
+		return content
+	}
+	return content[:startIdx] + strings.TrimPrefix(content[endIdx+len(end):], "\n")
+}
+
+// setIniKey sets key=value inside [section], adding the key or section as needed
+func setIniKey(content, section, key, value string) string {
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if content == "" {
+		lines = nil
+	}
+
+	inSection := false
+	insertAt := -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			if inSection {
+				break
+			}
+			inSection = trimmed == "["+section+"]"
+			if inSection {
+				insertAt = i + 1
+			}
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		if parts := strings.SplitN(trimmed, "=", 2); len(parts) == 2 && strings.TrimSpace(parts[0]) == key {
+			lines[i] = key + "=" + value
+			return strings.Join(lines, "\n") + "\n"
+		}
+		if trimmed != "" {
+			insertAt = i + 1
+		}
+	}
+
+	if insertAt < 0 {
+		lines = append(lines, "["+section+"]", key+"="+value)
+		return strings.Join(lines, "\n") + "\n"
+	}
+
+	lines = append(lines[:insertAt], append([]string{key + "=" + value}, lines[insertAt:]...)...)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// setShellVar sets KEY="value" in a shell style variable file
+func setShellVar(content, key, value string) string {
+	assignment := fmt.Sprintf("%s=\"%s\"", key, value)
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if content == "" {
+		lines = nil
+	}
+
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), key+"=") {
+			lines[i] = assignment
+			return strings.Join(lines, "\n") + "\n"
+		}
+	}
+	return strings.Join(append(lines, assignment), "\n") + "\n"
+}
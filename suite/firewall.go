@@ -0,0 +1,1043 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"suite/suite/config"
+)
+
+// firewallRuleComment marks the ufw and iptables rules SetupSuite owns
+const firewallRuleComment = "setupsuite"
+
+// firewalldStatePath records the firewalld rules SetupSuite added, since
+// firewalld rules cannot carry a comment
+var firewalldStatePath = "/var/lib/setupsuite/firewalld-ports.json"
+
+// FirewallRule allows incoming traffic. ICMP rules allow echo requests.
+type FirewallRule struct {
+	Port     int    `json:"port,omitempty"`
+	PortEnd  int    `json:"port_end,omitempty"` // last port of a range
+	Protocol string `json:"protocol"`           // tcp, udp or icmp
+	Source   string `json:"source,omitempty"`   // CIDR, any if empty
+	Limit    string `json:"limit,omitempty"`    // normalized rate, e.g. 6/min
+	Family   string `json:"family,omitempty"`   // ipv4 or ipv6, both if empty
+}
+
+// portSpec returns the port or port range joined with sep
+func (r FirewallRule) portSpec(sep string) string {
+	if r.PortEnd > r.Port {
+		return fmt.Sprintf("%d%s%d", r.Port, sep, r.PortEnd)
+	}
+	return strconv.Itoa(r.Port)
+}
+
+// String identifies the rule; rules with equal strings are the same rule
+func (r FirewallRule) String() string {
+	s := r.Protocol
+	if r.Protocol != "icmp" {
+		s = r.portSpec(":") + "/" + r.Protocol
+	}
+	if r.Source != "" {
+		s += " from " + r.Source
+	}
+	if r.Limit != "" {
+		s += " limit " + r.Limit
+	}
+	// A source already implies the family
+	if r.Family != "" && r.Source == "" {
+		s += " " + r.Family
+	}
+	return s
+}
+
+// FirewallPlan lists the changes needed to reach the desired state
+type FirewallPlan struct {
+	Add    []FirewallRule
+	Remove []FirewallRule
+	// Enable is set when the firewall is not enforcing yet, e.g. ufw is
+	// inactive or the iptables INPUT policy still accepts everything
+	Enable bool
+}
+
+// Empty reports whether the firewall is already in the desired state
+func (p *FirewallPlan) Empty() bool {
+	return len(p.Add) == 0 && len(p.Remove) == 0 && !p.Enable
+}
+
+// Firewall manages the rules SetupSuite owns on one firewall backend. Rules
+// created by anyone else, like Docker's chains or an admin's own ports, are
+// never changed.
+type Firewall interface {
+	GetName() string
+	// CurrentRules returns the active rules SetupSuite created
+	CurrentRules() ([]FirewallRule, error)
+	// Plan compares the desired rules with the active ones
+	Plan(desired []FirewallRule) (*FirewallPlan, error)
+	// Apply adds and removes the planned rules
+	Apply(plan *FirewallPlan) error
+}
+
+// firewallCommands maps each backend to the command it needs
+var firewallCommands = map[string]string{
+	"ufw":       "ufw",
+	"firewalld": "firewall-cmd",
+	"iptables":  "iptables",
+	"nftables":  "nft",
+}
+
+// NewFirewall returns the firewall for the configured backend, or the
+// detected one if backend is empty or "auto". facts may be nil for a
+// firewall that is only read.
+func NewFirewall(backend string, facts *Facts) (Firewall, error) {
+	if backend == "" || backend == "auto" {
+		detected, err := firewallBackend()
+		if err != nil {
+			return nil, err
+		}
+		backend = detected
+	} else if command, ok := firewallCommands[backend]; !ok {
+		return nil, fmt.Errorf("unsupported firewall backend %q (use ufw, firewalld, iptables or nftables)", backend)
+	} else if _, err := exec.LookPath(command); err != nil {
+		return nil, fmt.Errorf("firewall backend %s selected but %s is not installed", backend, command)
+	}
+
+	switch backend {
+	case "ufw":
+		return &UFWFirewall{}, nil
+	case "firewalld":
+		return &FirewalldFirewall{}, nil
+	case "iptables":
+		return &IptablesFirewall{facts: facts}, nil
+	case "nftables":
+		return &NftablesFirewall{}, nil
+	}
+	return nil, fmt.Errorf("unsupported firewall manager: %s", backend)
+}
+
+// portRules turns open_ports into tcp rules
+func portRules(ports []int) []FirewallRule {
+	var rules []FirewallRule
+	for _, port := range ports {
+		rules = append(rules, FirewallRule{Port: port, Protocol: "tcp"})
+	}
+	return rules
+}
+
+// DesiredFirewallRules turns the .firewall{} block into rules, one per
+// source address
+func DesiredFirewallRules(fw *config.Firewall) ([]FirewallRule, error) {
+	rules := portRules(fw.OpenPorts)
+	for _, entry := range fw.Rules {
+		base := FirewallRule{Protocol: entry.Proto, Port: entry.Port, Family: entry.Family}
+		if base.Protocol == "" {
+			base.Protocol = "tcp"
+		}
+		if base.Protocol != "tcp" && base.Protocol != "udp" && base.Protocol != "icmp" {
+			return nil, fmt.Errorf("unsupported protocol %q (use tcp, udp or icmp)", entry.Proto)
+		}
+		if base.Family != "" && base.Family != "ipv4" && base.Family != "ipv6" {
+			return nil, fmt.Errorf("unsupported family %q (use ipv4 or ipv6)", entry.Family)
+		}
+
+		if entry.Ports != "" {
+			start, end, err := parsePortRange(entry.Ports)
+			if err != nil {
+				return nil, err
+			}
+			base.Port, base.PortEnd = start, end
+		}
+		if base.Protocol == "icmp" {
+			base.Port, base.PortEnd = 0, 0
+		} else if base.Port < 1 || base.Port > 65535 {
+			return nil, fmt.Errorf("rule %+v needs a port or ports", entry)
+		}
+
+		if entry.Limit != "" {
+			limit, err := normalizeRateLimit(entry.Limit)
+			if err != nil {
+				return nil, err
+			}
+			base.Limit = limit
+		}
+
+		if len(entry.From) == 0 {
+			rules = append(rules, base)
+			continue
+		}
+		for _, from := range entry.From {
+			rule := base
+			source, family, err := normalizeSource(from)
+			if err != nil {
+				return nil, err
+			}
+			if rule.Family != "" && rule.Family != family {
+				return nil, fmt.Errorf("source %s is not %s", from, rule.Family)
+			}
+			rule.Source, rule.Family = source, family
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// parsePortRange reads "60000:61000" or "60000-61000"
+func parsePortRange(ports string) (int, int, error) {
+	parts := strings.FieldsFunc(ports, func(r rune) bool { return r == ':' || r == '-' })
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %q, expected start:end", ports)
+	}
+	start, err1 := strconv.Atoi(parts[0])
+	end, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || start < 1 || end > 65535 || start >= end {
+		return 0, 0, fmt.Errorf("invalid port range %q", ports)
+	}
+	return start, end, nil
+}
+
+// normalizeSource turns an address or CIDR into a CIDR and its family
+func normalizeSource(from string) (string, string, error) {
+	if !strings.Contains(from, "/") {
+		ip := net.ParseIP(from)
+		if ip == nil {
+			return "", "", fmt.Errorf("invalid source address %q", from)
+		}
+		if ip.To4() != nil {
+			return ip.String() + "/32", "ipv4", nil
+		}
+		return ip.String() + "/128", "ipv6", nil
+	}
+
+	_, network, err := net.ParseCIDR(from)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid source network %q", from)
+	}
+	if network.IP.To4() != nil {
+		return network.String(), "ipv4", nil
+	}
+	return network.String(), "ipv6", nil
+}
+
+// normalizeRateLimit turns "6/min", "6/m" or "6/minute" into "6/min"
+func normalizeRateLimit(limit string) (string, error) {
+	parts := strings.SplitN(limit, "/", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid rate limit %q, expected count/unit", limit)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || count < 1 {
+		return "", fmt.Errorf("invalid rate limit %q", limit)
+	}
+
+	units := map[string]string{
+		"s": "sec", "sec": "sec", "second": "sec",
+		"m": "min", "min": "min", "minute": "min",
+		"h": "hour", "hour": "hour",
+		"d": "day", "day": "day",
+	}
+	unit, ok := units[strings.TrimSpace(parts[1])]
+	if !ok {
+		return "", fmt.Errorf("invalid rate limit unit in %q (use sec, min, hour or day)", limit)
+	}
+	return fmt.Sprintf("%d/%s", count, unit), nil
+}
+
+// ConfigureFirewall brings the firewall to the desired rules, changing only
+// the rules that differ
+func ConfigureFirewall(fwConfig *config.Firewall, facts *Facts) error {
+	desired, err := DesiredFirewallRules(fwConfig)
+	if err != nil {
+		return err
+	}
+	if len(desired) == 0 {
+		fmt.Println("No firewall ports to configure")
+		return nil
+	}
+
+	fw, err := NewFirewall(fwConfig.Backend, facts)
+	if err != nil && fwConfig.Backend != "" {
+		return err
+	}
+	if err != nil {
+		fmt.Printf("Warning: %v. Skipping firewall configuration.\n", err)
+		return nil
+	}
+	fmt.Printf("Configuring firewall using %s...\n", fw.GetName())
+
+	if ActiveSafeApply != nil {
+		// Confirming applies exactly these rules, closing the old SSH ports
+		ActiveSafeApply.DesiredRules = desired
+		if err := ActiveSafeApply.Save(); err != nil {
+			return err
+		}
+		desired = append(desired, portRules(ActiveSafeApply.oldPorts())...)
+	}
+	return applyFirewallRules(fw, desired)
+}
+
+// applyFirewallRules plans and applies the desired rules, printing the changes
+func applyFirewallRules(fw Firewall, desired []FirewallRule) error {
+	plan, err := fw.Plan(desired)
+	if err != nil {
+		return err
+	}
+	if plan.Empty() {
+		fmt.Println("Firewall rules are up to date")
+		return nil
+	}
+	for _, rule := range plan.Add {
+		fmt.Printf("  + allow %s\n", rule)
+	}
+	for _, rule := range plan.Remove {
+		fmt.Printf("  - allow %s\n", rule)
+	}
+	return fw.Apply(plan)
+}
+
+// diffRules plans the changes from the managed rules to the desired ones.
+// Desired rules that a foreign rule already allows are not added again.
+func diffRules(managed, foreign, desired []FirewallRule) *FirewallPlan {
+	have := make(map[string]bool)
+	for _, rule := range managed {
+		have[rule.String()] = true
+	}
+	for _, rule := range foreign {
+		have[rule.String()] = true
+	}
+	want := make(map[string]bool)
+
+	plan := &FirewallPlan{}
+	for _, rule := range desired {
+		if want[rule.String()] {
+			continue
+		}
+		want[rule.String()] = true
+		if !have[rule.String()] {
+			plan.Add = append(plan.Add, rule)
+		}
+	}
+	for _, rule := range managed {
+		if !want[rule.String()] {
+			plan.Remove = append(plan.Remove, rule)
+		}
+	}
+	return plan
+}
+
+// UFWFirewall manages ufw rules tagged with the setupsuite comment
+type UFWFirewall struct{}
+
+func (fw *UFWFirewall) GetName() string { return "ufw" }
+
+func (fw *UFWFirewall) rules() (managed, foreign []FirewallRule, active bool, err error) {
+	output, err := VerboseCommandOutput("ufw", "status")
+	if err != nil {
+		return nil, nil, false, err
+	}
+	managed, foreign = parseUFWStatus(string(output))
+	return managed, foreign, strings.Contains(string(output), "Status: active"), nil
+}
+
+func (fw *UFWFirewall) CurrentRules() ([]FirewallRule, error) {
+	managed, _, _, err := fw.rules()
+	return managed, err
+}
+
+func (fw *UFWFirewall) Plan(desired []FirewallRule) (*FirewallPlan, error) {
+	managed, foreign, active, err := fw.rules()
+	if err != nil {
+		return nil, err
+	}
+	plan := diffRules(managed, foreign, ufwRules(desired))
+	plan.Enable = !active
+	return plan, nil
+}
+
+// ufwRules adapts rules to what ufw can express: ufw has one fixed rate
+// limit, always allows ICMP echo requests through its before.rules, and
+// applies rules without a source to both families
+func ufwRules(desired []FirewallRule) []FirewallRule {
+	var rules []FirewallRule
+	for _, rule := range desired {
+		switch {
+		case rule.Protocol == "icmp":
+			fmt.Println("Note: ufw allows ICMP echo requests by default, skipping icmp rule")
+			continue
+		case rule.Limit != "" && rule.Limit != "6/30sec":
+			fmt.Printf("Note: ufw limits %s to its fixed rate of 6 connections per 30 seconds\n", rule.portSpec(":"))
+		}
+		if rule.Limit != "" {
+			rule.Limit = "6/30sec"
+		}
+		if rule.Source == "" {
+			rule.Family = ""
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func (fw *UFWFirewall) Apply(plan *FirewallPlan) error {
+	for _, rule := range plan.Add {
+		args := append(ufwRuleArgs(rule), "comment", firewallRuleComment)
+		if err := VerboseCommandRun("ufw", args...); err != nil {
+			return fmt.Errorf("could not allow %s: %v", rule, err)
+		}
+	}
+	for _, rule := range plan.Remove {
+		if err := VerboseCommandRun("ufw", append([]string{"delete"}, ufwRuleArgs(rule)...)...); err != nil {
+			return fmt.Errorf("could not remove %s: %v", rule, err)
+		}
+	}
+
+	// Only a firewall that is not running yet gets SetupSuite's defaults
+	if !plan.Enable {
+		return nil
+	}
+	VerboseCommandRun("ufw", "default", "deny", "incoming")
+	VerboseCommandRun("ufw", "default", "allow", "outgoing")
+	return VerboseCommandRun("ufw", "--force", "enable")
+}
+
+// ufwRuleArgs returns the ufw arguments for adding or deleting a rule
+func ufwRuleArgs(rule FirewallRule) []string {
+	action := "allow"
+	if rule.Limit != "" {
+		action = "limit"
+	}
+	if rule.Source == "" {
+		return []string{action, rule.portSpec(":") + "/" + rule.Protocol}
+	}
+	return []string{action, "proto", rule.Protocol, "from", rule.Source, "to", "any", "port", rule.portSpec(":")}
+}
+
+// parseUFWStatus splits the ALLOW and LIMIT rules of `ufw status` into
+// SetupSuite's and everyone else's. IPv6 duplicates of a rule are folded
+// into it.
+func parseUFWStatus(output string) (managed, foreign []FirewallRule) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		// 3306/tcp                   ALLOW       10.0.0.0/8                 # setupsuite
+		// 22/tcp (v6)                LIMIT       Anywhere (v6)
+		if len(fields) > 1 && fields[1] == "(v6)" {
+			fields = append(fields[:1], fields[2:]...)
+		}
+		if len(fields) < 3 || (fields[1] != "ALLOW" && fields[1] != "LIMIT") {
+			continue
+		}
+
+		port, proto := fields[0], "tcp"
+		if parts := strings.SplitN(port, "/", 2); len(parts) == 2 {
+			port, proto = parts[0], parts[1]
+		}
+		rule := FirewallRule{Protocol: proto}
+		var err error
+		if strings.Contains(port, ":") {
+			rule.Port, rule.PortEnd, err = parsePortRange(port)
+		} else {
+			rule.Port, err = strconv.Atoi(port)
+		}
+		if err != nil {
+			continue
+		}
+		if fields[1] == "LIMIT" {
+			rule.Limit = "6/30sec"
+		}
+		if fields[2] != "Anywhere" {
+			if source, family, err := normalizeSource(fields[2]); err == nil {
+				rule.Source, rule.Family = source, family
+			}
+		}
+
+		if strings.Contains(line, "# "+firewallRuleComment) {
+			managed = appendUniqueRule(managed, rule)
+		} else {
+			foreign = appendUniqueRule(foreign, rule)
+		}
+	}
+	return managed, foreign
+}
+
+// FirewalldFirewall manages ports and rich rules in the default zone's
+// permanent configuration
+type FirewalldFirewall struct{}
+
+func (fw *FirewalldFirewall) GetName() string { return "firewalld" }
+
+func (fw *FirewalldFirewall) rules() (managed, foreign []FirewallRule, err error) {
+	ports, err := VerboseCommandOutput("firewall-cmd", "--permanent", "--list-ports")
+	if err != nil {
+		return nil, nil, err
+	}
+	services, _ := VerboseCommandOutput("firewall-cmd", "--permanent", "--list-services")
+	richRules, _ := VerboseCommandOutput("firewall-cmd", "--permanent", "--list-rich-rules")
+	owned, err := readFirewalldState()
+	if err != nil {
+		return nil, nil, err
+	}
+	managed, foreign = parseFirewalldRules(string(ports), string(services), string(richRules), owned)
+	return managed, foreign, nil
+}
+
+func (fw *FirewalldFirewall) CurrentRules() ([]FirewallRule, error) {
+	managed, _, err := fw.rules()
+	return managed, err
+}
+
+func (fw *FirewalldFirewall) Plan(desired []FirewallRule) (*FirewallPlan, error) {
+	managed, foreign, err := fw.rules()
+	if err != nil {
+		return nil, err
+	}
+	plan := diffRules(managed, foreign, desired)
+	plan.Enable = exec.Command("firewall-cmd", "--state").Run() != nil
+	return plan, nil
+}
+
+func (fw *FirewalldFirewall) Apply(plan *FirewallPlan) error {
+	if sm, err := NewServiceManager(); err == nil {
+		if err := EnableAndStart(sm, ResolveService(nil, "firewalld")); err != nil {
+			return err
+		}
+	}
+	if len(plan.Add) == 0 && len(plan.Remove) == 0 {
+		return nil
+	}
+
+	owned, err := readFirewalldState()
+	if err != nil {
+		return err
+	}
+	for _, rule := range plan.Add {
+		if err := VerboseCommandRun("firewall-cmd", "--permanent", firewalldRuleArg("add", rule)); err != nil {
+			return fmt.Errorf("could not allow %s: %v", rule, err)
+		}
+		owned = appendUniqueRule(owned, rule)
+	}
+	for _, rule := range plan.Remove {
+		if err := VerboseCommandRun("firewall-cmd", "--permanent", firewalldRuleArg("remove", rule)); err != nil {
+			return fmt.Errorf("could not remove %s: %v", rule, err)
+		}
+		owned = removeRule(owned, rule)
+	}
+	if err := writeFirewalldState(owned); err != nil {
+		return err
+	}
+	return VerboseCommandRun("firewall-cmd", "--reload")
+}
+
+// firewalldNeedsRichRule reports whether a rule cannot be a plain port
+func firewalldNeedsRichRule(rule FirewallRule) bool {
+	return rule.Source != "" || rule.Limit != "" || rule.Family != "" || rule.Protocol == "icmp"
+}
+
+// firewalldRuleArg returns --add-port/--remove-port or the rich rule variant
+func firewalldRuleArg(action string, rule FirewallRule) string {
+	if firewalldNeedsRichRule(rule) {
+		return fmt.Sprintf("--%s-rich-rule=%s", action, renderFirewalldRichRule(rule))
+	}
+	return fmt.Sprintf("--%s-port=%s/%s", action, rule.portSpec("-"), rule.Protocol)
+}
+
+// firewalldLimitUnits maps normalized rate units to firewalld's
+var firewalldLimitUnits = map[string]string{"sec": "s", "min": "m", "hour": "h", "day": "d"}
+
+// renderFirewalldRichRule renders a rule the way firewall-cmd lists it
+func renderFirewalldRichRule(rule FirewallRule) string {
+	parts := []string{"rule"}
+	if rule.Family != "" {
+		parts = append(parts, fmt.Sprintf("family=%q", rule.Family))
+	}
+	if rule.Source != "" {
+		parts = append(parts, fmt.Sprintf("source address=%q", rule.Source))
+	}
+	if rule.Protocol == "icmp" {
+		parts = append(parts, `icmp-type name="echo-request"`)
+	} else {
+		parts = append(parts, fmt.Sprintf("port port=%q protocol=%q", rule.portSpec("-"), rule.Protocol))
+	}
+	parts = append(parts, "accept")
+	if rule.Limit != "" {
+		limit := strings.SplitN(rule.Limit, "/", 2)
+		parts = append(parts, fmt.Sprintf("limit value=\"%s/%s\"", limit[0], firewalldLimitUnits[limit[1]]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseFirewalldRichRule reads an accept rule rendered by renderFirewalldRichRule
+func parseFirewalldRichRule(line string) (FirewallRule, bool) {
+	attrs := make(map[string]string)
+	for _, field := range strings.Fields(line) {
+		if parts := strings.SplitN(field, "=", 2); len(parts) == 2 {
+			attrs[parts[0]] = strings.Trim(parts[1], `"`)
+		}
+	}
+	if !strings.Contains(line, " accept") {
+		return FirewallRule{}, false
+	}
+
+	rule := FirewallRule{Family: attrs["family"], Source: attrs["address"]}
+	switch {
+	case strings.Contains(line, `icmp-type name="echo-request"`):
+		rule.Protocol = "icmp"
+	case attrs["port"] != "":
+		rule.Protocol = attrs["protocol"]
+		if strings.Contains(attrs["port"], "-") {
+			var err error
+			if rule.Port, rule.PortEnd, err = parsePortRange(attrs["port"]); err != nil {
+				return FirewallRule{}, false
+			}
+		} else if port, err := strconv.Atoi(attrs["port"]); err == nil {
+			rule.Port = port
+		} else {
+			return FirewallRule{}, false
+		}
+	default:
+		return FirewallRule{}, false
+	}
+
+	if value := attrs["value"]; value != "" {
+		limit := strings.SplitN(value, "/", 2)
+		if len(limit) == 2 {
+			normalized, err := normalizeRateLimit(limit[0] + "/" + limit[1])
+			if err != nil {
+				return FirewallRule{}, false
+			}
+			rule.Limit = normalized
+		}
+	}
+	return rule, true
+}
+
+// firewalldServicePorts maps the predefined firewalld services SetupSuite
+// commonly sees to their ports
+var firewalldServicePorts = map[string]int{
+	"ssh":        22,
+	"http":       80,
+	"https":      443,
+	"mysql":      3306,
+	"postgresql": 5432,
+}
+
+// parseFirewalldRules reads `firewall-cmd --list-ports`, `--list-services`
+// and `--list-rich-rules`. Rules are SetupSuite's if the state file lists them.
+func parseFirewalldRules(portList, serviceList, richRules string, owned []FirewallRule) (managed, foreign []FirewallRule) {
+	isOwned := make(map[string]bool)
+	for _, rule := range owned {
+		isOwned[rule.String()] = true
+	}
+	add := func(rule FirewallRule) {
+		if isOwned[rule.String()] {
+			managed = append(managed, rule)
+		} else {
+			foreign = appendUniqueRule(foreign, rule)
+		}
+	}
+
+	for _, entry := range strings.Fields(portList) {
+		parts := strings.SplitN(entry, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		rule := FirewallRule{Protocol: parts[1]}
+		var err error
+		if strings.Contains(parts[0], "-") {
+			rule.Port, rule.PortEnd, err = parsePortRange(parts[0])
+		} else {
+			rule.Port, err = strconv.Atoi(parts[0])
+		}
+		if err == nil {
+			add(rule)
+		}
+	}
+	for _, line := range strings.Split(richRules, "\n") {
+		if rule, ok := parseFirewalldRichRule(strings.TrimSpace(line)); ok {
+			add(rule)
+		}
+	}
+	for _, service := range strings.Fields(serviceList) {
+		if port, ok := firewalldServicePorts[service]; ok {
+			foreign = appendUniqueRule(foreign, FirewallRule{Port: port, Protocol: "tcp"})
+		}
+	}
+	return managed, foreign
+}
+
+func readFirewalldState() ([]FirewallRule, error) {
+	data, err := ioutil.ReadFile(firewalldStatePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rules []FirewallRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid firewall state %s: %v", firewalldStatePath, err)
+	}
+	return rules, nil
+}
+
+func writeFirewalldState(rules []FirewallRule) error {
+	sort.Slice(rules, func(i, j int) bool { return rules[i].String() < rules[j].String() })
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := VerboseMkdirAll(filepath.Dir(firewalldStatePath), 0755); err != nil {
+		return err
+	}
+	return VerboseWriteFile(firewalldStatePath, string(data)+"\n")
+}
+
+// IptablesFirewall manages INPUT rules tagged with the setupsuite comment in
+// iptables and, where available, ip6tables
+type IptablesFirewall struct {
+	// facts pick the boot service that restores the saved rules
+	facts *Facts
+}
+
+func (fw *IptablesFirewall) GetName() string { return "iptables" }
+
+// iptablesFamilies maps each address family to its command
+func (fw *IptablesFirewall) families() map[string]string {
+	families := map[string]string{"ipv4": "iptables"}
+	if _, err := exec.LookPath("ip6tables"); err == nil {
+		families["ipv6"] = "ip6tables"
+	}
+	return families
+}
+
+func (fw *IptablesFirewall) rules() (managed, foreign []FirewallRule, enforcing bool, err error) {
+	enforcing = true
+	for family, command := range fw.families() {
+		data, err := VerboseCommandOutput(command, "-S", "INPUT")
+		if err != nil {
+			return nil, nil, false, err
+		}
+		m, f := parseIptablesRules(string(data), family)
+		managed = append(managed, m...)
+		foreign = append(foreign, f...)
+		if !iptablesEnforcing(string(data), family) {
+			enforcing = false
+		}
+	}
+	sortRules(managed)
+	sortRules(foreign)
+	return managed, foreign, enforcing, nil
+}
+
+func (fw *IptablesFirewall) CurrentRules() ([]FirewallRule, error) {
+	managed, _, _, err := fw.rules()
+	return managed, err
+}
+
+func (fw *IptablesFirewall) Plan(desired []FirewallRule) (*FirewallPlan, error) {
+	managed, foreign, enforcing, err := fw.rules()
+	if err != nil {
+		return nil, err
+	}
+	plan := diffRules(managed, foreign, expandFamilies(desired, fw.families()))
+	plan.Enable = !enforcing
+	return plan, nil
+}
+
+// expandFamilies splits rules without a family into one rule per family,
+// since iptables and ip6tables keep separate tables
+func expandFamilies(desired []FirewallRule, families map[string]string) []FirewallRule {
+	var rules []FirewallRule
+	for _, rule := range desired {
+		if rule.Family != "" {
+			if _, ok := families[rule.Family]; !ok {
+				fmt.Printf("Warning: Skipping %s: %s is not available\n", rule, rule.Family)
+				continue
+			}
+			rules = append(rules, rule)
+			continue
+		}
+		for _, family := range []string{"ipv4", "ipv6"} {
+			if _, ok := families[family]; ok {
+				expanded := rule
+				expanded.Family = family
+				rules = append(rules, expanded)
+			}
+		}
+	}
+	return rules
+}
+
+// Apply changes each family in one iptables-restore transaction and saves
+// the result where the distribution restores it at boot
+func (fw *IptablesFirewall) Apply(plan *FirewallPlan) error {
+	families := fw.families()
+
+	for family, command := range families {
+		data, err := VerboseCommandOutput(command, "-S", "INPUT")
+		if err != nil {
+			return err
+		}
+		input := iptablesRestoreInput(family, string(data), plan)
+
+		// --noflush keeps every rule the input does not mention, e.g. Docker's
+		cmd := VerboseCommand(command+"-restore", "--noflush")
+		cmd.Stdin = strings.NewReader(input)
+		output, err := cmd.CombinedOutput()
+		VerboseLogger.LogCommandOutput(command+"-restore", []string{"--noflush"}, output, err)
+		if err != nil {
+			return fmt.Errorf("%s-restore failed: %s", command, strings.TrimSpace(string(output)))
+		}
+	}
+
+	return persistIptables(families, fw.facts)
+}
+
+// iptablesRestoreInput renders the changes for one family as input for
+// iptables-restore --noflush. The base rules for loopback and established
+// traffic come with the DROP policy, so the running session is never cut.
+func iptablesRestoreInput(family, current string, plan *FirewallPlan) string {
+	var b strings.Builder
+	b.WriteString("*filter\n")
+	b.WriteString(":INPUT DROP [0:0]\n")
+
+	base := iptablesBaseRules(family)
+	for i := len(base) - 1; i >= 0; i-- {
+		if !strings.Contains(current, strings.Join(base[i], " ")) {
+			b.WriteString("-I INPUT 1 " + strings.Join(base[i], " ") + "\n")
+		}
+	}
+	for _, rule := range plan.Remove {
+		if rule.Family == family {
+			b.WriteString("-D INPUT " + strings.Join(iptablesRuleSpec(rule), " ") + "\n")
+		}
+	}
+	for _, rule := range plan.Add {
+		if rule.Family == family {
+			// Inserted, so a trailing REJECT like RHEL's default cannot shadow it
+			b.WriteString("-I INPUT " + strings.Join(iptablesRuleSpec(rule), " ") + "\n")
+		}
+	}
+
+	b.WriteString("COMMIT\n")
+	return b.String()
+}
+
+// iptablesPersistence describes how a distribution restores iptables rules
+// at boot
+type iptablesPersistence struct {
+	Package   string            // package providing the boot service
+	Installed string            // file that exists once Package is installed
+	Services  map[string]string // family to boot service
+	Rules     map[string]string // family to the file the service restores
+}
+
+// iptablesPersistenceFor returns the boot persistence of a distribution, or
+// nil if it is not known
+func iptablesPersistenceFor(distro DistroFacts) *iptablesPersistence {
+	switch {
+	case distro.IsLike("debian", "ubuntu"):
+		return &iptablesPersistence{
+			Package:   "iptables-persistent",
+			Installed: "/usr/sbin/netfilter-persistent",
+			// netfilter-persistent restores both files
+			Services: map[string]string{"ipv4": "netfilter-persistent"},
+			Rules:    map[string]string{"ipv4": "/etc/iptables/rules.v4", "ipv6": "/etc/iptables/rules.v6"},
+		}
+	case distro.IsLike("rhel", "fedora", "centos"):
+		return &iptablesPersistence{
+			Package:   "iptables-services",
+			Installed: "/usr/libexec/iptables/iptables.init",
+			Services:  map[string]string{"ipv4": "iptables", "ipv6": "ip6tables"},
+			Rules:     map[string]string{"ipv4": "/etc/sysconfig/iptables", "ipv6": "/etc/sysconfig/ip6tables"},
+		}
+	case distro.IsLike("arch"):
+		return &iptablesPersistence{
+			Services: map[string]string{"ipv4": "iptables", "ipv6": "ip6tables"},
+			Rules:    map[string]string{"ipv4": "/etc/iptables/iptables.rules", "ipv6": "/etc/iptables/ip6tables.rules"},
+		}
+	case distro.IsLike("alpine"):
+		return &iptablesPersistence{
+			Package:   "iptables-openrc",
+			Installed: "/etc/init.d/iptables",
+			Services:  map[string]string{"ipv4": "iptables", "ipv6": "ip6tables"},
+			Rules:     map[string]string{"ipv4": "/etc/iptables/rules-save", "ipv6": "/etc/iptables/rules6-save"},
+		}
+	}
+	return nil
+}
+
+// persistIptables saves the active rules of each family and enables the
+// service that restores them at boot
+func persistIptables(families map[string]string, facts *Facts) error {
+	var distro DistroFacts
+	if facts != nil {
+		distro = facts.Distro
+	}
+	persistence := iptablesPersistenceFor(distro)
+	if persistence == nil {
+		fmt.Printf("Warning: Don't know how to persist iptables rules on %q, they are lost on reboot\n", distro.ID)
+		return nil
+	}
+
+	if persistence.Package != "" {
+		if _, err := os.Stat(persistence.Installed); os.IsNotExist(err) {
+			if err := InstallPackages(facts, []string{persistence.Package}); err != nil {
+				fmt.Printf("Warning: Could not install %s, iptables rules are lost on reboot: %v\n", persistence.Package, err)
+				return nil
+			}
+		}
+	}
+
+	for family, command := range families {
+		output, err := VerboseCommandOutput(command + "-save")
+		if err != nil {
+			return fmt.Errorf("%s-save failed: %v", command, err)
+		}
+		path := persistence.Rules[family]
+		if err := VerboseMkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := VerboseWriteFile(path, string(output)); err != nil {
+			return err
+		}
+	}
+
+	sm, err := NewServiceManager()
+	if err != nil {
+		fmt.Printf("Warning: %v. iptables rules are saved but not restored at boot.\n", err)
+		return nil
+	}
+	for family := range families {
+		if service, ok := persistence.Services[family]; ok {
+			if err := sm.Enable(service); err != nil {
+				fmt.Printf("Warning: Could not enable %s: %v\n", service, err)
+			}
+		}
+	}
+	return nil
+}
+
+// iptablesBaseRules are SetupSuite's INPUT rules besides the allow rules, as
+// printed by `iptables -S`. IPv6 needs ICMPv6 for neighbour discovery.
+func iptablesBaseRules(family string) [][]string {
+	rules := [][]string{
+		{"-i", "lo", "-m", "comment", "--comment", firewallRuleComment, "-j", "ACCEPT"},
+		{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-m", "comment", "--comment", firewallRuleComment, "-j", "ACCEPT"},
+	}
+	if family == "ipv6" {
+		rules = append(rules, []string{"-p", "ipv6-icmp", "-m", "comment", "--comment", firewallRuleComment, "-j", "ACCEPT"})
+	}
+	return rules
+}
+
+// iptablesEnforcing reports whether the INPUT chain drops by default and
+// SetupSuite's base rules are in place
+func iptablesEnforcing(output, family string) bool {
+	if !strings.Contains(output, "-P INPUT DROP") {
+		return false
+	}
+	for _, base := range iptablesBaseRules(family) {
+		if !strings.Contains(output, strings.Join(base, " ")) {
+			return false
+		}
+	}
+	return true
+}
+
+// iptablesRuleSpec returns the rule specification for -I and -D, in the
+// order `iptables -S` prints it
+func iptablesRuleSpec(rule FirewallRule) []string {
+	var spec []string
+	if rule.Source != "" {
+		spec = append(spec, "-s", rule.Source)
+	}
+	switch {
+	case rule.Protocol == "icmp" && rule.Family == "ipv6":
+		spec = append(spec, "-p", "ipv6-icmp", "-m", "icmp6", "--icmpv6-type", "128")
+	case rule.Protocol == "icmp":
+		spec = append(spec, "-p", "icmp", "-m", "icmp", "--icmp-type", "8")
+	default:
+		spec = append(spec, "-p", rule.Protocol, "-m", rule.Protocol, "--dport", rule.portSpec(":"))
+	}
+	if rule.Limit != "" {
+		spec = append(spec, "-m", "limit", "--limit", rule.Limit)
+	}
+	return append(spec, "-m", "comment", "--comment", firewallRuleComment, "-j", "ACCEPT")
+}
+
+// parseIptablesRules reads the ACCEPT rules of `iptables -S INPUT`
+func parseIptablesRules(output, family string) (managed, foreign []FirewallRule) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		// -A INPUT -s 10.0.0.0/8 -p tcp -m tcp --dport 3306 -m comment --comment setupsuite -j ACCEPT
+		if len(fields) < 2 || fields[0] != "-A" || !strings.HasSuffix(line, "-j ACCEPT") {
+			continue
+		}
+		rule := FirewallRule{Family: family}
+		owned := false
+		for i := 0; i+1 < len(fields); i++ {
+			value := fields[i+1]
+			switch fields[i] {
+			case "-s":
+				if source, _, err := normalizeSource(value); err == nil {
+					rule.Source = source
+				}
+			case "-p":
+				rule.Protocol = value
+			case "--dport":
+				if strings.Contains(value, ":") {
+					rule.Port, rule.PortEnd, _ = parsePortRange(value)
+				} else {
+					rule.Port, _ = strconv.Atoi(value)
+				}
+			case "--icmp-type", "--icmpv6-type":
+				if value == "8" || value == "128" || value == "echo-request" {
+					rule.Protocol = "icmp"
+				}
+			case "--limit":
+				rule.Limit, _ = normalizeRateLimit(value)
+			case "--comment":
+				owned = strings.Trim(value, `"`) == firewallRuleComment
+			}
+		}
+		if rule.Protocol != "icmp" && (rule.Port == 0 || (rule.Protocol != "tcp" && rule.Protocol != "udp")) {
+			continue
+		}
+		if owned {
+			managed = append(managed, rule)
+		} else {
+			foreign = append(foreign, rule)
+		}
+	}
+	return managed, foreign
+}
+
+func sortRules(rules []FirewallRule) {
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].String() < rules[j].String() })
+}
+
+func appendUniqueRule(rules []FirewallRule, rule FirewallRule) []FirewallRule {
+	for _, r := range rules {
+		if r.String() == rule.String() {
+			return rules
+		}
+	}
+	return append(rules, rule)
+}
+
+func removeRule(rules []FirewallRule, rule FirewallRule) []FirewallRule {
+	var kept []FirewallRule
+	for _, r := range rules {
+		if r.String() != rule.String() {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// nftablesRulesPath holds SetupSuite's table. The whole table is SetupSuite's,
+// tables of other tools like Docker or libvirt are never touched.
+var nftablesRulesPath = "/etc/nftables.d/setupsuite.nft"
+
+// nftablesConfigPaths are the files nftables.service loads at boot on
+// Debian/Arch, RHEL and Alpine
+var nftablesConfigPaths = []string{"/etc/nftables.conf", "/etc/sysconfig/nftables.conf", "/etc/nftables.nft"}
+
+// NftablesFirewall manages the inet setupsuite table
+type NftablesFirewall struct{}
+
+func (fw *NftablesFirewall) GetName() string { return "nftables" }
+
+func (fw *NftablesFirewall) rules() (managed []FirewallRule, loaded bool, err error) {
+	output, err := VerboseCommandOutput("nft", "list", "table", "inet", "setupsuite")
+	if err != nil {
+		// The table does not exist before the first run
+		return nil, false, nil
+	}
+	return parseNftablesRules(string(output)), true, nil
+}
+
+func (fw *NftablesFirewall) CurrentRules() ([]FirewallRule, error) {
+	managed, _, err := fw.rules()
+	return managed, err
+}
+
+func (fw *NftablesFirewall) Plan(desired []FirewallRule) (*FirewallPlan, error) {
+	managed, loaded, err := fw.rules()
+	if err != nil {
+		return nil, err
+	}
+	plan := diffRules(managed, nil, nftablesRules(desired))
+	plan.Enable = !loaded
+	return plan, nil
+}
+
+// nftablesRules splits ICMP rules without a family into one per family,
+// since ICMP and ICMPv6 are different protocols
+func nftablesRules(desired []FirewallRule) []FirewallRule {
+	var rules []FirewallRule
+	for _, rule := range desired {
+		if rule.Protocol != "icmp" || rule.Family != "" {
+			rules = append(rules, rule)
+			continue
+		}
+		for _, family := range []string{"ipv4", "ipv6"} {
+			expanded := rule
+			expanded.Family = family
+			rules = append(rules, expanded)
+		}
+	}
+	return rules
+}
+
+// Apply rewrites the table file, checks it with nft -c and loads it in one
+// transaction, so the firewall is never half configured
+func (fw *NftablesFirewall) Apply(plan *FirewallPlan) error {
+	rules, _, err := fw.rules()
+	if err != nil {
+		return err
+	}
+	for _, rule := range plan.Remove {
+		rules = removeRule(rules, rule)
+	}
+	for _, rule := range plan.Add {
+		rules = appendUniqueRule(rules, rule)
+	}
+	sortRules(rules)
+	content := renderNftablesRuleset(rules)
+
+	if err := checkNftablesRuleset(content); err != nil {
+		return err
+	}
+	if err := VerboseMkdirAll(filepath.Dir(nftablesRulesPath), 0755); err != nil {
+		return err
+	}
+	if err := VerboseWriteFile(nftablesRulesPath, content); err != nil {
+		return err
+	}
+	if err := VerboseCommandRun("nft", "-f", nftablesRulesPath); err != nil {
+		return fmt.Errorf("could not load %s: %v", nftablesRulesPath, err)
+	}
+
+	// Load the table at boot as well
+	if err := ensureNftablesInclude(); err != nil {
+		return err
+	}
+	if sm, err := NewServiceManager(); err == nil {
+		if err := sm.Enable("nftables"); err != nil {
+			fmt.Printf("Warning: Could not enable nftables service: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// checkNftablesRuleset validates a ruleset with nft -c without loading it
+func checkNftablesRuleset(content string) error {
+	file, err := ioutil.TempFile("", "setupsuite-*.nft")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+
+	if output, err := VerboseCommandOutput("nft", "-c", "-f", file.Name()); err != nil {
+		return fmt.Errorf("nft rejected the ruleset: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// ensureNftablesInclude makes the boot configuration include the table file.
+// Alpine's configuration already includes all of /etc/nftables.d.
+func ensureNftablesInclude() error {
+	include := fmt.Sprintf("include %q", nftablesRulesPath)
+	glob := fmt.Sprintf("include %q", filepath.Join(filepath.Dir(nftablesRulesPath), "*.nft"))
+
+	target := ""
+	for _, path := range nftablesConfigPaths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if strings.Contains(string(data), include) || strings.Contains(string(data), glob) {
+			return nil
+		}
+		if target == "" {
+			target = path
+		}
+	}
+
+	if target == "" {
+		target = nftablesConfigPaths[0]
+	}
+	// Appended after any flush ruleset at the top of the configuration
+	return updateFile(target, func(content string) string {
+		return setManagedBlock(content, "nftables", include+"\n")
+	})
+}
+
+// renderNftablesRuleset renders the setupsuite table. Declaring and deleting
+// the table first makes nft -f replace it atomically.
+func renderNftablesRuleset(rules []FirewallRule) string {
+	var b strings.Builder
+	b.WriteString("#!/usr/sbin/nft -f\n")
+	b.WriteString(managedHeader + "\n")
+	b.WriteString("table inet setupsuite\n")
+	b.WriteString("delete table inet setupsuite\n\n")
+	b.WriteString("table inet setupsuite {\n")
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority 0; policy drop;\n")
+	b.WriteString("\t\tiif \"lo\" accept\n")
+	b.WriteString("\t\tct state established,related accept\n")
+	// Neighbour discovery breaks IPv6 without ICMPv6
+	b.WriteString("\t\tmeta l4proto ipv6-icmp accept\n")
+	for _, rule := range rules {
+		b.WriteString("\t\t" + nftablesRuleSpec(rule) + "\n")
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// nftablesLimitUnits maps normalized rate units to nft's
+var nftablesLimitUnits = map[string]string{"sec": "second", "min": "minute", "hour": "hour", "day": "day"}
+
+// nftablesRuleSpec renders a rule the way `nft list` prints it
+func nftablesRuleSpec(rule FirewallRule) string {
+	var parts []string
+	switch {
+	case rule.Source != "" && rule.Family == "ipv6":
+		parts = append(parts, "ip6 saddr "+rule.Source)
+	case rule.Source != "":
+		parts = append(parts, "ip saddr "+rule.Source)
+	case rule.Family != "" && rule.Protocol != "icmp":
+		parts = append(parts, "meta nfproto "+rule.Family)
+	}
+
+	switch {
+	case rule.Protocol == "icmp" && rule.Family == "ipv6":
+		parts = append(parts, "icmpv6 type echo-request")
+	case rule.Protocol == "icmp":
+		parts = append(parts, "icmp type echo-request")
+	default:
+		parts = append(parts, rule.Protocol+" dport "+rule.portSpec("-"))
+	}
+
+	if rule.Limit != "" {
+		limit := strings.SplitN(rule.Limit, "/", 2)
+		parts = append(parts, fmt.Sprintf("limit rate %s/%s", limit[0], nftablesLimitUnits[limit[1]]))
+	}
+	return strings.Join(append(parts, "accept"), " ")
+}
+
+// parseNftablesRules reads the accept rules of `nft list table inet setupsuite`
+func parseNftablesRules(output string) []FirewallRule {
+	var rules []FirewallRule
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[len(fields)-1] != "accept" {
+			continue
+		}
+
+		rule := FirewallRule{}
+		for i := 0; i+2 < len(fields); i++ {
+			key, value := fields[i]+" "+fields[i+1], fields[i+2]
+			switch key {
+			case "ip saddr", "ip6 saddr":
+				if source, family, err := normalizeSource(value); err == nil {
+					rule.Source, rule.Family = source, family
+				}
+			case "meta nfproto":
+				rule.Family = value
+			case "tcp dport", "udp dport":
+				rule.Protocol = fields[i]
+				if strings.Contains(value, "-") {
+					rule.Port, rule.PortEnd, _ = parsePortRange(value)
+				} else {
+					rule.Port, _ = strconv.Atoi(value)
+				}
+			case "icmp type", "icmpv6 type":
+				if value == "echo-request" {
+					rule.Protocol = "icmp"
+					rule.Family = map[string]string{"icmp": "ipv4", "icmpv6": "ipv6"}[fields[i]]
+				}
+			case "limit rate":
+				rule.Limit, _ = normalizeRateLimit(value)
+			}
+		}
+		if rule.Protocol == "icmp" || rule.Port > 0 {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
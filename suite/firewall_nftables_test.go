@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNftablesRuleSpecRoundTrip(t *testing.T) {
+	tests := []struct {
+		rule FirewallRule
+		want string
+	}{
+		{FirewallRule{Port: 22, Protocol: "tcp"}, "tcp dport 22 accept"},
+		{FirewallRule{Port: 3306, Protocol: "tcp", Source: "10.0.0.0/8", Family: "ipv4"}, "ip saddr 10.0.0.0/8 tcp dport 3306 accept"},
+		{FirewallRule{Port: 5432, Protocol: "tcp", Source: "fd00::/8", Family: "ipv6"}, "ip6 saddr fd00::/8 tcp dport 5432 accept"},
+		{FirewallRule{Port: 60000, PortEnd: 61000, Protocol: "udp"}, "udp dport 60000-61000 accept"},
+		{FirewallRule{Port: 22022, Protocol: "tcp", Limit: "6/min"}, "tcp dport 22022 limit rate 6/minute accept"},
+		{FirewallRule{Port: 80, Protocol: "tcp", Family: "ipv6"}, "meta nfproto ipv6 tcp dport 80 accept"},
+		{FirewallRule{Protocol: "icmp", Family: "ipv4"}, "icmp type echo-request accept"},
+		{FirewallRule{Protocol: "icmp", Family: "ipv6"}, "icmpv6 type echo-request accept"},
+	}
+
+	for _, tt := range tests {
+		got := nftablesRuleSpec(tt.rule)
+		if got != tt.want {
+			t.Errorf("nftablesRuleSpec(%v) = %q, want %q", tt.rule, got, tt.want)
+		}
+		parsed := parseNftablesRules("\t\t" + got + "\n")
+		if len(parsed) != 1 || parsed[0] != tt.rule {
+			t.Errorf("parseNftablesRules(%q) = %v, want %v", got, parsed, tt.rule)
+		}
+	}
+}
+
+func TestParseNftablesRules(t *testing.T) {
+	output := `table inet setupsuite {
+	chain input {
+		type filter hook input priority filter; policy drop;
+		iif "lo" accept
+		ct state established,related accept
+		meta l4proto ipv6-icmp accept
+		tcp dport 22 accept
+		ip saddr 10.0.0.0/8 tcp dport 3306 accept
+		tcp dport 22022 limit rate 6/minute burst 5 packets accept
+	}
+}
+`
+	got := ruleStrings(parseNftablesRules(output))
+	want := "22/tcp 3306/tcp from 10.0.0.0/8 22022/tcp limit 6/min"
+	if got != want {
+		t.Errorf("parseNftablesRules() = %q, want %q", got, want)
+	}
+}
+
+func TestRenderNftablesRuleset(t *testing.T) {
+	content := renderNftablesRuleset([]FirewallRule{{Port: 22, Protocol: "tcp"}})
+
+	// The table is declared and deleted first so nft -f replaces it atomically
+	if !strings.Contains(content, "table inet setupsuite\ndelete table inet setupsuite\n") {
+		t.Errorf("ruleset does not replace the table:\n%s", content)
+	}
+	for _, want := range []string{"policy drop;", "ct state established,related accept", "\t\ttcp dport 22 accept\n"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("ruleset missing %q:\n%s", want, content)
+		}
+	}
+}
+
+func TestNftablesRulesExpandsICMP(t *testing.T) {
+	rules := nftablesRules([]FirewallRule{{Protocol: "icmp"}, {Port: 22, Protocol: "tcp"}})
+	if got := ruleStrings(rules); got != "icmp ipv4 icmp ipv6 22/tcp" {
+		t.Errorf("nftablesRules() = %q", got)
+	}
+}
+
+func TestEnsureNftablesInclude(t *testing.T) {
+	InitLogger(false)
+
+	dir, err := ioutil.TempDir("", "setupsuite-nftables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldRules, oldConfigs := nftablesRulesPath, nftablesConfigPaths
+	defer func() { nftablesRulesPath, nftablesConfigPaths = oldRules, oldConfigs }()
+	nftablesRulesPath = filepath.Join(dir, "nftables.d", "setupsuite.nft")
+	debian := filepath.Join(dir, "nftables.conf")
+	alpine := filepath.Join(dir, "nftables.nft")
+	nftablesConfigPaths = []string{debian, alpine}
+
+	// Alpine style configuration already includes the directory
+	ioutil.WriteFile(alpine, []byte(`include "`+filepath.Join(dir, "nftables.d")+`/*.nft"`+"\n"), 0644)
+	if err := ensureNftablesInclude(); err != nil {
+		t.Fatalf("ensureNftablesInclude() error = %v", err)
+	}
+	if _, err := os.Stat(debian); !os.IsNotExist(err) {
+		t.Errorf("%s was created although the glob include exists", debian)
+	}
+
+	// Debian style configuration gets the include appended once
+	os.Remove(alpine)
+	ioutil.WriteFile(debian, []byte("#!/usr/sbin/nft -f\n\nflush ruleset\n"), 0644)
+	for i := 0; i < 2; i++ {
+		if err := ensureNftablesInclude(); err != nil {
+			t.Fatalf("ensureNftablesInclude() error = %v", err)
+		}
+	}
+	data, _ := ioutil.ReadFile(debian)
+	include := `include "` + nftablesRulesPath + `"`
+	if strings.Count(string(data), include) != 1 || strings.Index(string(data), "flush ruleset") > strings.Index(string(data), include) {
+		t.Errorf("nftables.conf =\n%s", data)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"suite/suite/config"
+)
+
+func ruleStrings(rules []FirewallRule) string {
+	var parts []string
+	for _, rule := range rules {
+		parts = append(parts, rule.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestDiffRules(t *testing.T) {
+	tests := []struct {
+		name       string
+		managed    []FirewallRule
+		foreign    []FirewallRule
+		desired    []int
+		wantAdd    string
+		wantRemove string
+	}{
+		{
+			name:    "fresh firewall",
+			desired: []int{22, 80},
+			wantAdd: "22/tcp 80/tcp",
+		},
+		{
+			name:    "up to date",
+			managed: portRules([]int{22, 80}),
+			desired: []int{80, 22},
+		},
+		{
+			name:       "port added and removed",
+			managed:    portRules([]int{22, 8080}),
+			desired:    []int{22, 443},
+			wantAdd:    "443/tcp",
+			wantRemove: "8080/tcp",
+		},
+		{
+			name:    "foreign rule satisfies desired port",
+			foreign: portRules([]int{22}),
+			desired: []int{22, 80},
+			wantAdd: "80/tcp",
+		},
+		{
+			name:    "foreign rule is never removed",
+			foreign: portRules([]int{6443, 10250}),
+			desired: []int{22},
+			wantAdd: "22/tcp",
+		},
+		{
+			name:    "duplicate desired ports",
+			desired: []int{22, 22},
+			wantAdd: "22/tcp",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := diffRules(tt.managed, tt.foreign, portRules(tt.desired))
+			if got := ruleStrings(plan.Add); got != tt.wantAdd {
+				t.Errorf("Add = %q, want %q", got, tt.wantAdd)
+			}
+			if got := ruleStrings(plan.Remove); got != tt.wantRemove {
+				t.Errorf("Remove = %q, want %q", got, tt.wantRemove)
+			}
+			if plan.Empty() != (tt.wantAdd == "" && tt.wantRemove == "") {
+				t.Errorf("Empty() = %v", plan.Empty())
+			}
+		})
+	}
+}
+
+func TestParseUFWStatus(t *testing.T) {
+	output := `Status: active
+
+To                         Action      From
+--                         ------      ----
+22/tcp                     ALLOW       Anywhere                   # setupsuite
+80                         ALLOW       Anywhere
+8080/tcp                   DENY        Anywhere
+53/udp                     ALLOW       Anywhere
+22/tcp (v6)                ALLOW       Anywhere (v6)              # setupsuite
+3306/tcp                   ALLOW       10.0.0.0/8                 # setupsuite
+60000:61000/udp            ALLOW       Anywhere                   # setupsuite
+22022/tcp                  LIMIT       Anywhere                   # setupsuite
+5432/tcp                   ALLOW       fd00::/8                   # setupsuite
+`
+	managed, foreign := parseUFWStatus(output)
+	want := "22/tcp 3306/tcp from 10.0.0.0/8 60000:61000/udp 22022/tcp limit 6/30sec 5432/tcp from fd00::/8"
+	if got := ruleStrings(managed); got != want {
+		t.Errorf("managed = %q, want %q", got, want)
+	}
+	if got := ruleStrings(foreign); got != "80/tcp 53/udp" {
+		t.Errorf("foreign = %q, want 80/tcp 53/udp", got)
+	}
+}
+
+func TestParseFirewalldRules(t *testing.T) {
+	owned := portRules([]int{8443, 9000})
+	owned = append(owned, FirewallRule{Port: 3306, Protocol: "tcp", Source: "10.0.0.0/8", Family: "ipv4"})
+	richRules := `rule family="ipv4" source address="10.0.0.0/8" port port="3306" protocol="tcp" accept
+rule family="ipv4" source address="192.168.1.0/24" service name="ssh" accept
+rule port port="22022" protocol="tcp" accept limit value="6/m"
+`
+	managed, foreign := parseFirewalldRules("8443/tcp 53/udp 3000/tcp 60000-61000/udp\n", "ssh dhcpv6-client https\n", richRules, owned)
+
+	// 9000 is in the state file but was removed by hand, so it is not active
+	if got := ruleStrings(managed); got != "8443/tcp 3306/tcp from 10.0.0.0/8" {
+		t.Errorf("managed = %q, want 8443/tcp 3306/tcp from 10.0.0.0/8", got)
+	}
+	if got := ruleStrings(foreign); got != "53/udp 3000/tcp 60000:61000/udp 22022/tcp limit 6/min 22/tcp 443/tcp" {
+		t.Errorf("foreign = %q", got)
+	}
+}
+
+func TestFirewalldState(t *testing.T) {
+	InitLogger(false)
+
+	dir, err := ioutil.TempDir("", "setupsuite-firewall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldPath := firewalldStatePath
+	firewalldStatePath = filepath.Join(dir, "state", "firewalld-ports.json")
+	defer func() { firewalldStatePath = oldPath }()
+
+	rules, err := readFirewalldState()
+	if err != nil || len(rules) != 0 {
+		t.Fatalf("readFirewalldState() on missing file = %v, %v", rules, err)
+	}
+
+	if err := writeFirewalldState(portRules([]int{443, 22})); err != nil {
+		t.Fatalf("writeFirewalldState() error = %v", err)
+	}
+	rules, err = readFirewalldState()
+	if err != nil {
+		t.Fatalf("readFirewalldState() error = %v", err)
+	}
+	if got := ruleStrings(rules); got != "22/tcp 443/tcp" {
+		t.Errorf("state = %q, want 22/tcp 443/tcp", got)
+	}
+}
+
+func TestParseIptablesRules(t *testing.T) {
+	output := `-P INPUT DROP
+-A INPUT -i lo -m comment --comment setupsuite -j ACCEPT
+-A INPUT -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment setupsuite -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 22 -m comment --comment setupsuite -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 443 -m comment --comment "setupsuite" -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 6443 -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 8080 -j DROP
+-A INPUT -j KUBE-FIREWALL
+`
+	managed, foreign := parseIptablesRules(output, "ipv4")
+	if got := ruleStrings(managed); got != "22/tcp ipv4 443/tcp ipv4" {
+		t.Errorf("managed = %q, want 22/tcp ipv4 443/tcp ipv4", got)
+	}
+	if got := ruleStrings(foreign); got != "6443/tcp ipv4" {
+		t.Errorf("foreign = %q, want 6443/tcp ipv4", got)
+	}
+}
+
+func TestIptablesRuleSpecRoundTrip(t *testing.T) {
+	rules := []FirewallRule{
+		{Port: 2222, Protocol: "tcp", Family: "ipv4"},
+		{Port: 3306, Protocol: "tcp", Source: "10.0.0.0/8", Family: "ipv4"},
+		{Port: 60000, PortEnd: 61000, Protocol: "udp", Family: "ipv6"},
+		{Port: 22022, Protocol: "tcp", Limit: "6/min", Family: "ipv4"},
+		{Protocol: "icmp", Family: "ipv4"},
+		{Protocol: "icmp", Source: "fd00::/8", Family: "ipv6"},
+	}
+	for _, rule := range rules {
+		line := "-A INPUT " + strings.Join(iptablesRuleSpec(rule), " ")
+		managed, _ := parseIptablesRules(line, rule.Family)
+		if len(managed) != 1 || managed[0] != rule {
+			t.Errorf("parseIptablesRules(%q) = %v, want %v", line, managed, rule)
+		}
+	}
+}
+
+func TestExpandFamilies(t *testing.T) {
+	desired := []FirewallRule{
+		{Port: 22, Protocol: "tcp"},
+		{Port: 3306, Protocol: "tcp", Source: "fd00::/8", Family: "ipv6"},
+	}
+
+	both := map[string]string{"ipv4": "iptables", "ipv6": "ip6tables"}
+	if got := ruleStrings(expandFamilies(desired, both)); got != "22/tcp ipv4 22/tcp ipv6 3306/tcp from fd00::/8" {
+		t.Errorf("expandFamilies() = %q", got)
+	}
+
+	ipv4Only := map[string]string{"ipv4": "iptables"}
+	if got := ruleStrings(expandFamilies(desired, ipv4Only)); got != "22/tcp ipv4" {
+		t.Errorf("expandFamilies() without ip6tables = %q", got)
+	}
+}
+
+func TestDesiredFirewallRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		fw      config.Firewall
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "open ports",
+			fw:   config.Firewall{OpenPorts: []int{22, 80}},
+			want: "22/tcp 80/tcp",
+		},
+		{
+			name: "one rule per source",
+			fw:   config.Firewall{Rules: []config.FirewallRule{{Port: 3306, From: []string{"10.0.0.0/8", "2001:db8::1"}}}},
+			want: "3306/tcp from 10.0.0.0/8 3306/tcp from 2001:db8::1/128",
+		},
+		{
+			name: "port range",
+			fw:   config.Firewall{Rules: []config.FirewallRule{{Ports: "60000-61000", Proto: "udp"}}},
+			want: "60000:61000/udp",
+		},
+		{
+			name: "rate limit",
+			fw:   config.Firewall{Rules: []config.FirewallRule{{Port: 22022, Limit: "6/m"}}},
+			want: "22022/tcp limit 6/min",
+		},
+		{
+			name: "icmp on ipv4 only",
+			fw:   config.Firewall{Rules: []config.FirewallRule{{Proto: "icmp", Family: "ipv4"}}},
+			want: "icmp ipv4",
+		},
+		{
+			name: "host bits are masked",
+			fw:   config.Firewall{Rules: []config.FirewallRule{{Port: 5432, From: []string{"192.168.1.10/24"}}}},
+			want: "5432/tcp from 192.168.1.0/24",
+		},
+		{name: "missing port", fw: config.Firewall{Rules: []config.FirewallRule{{Proto: "tcp"}}}, wantErr: true},
+		{name: "bad protocol", fw: config.Firewall{Rules: []config.FirewallRule{{Port: 1, Proto: "sctp"}}}, wantErr: true},
+		{name: "bad range", fw: config.Firewall{Rules: []config.FirewallRule{{Ports: "61000:60000"}}}, wantErr: true},
+		{name: "bad source", fw: config.Firewall{Rules: []config.FirewallRule{{Port: 22, From: []string{"office"}}}}, wantErr: true},
+		{name: "bad limit", fw: config.Firewall{Rules: []config.FirewallRule{{Port: 22, Limit: "6/week"}}}, wantErr: true},
+		{
+			name:    "family mismatch",
+			fw:      config.Firewall{Rules: []config.FirewallRule{{Port: 22, Family: "ipv6", From: []string{"10.0.0.1"}}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := DesiredFirewallRules(&tt.fw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DesiredFirewallRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := ruleStrings(rules); !tt.wantErr && got != tt.want {
+				t.Errorf("DesiredFirewallRules() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUFWRuleArgs(t *testing.T) {
+	tests := []struct {
+		rule FirewallRule
+		want string
+	}{
+		{FirewallRule{Port: 22, Protocol: "tcp"}, "allow 22/tcp"},
+		{FirewallRule{Port: 60000, PortEnd: 61000, Protocol: "udp"}, "allow 60000:61000/udp"},
+		{FirewallRule{Port: 22022, Protocol: "tcp", Limit: "6/30sec"}, "limit 22022/tcp"},
+		{FirewallRule{Port: 3306, Protocol: "tcp", Source: "10.0.0.0/8"}, "allow proto tcp from 10.0.0.0/8 to any port 3306"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(ufwRuleArgs(tt.rule), " "); got != tt.want {
+			t.Errorf("ufwRuleArgs(%v) = %q, want %q", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestFirewalldRichRuleRoundTrip(t *testing.T) {
+	tests := []struct {
+		rule FirewallRule
+		want string
+	}{
+		{
+			FirewallRule{Port: 3306, Protocol: "tcp", Source: "10.0.0.0/8", Family: "ipv4"},
+			`rule family="ipv4" source address="10.0.0.0/8" port port="3306" protocol="tcp" accept`,
+		},
+		{
+			FirewallRule{Port: 22022, Protocol: "tcp", Limit: "6/min"},
+			`rule port port="22022" protocol="tcp" accept limit value="6/m"`,
+		},
+		{
+			FirewallRule{Port: 60000, PortEnd: 61000, Protocol: "udp", Family: "ipv6"},
+			`rule family="ipv6" port port="60000-61000" protocol="udp" accept`,
+		},
+		{
+			FirewallRule{Protocol: "icmp"},
+			`rule icmp-type name="echo-request" accept`,
+		},
+	}
+	for _, tt := range tests {
+		got := renderFirewalldRichRule(tt.rule)
+		if got != tt.want {
+			t.Errorf("renderFirewalldRichRule(%v) = %q, want %q", tt.rule, got, tt.want)
+		}
+		parsed, ok := parseFirewalldRichRule(got)
+		if !ok || parsed != tt.rule {
+			t.Errorf("parseFirewalldRichRule(%q) = %v, %v, want %v", got, parsed, ok, tt.rule)
+		}
+	}
+}
+
+func TestIptablesRestoreInput(t *testing.T) {
+	current := `-P INPUT ACCEPT
+-A INPUT -i lo -m comment --comment setupsuite -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 8080 -m comment --comment setupsuite -j ACCEPT
+`
+	plan := &FirewallPlan{
+		Add:    []FirewallRule{{Port: 443, Protocol: "tcp", Family: "ipv4"}, {Port: 443, Protocol: "tcp", Family: "ipv6"}},
+		Remove: []FirewallRule{{Port: 8080, Protocol: "tcp", Family: "ipv4"}},
+	}
+
+	want := `*filter
+:INPUT DROP [0:0]
+-I INPUT 1 -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment setupsuite -j ACCEPT
+-D INPUT -p tcp -m tcp --dport 8080 -m comment --comment setupsuite -j ACCEPT
+-I INPUT -p tcp -m tcp --dport 443 -m comment --comment setupsuite -j ACCEPT
+COMMIT
+`
+	if got := iptablesRestoreInput("ipv4", current, plan); got != want {
+		t.Errorf("iptablesRestoreInput() =\n%s\nwant\n%s", got, want)
+	}
+
+	// A fresh ip6tables gets all base rules in order, ICMPv6 included
+	got := iptablesRestoreInput("ipv6", "-P INPUT ACCEPT\n", &FirewallPlan{})
+	lo := strings.Index(got, "-i lo")
+	conntrack := strings.Index(got, "--ctstate")
+	icmp := strings.Index(got, "ipv6-icmp")
+	if lo < 0 || conntrack < 0 || icmp < 0 || !(icmp < conntrack && conntrack < lo) {
+		t.Errorf("ipv6 base rules not inserted in order:\n%s", got)
+	}
+}
+
+func TestIptablesPersistenceFor(t *testing.T) {
+	tests := []struct {
+		distro   DistroFacts
+		wantPkg  string
+		wantIPv4 string
+	}{
+		{DistroFacts{ID: "ubuntu", IDLike: []string{"debian"}}, "iptables-persistent", "/etc/iptables/rules.v4"},
+		{DistroFacts{ID: "rocky", IDLike: []string{"rhel", "centos", "fedora"}}, "iptables-services", "/etc/sysconfig/iptables"},
+		{DistroFacts{ID: "arch"}, "", "/etc/iptables/iptables.rules"},
+		{DistroFacts{ID: "alpine"}, "iptables-openrc", "/etc/iptables/rules-save"},
+	}
+	for _, tt := range tests {
+		p := iptablesPersistenceFor(tt.distro)
+		if p == nil {
+			t.Errorf("iptablesPersistenceFor(%s) = nil", tt.distro.ID)
+			continue
+		}
+		if p.Package != tt.wantPkg || p.Rules["ipv4"] != tt.wantIPv4 {
+			t.Errorf("iptablesPersistenceFor(%s) = %+v", tt.distro.ID, p)
+		}
+	}
+
+	if p := iptablesPersistenceFor(DistroFacts{ID: "void"}); p != nil {
+		t.Errorf("iptablesPersistenceFor(void) = %+v, want nil", p)
+	}
+}
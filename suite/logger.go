@@ -155,6 +155,7 @@ func VerboseMkdirAll(path string, perm os.FileMode) error {
 func VerboseWriteFile(filename, content string) error {
 	VerboseLogger.LogFileOperation("WRITE_FILE", filename)
 	VerboseLogger.LogFileContent(filename, content)
+	recordFileChange(filename, content)
 
 	file, err := VerboseCreate(filename)
 	if err != nil {
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PackageLockTimeout is how long package operations wait for a lock held by
+// another process, such as unattended-upgrades or cloud-init
+var PackageLockTimeout = 5 * time.Minute
+
+// packageLockPollInterval is how often a held lock is checked again
+var packageLockPollInterval = 2 * time.Second
+
+// procRoot is the proc filesystem used to find lock holders
+var procRoot = "/proc"
+
+// PackageLock is a lock file a package manager takes while it runs
+type PackageLock struct {
+	Path string
+	// ExistenceIsLock marks locks that are held for as long as the file
+	// exists, like pacman's db.lck, rather than through fcntl or a pid file
+	ExistenceIsLock bool
+}
+
+// LockHolder describes the process holding a package manager lock
+type LockHolder struct {
+	Lock    string
+	PID     int
+	Command string
+}
+
+func (h *LockHolder) String() string {
+	if h.PID == 0 {
+		return fmt.Sprintf("%s (lock file present)", h.Lock)
+	}
+	return fmt.Sprintf("%s held by %s (pid %d)", h.Lock, h.Command, h.PID)
+}
+
+// WaitForPackageLock blocks until none of the package manager's locks are
+// held, or fails with the current holder once PackageLockTimeout expires
+func WaitForPackageLock(pm PackageManager) error {
+	deadline := time.Now().Add(PackageLockTimeout)
+	var last string
+
+	for {
+		holder := findLockHolder(pm.Locks())
+		if holder == nil {
+			return nil
+		}
+
+		if holder.String() != last {
+			last = holder.String()
+			fmt.Printf("Waiting for package manager lock: %s\n", last)
+			VerboseLogger.LogWarning("Waiting for package manager lock: %s", last)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for package manager lock: %s", PackageLockTimeout, last)
+		}
+		time.Sleep(packageLockPollInterval)
+	}
+}
+
+// runLocked waits for the package manager lock and runs the command. If the
+// command fails because another process grabbed the lock in the meantime it
+// waits again and retries once.
+func runLocked(pm PackageManager, name string, args ...string) error {
+	if err := WaitForPackageLock(pm); err != nil {
+		return err
+	}
+
+	err := VerboseCommandRun(name, args...)
+	if err == nil || findLockHolder(pm.Locks()) == nil {
+		return err
+	}
+
+	if err := WaitForPackageLock(pm); err != nil {
+		return err
+	}
+	return VerboseCommandRun(name, args...)
+}
+
+// findLockHolder returns the first held lock, or nil if all are free
+func findLockHolder(locks []PackageLock) *LockHolder {
+	var lockPIDs map[int]bool
+	if data, err := ioutil.ReadFile(filepath.Join(procRoot, "locks")); err == nil {
+		lockPIDs = parseProcLocks(string(data))
+	}
+
+	for _, lock := range locks {
+		if _, err := os.Stat(lock.Path); err != nil {
+			continue
+		}
+
+		for pid := range lockPIDs {
+			if processHasOpen(pid, lock.Path) {
+				return &LockHolder{Lock: lock.Path, PID: pid, Command: processCommand(pid)}
+			}
+		}
+
+		// pid files used by dnf, yum and zypper
+		if data, err := ioutil.ReadFile(lock.Path); err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid > 0 && pid != os.Getpid() {
+				if _, err := os.Stat(filepath.Join(procRoot, strconv.Itoa(pid))); err == nil {
+					return &LockHolder{Lock: lock.Path, PID: pid, Command: processCommand(pid)}
+				}
+			}
+		}
+
+		if lock.ExistenceIsLock {
+			return &LockHolder{Lock: lock.Path}
+		}
+	}
+	return nil
+}
+
+// parseProcLocks returns the pids holding (not waiting for) a lock in /proc/locks
+func parseProcLocks(content string) map[int]bool {
+	pids := make(map[int]bool)
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		// 1: POSIX  ADVISORY  WRITE 1234 08:01:131075 0 EOF
+		if len(fields) < 5 || fields[1] == "->" {
+			continue
+		}
+		if pid, err := strconv.Atoi(fields[4]); err == nil && pid > 0 {
+			pids[pid] = true
+		}
+	}
+	return pids
+}
+
+// processHasOpen reports whether the process has path open
+func processHasOpen(pid int, path string) bool {
+	fdDir := filepath.Join(procRoot, strconv.Itoa(pid), "fd")
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return false
+	}
+	for _, fd := range fds {
+		if target, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && target == path {
+			return true
+		}
+	}
+	return false
+}
+
+// processCommand returns the command line of a process for display
+func processCommand(pid int) string {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "cmdline")); err == nil && len(data) > 0 {
+		return strings.TrimSpace(strings.ReplaceAll(string(data), "\x00", " "))
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return "unknown process"
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProcLocks(t *testing.T) {
+	content := `1: POSIX  ADVISORY  WRITE 1234 08:01:131075 0 EOF
+1: -> POSIX  ADVISORY  WRITE 5678 08:01:131075 0 EOF
+2: FLOCK  ADVISORY  WRITE 910 00:19:2345 0 EOF
+3: OFDLCK ADVISORY  READ  -1 00:06:9285 0 EOF
+`
+	pids := parseProcLocks(content)
+	if !pids[1234] || !pids[910] {
+		t.Errorf("parseProcLocks() = %v, want holders 1234 and 910", pids)
+	}
+	if pids[5678] {
+		t.Error("parseProcLocks() included a waiting process")
+	}
+	if len(pids) != 2 {
+		t.Errorf("parseProcLocks() returned %d pids, want 2", len(pids))
+	}
+}
+
+// fakeProc builds a minimal /proc with one process holding lockPath open
+func fakeProc(t *testing.T, pid string, lockPath string) string {
+	root := t.TempDir()
+	fdDir := filepath.Join(root, pid, "fd")
+	os.MkdirAll(fdDir, 0755)
+	os.Symlink(lockPath, filepath.Join(fdDir, "3"))
+	os.WriteFile(filepath.Join(root, pid, "cmdline"), []byte("/usr/bin/python3\x00/usr/bin/unattended-upgrade\x00"), 0644)
+	os.WriteFile(filepath.Join(root, "locks"), []byte("1: POSIX  ADVISORY  WRITE "+pid+" 08:01:131075 0 EOF\n"), 0644)
+	return root
+}
+
+func TestFindLockHolder(t *testing.T) {
+	defer func(root string) { procRoot = root }(procRoot)
+
+	dir := t.TempDir()
+	lockPath := filepath.Join(dir, "lock-frontend")
+	os.WriteFile(lockPath, nil, 0640)
+
+	procRoot = fakeProc(t, "4242", lockPath)
+	holder := findLockHolder([]PackageLock{{Path: lockPath}})
+	if holder == nil {
+		t.Fatal("findLockHolder() = nil, want holder")
+	}
+	if holder.PID != 4242 || !strings.Contains(holder.Command, "unattended-upgrade") {
+		t.Errorf("findLockHolder() = %+v", holder)
+	}
+
+	// An unlocked lock file that merely exists is free
+	procRoot = t.TempDir()
+	if holder := findLockHolder([]PackageLock{{Path: lockPath}}); holder != nil {
+		t.Errorf("findLockHolder() = %v, want nil", holder)
+	}
+
+	// Unless its existence is the lock
+	if holder := findLockHolder([]PackageLock{{Path: lockPath, ExistenceIsLock: true}}); holder == nil {
+		t.Error("findLockHolder() = nil for existence lock")
+	}
+}
+
+func TestFindLockHolderPidFile(t *testing.T) {
+	defer func(root string) { procRoot = root }(procRoot)
+	procRoot = t.TempDir()
+	os.MkdirAll(filepath.Join(procRoot, "777"), 0755)
+	os.WriteFile(filepath.Join(procRoot, "777", "comm"), []byte("dnf\n"), 0644)
+
+	pidFile := filepath.Join(t.TempDir(), "rpmdb_lock.pid")
+	os.WriteFile(pidFile, []byte("777\n"), 0644)
+	if holder := findLockHolder([]PackageLock{{Path: pidFile}}); holder == nil || holder.Command != "dnf" {
+		t.Errorf("findLockHolder() = %v, want dnf (pid 777)", holder)
+	}
+
+	// Stale pid file left behind by a dead process
+	os.WriteFile(pidFile, []byte("778\n"), 0644)
+	if holder := findLockHolder([]PackageLock{{Path: pidFile}}); holder != nil {
+		t.Errorf("findLockHolder() = %v, want nil for stale pid", holder)
+	}
+}
+
+func TestWaitForPackageLockTimeout(t *testing.T) {
+	InitLogger(false)
+	defer func(timeout, poll time.Duration) {
+		PackageLockTimeout, packageLockPollInterval = timeout, poll
+	}(PackageLockTimeout, packageLockPollInterval)
+	PackageLockTimeout = 50 * time.Millisecond
+	packageLockPollInterval = 10 * time.Millisecond
+
+	lockPath := filepath.Join(t.TempDir(), "db.lck")
+	os.WriteFile(lockPath, nil, 0644)
+
+	err := WaitForPackageLock(&lockedPackageManager{locks: []PackageLock{{Path: lockPath, ExistenceIsLock: true}}})
+	if err == nil || !strings.Contains(err.Error(), lockPath) {
+		t.Errorf("WaitForPackageLock() error = %v, want timeout naming %s", err, lockPath)
+	}
+
+	os.Remove(lockPath)
+	if err := WaitForPackageLock(&lockedPackageManager{locks: []PackageLock{{Path: lockPath}}}); err != nil {
+		t.Errorf("WaitForPackageLock() error = %v, want nil", err)
+	}
+}
+
+type lockedPackageManager struct {
+	DebianPackageManager
+	locks []PackageLock
+}
+
+func (pm *lockedPackageManager) Locks() []PackageLock {
+	return pm.locks
+}
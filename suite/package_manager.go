@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -13,6 +14,15 @@ type PackageManager interface {
 	Update() error
 	Install(packages []string) error
 	GetName() string
+	Locks() []PackageLock
+}
+
+// OfflinePackageManager is implemented by package managers that can download
+// packages into a bundle and install them again without network access
+type OfflinePackageManager interface {
+	PackageManager
+	Download(packages []string, dir string) error
+	InstallFromDir(dir string, packages []string) error
 }
 
 // DebianPackageManager for apt-based systems (Ubuntu, Debian)
@@ -20,18 +30,97 @@ type DebianPackageManager struct{}
 
 func (pm *DebianPackageManager) Update() error {
 	fmt.Println("Updating package list (apt)...")
-	return exec.Command("apt-get", "update").Run()
+	return runLocked(pm, "apt-get", append(aptLockArgs(), "update")...)
 }
 
 func (pm *DebianPackageManager) Install(packages []string) error {
-	args := append([]string{"install", "-y"}, packages...)
-	return exec.Command("apt-get", args...).Run()
+	args := append(aptLockArgs(), "install", "-y")
+	return runLocked(pm, "apt-get", append(args, packages...)...)
 }
 
 func (pm *DebianPackageManager) GetName() string {
 	return "apt"
 }
 
+func (pm *DebianPackageManager) Locks() []PackageLock {
+	return []PackageLock{
+		{Path: "/var/lib/dpkg/lock-frontend"},
+		{Path: "/var/lib/dpkg/lock"},
+		{Path: "/var/lib/apt/lists/lock"},
+		{Path: "/var/cache/apt/archives/lock"},
+	}
+}
+
+// aptLockArgs makes apt itself wait for the dpkg lock on apt 1.9.11 and
+// newer, covering the window between our own check and apt taking the lock
+func aptLockArgs() []string {
+	return []string{"-o", fmt.Sprintf("DPkg::Lock::Timeout=%d", int(PackageLockTimeout.Seconds()))}
+}
+
+// Download fetches the packages and their full dependency closure and
+// indexes them as a flat apt repository
+func (pm *DebianPackageManager) Download(packages []string, dir string) error {
+	args := append([]string{"depends", "--recurse", "--no-recommends", "--no-suggests",
+		"--no-conflicts", "--no-breaks", "--no-replaces", "--no-enhances"}, packages...)
+	output, err := VerboseCommandOutput("apt-cache", args...)
+	if err != nil {
+		return fmt.Errorf("failed to resolve dependencies: %v", err)
+	}
+
+	cmd := VerboseCommand("apt-get", append([]string{"download"}, parseAptDependsOutput(string(output))...)...)
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("apt-get download failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	cmd = VerboseCommand("dpkg-scanpackages", "-m", ".", "/dev/null")
+	cmd.Dir = dir
+	index, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("dpkg-scanpackages failed (is dpkg-dev installed?): %v", err)
+	}
+	return VerboseWriteFile(filepath.Join(dir, "Packages"), string(index))
+}
+
+// InstallFromDir installs packages from a flat apt repository in dir while
+// ignoring every configured network source
+func (pm *DebianPackageManager) InstallFromDir(dir string, packages []string) error {
+	sourceList := "/etc/apt/setupsuite-offline.list"
+	if err := VerboseWriteFile(sourceList, fmt.Sprintf("deb [trusted=yes] file:%s ./\n", dir)); err != nil {
+		return err
+	}
+
+	aptOpts := []string{
+		"-o", "Dir::Etc::sourcelist=" + sourceList,
+		"-o", "Dir::Etc::sourceparts=-",
+		"-o", "APT::Get::List-Cleanup=0",
+	}
+	aptOpts = append(aptOpts, aptLockArgs()...)
+	if err := runLocked(pm, "apt-get", append(aptOpts, "update")...); err != nil {
+		return fmt.Errorf("failed to index offline repository: %v", err)
+	}
+	args := append(append(aptOpts, "install", "-y"), packages...)
+	return runLocked(pm, "apt-get", args...)
+}
+
+// parseAptDependsOutput extracts concrete package names from
+// `apt-cache depends --recurse`, skipping virtual packages
+func parseAptDependsOutput(output string) []string {
+	seen := make(map[string]bool)
+	var packages []string
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "<") {
+			continue
+		}
+		name := strings.TrimSpace(line)
+		if !seen[name] {
+			seen[name] = true
+			packages = append(packages, name)
+		}
+	}
+	return packages
+}
+
 // RedHatPackageManager for yum/dnf-based systems (RHEL, CentOS, Fedora)
 type RedHatPackageManager struct {
 	useYum bool
@@ -39,18 +128,12 @@ type RedHatPackageManager struct {
 
 func (pm *RedHatPackageManager) Update() error {
 	fmt.Println("Updating package list (yum/dnf)...")
-	if pm.useYum {
-		return exec.Command("yum", "check-update").Run()
-	}
-	return exec.Command("dnf", "check-update").Run()
+	return runLocked(pm, pm.GetName(), "check-update")
 }
 
 func (pm *RedHatPackageManager) Install(packages []string) error {
 	args := append([]string{"install", "-y"}, packages...)
-	if pm.useYum {
-		return exec.Command("yum", args...).Run()
-	}
-	return exec.Command("dnf", args...).Run()
+	return runLocked(pm, pm.GetName(), args...)
 }
 
 func (pm *RedHatPackageManager) GetName() string {
@@ -60,100 +143,377 @@ func (pm *RedHatPackageManager) GetName() string {
 	return "dnf"
 }
 
+func (pm *RedHatPackageManager) Locks() []PackageLock {
+	if pm.useYum {
+		return []PackageLock{{Path: "/var/run/yum.pid"}}
+	}
+	return []PackageLock{
+		{Path: "/var/lib/dnf/rpmdb_lock.pid"},
+		{Path: "/var/cache/dnf/metadata_lock.pid"},
+		{Path: "/var/cache/dnf/download_lock.pid"},
+	}
+}
+
+// Download fetches the packages with all dependencies and builds repodata
+func (pm *RedHatPackageManager) Download(packages []string, dir string) error {
+	var err error
+	if pm.useYum {
+		err = VerboseCommandRun("yumdownloader", append([]string{"--resolve", "--destdir", dir}, packages...)...)
+	} else {
+		err = VerboseCommandRun("dnf", append([]string{"download", "--resolve", "--alldeps", "--destdir", dir}, packages...)...)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := exec.LookPath("createrepo_c"); err == nil {
+		return VerboseCommandRun("createrepo_c", dir)
+	}
+	return VerboseCommandRun("createrepo", dir)
+}
+
+// InstallFromDir installs packages from a local repository in dir with all
+// network repositories disabled
+func (pm *RedHatPackageManager) InstallFromDir(dir string, packages []string) error {
+	repo := fmt.Sprintf("[setupsuite-offline]\nname=SetupSuite offline bundle\nbaseurl=file://%s\nenabled=0\ngpgcheck=0\n", dir)
+	if err := VerboseWriteFile("/etc/yum.repos.d/setupsuite-offline.repo", repo); err != nil {
+		return err
+	}
+
+	args := append([]string{"install", "-y", "--disablerepo=*", "--enablerepo=setupsuite-offline"}, packages...)
+	return runLocked(pm, pm.GetName(), args...)
+}
+
 // ArchPackageManager for pacman-based systems (Arch Linux)
 type ArchPackageManager struct{}
 
 func (pm *ArchPackageManager) Update() error {
 	fmt.Println("Updating package list (pacman)...")
-	return exec.Command("pacman", "-Sy").Run()
+	return runLocked(pm, "pacman", "-Sy")
 }
 
 func (pm *ArchPackageManager) Install(packages []string) error {
 	args := append([]string{"-S", "--noconfirm"}, packages...)
-	return exec.Command("pacman", args...).Run()
+	return runLocked(pm, "pacman", args...)
 }
 
 func (pm *ArchPackageManager) GetName() string {
 	return "pacman"
 }
 
+func (pm *ArchPackageManager) Locks() []PackageLock {
+	return []PackageLock{{Path: "/var/lib/pacman/db.lck", ExistenceIsLock: true}}
+}
+
+// Download fetches the packages and missing dependencies into dir
+func (pm *ArchPackageManager) Download(packages []string, dir string) error {
+	args := append([]string{"-Sw", "--noconfirm", "--cachedir", dir}, packages...)
+	return VerboseCommandRun("pacman", args...)
+}
+
+// InstallFromDir installs every package file in dir
+func (pm *ArchPackageManager) InstallFromDir(dir string, packages []string) error {
+	files, err := findBundleFiles(dir, ".pkg.tar.zst", ".pkg.tar.xz")
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no pacman packages found in %s", dir)
+	}
+	return runLocked(pm, "pacman", append([]string{"-U", "--noconfirm", "--needed"}, files...)...)
+}
+
 // AlpinePackageManager for apk-based systems (Alpine Linux)
 type AlpinePackageManager struct{}
 
 func (pm *AlpinePackageManager) Update() error {
 	fmt.Println("Updating package list (apk)...")
-	return exec.Command("apk", "update").Run()
+	return runLocked(pm, "apk", "update")
 }
 
 func (pm *AlpinePackageManager) Install(packages []string) error {
 	args := append([]string{"add"}, packages...)
-	return exec.Command("apk", args...).Run()
+	return runLocked(pm, "apk", args...)
 }
 
 func (pm *AlpinePackageManager) GetName() string {
 	return "apk"
 }
 
+func (pm *AlpinePackageManager) Locks() []PackageLock {
+	return []PackageLock{{Path: "/lib/apk/db/lock"}}
+}
+
+// Download fetches the packages and their dependencies into dir
+func (pm *AlpinePackageManager) Download(packages []string, dir string) error {
+	args := append([]string{"fetch", "--recursive", "--output", dir}, packages...)
+	return VerboseCommandRun("apk", args...)
+}
+
+// InstallFromDir installs every .apk file in dir without touching the network
+func (pm *AlpinePackageManager) InstallFromDir(dir string, packages []string) error {
+	files, err := findBundleFiles(dir, ".apk")
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no apk packages found in %s", dir)
+	}
+	return runLocked(pm, "apk", append([]string{"add", "--allow-untrusted", "--no-network"}, files...)...)
+}
+
 // OpenSUSEPackageManager for zypper-based systems (openSUSE)
 type OpenSUSEPackageManager struct{}
 
 func (pm *OpenSUSEPackageManager) Update() error {
 	fmt.Println("Updating package list (zypper)...")
-	return exec.Command("zypper", "refresh").Run()
+	return runLocked(pm, "zypper", "refresh")
 }
 
 func (pm *OpenSUSEPackageManager) Install(packages []string) error {
 	args := append([]string{"install", "-y"}, packages...)
-	return exec.Command("zypper", args...).Run()
+	return runLocked(pm, "zypper", args...)
 }
 
 func (pm *OpenSUSEPackageManager) GetName() string {
 	return "zypper"
 }
 
-// DetectPackageManager detects the package manager based on the system
+func (pm *OpenSUSEPackageManager) Locks() []PackageLock {
+	return []PackageLock{{Path: "/run/zypp.pid"}, {Path: "/var/run/zypp.pid"}}
+}
+
+// Download fetches the packages and their dependencies into dir
+func (pm *OpenSUSEPackageManager) Download(packages []string, dir string) error {
+	args := append([]string{"--non-interactive", "--pkg-cache-dir", dir, "install", "--download-only"}, packages...)
+	return runLocked(pm, "zypper", args...)
+}
+
+// InstallFromDir registers dir as a plain directory repository and installs from it
+func (pm *OpenSUSEPackageManager) InstallFromDir(dir string, packages []string) error {
+	// Ignore the error: the repository is already present on a second run
+	VerboseCommandRun("zypper", "--non-interactive", "addrepo", "--no-gpgcheck", "-t", "plaindir", dir, "setupsuite-offline")
+
+	args := append([]string{"--non-interactive", "--no-refresh", "install", "--from", "setupsuite-offline"}, packages...)
+	return runLocked(pm, "zypper", args...)
+}
+
+// GentooPackageManager for Portage-based systems (Gentoo)
+type GentooPackageManager struct{}
+
+func (pm *GentooPackageManager) Update() error {
+	fmt.Println("Updating package list (emerge)...")
+	return runLocked(pm, "emerge", "--sync", "--quiet")
+}
+
+func (pm *GentooPackageManager) Install(packages []string) error {
+	args := append([]string{"--ask=n", "--noreplace", "--quiet-build"}, packages...)
+	return runLocked(pm, "emerge", args...)
+}
+
+func (pm *GentooPackageManager) GetName() string {
+	return "emerge"
+}
+
+func (pm *GentooPackageManager) Locks() []PackageLock {
+	return []PackageLock{{Path: "/var/db/.pkg.portage_lockfile"}}
+}
+
+// Download fetches the source distfiles for the packages and dependencies into dir
+func (pm *GentooPackageManager) Download(packages []string, dir string) error {
+	cmd := VerboseCommand("emerge", append([]string{"--ask=n", "--fetchonly", "--oneshot"}, packages...)...)
+	cmd.Env = append(os.Environ(), "DISTDIR="+dir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("emerge --fetchonly failed: %v: %s", err, lastLine(string(output)))
+	}
+	return nil
+}
+
+// InstallFromDir builds the packages from the distfiles in dir with fetching disabled
+func (pm *GentooPackageManager) InstallFromDir(dir string, packages []string) error {
+	if err := WaitForPackageLock(pm); err != nil {
+		return err
+	}
+	cmd := VerboseCommand("emerge", append([]string{"--ask=n", "--noreplace", "--quiet-build"}, packages...)...)
+	cmd.Env = append(os.Environ(), "DISTDIR="+dir, "FETCHCOMMAND=false", "RESUMECOMMAND=false")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("emerge failed: %v: %s", err, lastLine(string(output)))
+	}
+	return nil
+}
+
+// VoidPackageManager for xbps-based systems (Void Linux)
+type VoidPackageManager struct{}
+
+func (pm *VoidPackageManager) Update() error {
+	fmt.Println("Updating package list (xbps)...")
+	return runLocked(pm, "xbps-install", "-S")
+}
+
+func (pm *VoidPackageManager) Install(packages []string) error {
+	args := append([]string{"-y"}, packages...)
+	return runLocked(pm, "xbps-install", args...)
+}
+
+func (pm *VoidPackageManager) GetName() string {
+	return "xbps"
+}
+
+func (pm *VoidPackageManager) Locks() []PackageLock {
+	return []PackageLock{{Path: "/var/db/xbps/lock"}}
+}
+
+// Download fetches the packages and dependencies and indexes them as a local repository
+func (pm *VoidPackageManager) Download(packages []string, dir string) error {
+	args := append([]string{"-y", "-S", "--download-only", "--cachedir", dir}, packages...)
+	if err := runLocked(pm, "xbps-install", args...); err != nil {
+		return err
+	}
+
+	files, err := findBundleFiles(dir, ".xbps")
+	if err != nil {
+		return err
+	}
+	return VerboseCommandRun("xbps-rindex", append([]string{"-a"}, files...)...)
+}
+
+// InstallFromDir installs packages from the local repository in dir only
+func (pm *VoidPackageManager) InstallFromDir(dir string, packages []string) error {
+	args := append([]string{"-y", "--ignore-conf-repos", "--repository", dir}, packages...)
+	return runLocked(pm, "xbps-install", args...)
+}
+
+// osReleasePath is read to identify the distribution
+var osReleasePath = "/etc/os-release"
+
+// ReadOSRelease reads the key/value pairs of /etc/os-release
+func ReadOSRelease() (map[string]string, error) {
+	file, err := os.Open(osReleasePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	osRelease := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") || !strings.Contains(line, "=") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		value := strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+		osRelease[key] = value
+	}
+	return osRelease, scanner.Err()
+}
+
+// packageManagerCandidate pairs a package manager with the binary it needs
+type packageManagerCandidate struct {
+	command string
+	pm      PackageManager
+}
+
+// packageManagerFamilies maps os-release IDs to their package managers in
+// order of preference
+var packageManagerFamilies = map[string][]packageManagerCandidate{
+	"debian":   {{"apt-get", &DebianPackageManager{}}},
+	"ubuntu":   {{"apt-get", &DebianPackageManager{}}},
+	"fedora":   {{"dnf", &RedHatPackageManager{useYum: false}}, {"yum", &RedHatPackageManager{useYum: true}}},
+	"rhel":     {{"dnf", &RedHatPackageManager{useYum: false}}, {"yum", &RedHatPackageManager{useYum: true}}},
+	"centos":   {{"dnf", &RedHatPackageManager{useYum: false}}, {"yum", &RedHatPackageManager{useYum: true}}},
+	"amzn":     {{"dnf", &RedHatPackageManager{useYum: false}}, {"yum", &RedHatPackageManager{useYum: true}}},
+	"arch":     {{"pacman", &ArchPackageManager{}}},
+	"suse":     {{"zypper", &OpenSUSEPackageManager{}}},
+	"opensuse": {{"zypper", &OpenSUSEPackageManager{}}},
+	"sles":     {{"zypper", &OpenSUSEPackageManager{}}},
+	"alpine":   {{"apk", &AlpinePackageManager{}}},
+	"gentoo":   {{"emerge", &GentooPackageManager{}}},
+	"void":     {{"xbps-install", &VoidPackageManager{}}},
+}
+
+// probeOrder is used when os-release does not identify a known family
+var probeOrder = []packageManagerCandidate{
+	{"apt-get", &DebianPackageManager{}},
+	{"dnf", &RedHatPackageManager{useYum: false}},
+	{"yum", &RedHatPackageManager{useYum: true}},
+	{"pacman", &ArchPackageManager{}},
+	{"zypper", &OpenSUSEPackageManager{}},
+	{"apk", &AlpinePackageManager{}},
+	{"emerge", &GentooPackageManager{}},
+	{"xbps-install", &VoidPackageManager{}},
+}
+
+// DetectPackageManager detects the package manager from /etc/os-release,
+// falling back to probing for package manager binaries
 func DetectPackageManager() (PackageManager, error) {
-	// Check for package manager binaries in order of preference
-	packageManagers := []struct {
-		command string
-		pm      PackageManager
-	}{
-		{"apt-get", &DebianPackageManager{}},
-		{"dnf", &RedHatPackageManager{useYum: false}},
-		{"yum", &RedHatPackageManager{useYum: true}},
-		{"pacman", &ArchPackageManager{}},
-		{"zypper", &OpenSUSEPackageManager{}},
-		{"apk", &AlpinePackageManager{}},
-	}
-
-	for _, pmInfo := range packageManagers {
-		if _, err := exec.LookPath(pmInfo.command); err == nil {
-			fmt.Printf("Detected package manager: %s\n", pmInfo.pm.GetName())
-			return pmInfo.pm, nil
+	osRelease, err := ReadOSRelease()
+	if err != nil {
+		osRelease = map[string]string{}
+	}
+	_, ostreeErr := os.Stat("/run/ostree-booted")
+
+	pm, err := selectPackageManager(osRelease, ostreeErr == nil, exec.LookPath)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Detected package manager: %s\n", pm.GetName())
+	return pm, nil
+}
+
+// selectPackageManager picks the package manager for a host described by its
+// os-release fields. lookPath reports which binaries are installed.
+func selectPackageManager(osRelease map[string]string, ostreeBooted bool, lookPath func(string) (string, error)) (PackageManager, error) {
+	if err := checkImmutableSystem(osRelease, ostreeBooted); err != nil {
+		return nil, err
+	}
+
+	// ID first, then ID_LIKE in the order listed
+	ids := append([]string{osRelease["ID"]}, strings.Fields(osRelease["ID_LIKE"])...)
+	for _, id := range ids {
+		for family, candidates := range packageManagerFamilies {
+			if id != family && !strings.HasPrefix(id, family+"-") {
+				continue
+			}
+			for _, candidate := range candidates {
+				if _, err := lookPath(candidate.command); err == nil {
+					return candidate.pm, nil
+				}
+			}
+		}
+	}
+
+	for _, candidate := range probeOrder {
+		if _, err := lookPath(candidate.command); err == nil {
+			return candidate.pm, nil
 		}
 	}
 
 	return nil, fmt.Errorf("no supported package manager found")
 }
 
+// checkImmutableSystem refuses image-based distributions whose packages
+// cannot be installed in place
+func checkImmutableSystem(osRelease map[string]string, ostreeBooted bool) error {
+	id := osRelease["ID"]
+	variant := osRelease["VARIANT_ID"]
+
+	switch {
+	case id == "nixos":
+		return fmt.Errorf("NixOS is not supported: packages and services are declared in configuration.nix and applied with nixos-rebuild")
+	case id == "fedora" && variant == "coreos", id == "rhcos", id == "flatcar":
+		return fmt.Errorf("%s is not supported: it is an immutable container OS provisioned with Ignition", osRelease["NAME"])
+	case ostreeBooted:
+		return fmt.Errorf("%s is not supported: it is an rpm-ostree based immutable system, layer packages with rpm-ostree instead", osRelease["NAME"])
+	}
+	return nil
+}
+
 // DetectDistribution detects the Linux distribution
 func DetectDistribution() (string, string, error) {
 	// Try to read /etc/os-release first (standard)
-	if file, err := os.Open("/etc/os-release"); err == nil {
-		defer file.Close()
-		scanner := bufio.NewScanner(file)
-		distro := make(map[string]string)
-
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			if strings.Contains(line, "=") {
-				parts := strings.SplitN(line, "=", 2)
-				key := strings.TrimSpace(parts[0])
-				value := strings.Trim(strings.TrimSpace(parts[1]), `"`)
-				distro[key] = value
-			}
-		}
-
+	if distro, err := ReadOSRelease(); err == nil {
 		if id, ok := distro["ID"]; ok {
 			version := distro["VERSION_ID"]
 			return id, version, nil
@@ -169,6 +529,7 @@ func DetectDistribution() (string, string, error) {
 		"/etc/arch-release":   "arch",
 		"/etc/alpine-release": "alpine",
 		"/etc/SuSE-release":   "opensuse",
+		"/etc/gentoo-release": "gentoo",
 	}
 
 	for file, distro := range distroFiles {
@@ -180,14 +541,15 @@ func DetectDistribution() (string, string, error) {
 	return "unknown", "unknown", fmt.Errorf("could not detect Linux distribution")
 }
 
-// GetFirewallManager returns the appropriate firewall management commands
-func GetFirewallManager() (string, error) {
-	// Check for firewall managers in order of preference
+// firewallBackend returns the preferred installed firewall manager
+func firewallBackend() (string, error) {
+	// Check for firewall managers in order of preference. nftables is only
+	// used when selected with backend:, its drop policy would also close
+	// ports that other tables accept
 	firewallManagers := []string{"ufw", "firewalld", "iptables"}
 
 	for _, fw := range firewallManagers {
 		if _, err := exec.LookPath(fw); err == nil {
-			fmt.Printf("Detected firewall manager: %s\n", fw)
 			return fw, nil
 		}
 	}
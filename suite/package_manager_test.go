@@ -19,7 +19,7 @@ func TestDetectPackageManager(t *testing.T) {
 	}
 
 	name := pm.GetName()
-	validPMs := []string{"apt", "yum", "dnf", "pacman", "apk", "zypper"}
+	validPMs := []string{"apt", "yum", "dnf", "pacman", "apk", "zypper", "emerge", "xbps"}
 	found := false
 	for _, valid := range validPMs {
 		if name == valid {
@@ -73,6 +73,139 @@ func TestOpenSUSEPackageManager(t *testing.T) {
 	}
 }
 
+func TestGentooPackageManager(t *testing.T) {
+	pm := &GentooPackageManager{}
+	if pm.GetName() != "emerge" {
+		t.Errorf("GetName() = %s, want emerge", pm.GetName())
+	}
+}
+
+func TestVoidPackageManager(t *testing.T) {
+	pm := &VoidPackageManager{}
+	if pm.GetName() != "xbps" {
+		t.Errorf("GetName() = %s, want xbps", pm.GetName())
+	}
+}
+
+func TestSelectPackageManager(t *testing.T) {
+	tests := []struct {
+		name      string
+		osRelease map[string]string
+		ostree    bool
+		binaries  []string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "arch with apt installed for debootstrap",
+			osRelease: map[string]string{"ID": "arch"},
+			binaries:  []string{"apt-get", "pacman"},
+			want:      "pacman",
+		},
+		{
+			name:      "rocky through ID_LIKE",
+			osRelease: map[string]string{"ID": "rocky", "ID_LIKE": "rhel centos fedora"},
+			binaries:  []string{"dnf", "yum"},
+			want:      "dnf",
+		},
+		{
+			name:      "centos 7 without dnf",
+			osRelease: map[string]string{"ID": "centos", "ID_LIKE": "rhel fedora"},
+			binaries:  []string{"yum"},
+			want:      "yum",
+		},
+		{
+			name:      "opensuse leap",
+			osRelease: map[string]string{"ID": "opensuse-leap", "ID_LIKE": "suse opensuse"},
+			binaries:  []string{"zypper"},
+			want:      "zypper",
+		},
+		{
+			name:      "linux mint",
+			osRelease: map[string]string{"ID": "linuxmint", "ID_LIKE": "ubuntu debian"},
+			binaries:  []string{"apt-get"},
+			want:      "apt",
+		},
+		{
+			name:      "gentoo",
+			osRelease: map[string]string{"ID": "gentoo"},
+			binaries:  []string{"emerge"},
+			want:      "emerge",
+		},
+		{
+			name:      "void",
+			osRelease: map[string]string{"ID": "void"},
+			binaries:  []string{"xbps-install"},
+			want:      "xbps",
+		},
+		{
+			name:      "unknown distribution falls back to probing",
+			osRelease: map[string]string{"ID": "somethingnew"},
+			binaries:  []string{"apk"},
+			want:      "apk",
+		},
+		{
+			name:      "nixos",
+			osRelease: map[string]string{"ID": "nixos"},
+			wantErr:   true,
+		},
+		{
+			name:      "fedora coreos",
+			osRelease: map[string]string{"ID": "fedora", "VARIANT_ID": "coreos", "NAME": "Fedora Linux"},
+			binaries:  []string{"dnf"},
+			ostree:    true,
+			wantErr:   true,
+		},
+		{
+			name:      "silverblue",
+			osRelease: map[string]string{"ID": "fedora", "VARIANT_ID": "silverblue"},
+			binaries:  []string{"dnf"},
+			ostree:    true,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookPath := func(name string) (string, error) {
+				for _, binary := range tt.binaries {
+					if binary == name {
+						return "/usr/bin/" + name, nil
+					}
+				}
+				return "", os.ErrNotExist
+			}
+
+			pm, err := selectPackageManager(tt.osRelease, tt.ostree, lookPath)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectPackageManager() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && pm.GetName() != tt.want {
+				t.Errorf("selectPackageManager() = %s, want %s", pm.GetName(), tt.want)
+			}
+		})
+	}
+}
+
+func TestReadOSRelease(t *testing.T) {
+	defer func(path string) { osReleasePath = path }(osReleasePath)
+	osReleasePath = filepath.Join(t.TempDir(), "os-release")
+	os.WriteFile(osReleasePath, []byte(`# comment
+NAME="Rocky Linux"
+ID="rocky"
+ID_LIKE="rhel centos fedora"
+VERSION_ID='9.3'
+`), 0644)
+
+	osRelease, err := ReadOSRelease()
+	if err != nil {
+		t.Fatalf("ReadOSRelease() error = %v", err)
+	}
+	if osRelease["ID"] != "rocky" || osRelease["ID_LIKE"] != "rhel centos fedora" || osRelease["VERSION_ID"] != "9.3" {
+		t.Errorf("ReadOSRelease() = %v", osRelease)
+	}
+}
+
 func TestDetectDistribution(t *testing.T) {
 	distro, version, err := DetectDistribution()
 	if err != nil {
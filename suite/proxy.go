@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"suite/suite/config"
+)
+
+const (
+	aptProxyConf      = "/etc/apt/apt.conf.d/95setupsuite-proxy"
+	zypperProxyConf   = "/etc/sysconfig/proxy"
+	dockerProxyDropIn = "/etc/systemd/system/docker.service.d/http-proxy.conf"
+)
+
+// ApplyProxyEnvironment exports the proxy settings to the environment that
+// SetupSuite's own subprocesses inherit from exec.Command
+func ApplyProxyEnvironment(p *config.HTTPProxy) {
+	for key, value := range proxyEnvironment(p) {
+		os.Setenv(key, value)
+	}
+}
+
+// ConfigureHTTPProxy configures the proxy for the package manager, Docker
+// and login shells so that every install step can reach the mirrors
+func ConfigureHTTPProxy(p *config.HTTPProxy, facts *Facts) error {
+	if p == nil || (p.HTTP == "" && p.HTTPS == "") {
+		return nil
+	}
+
+	fmt.Println("Configuring HTTP proxy...")
+	VerboseLogger.LogInfo("Configuring HTTP proxy: http=%s https=%s", p.HTTP, p.HTTPS)
+	ApplyProxyEnvironment(p)
+
+	if err := updateFile("/etc/environment", func(content string) string {
+		return setManagedBlock(content, "proxy", renderEnvironmentProxy(p))
+	}); err != nil {
+		return fmt.Errorf("failed to update /etc/environment: %v", err)
+	}
+
+	pm, err := facts.Packages()
+	if err != nil {
+		fmt.Printf("Warning: %v. Package manager proxy not configured.\n", err)
+	} else if err := configurePackageManagerProxy(pm.GetName(), p); err != nil {
+		return fmt.Errorf("failed to configure %s proxy: %v", pm.GetName(), err)
+	}
+
+	if _, err := exec.LookPath("systemctl"); err == nil {
+		if err := configureDockerProxy(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// configureDockerProxy writes the Docker drop-in and restarts a running
+// dockerd when it changed, since the daemon reads the proxy only at start
+func configureDockerProxy(p *config.HTTPProxy) error {
+	content := renderDockerProxyDropIn(p)
+	if previous, err := ioutil.ReadFile(dockerProxyDropIn); err == nil && string(previous) == content {
+		return nil
+	}
+
+	if err := VerboseMkdirAll(filepath.Dir(dockerProxyDropIn), 0755); err != nil {
+		return err
+	}
+	if err := VerboseWriteFile(dockerProxyDropIn, content); err != nil {
+		return fmt.Errorf("failed to write Docker proxy drop-in: %v", err)
+	}
+
+	sm, err := NewServiceManager()
+	if err != nil {
+		return fmt.Errorf("could not detect service manager: %v", err)
+	}
+	if err := sm.DaemonReload(); err != nil {
+		return fmt.Errorf("daemon reload failed: %v", err)
+	}
+	if sm.IsActive("docker") {
+		fmt.Println("Restarting Docker to apply the proxy...")
+		return RestartAndVerify(sm, "docker")
+	}
+	return nil
+}
+
+func configurePackageManagerProxy(pmName string, p *config.HTTPProxy) error {
+	switch pmName {
+	case "apt":
+		return VerboseWriteFile(aptProxyConf, renderAptProxyConf(p))
+	case "dnf", "yum":
+		path := "/etc/dnf/dnf.conf"
+		if pmName == "yum" {
+			path = "/etc/yum.conf"
+		}
+		return updateFile(path, func(content string) string {
+			return setIniKey(content, "main", "proxy", proxyURL(p))
+		})
+	case "zypper":
+		return updateFile(zypperProxyConf, func(content string) string {
+			content = setShellVar(content, "PROXY_ENABLED", "yes")
+			content = setShellVar(content, "HTTP_PROXY", p.HTTP)
+			content = setShellVar(content, "HTTPS_PROXY", p.HTTPS)
+			return setShellVar(content, "NO_PROXY", strings.Join(p.NoProxy, ","))
+		})
+	default:
+		// apk and pacman use the proxy variables from the environment
+		return nil
+	}
+}
+
+// proxyURL returns the proxy used by package managers that take a single URL
+func proxyURL(p *config.HTTPProxy) string {
+	if p.HTTP != "" {
+		return p.HTTP
+	}
+	return p.HTTPS
+}
+
+func proxyEnvironment(p *config.HTTPProxy) map[string]string {
+	env := make(map[string]string)
+	if p.HTTP != "" {
+		env["http_proxy"] = p.HTTP
+		env["HTTP_PROXY"] = p.HTTP
+	}
+	if p.HTTPS != "" {
+		env["https_proxy"] = p.HTTPS
+		env["HTTPS_PROXY"] = p.HTTPS
+	}
+	if len(p.NoProxy) > 0 {
+		env["no_proxy"] = strings.Join(p.NoProxy, ",")
+		env["NO_PROXY"] = strings.Join(p.NoProxy, ",")
+	}
+	return env
+}
+
+func renderEnvironmentProxy(p *config.HTTPProxy) string {
+	var b strings.Builder
+	for _, key := range []string{"http_proxy", "HTTP_PROXY", "https_proxy", "HTTPS_PROXY", "no_proxy", "NO_PROXY"} {
+		if value, ok := proxyEnvironment(p)[key]; ok {
+			fmt.Fprintf(&b, "%s=\"%s\"\n", key, value)
+		}
+	}
+	return b.String()
+}
+
+func renderAptProxyConf(p *config.HTTPProxy) string {
+	var b strings.Builder
+	// apt.conf comments are C++ style
+	b.WriteString("//" + strings.TrimPrefix(managedHeader, "#"))
+	if p.HTTP != "" {
+		fmt.Fprintf(&b, "Acquire::http::Proxy \"%s\";\n", p.HTTP)
+	}
+	if p.HTTPS != "" {
+		fmt.Fprintf(&b, "Acquire::https::Proxy \"%s\";\n", p.HTTPS)
+	}
+	for _, host := range p.NoProxy {
+		// apt only understands plain host names, not CIDRs or wildcards
+		if strings.ContainsAny(host, "/*") {
+			continue
+		}
+		host = strings.TrimPrefix(host, ".")
+		fmt.Fprintf(&b, "Acquire::http::Proxy::%s \"DIRECT\";\n", host)
+		fmt.Fprintf(&b, "Acquire::https::Proxy::%s \"DIRECT\";\n", host)
+	}
+	return b.String()
+}
+
+func renderDockerProxyDropIn(p *config.HTTPProxy) string {
+	var b strings.Builder
+	b.WriteString(managedHeader + "[Service]\n")
+	for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"} {
+		if value, ok := proxyEnvironment(p)[key]; ok {
+			fmt.Fprintf(&b, "Environment=\"%s=%s\"\n", key, value)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"suite/suite/config"
+	"testing"
+)
+
+func TestRenderAptProxyConf(t *testing.T) {
+	p := &config.HTTPProxy{
+		HTTP:    "http://proxy.corp:3128",
+		HTTPS:   "http://proxy.corp:3128",
+		NoProxy: []string{"localhost", ".corp.local", "10.0.0.0/8"},
+	}
+
+	got := renderAptProxyConf(p)
+	for _, want := range []string{
+		`Acquire::http::Proxy "http://proxy.corp:3128";`,
+		`Acquire::https::Proxy "http://proxy.corp:3128";`,
+		`Acquire::http::Proxy::corp.local "DIRECT";`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("renderAptProxyConf() missing %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "10.0.0.0/8") {
+		t.Errorf("renderAptProxyConf() should skip CIDR entries:\n%s", got)
+	}
+}
+
+func TestSetManagedBlock(t *testing.T) {
+	original := "PATH=\"/usr/bin\"\n"
+	first := setManagedBlock(original, "proxy", "http_proxy=\"http://a:1\"\n")
+	second := setManagedBlock(first, "proxy", "http_proxy=\"http://b:2\"\n")
+
+	want := "PATH=\"/usr/bin\"\n# BEGIN SetupSuite proxy\nhttp_proxy=\"http://b:2\"\n# END SetupSuite proxy\n"
+	if second != want {
+		t.Errorf("setManagedBlock() = %q, want %q", second, want)
+	}
+}
+
+func TestSetIniKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "add to existing section",
+			content: "[main]\ngpgcheck=1\n\n[other]\nx=y\n",
+			want:    "[main]\ngpgcheck=1\nproxy=http://p:3128\n\n[other]\nx=y\n",
+		},
+		{
+			name:    "replace existing key",
+			content: "[main]\nproxy=http://old:8080\n",
+			want:    "[main]\nproxy=http://p:3128\n",
+		},
+		{
+			name:    "create section",
+			content: "",
+			want:    "[main]\nproxy=http://p:3128\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := setIniKey(tt.content, "main", "proxy", "http://p:3128")
+			if got != tt.want {
+				t.Errorf("setIniKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"suite/suite/config"
+)
+
+// safeApplyDir holds the snapshot and state of a run waiting for confirmation
+var safeApplyDir = "/var/lib/setupsuite/safe-apply"
+
+// safeApplyRevertUnit names the transient systemd timer that reverts
+const safeApplyRevertUnit = "setupsuite-revert"
+
+// defaultConfirmTimeout applies when ssh_confirm_timeout is not set
+const defaultConfirmTimeout = 10 * time.Minute
+
+// ActiveSafeApply is set while a run's SSH and firewall changes wait for
+// confirmation. configureSSHD and ConfigureFirewall keep the previous SSH
+// ports open while it is set.
+var ActiveSafeApply *SafeApply
+
+// snapshotFile records a file as it was before the run
+type snapshotFile struct {
+	Path   string      `json:"path"`
+	Exists bool        `json:"exists"`
+	Mode   os.FileMode `json:"mode,omitempty"`
+	Backup string      `json:"backup,omitempty"`
+}
+
+// SafeApply is a dead man's switch around the SSH and firewall changes: they
+// are reverted at Deadline unless confirmed
+type SafeApply struct {
+	ID            string         `json:"id"`
+	Mode          string         `json:"mode"` // confirm or self-test
+	Deadline      time.Time      `json:"deadline"`
+	SSHUser       string         `json:"ssh_user,omitempty"`
+	NewPort       int            `json:"new_port"`
+	PreviousPorts []int          `json:"previous_ports"`
+	Files         []snapshotFile `json:"files"`
+	// FirewallBackend is empty if the run does not configure the firewall
+	FirewallBackend string         `json:"firewall_backend,omitempty"`
+	PreviousRules   []FirewallRule `json:"previous_rules,omitempty"`
+	DesiredRules    []FirewallRule `json:"desired_rules,omitempty"`
+	// Timer is the systemd unit that reverts, empty for a detached process
+	Timer string `json:"timer,omitempty"`
+}
+
+// BeginSafeApply snapshots sshd and the firewall and arms the revert timer
+// before anything changes
+func BeginSafeApply(cfg *config.SetupSecure, facts *Facts) (*SafeApply, error) {
+	if cfg.SSHSafeApply != "confirm" && cfg.SSHSafeApply != "self-test" {
+		return nil, fmt.Errorf("invalid ssh_safe_apply %q (use confirm or self-test)", cfg.SSHSafeApply)
+	}
+	if pending, err := LoadSafeApply(); err != nil {
+		return nil, err
+	} else if pending != nil {
+		return nil, fmt.Errorf("a previous run waits for confirmation until %s, run setupsuite confirm or setupsuite revert first",
+			pending.Deadline.Format(time.RFC3339))
+	}
+
+	timeout := defaultConfirmTimeout
+	if cfg.SSHConfirmTimeout > 0 {
+		timeout = time.Duration(cfg.SSHConfirmTimeout) * time.Minute
+	}
+	sa := &SafeApply{
+		ID:            strconv.FormatInt(time.Now().UnixNano(), 36),
+		Mode:          cfg.SSHSafeApply,
+		Deadline:      time.Now().Add(timeout),
+		SSHUser:       cfg.SSHUser,
+		NewPort:       cfg.SSHPort,
+		PreviousPorts: currentSSHPorts(),
+	}
+
+	filesDir := filepath.Join(safeApplyDir, "files")
+	if err := VerboseMkdirAll(filesDir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := snapshotFiles(filesDir, []string{sshdConfigPath, sshdConfigPath + ".backup", sshdDropInPath})
+	if err != nil {
+		return nil, fmt.Errorf("could not snapshot the SSH configuration: %v", err)
+	}
+	sa.Files = files
+
+	if cfg.Firewall != nil {
+		if fw, err := NewFirewall(cfg.Firewall.Backend, facts); err == nil {
+			sa.FirewallBackend = fw.GetName()
+			if sa.PreviousRules, err = fw.CurrentRules(); err != nil {
+				return nil, fmt.Errorf("could not snapshot the firewall: %v", err)
+			}
+		}
+	}
+
+	if err := sa.armRevertTimer(timeout, facts); err != nil {
+		os.RemoveAll(safeApplyDir)
+		return nil, fmt.Errorf("could not arm the revert timer: %v", err)
+	}
+	if err := sa.Save(); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Safe apply: SSH and firewall changes are reverted at %s unless confirmed\n", sa.Deadline.Format("15:04:05"))
+	return sa, nil
+}
+
+// LoadSafeApply returns the run waiting for confirmation, or nil
+func LoadSafeApply() (*SafeApply, error) {
+	data, err := ioutil.ReadFile(filepath.Join(safeApplyDir, "state.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sa := &SafeApply{}
+	if err := json.Unmarshal(data, sa); err != nil {
+		return nil, fmt.Errorf("invalid safe apply state: %v", err)
+	}
+	return sa, nil
+}
+
+// Save writes the state for setupsuite confirm and setupsuite revert
+func (sa *SafeApply) Save() error {
+	data, err := json.MarshalIndent(sa, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := VerboseMkdirAll(safeApplyDir, 0700); err != nil {
+		return err
+	}
+	return VerboseWriteFile(filepath.Join(safeApplyDir, "state.json"), string(data)+"\n")
+}
+
+// oldPorts are the previous SSH ports that stay open until confirmation
+func (sa *SafeApply) oldPorts() []int {
+	var ports []int
+	for _, port := range sa.PreviousPorts {
+		if port != sa.NewPort {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// sshdPortsBlock returns the Port lines that keep sshd listening on the old
+// ports, or nothing if the port does not change
+func (sa *SafeApply) sshdPortsBlock() string {
+	var block strings.Builder
+	for _, port := range sa.oldPorts() {
+		fmt.Fprintf(&block, "Port %d\n", port)
+	}
+	if block.Len() == 0 {
+		return ""
+	}
+	return setManagedBlock("", "safe-apply", block.String())
+}
+
+// armRevertTimer schedules `setupsuite revert` with a transient systemd
+// timer, or a detached setupsuite process where systemd is not running
+func (sa *SafeApply) armRevertTimer(timeout time.Duration, facts *Facts) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	if facts != nil && facts.InitSystem == "systemd" {
+		if _, err := exec.LookPath("systemd-run"); err == nil {
+			// A unit left over from an earlier run would block the name
+			VerboseCommandRun("systemctl", "stop", safeApplyRevertUnit+".timer")
+			VerboseCommandRun("systemctl", "reset-failed", safeApplyRevertUnit+".service")
+			err := VerboseCommandRun("systemd-run", "--unit="+safeApplyRevertUnit,
+				fmt.Sprintf("--on-active=%d", int(timeout.Seconds())), exe, "revert", "-id", sa.ID)
+			if err == nil {
+				sa.Timer = safeApplyRevertUnit
+				return nil
+			}
+			fmt.Printf("Warning: systemd-run failed, using a background process: %v\n", err)
+		}
+	}
+
+	cmd := VerboseCommand(exe, "revert", "-id", sa.ID, "-after", timeout.String())
+	// Its own session, so the timer survives the SSH connection dropping
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// disarm stops the timer and removes the state
+func (sa *SafeApply) disarm() {
+	if sa.Timer != "" {
+		VerboseCommandRun("systemctl", "stop", sa.Timer+".timer")
+	}
+	os.RemoveAll(safeApplyDir)
+	ActiveSafeApply = nil
+}
+
+// Finish runs the self-test once the setup is done. A failing self-test
+// reverts right away; in self-test mode a passing one confirms.
+func (sa *SafeApply) Finish(facts *Facts) {
+	ran, err := sa.selfTest()
+	switch {
+	case err != nil:
+		fmt.Printf("SSH self-test failed: %v\n", err)
+		fmt.Println("Reverting SSH and firewall changes")
+		if err := sa.Revert(facts); err != nil {
+			fmt.Printf("Error: revert failed: %v\n", err)
+		}
+	case ran && sa.Mode == "self-test":
+		fmt.Printf("SSH self-test passed on port %d\n", sa.NewPort)
+		if err := sa.Confirm(facts); err != nil {
+			fmt.Printf("Error: confirm failed: %v\n", err)
+		}
+	default:
+		fmt.Printf("SSH listens on port %d", sa.NewPort)
+		if old := sa.oldPorts(); len(old) > 0 {
+			fmt.Printf(" and, until confirmed, on %s", joinPorts(old))
+		}
+		fmt.Println()
+		fmt.Printf("Log in on port %d from a new session and run `setupsuite confirm` before %s,\n", sa.NewPort, sa.Deadline.Format("15:04:05"))
+		fmt.Println("otherwise the SSH and firewall changes are reverted.")
+	}
+}
+
+// selfTest logs in as the SSH user on the new port from localhost with a
+// throwaway key. It reports whether the test could run at all.
+func (sa *SafeApply) selfTest() (bool, error) {
+	if sa.SSHUser == "" || sa.NewPort == 0 {
+		fmt.Println("Skipping SSH self-test: no ssh_user or ssh_port")
+		return false, nil
+	}
+	for _, tool := range []string{"ssh", "ssh-keygen"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			fmt.Printf("Skipping SSH self-test: %s is not installed\n", tool)
+			return false, nil
+		}
+	}
+	original, err := readAuthorizedKeysFile(sa.SSHUser)
+	if err != nil {
+		fmt.Printf("Skipping SSH self-test: %v\n", err)
+		return false, nil
+	}
+
+	keyPath := filepath.Join(safeApplyDir, "self-test")
+	os.Remove(keyPath)
+	os.Remove(keyPath + ".pub")
+	if err := VerboseCommandRun("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "setupsuite-self-test", "-f", keyPath); err != nil {
+		fmt.Printf("Skipping SSH self-test: could not generate a test key: %v\n", err)
+		return false, nil
+	}
+	defer os.Remove(keyPath)
+	defer os.Remove(keyPath + ".pub")
+	publicKey, err := ioutil.ReadFile(keyPath + ".pub")
+	if err != nil {
+		return false, err
+	}
+
+	// The test key is only authorized for the duration of the test
+	content := string(original)
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	if err := writeAuthorizedKeysFile(sa.SSHUser, content+string(publicKey)); err != nil {
+		return false, err
+	}
+	defer writeAuthorizedKeysFile(sa.SSHUser, string(original))
+
+	output, err := exec.Command("ssh", "-i", keyPath, "-p", strconv.Itoa(sa.NewPort),
+		"-o", "BatchMode=yes", "-o", "IdentitiesOnly=yes", "-o", "ConnectTimeout=10",
+		"-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null",
+		sa.SSHUser+"@127.0.0.1", "true").CombinedOutput()
+	VerboseLogger.LogCommandOutput("ssh", []string{sa.SSHUser + "@127.0.0.1"}, output, err)
+	if err != nil {
+		return true, fmt.Errorf("cannot log in as %s on port %d: %s", sa.SSHUser, sa.NewPort, lastLine(string(output)))
+	}
+	return true, nil
+}
+
+// Confirm closes the old SSH ports and keeps the new configuration
+func (sa *SafeApply) Confirm(facts *Facts) error {
+	if len(sa.oldPorts()) > 0 {
+		err := updateFile(sshdSettingsPath(), func(content string) string {
+			return removeManagedBlock(content, "safe-apply")
+		})
+		if err != nil {
+			return err
+		}
+		if err := VerboseCommandRun("sshd", "-t"); err != nil {
+			return fmt.Errorf("sshd configuration test failed: %v", err)
+		}
+		restartSSHD(facts)
+	}
+
+	if sa.FirewallBackend != "" && sa.DesiredRules != nil {
+		fw, err := NewFirewall(sa.FirewallBackend, facts)
+		if err != nil {
+			return err
+		}
+		if err := applyFirewallRules(fw, sa.DesiredRules); err != nil {
+			return err
+		}
+	}
+
+	sa.disarm()
+	fmt.Printf("Confirmed: SSH listens on port %d\n", sa.NewPort)
+	return nil
+}
+
+// Revert restores the snapshot of sshd and the firewall
+func (sa *SafeApply) Revert(facts *Facts) error {
+	if err := restoreFiles(sa.Files); err != nil {
+		return err
+	}
+	restartSSHD(facts)
+
+	if sa.FirewallBackend != "" {
+		fw, err := NewFirewall(sa.FirewallBackend, facts)
+		if err != nil {
+			return err
+		}
+		// The previous SSH ports must stay reachable whatever the rules were
+		rules := append(append([]FirewallRule(nil), sa.PreviousRules...), portRules(sa.PreviousPorts)...)
+		if err := applyFirewallRules(fw, rules); err != nil {
+			return err
+		}
+	}
+
+	sa.disarm()
+	fmt.Printf("Reverted: SSH listens on port %s again\n", joinPorts(sa.PreviousPorts))
+	return nil
+}
+
+// currentSSHPorts returns the ports sshd listens on, 22 if unknown
+func currentSSHPorts() []int {
+	if output, err := VerboseCommandOutput("sshd", "-T"); err == nil {
+		if ports := parseSSHDPorts(string(output)); len(ports) > 0 {
+			return ports
+		}
+	}
+	if data, err := ioutil.ReadFile(sshdConfigPath); err == nil {
+		if ports := parseSSHDPorts(string(data)); len(ports) > 0 {
+			return ports
+		}
+	}
+	return []int{22}
+}
+
+// parseSSHDPorts reads the Port lines of sshd_config or `sshd -T`
+func parseSSHDPorts(content string) []int {
+	var ports []int
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.EqualFold(fields[0], "port") {
+			continue
+		}
+		if port, err := strconv.Atoi(fields[1]); err == nil {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+func joinPorts(ports []int) string {
+	var parts []string
+	for _, port := range ports {
+		parts = append(parts, strconv.Itoa(port))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// snapshotFiles copies each path into dir, recording the ones that are missing
+func snapshotFiles(dir string, paths []string) ([]snapshotFile, error) {
+	var files []snapshotFile
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			files = append(files, snapshotFile{Path: path})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		backup := filepath.Join(dir, strconv.Itoa(i))
+		if err := ioutil.WriteFile(backup, data, 0600); err != nil {
+			return nil, err
+		}
+		files = append(files, snapshotFile{Path: path, Exists: true, Mode: info.Mode().Perm(), Backup: backup})
+	}
+	return files, nil
+}
+
+// restoreFiles puts the snapshot back, removing files that did not exist
+func restoreFiles(files []snapshotFile) error {
+	for _, file := range files {
+		if !file.Exists {
+			if err := os.Remove(file.Path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		data, err := ioutil.ReadFile(file.Backup)
+		if err != nil {
+			return err
+		}
+		if err := VerboseWriteFile(file.Path, string(data)); err != nil {
+			return err
+		}
+		if err := os.Chmod(file.Path, file.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
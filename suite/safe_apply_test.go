@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"suite/suite/config"
+)
+
+func TestParseSSHDPorts(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{content: "port 22\naddressfamily any\n", want: "22"},
+		{content: "Port 22022\n# BEGIN SetupSuite safe-apply\nPort 22\n# END SetupSuite safe-apply\n", want: "22022, 22"},
+		{content: "#Port 22\nPermitRootLogin no\n", want: ""},
+	}
+	for _, tt := range tests {
+		if got := joinPorts(parseSSHDPorts(tt.content)); got != tt.want {
+			t.Errorf("parseSSHDPorts(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestSafeApplySSHDPortsBlock(t *testing.T) {
+	sa := &SafeApply{NewPort: 22022, PreviousPorts: []int{22, 22022}}
+	want := "# BEGIN SetupSuite safe-apply\nPort 22\n# END SetupSuite safe-apply\n"
+	if got := sa.sshdPortsBlock(); got != want {
+		t.Errorf("sshdPortsBlock() = %q, want %q", got, want)
+	}
+
+	config := "Port 22022\n" + want + "PermitRootLogin no\n"
+	if got := removeManagedBlock(config, "safe-apply"); got != "Port 22022\nPermitRootLogin no\n" {
+		t.Errorf("removeManagedBlock() = %q", got)
+	}
+
+	unchanged := &SafeApply{NewPort: 22, PreviousPorts: []int{22}}
+	if got := unchanged.sshdPortsBlock(); got != "" {
+		t.Errorf("sshdPortsBlock() without a port change = %q, want empty", got)
+	}
+}
+
+func TestSnapshotAndRestoreFiles(t *testing.T) {
+	InitLogger(false)
+
+	dir, err := ioutil.TempDir("", "setupsuite-safe-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	existing := filepath.Join(dir, "sshd_config")
+	missing := filepath.Join(dir, "sshd_config.backup")
+	ioutil.WriteFile(existing, []byte("Port 22\n"), 0640)
+	backups := filepath.Join(dir, "files")
+	os.Mkdir(backups, 0700)
+
+	files, err := snapshotFiles(backups, []string{existing, missing})
+	if err != nil {
+		t.Fatalf("snapshotFiles() error = %v", err)
+	}
+
+	ioutil.WriteFile(existing, []byte("Port 22022\n"), 0644)
+	ioutil.WriteFile(missing, []byte("Port 22\n"), 0644)
+
+	if err := restoreFiles(files); err != nil {
+		t.Fatalf("restoreFiles() error = %v", err)
+	}
+	data, _ := ioutil.ReadFile(existing)
+	info, _ := os.Stat(existing)
+	if string(data) != "Port 22\n" || info.Mode().Perm() != 0640 {
+		t.Errorf("restored %s = %q with mode %v", existing, data, info.Mode().Perm())
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("%s should have been removed", missing)
+	}
+}
+
+func TestSafeApplyState(t *testing.T) {
+	InitLogger(false)
+
+	dir, err := ioutil.TempDir("", "setupsuite-safe-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { safeApplyDir = old }(safeApplyDir)
+	safeApplyDir = filepath.Join(dir, "safe-apply")
+
+	if sa, err := LoadSafeApply(); sa != nil || err != nil {
+		t.Fatalf("LoadSafeApply() without state = %v, %v", sa, err)
+	}
+
+	saved := &SafeApply{
+		ID:              "abc",
+		Mode:            "confirm",
+		NewPort:         22022,
+		PreviousPorts:   []int{22},
+		FirewallBackend: "ufw",
+		PreviousRules:   []FirewallRule{{Port: 22, Protocol: "tcp"}},
+	}
+	if err := saved.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	loaded, err := LoadSafeApply()
+	if err != nil || loaded == nil {
+		t.Fatalf("LoadSafeApply() = %v, %v", loaded, err)
+	}
+	if loaded.ID != "abc" || loaded.FirewallBackend != "ufw" || ruleStrings(loaded.PreviousRules) != "22/tcp" {
+		t.Errorf("LoadSafeApply() = %+v", loaded)
+	}
+	if got := joinPorts(loaded.oldPorts()); got != "22" {
+		t.Errorf("oldPorts() = %q, want 22", got)
+	}
+
+	loaded.disarm()
+	if _, err := os.Stat(safeApplyDir); !os.IsNotExist(err) {
+		t.Error("disarm() left the state directory")
+	}
+}
+
+func TestBeginSafeApplyRejectsUnknownMode(t *testing.T) {
+	_, err := BeginSafeApply(&config.SetupSecure{SSHSafeApply: "yes"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "confirm or self-test") {
+		t.Errorf("BeginSafeApply() error = %v", err)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"suite/suite/config"
+)
+
+// ToolSpec is a single tool requested from a secondary installer
+type ToolSpec struct {
+	Name    string
+	Version string
+}
+
+func (t ToolSpec) String() string {
+	if t.Version == "" {
+		return t.Name
+	}
+	return t.Name + "@" + t.Version
+}
+
+// InstallScope selects where a secondary installer puts its tools. The zero
+// value is the system scope.
+type InstallScope struct {
+	User string
+	Home string
+}
+
+// IsUser reports whether tools are installed for a single user
+func (s InstallScope) IsUser() bool {
+	return s.User != ""
+}
+
+// Command builds a command that runs as the scope's user with their home
+func (s InstallScope) Command(name string, args ...string) *exec.Cmd {
+	if !s.IsUser() {
+		return VerboseCommand(name, args...)
+	}
+	cmd := VerboseCommand("runuser", append([]string{"-u", s.User, "--", name}, args...)...)
+	cmd.Env = append(os.Environ(), "HOME="+s.Home, "USER="+s.User)
+	return cmd
+}
+
+// run executes a command in the scope and includes its output in errors
+func (s InstallScope) run(name string, args ...string) error {
+	cmd := s.Command(name, args...)
+	output, err := cmd.CombinedOutput()
+	VerboseLogger.LogCommandOutput(name, args, output, err)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, lastLine(string(output)))
+	}
+	return nil
+}
+
+// output executes a command in the scope and returns its standard output
+func (s InstallScope) output(name string, args ...string) (string, error) {
+	cmd := s.Command(name, args...)
+	output, err := cmd.Output()
+	VerboseLogger.LogCommandOutput(name, args, output, err)
+	return string(output), err
+}
+
+// SecondaryInstaller installs tools from a language or application ecosystem
+type SecondaryInstaller interface {
+	GetName() string
+	// Binary is the command the installer needs on PATH
+	Binary() string
+	ParseSpec(entry string) ToolSpec
+	// Installed returns the installed version, or false if the tool is missing
+	Installed(spec ToolSpec, scope InstallScope) (string, bool)
+	Install(spec ToolSpec, scope InstallScope) error
+}
+
+// PipInstaller installs Python packages with pip
+type PipInstaller struct{}
+
+func (i *PipInstaller) GetName() string { return "pip" }
+func (i *PipInstaller) Binary() string  { return "pip3" }
+
+func (i *PipInstaller) ParseSpec(entry string) ToolSpec {
+	parts := strings.SplitN(entry, "==", 2)
+	spec := ToolSpec{Name: strings.TrimSpace(parts[0])}
+	if len(parts) == 2 {
+		spec.Version = strings.TrimSpace(parts[1])
+	}
+	return spec
+}
+
+func (i *PipInstaller) Installed(spec ToolSpec, scope InstallScope) (string, bool) {
+	output, err := scope.output("pip3", "show", spec.Name)
+	if err != nil {
+		return "", false
+	}
+	return parsePipShowVersion(output)
+}
+
+func (i *PipInstaller) Install(spec ToolSpec, scope InstallScope) error {
+	target := spec.Name
+	if spec.Version != "" {
+		target += "==" + spec.Version
+	}
+	args := []string{"install", "--upgrade"}
+	if scope.IsUser() {
+		args = append(args, "--user")
+	}
+	return scope.run("pip3", append(args, target)...)
+}
+
+// NpmInstaller installs global npm packages
+type NpmInstaller struct{}
+
+func (i *NpmInstaller) GetName() string { return "npm" }
+func (i *NpmInstaller) Binary() string  { return "npm" }
+
+func (i *NpmInstaller) ParseSpec(entry string) ToolSpec {
+	// Scoped packages start with @, so only a later @ separates the version
+	if idx := strings.LastIndex(entry, "@"); idx > 0 {
+		return ToolSpec{Name: entry[:idx], Version: entry[idx+1:]}
+	}
+	return ToolSpec{Name: entry}
+}
+
+func (i *NpmInstaller) prefixArgs(scope InstallScope) []string {
+	if scope.IsUser() {
+		return []string{"--prefix", filepath.Join(scope.Home, ".local")}
+	}
+	return nil
+}
+
+func (i *NpmInstaller) Installed(spec ToolSpec, scope InstallScope) (string, bool) {
+	args := append([]string{"ls", "-g", "--depth=0", "--json"}, i.prefixArgs(scope)...)
+	// npm ls exits non-zero for unrelated problems but still prints the tree
+	output, _ := scope.output("npm", args...)
+	return parseNpmListVersion(output, spec.Name)
+}
+
+func (i *NpmInstaller) Install(spec ToolSpec, scope InstallScope) error {
+	args := append([]string{"install", "-g"}, i.prefixArgs(scope)...)
+	return scope.run("npm", append(args, spec.String())...)
+}
+
+// CargoInstaller installs Rust binaries with cargo install
+type CargoInstaller struct{}
+
+func (i *CargoInstaller) GetName() string { return "cargo" }
+func (i *CargoInstaller) Binary() string  { return "cargo" }
+
+func (i *CargoInstaller) ParseSpec(entry string) ToolSpec {
+	parts := strings.SplitN(entry, "@", 2)
+	spec := ToolSpec{Name: parts[0]}
+	if len(parts) == 2 {
+		spec.Version = strings.TrimPrefix(parts[1], "v")
+	}
+	return spec
+}
+
+func (i *CargoInstaller) rootArgs(scope InstallScope) []string {
+	if scope.IsUser() {
+		return nil
+	}
+	return []string{"--root", "/usr/local"}
+}
+
+func (i *CargoInstaller) Installed(spec ToolSpec, scope InstallScope) (string, bool) {
+	output, err := scope.output("cargo", append([]string{"install", "--list"}, i.rootArgs(scope)...)...)
+	if err != nil {
+		return "", false
+	}
+	return parseCargoListVersion(output, spec.Name)
+}
+
+func (i *CargoInstaller) Install(spec ToolSpec, scope InstallScope) error {
+	args := append([]string{"install", "--locked"}, i.rootArgs(scope)...)
+	if spec.Version != "" {
+		args = append(args, "--version", spec.Version)
+	}
+	return scope.run("cargo", append(args, spec.Name)...)
+}
+
+// GoInstaller installs Go binaries with go install
+type GoInstaller struct{}
+
+func (i *GoInstaller) GetName() string { return "go" }
+func (i *GoInstaller) Binary() string  { return "go" }
+
+func (i *GoInstaller) ParseSpec(entry string) ToolSpec {
+	parts := strings.SplitN(entry, "@", 2)
+	spec := ToolSpec{Name: parts[0], Version: "latest"}
+	if len(parts) == 2 {
+		spec.Version = parts[1]
+	}
+	return spec
+}
+
+func (i *GoInstaller) binDir(scope InstallScope) string {
+	if scope.IsUser() {
+		return filepath.Join(scope.Home, "go", "bin")
+	}
+	return "/usr/local/bin"
+}
+
+func (i *GoInstaller) Installed(spec ToolSpec, scope InstallScope) (string, bool) {
+	binary := filepath.Join(i.binDir(scope), goBinaryName(spec.Name))
+	if _, err := os.Stat(binary); err != nil {
+		return "", false
+	}
+	output, err := VerboseCommandOutput("go", "version", "-m", binary)
+	if err != nil {
+		return "", true
+	}
+	return parseGoVersionModule(string(output)), true
+}
+
+func (i *GoInstaller) Install(spec ToolSpec, scope InstallScope) error {
+	cmd := scope.Command("go", "install", spec.Name+"@"+spec.Version)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, "GOBIN="+i.binDir(scope))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("go install %s: %v: %s", spec, err, lastLine(string(output)))
+	}
+	return nil
+}
+
+// SnapInstaller installs snaps. Snaps are always installed system wide.
+type SnapInstaller struct{}
+
+func (i *SnapInstaller) GetName() string { return "snap" }
+func (i *SnapInstaller) Binary() string  { return "snap" }
+
+// ParseSpec reads "name" or "name@channel", for example "hugo@latest/stable"
+func (i *SnapInstaller) ParseSpec(entry string) ToolSpec {
+	parts := strings.SplitN(entry, "@", 2)
+	spec := ToolSpec{Name: parts[0]}
+	if len(parts) == 2 {
+		spec.Version = parts[1]
+		// snap list reports a bare risk level as latest/<risk>
+		if !strings.Contains(spec.Version, "/") {
+			spec.Version = "latest/" + spec.Version
+		}
+	}
+	return spec
+}
+
+func (i *SnapInstaller) Installed(spec ToolSpec, scope InstallScope) (string, bool) {
+	output, err := VerboseCommandOutput("snap", "list", spec.Name)
+	if err != nil {
+		return "", false
+	}
+	return parseSnapListTracking(string(output), spec.Name)
+}
+
+func (i *SnapInstaller) Install(spec ToolSpec, scope InstallScope) error {
+	action := "install"
+	if _, ok := i.Installed(spec, scope); ok {
+		action = "refresh"
+	}
+	args := []string{action, spec.Name}
+	if spec.Version != "" {
+		args = append(args, "--channel="+spec.Version)
+	}
+
+	err := InstallScope{}.run("snap", args...)
+	if err != nil && strings.Contains(err.Error(), "classic confinement") {
+		return InstallScope{}.run("snap", append(args, "--classic")...)
+	}
+	return err
+}
+
+// FlatpakInstaller installs Flatpak applications from flathub
+type FlatpakInstaller struct{}
+
+func (i *FlatpakInstaller) GetName() string { return "flatpak" }
+func (i *FlatpakInstaller) Binary() string  { return "flatpak" }
+
+// ParseSpec reads "app.id" or "app.id@branch"
+func (i *FlatpakInstaller) ParseSpec(entry string) ToolSpec {
+	parts := strings.SplitN(entry, "@", 2)
+	spec := ToolSpec{Name: parts[0]}
+	if len(parts) == 2 {
+		spec.Version = parts[1]
+	}
+	return spec
+}
+
+func (i *FlatpakInstaller) scopeFlag(scope InstallScope) string {
+	if scope.IsUser() {
+		return "--user"
+	}
+	return "--system"
+}
+
+func (i *FlatpakInstaller) ref(spec ToolSpec) string {
+	if spec.Version == "" {
+		return spec.Name
+	}
+	return spec.Name + "//" + spec.Version
+}
+
+func (i *FlatpakInstaller) Installed(spec ToolSpec, scope InstallScope) (string, bool) {
+	if _, err := scope.output("flatpak", "info", i.scopeFlag(scope), i.ref(spec)); err != nil {
+		return "", false
+	}
+	return spec.Version, true
+}
+
+func (i *FlatpakInstaller) Install(spec ToolSpec, scope InstallScope) error {
+	return scope.run("flatpak", "install", "-y", "--noninteractive", i.scopeFlag(scope), "flathub", i.ref(spec))
+}
+
+// InstallSecondaryTools installs the language-level tools listed in the config
+func InstallSecondaryTools(cfg *config.InstallTools) error {
+	groups := []struct {
+		installer SecondaryInstaller
+		entries   []string
+	}{
+		{&PipInstaller{}, cfg.Pip},
+		{&NpmInstaller{}, cfg.NpmGlobal},
+		{&CargoInstaller{}, cfg.Cargo},
+		{&GoInstaller{}, cfg.Go},
+		{&SnapInstaller{}, cfg.Snap},
+		{&FlatpakInstaller{}, cfg.Flatpak},
+	}
+
+	scope, err := resolveInstallScope(cfg)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, group := range groups {
+		for _, entry := range group.entries {
+			if err := installSecondaryTool(group.installer, entry, scope); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+				failed = append(failed, group.installer.GetName()+":"+entry)
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to install %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// installSecondaryTool installs a single entry unless the wanted version is already present
+func installSecondaryTool(installer SecondaryInstaller, entry string, scope InstallScope) error {
+	spec := installer.ParseSpec(entry)
+	if spec.Name == "" {
+		return fmt.Errorf("invalid %s entry %q", installer.GetName(), entry)
+	}
+
+	if ActiveBundle != nil {
+		return fmt.Errorf("cannot install %s %s in offline mode: it needs network access", installer.GetName(), spec)
+	}
+
+	if _, err := exec.LookPath(installer.Binary()); err != nil {
+		return fmt.Errorf("cannot install %s %s: %s not found, add it to tools", installer.GetName(), spec, installer.Binary())
+	}
+
+	if version, ok := installer.Installed(spec, scope); ok {
+		if spec.Version == "" || spec.Version == "latest" || spec.Version == version {
+			fmt.Printf("%s %s already installed (%s)\n", installer.GetName(), spec.Name, version)
+			return nil
+		}
+		fmt.Printf("%s %s: installed %s, want %s\n", installer.GetName(), spec.Name, version, spec.Version)
+	}
+
+	fmt.Printf("Installing %s %s\n", installer.GetName(), spec)
+	if err := installer.Install(spec, scope); err != nil {
+		return fmt.Errorf("failed to install %s %s: %v", installer.GetName(), spec, err)
+	}
+	return nil
+}
+
+func resolveInstallScope(cfg *config.InstallTools) (InstallScope, error) {
+	switch cfg.Scope {
+	case "", "system":
+		return InstallScope{}, nil
+	case "user":
+		if cfg.User == "" {
+			return InstallScope{}, fmt.Errorf("install_tools scope user requires a user")
+		}
+		u, err := user.Lookup(cfg.User)
+		if err != nil {
+			return InstallScope{}, fmt.Errorf("install_tools user %s: %v", cfg.User, err)
+		}
+		return InstallScope{User: u.Username, Home: u.HomeDir}, nil
+	default:
+		return InstallScope{}, fmt.Errorf("unknown install_tools scope: %s", cfg.Scope)
+	}
+}
+
+func parsePipShowVersion(output string) (string, bool) {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "Version:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Version:")), true
+		}
+	}
+	return "", false
+}
+
+func parseNpmListVersion(output, name string) (string, bool) {
+	var tree struct {
+		Dependencies map[string]struct {
+			Version string `json:"version"`
+		} `json:"dependencies"`
+	}
+	if err := json.Unmarshal([]byte(output), &tree); err != nil {
+		return "", false
+	}
+	dep, ok := tree.Dependencies[name]
+	return dep.Version, ok
+}
+
+var cargoListLine = regexp.MustCompile(`^(\S+) v(\S+?):?$`)
+
+func parseCargoListVersion(output, name string) (string, bool) {
+	for _, line := range strings.Split(output, "\n") {
+		// ripgrep v13.0.0:
+		if m := cargoListLine.FindStringSubmatch(strings.TrimSpace(line)); m != nil && m[1] == name {
+			return m[2], true
+		}
+	}
+	return "", false
+}
+
+// parseGoVersionModule returns the main module version from `go version -m`
+func parseGoVersionModule(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "mod" {
+			return fields[2]
+		}
+	}
+	return ""
+}
+
+// parseSnapListTracking returns the channel an installed snap tracks
+func parseSnapListTracking(output, name string) (string, bool) {
+	// Name  Version  Rev  Tracking  Publisher  Notes
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[0] == name {
+			return fields[3], true
+		}
+	}
+	return "", false
+}
+
+// goBinaryName returns the binary go install produces for a package path
+func goBinaryName(pkg string) string {
+	base := path.Base(pkg)
+	if regexp.MustCompile(`^v[0-9]+$`).MatchString(base) {
+		base = path.Base(path.Dir(pkg))
+	}
+	return base
+}
+
+// lastLine returns the last non-empty line of command output
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSecondaryInstallerParseSpec(t *testing.T) {
+	tests := []struct {
+		name      string
+		installer SecondaryInstaller
+		entry     string
+		want      ToolSpec
+	}{
+		{"pip unpinned", &PipInstaller{}, "virtualenv", ToolSpec{Name: "virtualenv"}},
+		{"pip pinned", &PipInstaller{}, "black==23.1.0", ToolSpec{Name: "black", Version: "23.1.0"}},
+		{"npm pinned", &NpmInstaller{}, "typescript@5.3.2", ToolSpec{Name: "typescript", Version: "5.3.2"}},
+		{"npm scoped", &NpmInstaller{}, "@angular/cli", ToolSpec{Name: "@angular/cli"}},
+		{"npm scoped pinned", &NpmInstaller{}, "@angular/cli@17.0.0", ToolSpec{Name: "@angular/cli", Version: "17.0.0"}},
+		{"cargo pinned", &CargoInstaller{}, "ripgrep@v13.0.0", ToolSpec{Name: "ripgrep", Version: "13.0.0"}},
+		{"go default latest", &GoInstaller{}, "golang.org/x/tools/gopls", ToolSpec{Name: "golang.org/x/tools/gopls", Version: "latest"}},
+		{"go pinned", &GoInstaller{}, "golang.org/x/tools/gopls@v0.14.2", ToolSpec{Name: "golang.org/x/tools/gopls", Version: "v0.14.2"}},
+		{"snap channel", &SnapInstaller{}, "hugo@extended/stable", ToolSpec{Name: "hugo", Version: "extended/stable"}},
+		{"snap risk", &SnapInstaller{}, "hugo@edge", ToolSpec{Name: "hugo", Version: "latest/edge"}},
+		{"flatpak branch", &FlatpakInstaller{}, "org.gimp.GIMP@stable", ToolSpec{Name: "org.gimp.GIMP", Version: "stable"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.installer.ParseSpec(tt.entry)
+			if got != tt.want {
+				t.Errorf("ParseSpec(%q) = %+v, want %+v", tt.entry, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstalledVersionParsers(t *testing.T) {
+	if v, ok := parsePipShowVersion("Name: black\nVersion: 23.1.0\nSummary: formatter\n"); !ok || v != "23.1.0" {
+		t.Errorf("parsePipShowVersion() = %s, %v", v, ok)
+	}
+
+	npm := `{"dependencies": {"typescript": {"version": "5.3.2"}, "@angular/cli": {"version": "17.0.0"}}}`
+	if v, ok := parseNpmListVersion(npm, "@angular/cli"); !ok || v != "17.0.0" {
+		t.Errorf("parseNpmListVersion() = %s, %v", v, ok)
+	}
+	if _, ok := parseNpmListVersion(npm, "eslint"); ok {
+		t.Error("parseNpmListVersion() found a missing package")
+	}
+
+	cargo := "bat v0.24.0:\n    bat\nripgrep v13.0.0:\n    rg\n"
+	if v, ok := parseCargoListVersion(cargo, "ripgrep"); !ok || v != "13.0.0" {
+		t.Errorf("parseCargoListVersion() = %s, %v", v, ok)
+	}
+
+	goVersion := "/usr/local/bin/gopls: go1.21.5\n\tpath\tgolang.org/x/tools/gopls\n\tmod\tgolang.org/x/tools/gopls\tv0.14.2\th1:abc=\n"
+	if v := parseGoVersionModule(goVersion); v != "v0.14.2" {
+		t.Errorf("parseGoVersionModule() = %s, want v0.14.2", v)
+	}
+
+	snap := "Name  Version  Rev    Tracking       Publisher  Notes\nhugo  0.121.1  18000  latest/stable  hugo       -\n"
+	if v, ok := parseSnapListTracking(snap, "hugo"); !ok || v != "latest/stable" {
+		t.Errorf("parseSnapListTracking() = %s, %v", v, ok)
+	}
+}
+
+func TestGoBinaryName(t *testing.T) {
+	tests := map[string]string{
+		"golang.org/x/tools/gopls":                            "gopls",
+		"github.com/golangci/golangci-lint/cmd/golangci-lint": "golangci-lint",
+		"github.com/example/tool/v2":                          "tool",
+	}
+	for pkg, want := range tests {
+		if got := goBinaryName(pkg); got != want {
+			t.Errorf("goBinaryName(%s) = %s, want %s", pkg, got, want)
+		}
+	}
+}
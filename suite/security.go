@@ -7,145 +7,46 @@ import (
 )
 
 // setupBasicSecurity handles the basic security configuration
-func setupBasicSecurity(cfg *config.SetupSecure) error {
+func setupBasicSecurity(cfg *config.SetupSecure, facts *Facts) error {
 	VerboseLogger.LogInfo("Starting basic security setup")
 
 	if cfg == nil {
 		return fmt.Errorf("security config is nil")
 	}
 
-	// Add user
-	if cfg.SSHUser != "" {
-		fmt.Printf("Adding user %s\n", cfg.SSHUser)
-		VerboseLogger.LogInfo("Creating user: %s", cfg.SSHUser)
-
-		err := VerboseCommandRun("adduser", "--disabled-password", "--gecos", "", cfg.SSHUser)
-		if err != nil {
-			VerboseLogger.LogWarning("Error adding user: %s", err)
-			fmt.Printf("Warning: Error adding user: %s\n", err)
-		}
-
-		// Group add
-		fmt.Println("Adding group sshuser")
-		VerboseCommandRun("groupadd", "sshuser")
-
-		// Usermod
-		fmt.Println("Adding user to group")
-		VerboseCommandRun("usermod", "-aG", "sshuser", cfg.SSHUser)
-
-		// Add to sudo
-		fmt.Println("Configuring sudo")
-		sudoCmd := fmt.Sprintf("echo '%s ALL=(ALL:ALL) ALL' | EDITOR='tee -a' visudo", cfg.SSHUser)
-		VerboseCommandRun("sh", "-c", sudoCmd)
-
-		// Setup SSH keys
-		if cfg.UserSSHRSA != "" && cfg.UserSSHRSA != "REPLACE_WITH_YOUR_SSH_KEY" {
-			setupSSHKeys(cfg.SSHUser, cfg.UserSSHRSA)
-		}
-	}
-
 	// Configure SSH daemon
-	if cfg.SSHPort > 0 {
-		configureSSHD(cfg.SSHPort)
+	if cfg.SSHPort > 0 || cfg.SSH != nil || cfg.SSHCA != nil {
+		if err := configureSSHD(cfg, facts); err != nil {
+			return fmt.Errorf("ssh configuration failed: %v", err)
+		}
 	}
 
 	// Setup root bashrc
 	setupRootBashrc()
 
 	// Update system
-	fmt.Println("Updating system")
-	VerboseLogger.LogInfo("Starting system update")
-	VerboseCommandRun("apt-get", "update")
-	VerboseCommandRun("apt-get", "upgrade", "-y")
+	if ActiveBundle != nil {
+		fmt.Println("Skipping system update in offline mode")
+		VerboseLogger.LogInfo("Skipping system update in offline mode")
+	} else if facts.PackageManager != "apt" {
+		fmt.Printf("Skipping system upgrade: not supported with %s yet\n", facts.PackageManager)
+		VerboseLogger.LogWarning("Skipping system upgrade with package manager %s", facts.PackageManager)
+	} else {
+		fmt.Println("Updating system")
+		VerboseLogger.LogInfo("Starting system update")
+		// Fresh cloud images often run unattended-upgrades right after boot
+		apt := &DebianPackageManager{}
+		if err := runLocked(apt, "apt-get", append(aptLockArgs(), "update")...); err != nil {
+			fmt.Printf("Warning: System update failed: %v\n", err)
+		} else if err := runLocked(apt, "apt-get", append(aptLockArgs(), "upgrade", "-y")...); err != nil {
+			fmt.Printf("Warning: System upgrade failed: %v\n", err)
+		}
+	}
 
 	VerboseLogger.LogInfo("Basic security setup completed")
 	return nil
 }
 
-func setupSSHKeys(user, sshKey string) {
-	VerboseLogger.LogInfo("Setting up SSH keys for user: %s", user)
-
-	homeDir := "/home/" + user
-	sshDir := homeDir + "/.ssh"
-
-	// Create .ssh directory
-	VerboseLogger.LogInfo("Creating SSH directory: %s", sshDir)
-	VerboseMkdirAll(sshDir, 0700)
-
-	// Create authorized_keys file
-	authKeys := sshDir + "/authorized_keys"
-	VerboseLogger.LogInfo("Creating authorized_keys file: %s", authKeys)
-	file, err := VerboseOpenFile(authKeys, os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
-		VerboseLogger.LogError("Error creating authorized_keys: %s", err)
-		fmt.Printf("Error creating authorized_keys: %s\n", err)
-		return
-	}
-	defer file.Close()
-
-	VerboseWriteString(file, sshKey+"\n")
-
-	// Set ownership and permissions
-	VerboseLogger.LogInfo("Setting ownership and permissions for SSH files")
-	VerboseCommandRun("chown", "-R", user+":"+user, sshDir)
-	VerboseCommandRun("chmod", "700", sshDir)
-	VerboseCommandRun("chmod", "600", authKeys)
-
-	// Copy to root for security backup
-	rootSshDir := "/root/.ssh"
-	VerboseLogger.LogInfo("Creating backup in root SSH directory: %s", rootSshDir)
-	VerboseMkdirAll(rootSshDir, 0700)
-	VerboseCommandRun("cp", authKeys, rootSshDir+"/authorized_keys_copied_due_to_security")
-}
-
-func configureSSHD(port int) {
-	fmt.Printf("Configuring SSH daemon on port %d\n", port)
-	VerboseLogger.LogInfo("Configuring SSH daemon on port %d", port)
-
-	// Backup original sshd_config
-	VerboseLogger.LogInfo("Backing up original sshd_config")
-	VerboseCommandRun("cp", "/etc/ssh/sshd_config", "/etc/ssh/sshd_config.backup")
-
-	// Create new sshd_config
-	sshdConfig := fmt.Sprintf(`# SetupSuite generated SSH configuration
-Port %d
-PermitRootLogin no
-AllowGroups sshuser
-PubkeyAuthentication yes
-PasswordAuthentication no
-PermitEmptyPasswords no
-ChallengeResponseAuthentication no
-UsePAM yes
-X11Forwarding yes
-PrintMotd no
-AcceptEnv LANG LC_*
-Subsystem sftp /usr/lib/openssh/sftp-server
-
-# Include original config for other settings
-Include /etc/ssh/sshd_config.backup
-`, port)
-
-	VerboseLogger.LogInfo("Writing new SSH configuration")
-	file, err := VerboseCreate("/etc/ssh/sshd_config")
-	if err == nil {
-		VerboseWriteString(file, sshdConfig)
-		file.Close()
-
-		// Test configuration and restart SSH
-		VerboseLogger.LogInfo("Testing SSH configuration")
-		if VerboseCommandRun("sshd", "-t") == nil {
-			VerboseLogger.LogInfo("SSH configuration test passed, restarting SSH service")
-			VerboseCommandRun("systemctl", "restart", "sshd")
-		} else {
-			fmt.Println("SSH configuration test failed, reverting...")
-			VerboseLogger.LogError("SSH configuration test failed, reverting to backup")
-			VerboseCommandRun("mv", "/etc/ssh/sshd_config.backup", "/etc/ssh/sshd_config")
-		}
-	} else {
-		VerboseLogger.LogError("Failed to create SSH config file: %s", err)
-	}
-}
-
 func setupRootBashrc() {
 	fmt.Println("Configuring root bashrc")
 	VerboseLogger.LogInfo("Configuring root bashrc")
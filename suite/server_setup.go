@@ -6,11 +6,13 @@ import (
 	"os/exec"
 	"strings"
 	"suite/suite/config"
+	"text/template"
 )
 
 // ServerSetup handles different server setup types
 type ServerSetup struct {
 	Config *config.ServerConfig
+	Facts  *Facts
 }
 
 // SetupWebServer configures a web server with Nginx and SSL
@@ -25,11 +27,8 @@ func (s *ServerSetup) SetupWebServer() error {
 	}
 
 	// Install and configure Nginx
-	if err := sm.Enable("nginx"); err != nil {
-		fmt.Printf("Warning: Could not enable nginx: %v\n", err)
-	}
-	if err := sm.Start("nginx"); err != nil {
-		fmt.Printf("Warning: Could not start nginx: %v\n", err)
+	if err := EnableAndStart(sm, ResolveService(s.Facts, "nginx")); err != nil {
+		return err
 	}
 
 	// Configure basic nginx site
@@ -84,10 +83,7 @@ func (s *ServerSetup) SetupDockerHost() error {
 	s.setupDockerDaemon()
 
 	// Enable and start Docker
-	sm.Enable("docker")
-	sm.Start("docker")
-
-	return nil
+	return EnableAndStart(sm, ResolveService(s.Facts, "docker"))
 }
 
 // SetupProxyServer configures a reverse proxy server
@@ -105,8 +101,9 @@ func (s *ServerSetup) SetupProxyServer() error {
 	s.setupNginxProxy()
 
 	// Enable and start Nginx
-	sm.Enable("nginx")
-	sm.Start("nginx")
+	if err := EnableAndStart(sm, ResolveService(s.Facts, "nginx")); err != nil {
+		return err
+	}
 
 	// Setup SSL if domain and email are provided
 	if s.Config.SetupSecure.Config.Domain != "" && s.Config.SetupSecure.Config.Email != "" {
@@ -134,35 +131,62 @@ func (s *ServerSetup) SetupBuildServer() error {
 	// Install Node.js LTS
 	s.installNodeJS()
 
-	// Setup Python virtual environment tools
-	exec.Command("pip3", "install", "virtualenv").Run()
+	// Setup Python virtual environment tools, offline the bundled package
+	if ActiveBundle == nil {
+		if err := installSecondaryTool(&PipInstaller{}, "virtualenv", InstallScope{}); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
 
 	// Enable Docker if service manager is available
 	if sm != nil {
-		sm.Enable("docker")
-		sm.Start("docker")
+		if err := EnableAndStart(sm, ResolveService(s.Facts, "docker")); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (s *ServerSetup) setupNginxSite(domain string) {
-	nginxConfig := fmt.Sprintf(`server {
+// templateData is passed to every configuration template
+type templateData struct {
+	Config *config.ServerConfig
+	Facts  *Facts
+	Domain string
+}
+
+// renderTemplate renders a configuration template with the host facts
+func (s *ServerSetup) renderTemplate(name, text string, domain string) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = tmpl.Execute(&b, templateData{Config: s.Config, Facts: s.Facts, Domain: domain})
+	return b.String(), err
+}
+
+const nginxSiteTemplate = `server {
     listen 80;
-    server_name %s www.%s;
+    server_name {{.Domain}} www.{{.Domain}};
     
     root /var/www/html;
-    index index.html index.htm index.nginx-debian.html;
+    index index.html index.htm{{if .Facts.Distro.IsLike "debian"}} index.nginx-debian.html{{end}};
     
     location / {
         try_files $uri $uri/ =404;
     }
-}`, domain, domain)
+}`
+
+func (s *ServerSetup) setupNginxSite(domain string) {
+	nginxConfig, err := s.renderTemplate("nginx-site", nginxSiteTemplate, domain)
+	if err != nil {
+		fmt.Printf("Warning: Could not render nginx site: %v\n", err)
+		return
+	}
 
 	configPath := "/etc/nginx/sites-available/" + domain
-	if file, err := os.Create(configPath); err == nil {
-		file.WriteString(nginxConfig)
-		file.Close()
+	if err := VerboseWriteFile(configPath, nginxConfig); err == nil {
 
 		// Enable site
 		linkPath := "/etc/nginx/sites-enabled/" + domain
@@ -176,7 +200,7 @@ func (s *ServerSetup) setupNginxSite(domain string) {
 
 		// Reload nginx using service manager
 		if sm, err := NewServiceManager(); err == nil {
-			sm.Reload("nginx")
+			sm.Reload(ResolveService(s.Facts, "nginx"))
 		} else {
 			exec.Command("systemctl", "reload", "nginx").Run()
 		}
@@ -186,6 +210,12 @@ func (s *ServerSetup) setupNginxSite(domain string) {
 func (s *ServerSetup) setupSSL(domain, email string) {
 	fmt.Printf("Setting up SSL for %s...\n", domain)
 
+	if ActiveBundle != nil {
+		fmt.Println("Skipping certbot: Let's Encrypt needs network access and is unavailable in offline mode")
+		fmt.Println("Install a certificate manually and reference it in the nginx site configuration")
+		return
+	}
+
 	// Use certbot to get SSL certificate
 	cmd := exec.Command("certbot", "--nginx", "-d", domain, "-d", "www."+domain,
 		"--non-interactive", "--agree-tos", "--email", email, "--redirect")
@@ -202,27 +232,13 @@ func (s *ServerSetup) setupMySQL() error {
 		return err
 	}
 
-	// Detect distribution to handle MySQL service names
-	distro, _, _ := DetectDistribution()
-	serviceName := "mysql"
-
-	switch distro {
-	case "rhel", "centos", "fedora":
-		serviceName = "mysqld"
-	case "alpine":
-		serviceName = "mariadb"
-	default:
-		serviceName = "mysql"
-	}
+	serviceName := ResolveService(s.Facts, "mysql")
 
 	// Secure MySQL installation (non-interactive)
 	exec.Command("mysql_secure_installation").Run()
 
 	// Enable and start MySQL
-	sm.Enable(serviceName)
-	sm.Start(serviceName)
-
-	return nil
+	return EnableAndStart(sm, serviceName)
 }
 
 func (s *ServerSetup) setupPostgreSQL() error {
@@ -235,24 +251,10 @@ func (s *ServerSetup) setupPostgreSQL() error {
 		return err
 	}
 
-	// Detect distribution to handle PostgreSQL service names
-	distro, _, _ := DetectDistribution()
-	serviceName := "postgresql"
-
-	switch distro {
-	case "rhel", "centos", "fedora":
-		serviceName = "postgresql"
-	case "alpine":
-		serviceName = "postgresql"
-	default:
-		serviceName = "postgresql"
-	}
+	serviceName := ResolveService(s.Facts, "postgres")
 
 	// Enable and start PostgreSQL
-	sm.Enable(serviceName)
-	sm.Start(serviceName)
-
-	return nil
+	return EnableAndStart(sm, serviceName)
 }
 
 func (s *ServerSetup) setupDockerDaemon() {
@@ -270,13 +272,13 @@ func (s *ServerSetup) setupDockerDaemon() {
 	// Create /etc/docker directory if it doesn't exist
 	os.MkdirAll("/etc/docker", 0755)
 
-	if file, err := os.Create("/etc/docker/daemon.json"); err == nil {
-		file.WriteString(daemonConfig)
-		file.Close()
+	if err := VerboseWriteFile("/etc/docker/daemon.json", daemonConfig); err == nil {
 
 		// Restart Docker to apply changes
 		if sm, err := NewServiceManager(); err == nil {
-			sm.Restart("docker")
+			if err := RestartAndVerify(sm, ResolveService(s.Facts, "docker")); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+			}
 		} else {
 			exec.Command("systemctl", "restart", "docker").Run()
 		}
@@ -305,9 +307,7 @@ server {
 }`
 
 	configPath := "/etc/nginx/sites-available/proxy"
-	if file, err := os.Create(configPath); err == nil {
-		file.WriteString(nginxConfig)
-		file.Close()
+	if err := VerboseWriteFile(configPath, nginxConfig); err == nil {
 
 		// Enable site
 		linkPath := "/etc/nginx/sites-enabled/proxy"
@@ -321,56 +321,58 @@ server {
 func (s *ServerSetup) installNodeJS() {
 	fmt.Println("Installing Node.js LTS...")
 
-	// Detect distribution for appropriate installation method
-	distro, _, err := DetectDistribution()
-	if err != nil {
-		fmt.Printf("Warning: Could not detect distribution: %v\n", err)
+	// NodeSource needs the network; offline the role packages brought the
+	// distro's nodejs and npm from the bundle
+	if ActiveBundle != nil {
 		return
 	}
 
-	switch distro {
-	case "ubuntu", "debian":
+	// Pick the installation method for the distribution
+	distro := s.Facts.Distro
+	switch {
+	case distro.IsLike("ubuntu", "debian"):
 		// Install NodeSource repository for Debian/Ubuntu
 		exec.Command("curl", "-fsSL", "https://deb.nodesource.com/setup_lts.x", "|", "bash", "-").Run()
 		exec.Command("apt-get", "install", "-y", "nodejs").Run()
-	case "rhel", "centos", "fedora":
+	case distro.IsLike("rhel", "centos", "fedora"):
 		// Use NodeSource for RHEL-based systems
 		exec.Command("curl", "-fsSL", "https://rpm.nodesource.com/setup_lts.x", "|", "bash", "-").Run()
-		pm, _ := DetectPackageManager()
-		if pm != nil {
+		if pm, err := s.Facts.Packages(); err == nil {
 			pm.Install([]string{"nodejs"})
 		}
-	case "arch":
+	case distro.IsLike("arch"):
 		// Use official Arch repositories
-		pm, _ := DetectPackageManager()
-		if pm != nil {
+		if pm, err := s.Facts.Packages(); err == nil {
 			pm.Install([]string{"nodejs", "npm"})
 		}
-	case "alpine":
+	case distro.IsLike("alpine"):
 		// Use Alpine repositories
-		pm, _ := DetectPackageManager()
-		if pm != nil {
+		if pm, err := s.Facts.Packages(); err == nil {
 			pm.Install([]string{"nodejs", "npm"})
 		}
 	default:
-		fmt.Printf("Warning: Node.js installation not configured for distribution: %s\n", distro)
+		fmt.Printf("Warning: Node.js installation not configured for distribution: %s\n", distro.ID)
 		fmt.Println("Please install Node.js manually")
 	}
 }
 
-// InstallPackages installs system packages using the detected package manager
-func InstallPackages(packages []string) error {
+// InstallPackages installs system packages using the package manager
+// detected with the host facts
+func InstallPackages(facts *Facts, packages []string) error {
 	if len(packages) == 0 {
 		fmt.Println("No packages to install")
 		return nil
 	}
 
-	// Detect the package manager
-	pm, err := DetectPackageManager()
+	pm, err := facts.Packages()
 	if err != nil {
 		return fmt.Errorf("failed to detect package manager: %v", err)
 	}
 
+	if ActiveBundle != nil {
+		return installPackagesOffline(pm, packages)
+	}
+
 	fmt.Printf("Installing packages using %s: %s\n", pm.GetName(), strings.Join(packages, ", "))
 
 	// Update package list
@@ -388,91 +390,24 @@ func InstallPackages(packages []string) error {
 	return nil
 }
 
-// ConfigureFirewall sets up firewall rules using the detected firewall manager
-func ConfigureFirewall(ports []int) error {
-	if len(ports) == 0 {
-		fmt.Println("No firewall ports to configure")
-		return nil
+// installPackagesOffline installs packages from the active offline bundle
+func installPackagesOffline(pm PackageManager, packages []string) error {
+	offlinePM, ok := pm.(OfflinePackageManager)
+	if !ok {
+		return fmt.Errorf("package manager %s does not support offline installation", pm.GetName())
 	}
 
-	// Detect firewall manager
-	fwManager, err := GetFirewallManager()
-	if err != nil {
-		fmt.Printf("Warning: %v. Skipping firewall configuration.\n", err)
-		return nil
-	}
-
-	fmt.Printf("Configuring firewall using %s...\n", fwManager)
-
-	switch fwManager {
-	case "ufw":
-		return configureUFW(ports)
-	case "firewalld":
-		return configureFirewalld(ports)
-	case "iptables":
-		return configureIptables(ports)
-	default:
-		return fmt.Errorf("unsupported firewall manager: %s", fwManager)
-	}
-}
-
-func configureUFW(ports []int) error {
-	// Reset UFW to defaults
-	exec.Command("ufw", "--force", "reset").Run()
-
-	// Set default policies
-	exec.Command("ufw", "default", "deny", "incoming").Run()
-	exec.Command("ufw", "default", "allow", "outgoing").Run()
-
-	// Open specified ports
-	for _, port := range ports {
-		fmt.Printf("Opening port %d (UFW)\n", port)
-		exec.Command("ufw", "allow", fmt.Sprintf("%d", port)).Run()
-	}
-
-	// Enable UFW
-	exec.Command("ufw", "--force", "enable").Run()
-	return nil
-}
-
-func configureFirewalld(ports []int) error {
-	// Start firewalld if not running
-	exec.Command("systemctl", "start", "firewalld").Run()
-	exec.Command("systemctl", "enable", "firewalld").Run()
-
-	// Open specified ports
-	for _, port := range ports {
-		fmt.Printf("Opening port %d (firewalld)\n", port)
-		exec.Command("firewall-cmd", "--permanent", "--add-port", fmt.Sprintf("%d/tcp", port)).Run()
+	for _, pkg := range packages {
+		if !ActiveBundle.HasPackage(pkg) {
+			return fmt.Errorf("package %s is not part of the offline bundle", pkg)
+		}
 	}
 
-	// Reload firewall rules
-	exec.Command("firewall-cmd", "--reload").Run()
-	return nil
-}
-
-func configureIptables(ports []int) error {
-	// Flush existing rules (be careful!)
-	exec.Command("iptables", "-F").Run()
-
-	// Set default policies
-	exec.Command("iptables", "-P", "INPUT", "DROP").Run()
-	exec.Command("iptables", "-P", "FORWARD", "DROP").Run()
-	exec.Command("iptables", "-P", "OUTPUT", "ACCEPT").Run()
-
-	// Allow loopback
-	exec.Command("iptables", "-A", "INPUT", "-i", "lo", "-j", "ACCEPT").Run()
-
-	// Allow established connections
-	exec.Command("iptables", "-A", "INPUT", "-m", "state", "--state", "ESTABLISHED,RELATED", "-j", "ACCEPT").Run()
-
-	// Open specified ports
-	for _, port := range ports {
-		fmt.Printf("Opening port %d (iptables)\n", port)
-		exec.Command("iptables", "-A", "INPUT", "-p", "tcp", "--dport", fmt.Sprintf("%d", port), "-j", "ACCEPT").Run()
+	fmt.Printf("Installing packages from bundle using %s: %s\n", pm.GetName(), strings.Join(packages, ", "))
+	if err := offlinePM.InstallFromDir(ActiveBundle.PackagesDir(), packages); err != nil {
+		return fmt.Errorf("failed to install packages with %s: %v", pm.GetName(), err)
 	}
 
-	// Save rules (distribution-specific)
-	exec.Command("iptables-save").Run() // Basic save, may need distribution-specific handling
+	fmt.Println("Package installation completed successfully")
 	return nil
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// serviceRoot is prefixed to every path probed for service definitions
+var serviceRoot = "/"
+
+// serviceCatalogEntry lists the service names a distribution family uses,
+// most likely first. A name ending in "-*" matches versioned services such as
+// postgresql-16 and resolves to the newest one installed.
+type serviceCatalogEntry struct {
+	distros []string // matched with DistroFacts.IsLike, empty matches any
+	names   []string
+}
+
+// serviceCatalog maps logical services to their concrete names. Entries are
+// tried in order and the first one matching the distribution is used.
+var serviceCatalog = map[string][]serviceCatalogEntry{
+	"ssh": {
+		{distros: []string{"debian", "ubuntu"}, names: []string{"ssh", "sshd"}},
+		{names: []string{"sshd", "ssh"}},
+	},
+	"mysql": {
+		{distros: []string{"rhel", "centos", "fedora"}, names: []string{"mysqld", "mariadb"}},
+		{distros: []string{"alpine", "arch", "opensuse", "suse", "void"}, names: []string{"mariadb", "mysqld", "mysql"}},
+		{names: []string{"mysql", "mariadb", "mysqld"}},
+	},
+	"postgres": {
+		// PGDG packages install postgresql-<major> next to the distro's postgresql
+		{distros: []string{"rhel", "centos", "fedora", "gentoo"}, names: []string{"postgresql-*", "postgresql"}},
+		{names: []string{"postgresql", "postgresql-*"}},
+	},
+	"nginx": {
+		{names: []string{"nginx"}},
+	},
+	"docker": {
+		{names: []string{"docker"}},
+	},
+	"cron": {
+		{distros: []string{"debian", "ubuntu"}, names: []string{"cron"}},
+		{distros: []string{"rhel", "centos", "fedora", "alpine"}, names: []string{"crond", "cronie"}},
+		{distros: []string{"arch", "gentoo", "void"}, names: []string{"cronie", "crond"}},
+		{names: []string{"cron", "crond", "cronie"}},
+	},
+	"firewalld": {
+		{names: []string{"firewalld"}},
+	},
+}
+
+// ResolveService returns the concrete service name for a logical service on
+// this host. Names whose service definition exists win; if none is installed
+// yet the distribution's usual name is returned. Unknown logical names are
+// returned unchanged.
+func ResolveService(facts *Facts, logical string) string {
+	var distro DistroFacts
+	initSystem := ""
+	if facts != nil {
+		distro = facts.Distro
+		initSystem = facts.InitSystem
+	}
+	if initSystem == "" {
+		initSystem = detectInitSystem()
+	}
+
+	names := catalogNames(distro, logical)
+	if names == nil {
+		return logical
+	}
+
+	dirs := serviceDefinitionDirs(initSystem)
+	for _, name := range names {
+		if found := findServiceDefinition(dirs, name); found != "" {
+			return found
+		}
+	}
+
+	for _, name := range names {
+		if !strings.HasSuffix(name, "-*") {
+			return name
+		}
+	}
+	return strings.TrimSuffix(names[0], "-*")
+}
+
+// catalogNames returns the candidate names for the distribution
+func catalogNames(distro DistroFacts, logical string) []string {
+	for _, entry := range serviceCatalog[logical] {
+		if len(entry.distros) == 0 || distro.IsLike(entry.distros...) {
+			return entry.names
+		}
+	}
+	return nil
+}
+
+// serviceDefinition describes where an init system keeps service definitions
+type serviceDefinition struct {
+	dir    string
+	suffix string
+}
+
+func serviceDefinitionDirs(initSystem string) []serviceDefinition {
+	switch initSystem {
+	case "systemd":
+		return []serviceDefinition{
+			{dir: "etc/systemd/system", suffix: ".service"},
+			{dir: "run/systemd/system", suffix: ".service"},
+			{dir: "usr/lib/systemd/system", suffix: ".service"},
+			{dir: "lib/systemd/system", suffix: ".service"},
+		}
+	case "runit":
+		return []serviceDefinition{{dir: "etc/sv"}}
+	case "s6":
+		return []serviceDefinition{{dir: "etc/s6/sv"}, {dir: "etc/s6/adminsv"}}
+	default:
+		return []serviceDefinition{{dir: "etc/init.d"}}
+	}
+}
+
+// findServiceDefinition returns name if a definition for it exists. For a
+// "-*" pattern it returns the newest installed version.
+func findServiceDefinition(dirs []serviceDefinition, name string) string {
+	var matches []string
+	for _, def := range dirs {
+		pattern := filepath.Join(serviceRoot, def.dir, name+def.suffix)
+		if !strings.HasSuffix(name, "-*") {
+			if _, err := os.Stat(pattern); err == nil {
+				return name
+			}
+			continue
+		}
+		paths, _ := filepath.Glob(pattern)
+		for _, path := range paths {
+			match := strings.TrimSuffix(filepath.Base(path), def.suffix)
+			// postgresql-16 but not helpers like postgresql-setup
+			if _, err := serviceVersion(match); err == nil {
+				matches = append(matches, match)
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return ""
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		vi, _ := serviceVersion(matches[i])
+		vj, _ := serviceVersion(matches[j])
+		return vi > vj
+	})
+	return matches[0]
+}
+
+// serviceVersion returns the numeric suffix of a versioned service name
+func serviceVersion(name string) (float64, error) {
+	return strconv.ParseFloat(name[strings.LastIndex(name, "-")+1:], 64)
+}
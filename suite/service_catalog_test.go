@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveService(t *testing.T) {
+	debian := DistroFacts{ID: "debian"}
+	ubuntu := DistroFacts{ID: "ubuntu", IDLike: []string{"debian"}}
+	rocky := DistroFacts{ID: "rocky", IDLike: []string{"rhel", "centos", "fedora"}}
+	alpine := DistroFacts{ID: "alpine"}
+	arch := DistroFacts{ID: "arch"}
+
+	tests := []struct {
+		name       string
+		distro     DistroFacts
+		initSystem string
+		files      []string
+		logical    string
+		want       string
+	}{
+		{name: "debian ssh", distro: debian, initSystem: "systemd", files: []string{"lib/systemd/system/ssh.service"}, logical: "ssh", want: "ssh"},
+		{name: "ubuntu ssh not installed", distro: ubuntu, initSystem: "systemd", logical: "ssh", want: "ssh"},
+		{name: "rocky ssh", distro: rocky, initSystem: "systemd", files: []string{"usr/lib/systemd/system/sshd.service"}, logical: "ssh", want: "sshd"},
+		{name: "alpine ssh", distro: alpine, initSystem: "openrc", files: []string{"etc/init.d/sshd"}, logical: "ssh", want: "sshd"},
+		{name: "rocky mariadb installed", distro: rocky, initSystem: "systemd", files: []string{"usr/lib/systemd/system/mariadb.service"}, logical: "mysql", want: "mariadb"},
+		{name: "rocky mysql not installed", distro: rocky, initSystem: "systemd", logical: "mysql", want: "mysqld"},
+		{name: "debian mysql", distro: debian, initSystem: "systemd", files: []string{"lib/systemd/system/mysql.service"}, logical: "mysql", want: "mysql"},
+		{
+			name:       "rocky pgdg postgres",
+			distro:     rocky,
+			initSystem: "systemd",
+			files: []string{
+				"usr/lib/systemd/system/postgresql-15.service",
+				"usr/lib/systemd/system/postgresql-16.service",
+				"usr/lib/systemd/system/postgresql-setup.service",
+			},
+			logical: "postgres",
+			want:    "postgresql-16",
+		},
+		{name: "rocky distro postgres", distro: rocky, initSystem: "systemd", files: []string{"usr/lib/systemd/system/postgresql.service"}, logical: "postgres", want: "postgresql"},
+		{name: "debian postgres", distro: debian, initSystem: "systemd", files: []string{"lib/systemd/system/postgresql.service"}, logical: "postgres", want: "postgresql"},
+		{name: "postgres not installed", distro: rocky, initSystem: "systemd", logical: "postgres", want: "postgresql"},
+		{name: "arch cron", distro: arch, initSystem: "systemd", files: []string{"usr/lib/systemd/system/cronie.service"}, logical: "cron", want: "cronie"},
+		{name: "alpine cron", distro: alpine, initSystem: "openrc", files: []string{"etc/init.d/crond"}, logical: "cron", want: "crond"},
+		{name: "unknown service", distro: debian, initSystem: "systemd", logical: "redis-server", want: "redis-server"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "setupsuite-services")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			for _, file := range tt.files {
+				path := filepath.Join(root, file)
+				os.MkdirAll(filepath.Dir(path), 0755)
+				if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			oldRoot := serviceRoot
+			serviceRoot = root
+			defer func() { serviceRoot = oldRoot }()
+
+			facts := &Facts{Distro: tt.distro, InitSystem: tt.initSystem}
+			if got := ResolveService(facts, tt.logical); got != tt.want {
+				t.Errorf("ResolveService(%q) = %q, want %q", tt.logical, got, tt.want)
+			}
+		})
+	}
+}
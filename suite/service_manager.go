@@ -1,119 +1,670 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
-// ServiceManager handles service operations across different init systems
-type ServiceManager struct {
-	manager string
+// serviceStartTimeout is how long setup steps wait for a service to come up
+var serviceStartTimeout = 30 * time.Second
+
+// serviceWaitPollInterval is how often WaitActive checks the service again
+var serviceWaitPollInterval = 500 * time.Millisecond
+
+// ServiceState is the structured state of a service
+type ServiceState struct {
+	Name    string `json:"name"`
+	Active  bool   `json:"active"`
+	Enabled bool   `json:"enabled"`
+	Masked  bool   `json:"masked"`
+	// State is the init system's own description, e.g. "running" or "failed"
+	State string `json:"state"`
+}
+
+func (s ServiceState) String() string {
+	enabled := "disabled"
+	switch {
+	case s.Masked:
+		enabled = "masked"
+	case s.Enabled:
+		enabled = "enabled"
+	}
+	active := "inactive"
+	if s.Active {
+		active = "active"
+	}
+	if s.State != "" {
+		return fmt.Sprintf("%s, %s (%s)", enabled, active, s.State)
+	}
+	return fmt.Sprintf("%s, %s", enabled, active)
+}
+
+// ServiceManager handles service operations for one init system
+type ServiceManager interface {
+	GetName() string
+	Enable(serviceName string) error
+	Disable(serviceName string) error
+	Start(serviceName string) error
+	Stop(serviceName string) error
+	Restart(serviceName string) error
+	Reload(serviceName string) error
+	// Mask prevents a service from being started, manually or as a dependency
+	Mask(serviceName string) error
+	// Unmask undoes Mask so the service can be enabled again
+	Unmask(serviceName string) error
+	IsActive(serviceName string) bool
+	IsEnabled(serviceName string) bool
+	Status(serviceName string) (ServiceState, error)
+	// DaemonReload makes the init system pick up changed service definitions
+	DaemonReload() error
+	// WaitActive blocks until the service is active or the timeout expires
+	WaitActive(ctx context.Context, serviceName string, timeout time.Duration) error
 }
 
 // NewServiceManager creates a service manager based on detected init system
-func NewServiceManager() (*ServiceManager, error) {
+func NewServiceManager() (ServiceManager, error) {
+	if sm := serviceManagerForInit(detectInitSystem()); sm != nil {
+		return sm, nil
+	}
+
+	// pid 1 was not recognised, e.g. inside a container: probe the tools
 	manager, err := GetServiceManager()
 	if err != nil {
 		return nil, err
 	}
-	return &ServiceManager{manager: manager}, nil
-}
-
-// Enable enables a service
-func (sm *ServiceManager) Enable(serviceName string) error {
-	fmt.Printf("Enabling service %s using %s\n", serviceName, sm.manager)
-
-	switch sm.manager {
+	switch manager {
 	case "systemctl":
-		return exec.Command("systemctl", "enable", serviceName).Run()
-	case "service":
-		// For SysV init, enable usually means adding to runlevels
-		return exec.Command("chkconfig", serviceName, "on").Run()
+		return &SystemdServiceManager{}, nil
 	case "rc-service":
-		// For OpenRC (Alpine)
-		return exec.Command("rc-update", "add", serviceName, "default").Run()
+		return &OpenRCServiceManager{}, nil
 	default:
-		return fmt.Errorf("unsupported service manager: %s", sm.manager)
+		return &SysVServiceManager{}, nil
 	}
 }
 
-// Start starts a service
-func (sm *ServiceManager) Start(serviceName string) error {
-	fmt.Printf("Starting service %s using %s\n", serviceName, sm.manager)
+// serviceManagerForInit returns the service manager for an init system name
+func serviceManagerForInit(initSystem string) ServiceManager {
+	switch initSystem {
+	case "systemd":
+		return &SystemdServiceManager{}
+	case "openrc":
+		return &OpenRCServiceManager{}
+	case "runit":
+		return &RunitServiceManager{}
+	case "s6":
+		return &S6ServiceManager{}
+	case "sysvinit":
+		return &SysVServiceManager{}
+	}
+	return nil
+}
 
-	switch sm.manager {
-	case "systemctl":
-		return exec.Command("systemctl", "start", serviceName).Run()
-	case "service":
-		return exec.Command("service", serviceName, "start").Run()
-	case "rc-service":
-		return exec.Command("rc-service", serviceName, "start").Run()
-	default:
-		return fmt.Errorf("unsupported service manager: %s", sm.manager)
+// waitActive polls IsActive until the service is up or the timeout expires
+func waitActive(ctx context.Context, sm ServiceManager, serviceName string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		if sm.IsActive(serviceName) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			state, err := sm.Status(serviceName)
+			if err != nil {
+				return fmt.Errorf("%s did not become active within %s", serviceName, timeout)
+			}
+			return fmt.Errorf("%s did not become active within %s: %s", serviceName, timeout, state)
+		case <-time.After(serviceWaitPollInterval):
+		}
 	}
 }
 
-// Restart restarts a service
-func (sm *ServiceManager) Restart(serviceName string) error {
-	fmt.Printf("Restarting service %s using %s\n", serviceName, sm.manager)
+// EnableAndStart enables and starts a service and verifies that it came up
+func EnableAndStart(sm ServiceManager, serviceName string) error {
+	if err := sm.Enable(serviceName); err != nil {
+		fmt.Printf("Warning: Could not enable %s: %v\n", serviceName, err)
+	}
+	if err := sm.Start(serviceName); err != nil {
+		fmt.Printf("Warning: Could not start %s: %v\n", serviceName, err)
+	}
+	return sm.WaitActive(context.Background(), serviceName, serviceStartTimeout)
+}
 
-	switch sm.manager {
-	case "systemctl":
-		return exec.Command("systemctl", "restart", serviceName).Run()
-	case "service":
-		return exec.Command("service", serviceName, "restart").Run()
-	case "rc-service":
-		return exec.Command("rc-service", serviceName, "restart").Run()
-	default:
-		return fmt.Errorf("unsupported service manager: %s", sm.manager)
+// RestartAndVerify restarts a service and verifies that it came back up
+func RestartAndVerify(sm ServiceManager, serviceName string) error {
+	if err := sm.Restart(serviceName); err != nil {
+		fmt.Printf("Warning: Could not restart %s: %v\n", serviceName, err)
 	}
+	return sm.WaitActive(context.Background(), serviceName, serviceStartTimeout)
 }
 
-// Stop stops a service
-func (sm *ServiceManager) Stop(serviceName string) error {
-	fmt.Printf("Stopping service %s using %s\n", serviceName, sm.manager)
+// SystemdServiceManager manages services with systemctl
+type SystemdServiceManager struct{}
 
-	switch sm.manager {
-	case "systemctl":
-		return exec.Command("systemctl", "stop", serviceName).Run()
-	case "service":
-		return exec.Command("service", serviceName, "stop").Run()
-	case "rc-service":
-		return exec.Command("rc-service", serviceName, "stop").Run()
-	default:
-		return fmt.Errorf("unsupported service manager: %s", sm.manager)
+func (sm *SystemdServiceManager) GetName() string { return "systemd" }
+
+func (sm *SystemdServiceManager) systemctl(action, serviceName string) error {
+	fmt.Printf("%s service %s using systemd\n", serviceActions[action], serviceName)
+	return VerboseCommandRun("systemctl", action, serviceName)
+}
+
+func (sm *SystemdServiceManager) Enable(serviceName string) error {
+	return sm.systemctl("enable", serviceName)
+}
+
+func (sm *SystemdServiceManager) Disable(serviceName string) error {
+	return sm.systemctl("disable", serviceName)
+}
+
+func (sm *SystemdServiceManager) Start(serviceName string) error {
+	return sm.systemctl("start", serviceName)
+}
+
+func (sm *SystemdServiceManager) Stop(serviceName string) error {
+	return sm.systemctl("stop", serviceName)
+}
+
+func (sm *SystemdServiceManager) Restart(serviceName string) error {
+	return sm.systemctl("restart", serviceName)
+}
+
+func (sm *SystemdServiceManager) Reload(serviceName string) error {
+	return sm.systemctl("reload", serviceName)
+}
+
+func (sm *SystemdServiceManager) Mask(serviceName string) error {
+	fmt.Printf("Masking service %s using systemd\n", serviceName)
+	return VerboseCommandRun("systemctl", "mask", "--now", serviceName)
+}
+
+func (sm *SystemdServiceManager) Unmask(serviceName string) error {
+	fmt.Printf("Unmasking service %s using systemd\n", serviceName)
+	return VerboseCommandRun("systemctl", "unmask", serviceName)
+}
+
+func (sm *SystemdServiceManager) IsActive(serviceName string) bool {
+	return exec.Command("systemctl", "is-active", "--quiet", serviceName).Run() == nil
+}
+
+func (sm *SystemdServiceManager) IsEnabled(serviceName string) bool {
+	return exec.Command("systemctl", "is-enabled", "--quiet", serviceName).Run() == nil
+}
+
+func (sm *SystemdServiceManager) Status(serviceName string) (ServiceState, error) {
+	output, err := VerboseCommandOutput("systemctl", "show", serviceName,
+		"--property=LoadState,ActiveState,SubState,UnitFileState")
+	if err != nil {
+		return ServiceState{Name: serviceName}, err
 	}
+	return parseSystemdShow(serviceName, string(output)), nil
 }
 
-// Reload reloads a service configuration
-func (sm *ServiceManager) Reload(serviceName string) error {
-	fmt.Printf("Reloading service %s using %s\n", serviceName, sm.manager)
+func (sm *SystemdServiceManager) DaemonReload() error {
+	return VerboseCommandRun("systemctl", "daemon-reload")
+}
 
-	switch sm.manager {
-	case "systemctl":
-		return exec.Command("systemctl", "reload", serviceName).Run()
-	case "service":
-		return exec.Command("service", serviceName, "reload").Run()
-	case "rc-service":
-		return exec.Command("rc-service", serviceName, "reload").Run()
-	default:
-		return fmt.Errorf("unsupported service manager: %s", sm.manager)
+func (sm *SystemdServiceManager) WaitActive(ctx context.Context, serviceName string, timeout time.Duration) error {
+	return waitActive(ctx, sm, serviceName, timeout)
+}
+
+// parseSystemdShow reads `systemctl show --property=...` output
+func parseSystemdShow(serviceName, output string) ServiceState {
+	props := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if parts := strings.SplitN(strings.TrimSpace(line), "=", 2); len(parts) == 2 {
+			props[parts[0]] = parts[1]
+		}
+	}
+
+	state := ServiceState{
+		Name:   serviceName,
+		Active: props["ActiveState"] == "active" || props["ActiveState"] == "reloading",
+		Masked: props["LoadState"] == "masked" || strings.HasPrefix(props["UnitFileState"], "masked"),
+		State:  props["SubState"],
+	}
+	switch props["UnitFileState"] {
+	case "enabled", "enabled-runtime", "static", "alias", "indirect", "generated":
+		state.Enabled = true
+	}
+	if props["ActiveState"] == "failed" {
+		state.State = "failed"
 	}
+	return state
 }
 
-// IsActive checks if a service is active
-func (sm *ServiceManager) IsActive(serviceName string) bool {
-	switch sm.manager {
-	case "systemctl":
-		err := exec.Command("systemctl", "is-active", "--quiet", serviceName).Run()
-		return err == nil
-	case "service":
-		err := exec.Command("service", serviceName, "status").Run()
-		return err == nil
-	case "rc-service":
-		err := exec.Command("rc-service", serviceName, "status").Run()
-		return err == nil
-	default:
+// SysVServiceManager manages SysV init scripts
+type SysVServiceManager struct{}
+
+func (sm *SysVServiceManager) GetName() string { return "sysvinit" }
+
+func (sm *SysVServiceManager) service(action, serviceName string) error {
+	fmt.Printf("%s service %s using sysvinit\n", serviceActions[action], serviceName)
+	return VerboseCommandRun("service", serviceName, action)
+}
+
+func (sm *SysVServiceManager) Enable(serviceName string) error {
+	fmt.Printf("Enabling service %s using sysvinit\n", serviceName)
+	// For SysV init, enable means adding the script to the runlevels
+	if _, err := exec.LookPath("chkconfig"); err == nil {
+		return VerboseCommandRun("chkconfig", serviceName, "on")
+	}
+	if err := VerboseCommandRun("update-rc.d", serviceName, "defaults"); err != nil {
+		return err
+	}
+	return VerboseCommandRun("update-rc.d", serviceName, "enable")
+}
+
+func (sm *SysVServiceManager) Disable(serviceName string) error {
+	fmt.Printf("Disabling service %s using sysvinit\n", serviceName)
+	if _, err := exec.LookPath("chkconfig"); err == nil {
+		return VerboseCommandRun("chkconfig", serviceName, "off")
+	}
+	return VerboseCommandRun("update-rc.d", serviceName, "disable")
+}
+
+func (sm *SysVServiceManager) Start(serviceName string) error {
+	return sm.service("start", serviceName)
+}
+
+func (sm *SysVServiceManager) Stop(serviceName string) error { return sm.service("stop", serviceName) }
+
+func (sm *SysVServiceManager) Restart(serviceName string) error {
+	return sm.service("restart", serviceName)
+}
+
+func (sm *SysVServiceManager) Reload(serviceName string) error {
+	return sm.service("reload", serviceName)
+}
+
+// Mask stops and disables the service and removes the execute bit from its
+// init script, which is the closest SysV init has to masking
+func (sm *SysVServiceManager) Mask(serviceName string) error {
+	sm.Stop(serviceName)
+	if err := sm.Disable(serviceName); err != nil {
+		return err
+	}
+	return os.Chmod(filepath.Join("/etc/init.d", serviceName), 0644)
+}
+
+func (sm *SysVServiceManager) Unmask(serviceName string) error {
+	return os.Chmod(filepath.Join("/etc/init.d", serviceName), 0755)
+}
+
+func (sm *SysVServiceManager) IsActive(serviceName string) bool {
+	return exec.Command("service", serviceName, "status").Run() == nil
+}
+
+func (sm *SysVServiceManager) IsEnabled(serviceName string) bool {
+	if _, err := exec.LookPath("chkconfig"); err == nil {
+		return exec.Command("chkconfig", serviceName).Run() == nil
+	}
+	links, _ := filepath.Glob(filepath.Join("/etc/rc2.d", "S??"+serviceName))
+	return len(links) > 0
+}
+
+func (sm *SysVServiceManager) Status(serviceName string) (ServiceState, error) {
+	state := ServiceState{
+		Name:    serviceName,
+		Active:  sm.IsActive(serviceName),
+		Enabled: sm.IsEnabled(serviceName),
+	}
+	if info, err := os.Stat(filepath.Join("/etc/init.d", serviceName)); err == nil && info.Mode()&0111 == 0 {
+		state.Masked = true
+	}
+	state.State = "stopped"
+	if state.Active {
+		state.State = "running"
+	}
+	return state, nil
+}
+
+func (sm *SysVServiceManager) DaemonReload() error { return nil }
+
+func (sm *SysVServiceManager) WaitActive(ctx context.Context, serviceName string, timeout time.Duration) error {
+	return waitActive(ctx, sm, serviceName, timeout)
+}
+
+// OpenRCServiceManager manages OpenRC services (Alpine, Gentoo)
+type OpenRCServiceManager struct{}
+
+func (sm *OpenRCServiceManager) GetName() string { return "openrc" }
+
+func (sm *OpenRCServiceManager) rcService(action, serviceName string) error {
+	fmt.Printf("%s service %s using openrc\n", serviceActions[action], serviceName)
+	return VerboseCommandRun("rc-service", serviceName, action)
+}
+
+func (sm *OpenRCServiceManager) Enable(serviceName string) error {
+	fmt.Printf("Enabling service %s using openrc\n", serviceName)
+	return VerboseCommandRun("rc-update", "add", serviceName, "default")
+}
+
+func (sm *OpenRCServiceManager) Disable(serviceName string) error {
+	fmt.Printf("Disabling service %s using openrc\n", serviceName)
+	return VerboseCommandRun("rc-update", "del", serviceName, "default")
+}
+
+func (sm *OpenRCServiceManager) Start(serviceName string) error {
+	return sm.rcService("start", serviceName)
+}
+
+func (sm *OpenRCServiceManager) Stop(serviceName string) error {
+	return sm.rcService("stop", serviceName)
+}
+
+func (sm *OpenRCServiceManager) Restart(serviceName string) error {
+	return sm.rcService("restart", serviceName)
+}
+
+func (sm *OpenRCServiceManager) Reload(serviceName string) error {
+	return sm.rcService("reload", serviceName)
+}
+
+// Mask stops the service, removes it from every runlevel and makes its init
+// script non-executable, since OpenRC has no native masking
+func (sm *OpenRCServiceManager) Mask(serviceName string) error {
+	sm.Stop(serviceName)
+	VerboseCommandRun("rc-update", "del", serviceName, "-a")
+	return os.Chmod(filepath.Join("/etc/init.d", serviceName), 0644)
+}
+
+func (sm *OpenRCServiceManager) Unmask(serviceName string) error {
+	return os.Chmod(filepath.Join("/etc/init.d", serviceName), 0755)
+}
+
+func (sm *OpenRCServiceManager) IsActive(serviceName string) bool {
+	return exec.Command("rc-service", serviceName, "status").Run() == nil
+}
+
+func (sm *OpenRCServiceManager) IsEnabled(serviceName string) bool {
+	output, err := exec.Command("rc-update", "show", "default").Output()
+	if err != nil {
+		return false
+	}
+	return parseRcUpdateShow(string(output))[serviceName]
+}
+
+func (sm *OpenRCServiceManager) Status(serviceName string) (ServiceState, error) {
+	state := ServiceState{Name: serviceName, Enabled: sm.IsEnabled(serviceName)}
+	output, _ := exec.Command("rc-service", serviceName, "status").CombinedOutput()
+	// * status: started
+	if idx := strings.Index(string(output), "status:"); idx >= 0 {
+		state.State = strings.TrimSpace(string(output)[idx+len("status:"):])
+	}
+	state.Active = state.State == "started"
+	if info, err := os.Stat(filepath.Join("/etc/init.d", serviceName)); err == nil && info.Mode()&0111 == 0 {
+		state.Masked = true
+	}
+	return state, nil
+}
+
+func (sm *OpenRCServiceManager) DaemonReload() error { return nil }
+
+func (sm *OpenRCServiceManager) WaitActive(ctx context.Context, serviceName string, timeout time.Duration) error {
+	return waitActive(ctx, sm, serviceName, timeout)
+}
+
+// parseRcUpdateShow returns the services listed by `rc-update show <runlevel>`
+func parseRcUpdateShow(output string) map[string]bool {
+	services := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		// "            sshd | default"
+		if parts := strings.SplitN(line, "|", 2); len(parts) == 2 {
+			services[strings.TrimSpace(parts[0])] = true
+		}
+	}
+	return services
+}
+
+// runitServiceDir holds the service definitions on runit systems (Void)
+var runitServiceDir = "/etc/sv"
+
+// RunitServiceManager manages runit services through sv and service symlinks
+type RunitServiceManager struct{}
+
+func (sm *RunitServiceManager) GetName() string { return "runit" }
+
+// enabledDir is the directory runsvdir supervises
+func (sm *RunitServiceManager) enabledDir() string {
+	if _, err := os.Stat("/var/service"); err == nil {
+		return "/var/service"
+	}
+	return "/etc/runit/runsvdir/default"
+}
+
+func (sm *RunitServiceManager) sv(action, serviceName string) error {
+	fmt.Printf("%s service %s using runit\n", serviceActions[action], serviceName)
+	return VerboseCommandRun("sv", action, serviceName)
+}
+
+func (sm *RunitServiceManager) Enable(serviceName string) error {
+	fmt.Printf("Enabling service %s using runit\n", serviceName)
+	link := filepath.Join(sm.enabledDir(), serviceName)
+	if _, err := os.Lstat(link); err == nil {
+		return nil
+	}
+	os.Remove(filepath.Join(runitServiceDir, serviceName, "down"))
+	return os.Symlink(filepath.Join(runitServiceDir, serviceName), link)
+}
+
+func (sm *RunitServiceManager) Disable(serviceName string) error {
+	fmt.Printf("Disabling service %s using runit\n", serviceName)
+	err := os.Remove(filepath.Join(sm.enabledDir(), serviceName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Start brings the service up. runsvdir notices a freshly enabled service
+// within five seconds, so the first attempt may have to be retried.
+func (sm *RunitServiceManager) Start(serviceName string) error {
+	err := sm.sv("up", serviceName)
+	if err != nil {
+		time.Sleep(5 * time.Second)
+		err = sm.sv("up", serviceName)
+	}
+	return err
+}
+
+func (sm *RunitServiceManager) Stop(serviceName string) error { return sm.sv("down", serviceName) }
+
+func (sm *RunitServiceManager) Restart(serviceName string) error {
+	return sm.sv("restart", serviceName)
+}
+
+func (sm *RunitServiceManager) Reload(serviceName string) error { return sm.sv("hup", serviceName) }
+
+// Mask disables the service and adds a down file so runsv never starts it
+func (sm *RunitServiceManager) Mask(serviceName string) error {
+	sm.Stop(serviceName)
+	if err := sm.Disable(serviceName); err != nil {
+		return err
+	}
+	return VerboseWriteFile(filepath.Join(runitServiceDir, serviceName, "down"), "")
+}
+
+func (sm *RunitServiceManager) Unmask(serviceName string) error {
+	return removeDownFile(filepath.Join(runitServiceDir, serviceName, "down"))
+}
+
+func (sm *RunitServiceManager) IsActive(serviceName string) bool {
+	output, err := exec.Command("sv", "status", serviceName).Output()
+	return err == nil && strings.HasPrefix(string(output), "run:")
+}
+
+func (sm *RunitServiceManager) IsEnabled(serviceName string) bool {
+	_, err := os.Lstat(filepath.Join(sm.enabledDir(), serviceName))
+	return err == nil
+}
+
+func (sm *RunitServiceManager) Status(serviceName string) (ServiceState, error) {
+	state := ServiceState{Name: serviceName, Enabled: sm.IsEnabled(serviceName)}
+	output, _ := exec.Command("sv", "status", serviceName).CombinedOutput()
+	// run: sshd: (pid 412) 3600s
+	state.State = strings.SplitN(strings.TrimSpace(string(output)), ":", 2)[0]
+	state.Active = state.State == "run"
+	if _, err := os.Stat(filepath.Join(runitServiceDir, serviceName, "down")); err == nil && !state.Enabled {
+		state.Masked = true
+	}
+	return state, nil
+}
+
+func (sm *RunitServiceManager) DaemonReload() error { return nil }
+
+func (sm *RunitServiceManager) WaitActive(ctx context.Context, serviceName string, timeout time.Duration) error {
+	return waitActive(ctx, sm, serviceName, timeout)
+}
+
+// s6ScanDir is the s6-svscan scan directory
+var s6ScanDir = "/run/service"
+
+// S6ServiceManager manages s6 and s6-rc services
+type S6ServiceManager struct{}
+
+func (sm *S6ServiceManager) GetName() string { return "s6" }
+
+func (sm *S6ServiceManager) serviceDir(serviceName string) string {
+	return filepath.Join(s6ScanDir, serviceName)
+}
+
+func (sm *S6ServiceManager) hasRc() bool {
+	_, err := exec.LookPath("s6-rc")
+	return err == nil
+}
+
+// Enable adds the service to the default bundle. This needs s6-rc with the
+// s6-service helper (Artix); plain s6 has no notion of enabled services.
+func (sm *S6ServiceManager) Enable(serviceName string) error {
+	fmt.Printf("Enabling service %s using s6\n", serviceName)
+	if _, err := exec.LookPath("s6-service"); err != nil {
+		return fmt.Errorf("enabling services needs s6-rc with s6-service: add %s to the default bundle of your s6-rc database", serviceName)
+	}
+	if err := VerboseCommandRun("s6-service", "add", "default", serviceName); err != nil {
+		return err
+	}
+	return sm.DaemonReload()
+}
+
+func (sm *S6ServiceManager) Disable(serviceName string) error {
+	fmt.Printf("Disabling service %s using s6\n", serviceName)
+	if _, err := exec.LookPath("s6-service"); err != nil {
+		return fmt.Errorf("disabling services needs s6-rc with s6-service: remove %s from the default bundle of your s6-rc database", serviceName)
+	}
+	if err := VerboseCommandRun("s6-service", "delete", "default", serviceName); err != nil {
+		return err
+	}
+	return sm.DaemonReload()
+}
+
+func (sm *S6ServiceManager) Start(serviceName string) error {
+	fmt.Printf("Starting service %s using s6\n", serviceName)
+	if sm.hasRc() {
+		return VerboseCommandRun("s6-rc", "-u", "change", serviceName)
+	}
+	return VerboseCommandRun("s6-svc", "-u", sm.serviceDir(serviceName))
+}
+
+func (sm *S6ServiceManager) Stop(serviceName string) error {
+	fmt.Printf("Stopping service %s using s6\n", serviceName)
+	if sm.hasRc() {
+		return VerboseCommandRun("s6-rc", "-d", "change", serviceName)
+	}
+	return VerboseCommandRun("s6-svc", "-d", sm.serviceDir(serviceName))
+}
+
+func (sm *S6ServiceManager) Restart(serviceName string) error {
+	fmt.Printf("Restarting service %s using s6\n", serviceName)
+	return VerboseCommandRun("s6-svc", "-r", sm.serviceDir(serviceName))
+}
+
+func (sm *S6ServiceManager) Reload(serviceName string) error {
+	fmt.Printf("Reloading service %s using s6\n", serviceName)
+	return VerboseCommandRun("s6-svc", "-h", sm.serviceDir(serviceName))
+}
+
+// Mask stops and disables the service and adds a down file to its service directory
+func (sm *S6ServiceManager) Mask(serviceName string) error {
+	sm.Stop(serviceName)
+	sm.Disable(serviceName)
+	return VerboseWriteFile(filepath.Join(sm.serviceDir(serviceName), "down"), "")
+}
+
+func (sm *S6ServiceManager) Unmask(serviceName string) error {
+	return removeDownFile(filepath.Join(sm.serviceDir(serviceName), "down"))
+}
+
+// removeDownFile removes the down file runit and s6 supervisors honour
+func removeDownFile(path string) error {
+	VerboseLogger.LogFileOperation("REMOVE", path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (sm *S6ServiceManager) IsActive(serviceName string) bool {
+	output, err := exec.Command("s6-svstat", sm.serviceDir(serviceName)).Output()
+	return err == nil && strings.HasPrefix(string(output), "up")
+}
+
+func (sm *S6ServiceManager) IsEnabled(serviceName string) bool {
+	output, err := exec.Command("s6-rc-db", "contents", "default").Output()
+	if err != nil {
 		return false
 	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.TrimSpace(line) == serviceName {
+			return true
+		}
+	}
+	return false
+}
+
+func (sm *S6ServiceManager) Status(serviceName string) (ServiceState, error) {
+	state := ServiceState{Name: serviceName, Enabled: sm.IsEnabled(serviceName)}
+	output, err := exec.Command("s6-svstat", sm.serviceDir(serviceName)).Output()
+	if err != nil {
+		return state, err
+	}
+	// up (pid 123) 45 seconds
+	state.State = strings.Fields(string(output) + " unknown")[0]
+	state.Active = state.State == "up"
+	if _, err := os.Stat(filepath.Join(sm.serviceDir(serviceName), "down")); err == nil && !state.Enabled {
+		state.Masked = true
+	}
+	return state, nil
+}
+
+// DaemonReload recompiles and swaps in the s6-rc service database where the
+// distribution ships a helper for it
+func (sm *S6ServiceManager) DaemonReload() error {
+	if _, err := exec.LookPath("s6-db-reload"); err == nil {
+		return VerboseCommandRun("s6-db-reload")
+	}
+	return nil
+}
+
+func (sm *S6ServiceManager) WaitActive(ctx context.Context, serviceName string, timeout time.Duration) error {
+	return waitActive(ctx, sm, serviceName, timeout)
+}
+
+// serviceActions turns the command verbs of the service managers into
+// progress message verbs
+var serviceActions = map[string]string{
+	"enable":  "Enabling",
+	"disable": "Disabling",
+	"start":   "Starting",
+	"up":      "Starting",
+	"stop":    "Stopping",
+	"down":    "Stopping",
+	"restart": "Restarting",
+	"reload":  "Reloading",
+	"hup":     "Reloading",
 }
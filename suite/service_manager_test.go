@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"testing"
+	"time"
 )
 
 func TestNewServiceManager(t *testing.T) {
@@ -16,25 +18,141 @@ func TestNewServiceManager(t *testing.T) {
 		return
 	}
 
-	t.Logf("Detected service manager: %s", sm.manager)
+	t.Logf("Detected service manager: %s", sm.GetName())
 }
 
-func TestServiceManagerInterface(t *testing.T) {
+func TestServiceManagerForInit(t *testing.T) {
 	tests := []struct {
-		name    string
-		manager string
+		initSystem string
+		want       string
 	}{
-		{name: "systemctl", manager: "systemctl"},
-		{name: "service", manager: "service"},
-		{name: "rc-service", manager: "rc-service"},
+		{initSystem: "systemd", want: "systemd"},
+		{initSystem: "openrc", want: "openrc"},
+		{initSystem: "runit", want: "runit"},
+		{initSystem: "s6", want: "s6"},
+		{initSystem: "sysvinit", want: "sysvinit"},
+		{initSystem: "unknown", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.initSystem, func(t *testing.T) {
+			sm := serviceManagerForInit(tt.initSystem)
+			got := ""
+			if sm != nil {
+				got = sm.GetName()
+			}
+			if got != tt.want {
+				t.Errorf("serviceManagerForInit(%q) = %q, want %q", tt.initSystem, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSystemdShow(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   ServiceState
+	}{
+		{
+			name:   "running",
+			output: "LoadState=loaded\nActiveState=active\nSubState=running\nUnitFileState=enabled\n",
+			want:   ServiceState{Name: "nginx", Active: true, Enabled: true, State: "running"},
+		},
+		{
+			name:   "failed",
+			output: "LoadState=loaded\nActiveState=failed\nSubState=failed\nUnitFileState=disabled\n",
+			want:   ServiceState{Name: "nginx", State: "failed"},
+		},
+		{
+			name:   "masked",
+			output: "LoadState=masked\nActiveState=inactive\nSubState=dead\nUnitFileState=masked\n",
+			want:   ServiceState{Name: "nginx", Masked: true, State: "dead"},
+		},
+		{
+			name:   "static",
+			output: "LoadState=loaded\nActiveState=inactive\nSubState=dead\nUnitFileState=static\n",
+			want:   ServiceState{Name: "nginx", Enabled: true, State: "dead"},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			sm := &ServiceManager{manager: tt.manager}
-			if sm.manager != tt.manager {
-				t.Errorf("manager = %s, want %s", sm.manager, tt.manager)
+			if got := parseSystemdShow("nginx", tt.output); got != tt.want {
+				t.Errorf("parseSystemdShow() = %+v, want %+v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestParseRcUpdateShow(t *testing.T) {
+	output := `                 crond | default
+                 sshd | default
+              networking |      boot
+`
+	services := parseRcUpdateShow(output)
+	for _, name := range []string{"crond", "sshd", "networking"} {
+		if !services[name] {
+			t.Errorf("parseRcUpdateShow() missing %s", name)
+		}
+	}
+	if services["nginx"] {
+		t.Error("parseRcUpdateShow() reported nginx")
+	}
+}
+
+func TestServiceStateString(t *testing.T) {
+	tests := []struct {
+		state ServiceState
+		want  string
+	}{
+		{state: ServiceState{Active: true, Enabled: true, State: "running"}, want: "enabled, active (running)"},
+		{state: ServiceState{Masked: true, Enabled: true}, want: "masked, inactive"},
+		{state: ServiceState{State: "failed"}, want: "disabled, inactive (failed)"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.state.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+// fakeServiceManager becomes active after a number of IsActive calls
+type fakeServiceManager struct {
+	SystemdServiceManager
+	activeAfter int
+	calls       int
+}
+
+func (f *fakeServiceManager) IsActive(serviceName string) bool {
+	f.calls++
+	return f.activeAfter >= 0 && f.calls > f.activeAfter
+}
+
+func (f *fakeServiceManager) Status(serviceName string) (ServiceState, error) {
+	return ServiceState{Name: serviceName, State: "failed"}, nil
+}
+
+func TestWaitActive(t *testing.T) {
+	oldInterval := serviceWaitPollInterval
+	serviceWaitPollInterval = time.Millisecond
+	defer func() { serviceWaitPollInterval = oldInterval }()
+
+	sm := &fakeServiceManager{activeAfter: 3}
+	if err := waitActive(context.Background(), sm, "nginx", time.Second); err != nil {
+		t.Errorf("waitActive() error = %v", err)
+	}
+	if sm.calls != 4 {
+		t.Errorf("waitActive() polled %d times, want 4", sm.calls)
+	}
+
+	sm = &fakeServiceManager{activeAfter: -1}
+	err := waitActive(context.Background(), sm, "nginx", 20*time.Millisecond)
+	if err == nil {
+		t.Fatal("waitActive() expected timeout error")
+	}
+	if want := "nginx did not become active within 20ms: disabled, inactive (failed)"; err.Error() != want {
+		t.Errorf("waitActive() error = %q, want %q", err.Error(), want)
+	}
+}
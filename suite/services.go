@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"suite/suite/config"
+)
+
+// serviceChange is the before and after state of one declared service
+type serviceChange struct {
+	Name    string
+	Action  string
+	Before  ServiceState
+	After   ServiceState
+	Changed bool
+	Err     error
+}
+
+func (c serviceChange) String() string {
+	switch {
+	case c.Err != nil:
+		return fmt.Sprintf("%s (%s): %s -> failed: %v", c.Name, c.Action, c.Before, c.Err)
+	case !c.Changed:
+		return fmt.Sprintf("%s (%s): unchanged, %s", c.Name, c.Action, c.After)
+	}
+	return fmt.Sprintf("%s (%s): %s -> %s", c.Name, c.Action, c.Before, c.After)
+}
+
+// ApplyServices brings the services in the .services block to their declared
+// state. Services already in that state are left alone.
+func ApplyServices(services *config.Services) error {
+	sm, err := NewServiceManager()
+	if err != nil {
+		return fmt.Errorf("could not detect service manager: %v", err)
+	}
+
+	fmt.Println("Configuring services...")
+	var changes []serviceChange
+	for _, name := range services.Enable {
+		changes = append(changes, applyServiceState(sm, name, "enable"))
+	}
+	for _, name := range services.Disable {
+		changes = append(changes, applyServiceState(sm, name, "disable"))
+	}
+	for _, name := range services.Mask {
+		changes = append(changes, applyServiceState(sm, name, "mask"))
+	}
+
+	var failed []string
+	for _, change := range changes {
+		fmt.Printf("  %s\n", change)
+		VerboseLogger.LogInfo("Service %s", change)
+		if change.Err != nil {
+			failed = append(failed, change.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not configure services: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// applyServiceState moves one service to the state named by action
+func applyServiceState(sm ServiceManager, name, action string) serviceChange {
+	change := serviceChange{Name: name, Action: action}
+	change.Before, _ = sm.Status(name)
+
+	if !serviceNeedsChange(change.Before, action) {
+		change.After = change.Before
+		return change
+	}
+
+	switch action {
+	case "enable":
+		// A masked service refuses to be enabled or started
+		if change.Before.Masked {
+			change.Err = sm.Unmask(name)
+		}
+		if change.Err == nil {
+			change.Err = EnableAndStart(sm, name)
+		}
+	case "disable":
+		if change.Before.Active {
+			if err := sm.Stop(name); err != nil {
+				change.Err = err
+			}
+		}
+		if change.Err == nil && change.Before.Enabled {
+			change.Err = sm.Disable(name)
+		}
+	case "mask":
+		change.Err = sm.Mask(name)
+	}
+
+	change.After, _ = sm.Status(name)
+	change.Changed = change.After != change.Before
+	return change
+}
+
+// serviceNeedsChange reports whether a service in state is not yet in the
+// state named by action
+func serviceNeedsChange(state ServiceState, action string) bool {
+	switch action {
+	case "enable":
+		return state.Masked || !state.Enabled || !state.Active
+	case "disable":
+		return state.Enabled || state.Active
+	case "mask":
+		return !state.Masked || state.Active
+	}
+	return false
+}
+
+// RestartChangedServices restarts each restart_on_change service whose
+// watched path SetupSuite changed during this run
+func RestartChangedServices(services *config.Services) error {
+	var restart []string
+	seen := make(map[string]bool)
+	for _, entry := range services.RestartOnChange {
+		name, path := parseRestartOnChange(entry)
+		if name == "" || path == "" {
+			fmt.Printf("Warning: Ignoring restart_on_change entry %q, expected service=path\n", entry)
+			continue
+		}
+		if fileChangedUnder(path) && !seen[name] {
+			seen[name] = true
+			restart = append(restart, name)
+		}
+	}
+	if len(restart) == 0 {
+		return nil
+	}
+
+	sm, err := NewServiceManager()
+	if err != nil {
+		return fmt.Errorf("could not detect service manager: %v", err)
+	}
+	for _, name := range restart {
+		fmt.Printf("Restarting %s: its configuration changed\n", name)
+		if err := RestartAndVerify(sm, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRestartOnChange splits a "service=path" entry
+func parseRestartOnChange(entry string) (string, string) {
+	parts := strings.SplitN(entry, "=", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
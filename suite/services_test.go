@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingServiceManager keeps service state in memory and records calls
+type recordingServiceManager struct {
+	SystemdServiceManager
+	states map[string]ServiceState
+	calls  []string
+}
+
+func (r *recordingServiceManager) state(name string) ServiceState {
+	s := r.states[name]
+	s.Name = name
+	return s
+}
+
+func (r *recordingServiceManager) set(name, call string, fn func(*ServiceState)) error {
+	r.calls = append(r.calls, call+" "+name)
+	s := r.state(name)
+	fn(&s)
+	r.states[name] = s
+	return nil
+}
+
+func (r *recordingServiceManager) Enable(name string) error {
+	return r.set(name, "enable", func(s *ServiceState) { s.Enabled = true })
+}
+
+func (r *recordingServiceManager) Disable(name string) error {
+	return r.set(name, "disable", func(s *ServiceState) { s.Enabled = false })
+}
+
+func (r *recordingServiceManager) Start(name string) error {
+	return r.set(name, "start", func(s *ServiceState) { s.Active = true })
+}
+
+func (r *recordingServiceManager) Stop(name string) error {
+	return r.set(name, "stop", func(s *ServiceState) { s.Active = false })
+}
+
+func (r *recordingServiceManager) Mask(name string) error {
+	return r.set(name, "mask", func(s *ServiceState) { s.Masked, s.Active, s.Enabled = true, false, false })
+}
+
+func (r *recordingServiceManager) Unmask(name string) error {
+	return r.set(name, "unmask", func(s *ServiceState) { s.Masked = false })
+}
+
+func (r *recordingServiceManager) IsActive(name string) bool { return r.state(name).Active }
+
+func (r *recordingServiceManager) Status(name string) (ServiceState, error) {
+	return r.state(name), nil
+}
+
+func (r *recordingServiceManager) WaitActive(ctx context.Context, name string, timeout time.Duration) error {
+	return waitActive(ctx, r, name, timeout)
+}
+
+func TestApplyServiceState(t *testing.T) {
+	InitLogger(false)
+
+	tests := []struct {
+		name      string
+		action    string
+		before    ServiceState
+		wantCalls []string
+		wantAfter ServiceState
+	}{
+		{
+			name:      "disable running service",
+			action:    "disable",
+			before:    ServiceState{Active: true, Enabled: true},
+			wantCalls: []string{"stop cups", "disable cups"},
+			wantAfter: ServiceState{Name: "cups"},
+		},
+		{
+			name:      "disable already disabled service",
+			action:    "disable",
+			before:    ServiceState{},
+			wantCalls: nil,
+			wantAfter: ServiceState{Name: "cups"},
+		},
+		{
+			name:      "enable stopped service",
+			action:    "enable",
+			before:    ServiceState{},
+			wantCalls: []string{"enable cups", "start cups"},
+			wantAfter: ServiceState{Name: "cups", Active: true, Enabled: true},
+		},
+		{
+			name:      "enable masked service",
+			action:    "enable",
+			before:    ServiceState{Masked: true},
+			wantCalls: []string{"unmask cups", "enable cups", "start cups"},
+			wantAfter: ServiceState{Name: "cups", Active: true, Enabled: true},
+		},
+		{
+			name:      "mask enabled service",
+			action:    "mask",
+			before:    ServiceState{Active: true, Enabled: true},
+			wantCalls: []string{"mask cups"},
+			wantAfter: ServiceState{Name: "cups", Masked: true},
+		},
+		{
+			name:      "mask already masked service",
+			action:    "mask",
+			before:    ServiceState{Masked: true},
+			wantCalls: nil,
+			wantAfter: ServiceState{Name: "cups", Masked: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &recordingServiceManager{states: map[string]ServiceState{"cups": tt.before}}
+			change := applyServiceState(sm, "cups", tt.action)
+			if change.Err != nil {
+				t.Fatalf("applyServiceState() error = %v", change.Err)
+			}
+			if !reflect.DeepEqual(sm.calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", sm.calls, tt.wantCalls)
+			}
+			if change.After != tt.wantAfter {
+				t.Errorf("After = %+v, want %+v", change.After, tt.wantAfter)
+			}
+			if change.Changed != (tt.wantCalls != nil) {
+				t.Errorf("Changed = %v, want %v", change.Changed, tt.wantCalls != nil)
+			}
+		})
+	}
+}
+
+func TestParseRestartOnChange(t *testing.T) {
+	tests := []struct {
+		entry    string
+		wantName string
+		wantPath string
+	}{
+		{entry: "nginx=/etc/nginx", wantName: "nginx", wantPath: "/etc/nginx"},
+		{entry: " docker = /etc/docker/daemon.json ", wantName: "docker", wantPath: "/etc/docker/daemon.json"},
+		{entry: "nginx", wantName: "", wantPath: ""},
+	}
+
+	for _, tt := range tests {
+		name, path := parseRestartOnChange(tt.entry)
+		if name != tt.wantName || path != tt.wantPath {
+			t.Errorf("parseRestartOnChange(%q) = %q, %q, want %q, %q", tt.entry, name, path, tt.wantName, tt.wantPath)
+		}
+	}
+}
+
+func TestFileChangedUnder(t *testing.T) {
+	oldChanged := changedFiles
+	changedFiles = map[string]bool{"/etc/nginx/sites-available/example.com": true}
+	defer func() { changedFiles = oldChanged }()
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/etc/nginx", want: true},
+		{path: "/etc/nginx/", want: true},
+		{path: "/etc/nginx/sites-available/example.com", want: true},
+		{path: "/etc/nginx-extra", want: false},
+		{path: "/etc/docker", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := fileChangedUnder(tt.path); got != tt.want {
+			t.Errorf("fileChangedUnder(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
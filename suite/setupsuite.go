@@ -7,12 +7,18 @@ import (
 	"os/user"
 	"runtime"
 	"suite/suite/config"
+	"time"
 )
 
 func main() {
+	if runtime.GOOS != "windows" && isSubcommand(os.Args[1:]) {
+		runSubcommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	// Parse command line arguments
 	var (
-		configPath   = flag.String("config", "/etc/setupsuite/config.sscfg", "Path to configuration file")
+		configPath   = flag.String("config", defaultConfigPath, "Path to configuration file")
 		serverType   = flag.String("type", "", "Server type (web, database, docker, proxy, build)")
 		generateOnly = flag.Bool("generate", false, "Generate default config and exit")
 		verbose      = flag.Bool("verbose", false, "Enable verbose logging of all file operations and command outputs")
@@ -64,6 +70,16 @@ func showHelp() {
 	fmt.Println("")
 	fmt.Println("Usage:")
 	fmt.Println("  setupsuite [options]")
+	fmt.Println("  setupsuite <command> [options]")
+	fmt.Println("")
+	fmt.Println("Commands:")
+	fmt.Println("  apply             Run the setup (same as running without a command)")
+	fmt.Println("  bundle            Download every package a config needs into an offline bundle")
+	fmt.Println("  facts             Print the detected host facts as JSON")
+	fmt.Println("  verify            Run the health checks for a config without changing anything")
+	fmt.Println("  audit             Report the security posture of the host, scored, as markdown, json or html")
+	fmt.Println("  confirm           Keep the SSH and firewall changes of a safe apply run")
+	fmt.Println("  revert            Undo the SSH and firewall changes of a safe apply run now")
 	fmt.Println("")
 	fmt.Println("Options:")
 	fmt.Println("  -config string    Path to configuration file (default: /etc/setupsuite/config.sscfg)")
@@ -77,6 +93,10 @@ func showHelp() {
 	fmt.Println("  setupsuite -config /path/to/custom.sscfg          # Use custom config")
 	fmt.Println("  setupsuite -verbose                               # Run with verbose logging")
 	fmt.Println("  setupsuite                                        # Use default config")
+	fmt.Println("  setupsuite bundle -config web.sscfg -output web.tar.gz")
+	fmt.Println("  setupsuite apply -config web.sscfg --offline web.tar.gz")
+	fmt.Println("  setupsuite verify -config web.sscfg")
+	fmt.Println("  setupsuite audit -format html -output audit.html")
 	fmt.Println("")
 	fmt.Println("Server Types:")
 	fmt.Println("  web       - Web server with Nginx and SSL")
@@ -99,19 +119,27 @@ func execute(configPath string) {
 
 	// Detect system information
 	fmt.Println("Detecting system information...")
-	distro, version, err := DetectDistribution()
+	facts, err := GatherFacts()
 	if err != nil {
-		fmt.Printf("Warning: Could not detect distribution: %v\n", err)
-	} else {
-		fmt.Printf("Detected: %s %s\n", distro, version)
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
 	}
-
-	// Detect package manager
-	pm, err := DetectPackageManager()
+	fmt.Printf("Detected: %s %s (%s, %s)\n", facts.Distro.ID, facts.Distro.Version, facts.Arch, facts.InitSystem)
+	pm, err := facts.Packages()
 	if err != nil {
-		fmt.Printf("Warning: Could not detect package manager: %v\n", err)
-	} else {
-		fmt.Printf("Package manager: %s\n", pm.GetName())
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Package manager: %s\n", pm.GetName())
+	if factsJSON, err := facts.JSON(); err == nil {
+		VerboseLogger.LogInfo("Host facts:\n%s", factsJSON)
+	}
+
+	if ActiveBundle != nil {
+		if err := ActiveBundle.CheckDistribution(facts.Distro.ID, facts.Distro.Version); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
 	// Read and parse configuration
@@ -121,37 +149,116 @@ func execute(configPath string) {
 		os.Exit(1)
 	}
 
+	if ActiveBundle != nil {
+		if err := checkOffline(serverConfig); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// Perform server setup based on config
-	err = setupServer(serverConfig)
+	err = setupServer(serverConfig, facts)
 	if err != nil {
 		fmt.Printf("Setup failed: %v\n", err)
+		if ActiveSafeApply != nil {
+			fmt.Printf("SSH and firewall changes are reverted at %s unless confirmed\n", ActiveSafeApply.Deadline.Format("15:04:05"))
+		}
+		os.Exit(1)
+	}
+
+	report := RunHealthChecks(serverConfig)
+	report.Print()
+
+	if ActiveSafeApply != nil {
+		ActiveSafeApply.Finish(facts)
+	}
+
+	// Keep an audit of every run as evidence. It walks the filesystems, so
+	// it runs after safe apply is confirmed, not against its deadline.
+	audit := RunAudit(serverConfig, facts)
+	if path, err := SaveAuditReport(audit); err != nil {
+		fmt.Printf("Warning: Could not save the audit report: %v\n", err)
+	} else {
+		fmt.Printf("Audit score %d/100 (%d failed), report saved to %s\n", audit.Score, audit.Failed, path)
+	}
+	if len(report.Failed()) > 0 {
+		fmt.Println("Server setup completed, but verification failed")
 		os.Exit(1)
 	}
 
 	fmt.Println("Server setup completed successfully!")
 }
 
-func setupServer(cfg *config.ServerConfig) error {
+func setupServer(cfg *config.ServerConfig, facts *Facts) error {
+	if cfg.InstallTools != nil && cfg.InstallTools.LockTimeout > 0 {
+		PackageLockTimeout = time.Duration(cfg.InstallTools.LockTimeout) * time.Second
+	}
+
+	// Proxy first, every later step may need to reach the mirrors
+	if cfg.HTTPProxy != nil {
+		if err := ConfigureHTTPProxy(cfg.HTTPProxy, facts); err != nil {
+			return fmt.Errorf("proxy configuration failed: %v", err)
+		}
+	}
+
+	// Arm the dead man's switch before sshd or the firewall change
+	if cfg.SetupSecure != nil && cfg.SetupSecure.SSHSafeApply != "" {
+		safeApply, err := BeginSafeApply(cfg.SetupSecure, facts)
+		if err != nil {
+			return fmt.Errorf("safe apply failed: %v", err)
+		}
+		ActiveSafeApply = safeApply
+	}
+
+	// Users before sshd, which only admits the sshuser group
+	if users := configuredUsers(cfg); len(users) > 0 {
+		if err := ApplyUsers(users, sshMinRSABits(cfg.SetupSecure)); err != nil {
+			return fmt.Errorf("user setup failed: %v", err)
+		}
+	}
+
+	// CA files before sshd, which refers to them
+	if cfg.SetupSecure != nil && cfg.SetupSecure.SSHCA != nil {
+		if err := ConfigureSSHCA(cfg.SetupSecure.SSHCA, configuredUsers(cfg), cfg.SetupSecure.SSHPort); err != nil {
+			return fmt.Errorf("ssh ca setup failed: %v", err)
+		}
+	}
+
 	// Basic security setup
 	if cfg.SetupSecure != nil {
 		fmt.Println("Setting up basic security...")
-		err := setupBasicSecurity(cfg.SetupSecure)
+		err := setupBasicSecurity(cfg.SetupSecure, facts)
 		if err != nil {
 			return fmt.Errorf("security setup failed: %v", err)
 		}
 	}
 
+	// Kernel parameters
+	if cfg.Sysctl != nil {
+		if err := ApplySysctl(cfg.Sysctl, serverType(cfg)); err != nil {
+			return fmt.Errorf("sysctl configuration failed: %v", err)
+		}
+	}
+
 	// Install packages
 	if cfg.InstallTools != nil && len(cfg.InstallTools.Tools) > 0 {
-		err := InstallPackages(cfg.InstallTools.Tools)
+		err := InstallPackages(facts, cfg.InstallTools.Tools)
 		if err != nil {
 			return fmt.Errorf("package installation failed: %v", err)
 		}
 	}
 
+	// Install language-level tools that are not packaged by the distribution
+	if cfg.InstallTools != nil {
+		err := InstallSecondaryTools(cfg.InstallTools)
+		if err != nil {
+			return fmt.Errorf("tool installation failed: %v", err)
+		}
+	}
+
 	// Configure firewall
 	if cfg.SetupSecure != nil && cfg.SetupSecure.Firewall != nil {
-		err := ConfigureFirewall(cfg.SetupSecure.Firewall.OpenPorts)
+		err := ConfigureFirewall(cfg.SetupSecure.Firewall, facts)
 		if err != nil {
 			return fmt.Errorf("firewall configuration failed: %v", err)
 		}
@@ -159,23 +266,71 @@ func setupServer(cfg *config.ServerConfig) error {
 
 	// Server-specific setup
 	if cfg.SetupSecure != nil && cfg.SetupSecure.Config != nil {
-		serverSetup := &ServerSetup{Config: cfg}
-
-		switch cfg.SetupSecure.Config.Type {
-		case config.ServerTypeWeb:
-			return serverSetup.SetupWebServer()
-		case config.ServerTypeDatabase:
-			return serverSetup.SetupDatabaseServer()
-		case config.ServerTypeDocker:
-			return serverSetup.SetupDockerHost()
-		case config.ServerTypeProxy:
-			return serverSetup.SetupProxyServer()
-		case config.ServerTypeBuild:
-			return serverSetup.SetupBuildServer()
-		default:
-			fmt.Printf("Unknown server type: %s\n", cfg.SetupSecure.Config.Type)
+		if err := setupServerRole(cfg, facts); err != nil {
+			return err
+		}
+	}
+
+	// fail2ban after the roles, the nginx jails need their logs
+	if cfg.SetupSecure != nil && cfg.SetupSecure.Fail2ban != nil {
+		if err := ConfigureFail2ban(cfg.SetupSecure, facts); err != nil {
+			return fmt.Errorf("fail2ban configuration failed: %v", err)
+		}
+	}
+
+	// Custom daemons
+	if len(cfg.Units) > 0 {
+		if err := InstallUnits(cfg.Units, facts.InitSystem); err != nil {
+			return fmt.Errorf("unit installation failed: %v", err)
+		}
+	}
+
+	// Declared service states, after the roles installed their packages
+	if cfg.Services != nil {
+		if err := ApplyServices(cfg.Services); err != nil {
+			return fmt.Errorf("service configuration failed: %v", err)
+		}
+		if err := RestartChangedServices(cfg.Services); err != nil {
+			return fmt.Errorf("service restart failed: %v", err)
 		}
 	}
 
 	return nil
 }
+
+// serverType returns the configured server type, empty if none
+func serverType(cfg *config.ServerConfig) string {
+	if cfg.SetupSecure == nil || cfg.SetupSecure.Config == nil {
+		return ""
+	}
+	return cfg.SetupSecure.Config.Type
+}
+
+// setupServerRole runs the setup for the configured server type
+func setupServerRole(cfg *config.ServerConfig, facts *Facts) error {
+	serverSetup := &ServerSetup{Config: cfg, Facts: facts}
+
+	// Offline the bundle carries what the role runs on
+	if ActiveBundle != nil {
+		if err := InstallPackages(facts, rolePackages(cfg, facts)); err != nil {
+			return fmt.Errorf("role package installation failed: %v", err)
+		}
+	}
+
+	switch cfg.SetupSecure.Config.Type {
+	case config.ServerTypeWeb:
+		return serverSetup.SetupWebServer()
+	case config.ServerTypeDatabase:
+		return serverSetup.SetupDatabaseServer()
+	case config.ServerTypeDocker:
+		return serverSetup.SetupDockerHost()
+	case config.ServerTypeProxy:
+		return serverSetup.SetupProxyServer()
+	case config.ServerTypeBuild:
+		return serverSetup.SetupBuildServer()
+	default:
+		fmt.Printf("Unknown server type: %s\n", cfg.SetupSecure.Config.Type)
+	}
+
+	return nil
+}
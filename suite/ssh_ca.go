@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"suite/suite/config"
+)
+
+// sshCADir holds the CA files sshd reads
+var sshCADir = "/etc/ssh/setupsuite"
+
+// sshHostKeyGlob matches the public host keys sshd loads by default
+var sshHostKeyGlob = "/etc/ssh/ssh_host_*_key.pub"
+
+// hostCertRenewal is how long before expiry a host certificate is renewed
+const hostCertRenewal = 30 * 24 * time.Hour
+
+func userCAKeysPath() string   { return filepath.Join(sshCADir, "user_ca_keys") }
+func principalsDir() string    { return filepath.Join(sshCADir, "principals") }
+func defaultExportDir() string { return filepath.Join(sshCADir, "export") }
+
+// ConfigureSSHCA installs the trusted user CAs and the principals of every
+// managed user, signs the host keys if a host CA key is given, and exports
+// the host keys for clients. It runs before sshd is configured, which
+// refers to these files.
+func ConfigureSSHCA(ca *config.SSHCA, users []config.User, sshPort int) error {
+	fmt.Println("Configuring SSH certificate authority")
+	VerboseLogger.LogInfo("Configuring SSH certificate authority")
+
+	if err := VerboseMkdirAll(principalsDir(), 0755); err != nil {
+		return err
+	}
+	if err := writeUserCAKeys(ca.UserCAKeys); err != nil {
+		return err
+	}
+	if err := writePrincipals(users); err != nil {
+		return err
+	}
+
+	principals := ca.HostPrincipals
+	if len(principals) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("could not determine the hostname for the host certificate: %v", err)
+		}
+		principals = []string{hostname}
+	}
+	if ca.HostCAKey != "" {
+		if err := signHostKeys(ca, principals); err != nil {
+			return err
+		}
+	}
+
+	exportDir := ca.ExportDir
+	if exportDir == "" {
+		exportDir = defaultExportDir()
+	}
+	return exportHostKeys(exportDir, principals, sshPort, ca.HostCAKey != "")
+}
+
+// writeUserCAKeys writes the TrustedUserCAKeys file
+func writeUserCAKeys(lines []string) error {
+	var b strings.Builder
+	b.WriteString(managedHeader)
+	for i, line := range lines {
+		key, err := ParseAuthorizedKey(line)
+		if err != nil {
+			return fmt.Errorf("user CA key %d: %v", i+1, err)
+		}
+		if key.Options != "" {
+			return fmt.Errorf("user CA key %d: options are not allowed in TrustedUserCAKeys", i+1)
+		}
+		fmt.Printf("Trusting user CA %s\n", key)
+		b.WriteString(key.Line() + "\n")
+	}
+	return VerboseWriteFile(userCAKeysPath(), b.String())
+}
+
+// writePrincipals writes one AuthorizedPrincipalsFile per present user and
+// removes those of users no longer managed. Without a file sshd accepts no
+// certificate for the user.
+func writePrincipals(users []config.User) error {
+	keep := make(map[string]bool)
+	for _, u := range users {
+		if u.State == "absent" {
+			continue
+		}
+		principals := u.Principals
+		if len(principals) == 0 {
+			principals = []string{u.Name}
+		}
+		keep[u.Name] = true
+		if err := VerboseWriteFile(filepath.Join(principalsDir(), u.Name), strings.Join(principals, "\n")+"\n"); err != nil {
+			return err
+		}
+	}
+
+	entries, err := ioutil.ReadDir(principalsDir())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !keep[entry.Name()] {
+			VerboseLogger.LogFileOperation("REMOVE", filepath.Join(principalsDir(), entry.Name()))
+			if err := os.Remove(filepath.Join(principalsDir(), entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hostKeys returns the public host keys, sorted
+func hostKeys() []string {
+	paths, _ := filepath.Glob(sshHostKeyGlob)
+	sort.Strings(paths)
+	return paths
+}
+
+// hostCertPath returns the certificate ssh-keygen writes for a public key
+func hostCertPath(pubPath string) string {
+	return strings.TrimSuffix(pubPath, ".pub") + "-cert.pub"
+}
+
+// signHostKeys signs every host key whose certificate is missing, stale or
+// about to expire with the host CA key
+func signHostKeys(ca *config.SSHCA, principals []string) error {
+	if _, err := os.Stat(ca.HostCAKey); err != nil {
+		return fmt.Errorf("host CA key: %v", err)
+	}
+	output, err := exec.Command("ssh-keygen", "-y", "-f", ca.HostCAKey).Output()
+	if err != nil {
+		return fmt.Errorf("could not read host CA key %s (keys with a passphrase are not supported): %v", ca.HostCAKey, err)
+	}
+	caKey, err := ParseAuthorizedKey(string(output))
+	if err != nil {
+		return fmt.Errorf("host CA key: %v", err)
+	}
+
+	validity := ca.HostCertValidity
+	if validity == "" {
+		validity = "+52w"
+	}
+	hostname, _ := os.Hostname()
+
+	for _, pubPath := range hostKeys() {
+		data, err := ioutil.ReadFile(pubPath)
+		if err != nil {
+			return err
+		}
+		hostKey, err := ParseAuthorizedKey(string(data))
+		if err != nil {
+			return fmt.Errorf("%s: %v", pubPath, err)
+		}
+
+		certPath := hostCertPath(pubPath)
+		if output, err := exec.Command("ssh-keygen", "-L", "-f", certPath).Output(); err == nil {
+			info := parseCertInfo(string(output))
+			if !info.needsRenewal(hostKey.Fingerprint(), caKey.Fingerprint(), principals, time.Now()) {
+				VerboseLogger.LogInfo("Host certificate %s is current", certPath)
+				continue
+			}
+		}
+
+		fmt.Printf("Signing host key %s\n", pubPath)
+		identity := fmt.Sprintf("%s-%s", hostname, strings.ToLower(sshKeyTypes[hostKey.Type].Name))
+		err = VerboseCommandRun("ssh-keygen", "-q", "-s", ca.HostCAKey, "-I", identity, "-h",
+			"-n", strings.Join(principals, ","), "-V", validity, pubPath)
+		if err != nil {
+			return fmt.Errorf("could not sign %s: %v", pubPath, err)
+		}
+		changedFiles[filepath.Clean(certPath)] = true
+	}
+	return nil
+}
+
+// certInfo is what `ssh-keygen -L` reports about a certificate
+type certInfo struct {
+	PublicKey   string // fingerprint of the certified key
+	SigningCA   string // fingerprint of the CA
+	Principals  []string
+	ValidBefore time.Time // zero if valid forever
+}
+
+// parseCertInfo reads the output of `ssh-keygen -L`
+func parseCertInfo(output string) certInfo {
+	info := certInfo{}
+	inPrincipals := false
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		fields := strings.Fields(trimmed)
+		switch {
+		case strings.HasPrefix(trimmed, "Public key:") && len(fields) >= 4:
+			info.PublicKey = fields[3]
+		case strings.HasPrefix(trimmed, "Signing CA:") && len(fields) >= 4:
+			info.SigningCA = fields[3]
+		case strings.HasPrefix(trimmed, "Valid:"):
+			if i := strings.Index(trimmed, " to "); i >= 0 {
+				info.ValidBefore, _ = time.ParseInLocation("2006-01-02T15:04:05", trimmed[i+4:], time.Local)
+			}
+		case strings.HasPrefix(trimmed, "Principals:"):
+			inPrincipals = true
+			continue
+		case strings.HasSuffix(trimmed, ":") || strings.Contains(trimmed, ": "):
+			inPrincipals = false
+		case inPrincipals && trimmed != "" && trimmed != "(none)":
+			info.Principals = append(info.Principals, trimmed)
+		}
+	}
+	return info
+}
+
+// needsRenewal reports whether a certificate must be signed again
+func (c certInfo) needsRenewal(hostKey, caKey string, principals []string, now time.Time) bool {
+	if c.PublicKey != hostKey || c.SigningCA != caKey {
+		return true
+	}
+	if strings.Join(c.Principals, ",") != strings.Join(principals, ",") {
+		return true
+	}
+	return !c.ValidBefore.IsZero() && c.ValidBefore.Sub(now) < hostCertRenewal
+}
+
+// exportHostKeys writes known_hosts lines, fingerprints and certificates that
+// clients can pin
+func exportHostKeys(dir string, principals []string, sshPort int, withCerts bool) error {
+	if err := VerboseMkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	patterns := knownHostsPatterns(principals, sshPort)
+	var knownHosts, fingerprints strings.Builder
+	for _, pubPath := range hostKeys() {
+		data, err := ioutil.ReadFile(pubPath)
+		if err != nil {
+			return err
+		}
+		key, err := ParseAuthorizedKey(string(data))
+		if err != nil {
+			return fmt.Errorf("%s: %v", pubPath, err)
+		}
+		// The comment of a host key is the hostname it was generated on
+		key.Comment = ""
+		fmt.Fprintf(&knownHosts, "%s %s\n", patterns, key.Line())
+		fmt.Fprintf(&fingerprints, "%s\n", key)
+		fmt.Printf("Host key %s\n", key)
+
+		certPath := hostCertPath(pubPath)
+		if cert, err := ioutil.ReadFile(certPath); err == nil && withCerts {
+			if err := VerboseWriteFile(filepath.Join(dir, filepath.Base(certPath)), string(cert)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := VerboseWriteFile(filepath.Join(dir, "known_hosts"), knownHosts.String()); err != nil {
+		return err
+	}
+	if err := VerboseWriteFile(filepath.Join(dir, "fingerprints.txt"), fingerprints.String()); err != nil {
+		return err
+	}
+	fmt.Printf("Host keys exported to %s\n", dir)
+	return nil
+}
+
+// knownHostsPatterns renders the host patterns of a known_hosts line, with
+// the port in brackets unless it is 22
+func knownHostsPatterns(principals []string, port int) string {
+	var patterns []string
+	for _, principal := range principals {
+		if port > 0 && port != 22 {
+			principal = "[" + principal + "]:" + strconv.Itoa(port)
+		}
+		patterns = append(patterns, principal)
+	}
+	return strings.Join(patterns, ",")
+}
+
+// sshCADirectives returns the sshd settings for the CA files that exist
+func sshCADirectives(ca *config.SSHCA) []string {
+	if ca == nil {
+		return nil
+	}
+	var directives []string
+	if len(ca.UserCAKeys) > 0 {
+		directives = append(directives, "TrustedUserCAKeys "+userCAKeysPath())
+	}
+	directives = append(directives, "AuthorizedPrincipalsFile "+filepath.Join(principalsDir(), "%u"))
+	if ca.HostCAKey != "" {
+		for _, pubPath := range hostKeys() {
+			if _, err := os.Stat(hostCertPath(pubPath)); err == nil {
+				directives = append(directives, "HostCertificate "+hostCertPath(pubPath))
+			}
+		}
+	}
+	return directives
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"suite/suite/config"
+)
+
+const testCertInfo = `/etc/ssh/ssh_host_ed25519_key-cert.pub:
+        Type: ssh-ed25519-cert-v01@openssh.com host certificate
+        Public key: ED25519-CERT SHA256:canI9yOwFLFNm2bR/+fDufaoBqjgIPN3H9wItbkCy40
+        Signing CA: ED25519 SHA256:KXNq6XytNWJUCP3KhXElm6X6VmroVNK1ehqIstH8BOg (using ssh-ed25519)
+        Key ID: "web1-ed25519"
+        Serial: 0
+        Valid: from 2026-10-19T05:03:00 to 2027-10-18T05:04:39
+        Principals:
+                web1.example.com
+                10.0.0.5
+        Critical Options: (none)
+        Extensions: (none)
+`
+
+func TestParseCertInfo(t *testing.T) {
+	info := parseCertInfo(testCertInfo)
+	if info.PublicKey != "SHA256:canI9yOwFLFNm2bR/+fDufaoBqjgIPN3H9wItbkCy40" {
+		t.Errorf("PublicKey = %q", info.PublicKey)
+	}
+	if info.SigningCA != "SHA256:KXNq6XytNWJUCP3KhXElm6X6VmroVNK1ehqIstH8BOg" {
+		t.Errorf("SigningCA = %q", info.SigningCA)
+	}
+	if strings.Join(info.Principals, ",") != "web1.example.com,10.0.0.5" {
+		t.Errorf("Principals = %v", info.Principals)
+	}
+	if info.ValidBefore.Format("2006-01-02T15:04:05") != "2027-10-18T05:04:39" {
+		t.Errorf("ValidBefore = %v", info.ValidBefore)
+	}
+
+	forever := parseCertInfo("        Valid: forever\n        Principals: (none)\n")
+	if !forever.ValidBefore.IsZero() || len(forever.Principals) != 0 {
+		t.Errorf("parseCertInfo() of an unlimited certificate = %+v", forever)
+	}
+}
+
+func TestCertNeedsRenewal(t *testing.T) {
+	info := parseCertInfo(testCertInfo)
+	host, ca := info.PublicKey, info.SigningCA
+	principals := []string{"web1.example.com", "10.0.0.5"}
+	now := time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name       string
+		host, ca   string
+		principals []string
+		now        time.Time
+		want       bool
+	}{
+		{name: "current", host: host, ca: ca, principals: principals, now: now},
+		{name: "other host key", host: "SHA256:other", ca: ca, principals: principals, now: now, want: true},
+		{name: "other CA", host: host, ca: "SHA256:other", principals: principals, now: now, want: true},
+		{name: "other principals", host: host, ca: ca, principals: []string{"web1.example.com"}, now: now, want: true},
+		{name: "expiring", host: host, ca: ca, principals: principals, now: info.ValidBefore.Add(-24 * time.Hour), want: true},
+	}
+	for _, tt := range tests {
+		if got := info.needsRenewal(tt.host, tt.ca, tt.principals, tt.now); got != tt.want {
+			t.Errorf("needsRenewal() %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKnownHostsPatterns(t *testing.T) {
+	principals := []string{"web1.example.com", "10.0.0.5"}
+	if got := knownHostsPatterns(principals, 22); got != "web1.example.com,10.0.0.5" {
+		t.Errorf("knownHostsPatterns(22) = %q", got)
+	}
+	if got := knownHostsPatterns(principals, 2222); got != "[web1.example.com]:2222,[10.0.0.5]:2222" {
+		t.Errorf("knownHostsPatterns(2222) = %q", got)
+	}
+}
+
+func TestConfigureSSHCA(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not installed")
+	}
+	InitLogger(false)
+
+	dir, err := ioutil.TempDir("", "setupsuite-ssh-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir, oldGlob := sshCADir, sshHostKeyGlob
+	sshCADir = filepath.Join(dir, "setupsuite")
+	sshHostKeyGlob = filepath.Join(dir, "ssh_host_*_key.pub")
+	defer func() { sshCADir, sshHostKeyGlob = oldDir, oldGlob }()
+
+	caKey := filepath.Join(dir, "host_ca")
+	for _, path := range []string{caKey, filepath.Join(dir, "ssh_host_ed25519_key")} {
+		if err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", path).Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(principalsDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(principalsDir(), "olduser"), []byte("olduser\n"), 0644)
+
+	ca := &config.SSHCA{
+		UserCAKeys:     []string{testEd25519Key},
+		HostCAKey:      caKey,
+		HostPrincipals: []string{"web1.example.com"},
+	}
+	users := []config.User{{Name: "alice", Principals: []string{"alice", "ops"}}, {Name: "bob"}, {Name: "carol", State: "absent"}}
+	if err := ConfigureSSHCA(ca, users, 2222); err != nil {
+		t.Fatalf("ConfigureSSHCA() error = %v", err)
+	}
+
+	entries, _ := ioutil.ReadDir(principalsDir())
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != "alice,bob" {
+		t.Errorf("principals files = %v, want alice,bob", names)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(principalsDir(), "alice")); string(data) != "alice\nops\n" {
+		t.Errorf("principals of alice = %q", data)
+	}
+
+	certPath := filepath.Join(dir, "ssh_host_ed25519_key-cert.pub")
+	output, err := exec.Command("ssh-keygen", "-L", "-f", certPath).Output()
+	if err != nil {
+		t.Fatalf("no host certificate: %v", err)
+	}
+	if info := parseCertInfo(string(output)); strings.Join(info.Principals, ",") != "web1.example.com" {
+		t.Errorf("certificate principals = %v", info.Principals)
+	}
+	directives := strings.Join(sshCADirectives(ca), "\n")
+	if !strings.Contains(directives, "HostCertificate "+certPath) || !strings.Contains(directives, "TrustedUserCAKeys ") {
+		t.Errorf("sshCADirectives() = %q", directives)
+	}
+
+	knownHosts, _ := ioutil.ReadFile(filepath.Join(sshCADir, "export", "known_hosts"))
+	if !strings.HasPrefix(string(knownHosts), "[web1.example.com]:2222 ssh-ed25519 ") {
+		t.Errorf("known_hosts = %q", knownHosts)
+	}
+	if _, err := os.Stat(filepath.Join(sshCADir, "export", "ssh_host_ed25519_key-cert.pub")); err != nil {
+		t.Errorf("certificate not exported: %v", err)
+	}
+
+	// A current certificate is kept
+	before, _ := ioutil.ReadFile(certPath)
+	if err := ConfigureSSHCA(ca, users, 2222); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := ioutil.ReadFile(certPath); string(after) != string(before) {
+		t.Error("current host certificate was signed again")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// defaultMinRSABits is the shortest RSA key accepted unless .ssh{} says otherwise
+const defaultMinRSABits = 3072
+
+// sshKeyType describes a supported key type
+type sshKeyType struct {
+	Name  string // as ssh-keygen -l prints it
+	Curve string // ECDSA curve, empty otherwise
+}
+
+// sshKeyTypes are the key types accepted in authorized_keys. DSA keys are
+// left out, OpenSSH no longer accepts them.
+var sshKeyTypes = map[string]sshKeyType{
+	"ssh-rsa":                            {Name: "RSA"},
+	"ssh-ed25519":                        {Name: "ED25519"},
+	"ecdsa-sha2-nistp256":                {Name: "ECDSA", Curve: "nistp256"},
+	"ecdsa-sha2-nistp384":                {Name: "ECDSA", Curve: "nistp384"},
+	"ecdsa-sha2-nistp521":                {Name: "ECDSA", Curve: "nistp521"},
+	"sk-ecdsa-sha2-nistp256@openssh.com": {Name: "ECDSA-SK", Curve: "nistp256"},
+	"sk-ssh-ed25519@openssh.com":         {Name: "ED25519-SK"},
+}
+
+// ecdsaCurveBits is the size of each ECDSA curve
+var ecdsaCurveBits = map[string]int{"nistp256": 256, "nistp384": 384, "nistp521": 521}
+
+// SSHPublicKey is one parsed authorized_keys entry
+type SSHPublicKey struct {
+	Options string
+	Type    string
+	Blob    []byte
+	Comment string
+	Bits    int
+}
+
+// Fingerprint returns the SHA256 fingerprint the way ssh-keygen -l prints it
+func (k *SSHPublicKey) Fingerprint() string {
+	sum := sha256.Sum256(k.Blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Line renders the key as an authorized_keys line
+func (k *SSHPublicKey) Line() string {
+	parts := []string{k.Type, base64.StdEncoding.EncodeToString(k.Blob)}
+	if k.Options != "" {
+		parts = append([]string{k.Options}, parts...)
+	}
+	if k.Comment != "" {
+		parts = append(parts, k.Comment)
+	}
+	return strings.Join(parts, " ")
+}
+
+// String describes the key for messages, e.g. "SHA256:... (ED25519-256 alice@laptop)"
+func (k *SSHPublicKey) String() string {
+	description := fmt.Sprintf("%s-%d", sshKeyTypes[k.Type].Name, k.Bits)
+	if k.Comment != "" {
+		description += " " + k.Comment
+	}
+	return fmt.Sprintf("%s (%s)", k.Fingerprint(), description)
+}
+
+// ParseAuthorizedKey parses a line in authorized_keys format:
+// [options] type base64 [comment]
+func ParseAuthorizedKey(line string) (*SSHPublicKey, error) {
+	line = strings.TrimSpace(line)
+	if strings.Contains(strings.ToUpper(line), "REPLACE_WITH") {
+		return nil, fmt.Errorf("still the placeholder, replace it with your public key")
+	}
+
+	key := &SSHPublicKey{}
+	first, rest := splitAuthorizedKeyField(line)
+	if _, ok := sshKeyTypes[first]; !ok {
+		// Options come first, quoted values may contain spaces
+		key.Options = first
+		first, rest = splitAuthorizedKeyField(rest)
+		if _, ok := sshKeyTypes[first]; !ok {
+			if first == "" {
+				return nil, fmt.Errorf("no key found")
+			}
+			return nil, fmt.Errorf("unsupported key type %q", first)
+		}
+	}
+	key.Type = first
+
+	encoded, comment := splitAuthorizedKeyField(rest)
+	key.Comment = strings.TrimSpace(comment)
+	blob, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || encoded == "" {
+		return nil, fmt.Errorf("%s key is not valid base64", key.Type)
+	}
+	key.Blob = blob
+
+	bits, err := sshKeyBits(key.Type, blob)
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s key: %v", key.Type, err)
+	}
+	key.Bits = bits
+	return key, nil
+}
+
+// splitAuthorizedKeyField splits off the first field, honouring double quotes
+func splitAuthorizedKeyField(line string) (string, string) {
+	line = strings.TrimLeftFunc(line, unicode.IsSpace)
+	inQuotes := false
+	for i, r := range line {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case unicode.IsSpace(r) && !inQuotes:
+			return line[:i], line[i+1:]
+		}
+	}
+	return line, ""
+}
+
+// sshKeyBits checks the wire format of a key blob and returns its size
+func sshKeyBits(keyType string, blob []byte) (int, error) {
+	name, blob, err := readSSHString(blob)
+	if err != nil {
+		return 0, err
+	}
+	if string(name) != keyType {
+		return 0, fmt.Errorf("blob holds a %s key", name)
+	}
+
+	switch keyType {
+	case "ssh-rsa":
+		if _, blob, err = readSSHString(blob); err != nil {
+			return 0, err
+		}
+		modulus, _, err := readSSHString(blob)
+		if err != nil {
+			return 0, err
+		}
+		return new(big.Int).SetBytes(modulus).BitLen(), nil
+	case "ssh-ed25519", "sk-ssh-ed25519@openssh.com":
+		point, _, err := readSSHString(blob)
+		if err != nil {
+			return 0, err
+		}
+		if len(point) != 32 {
+			return 0, fmt.Errorf("ed25519 key has %d bytes", len(point))
+		}
+		return 256, nil
+	}
+
+	curve, blob, err := readSSHString(blob)
+	if err != nil {
+		return 0, err
+	}
+	if string(curve) != sshKeyTypes[keyType].Curve {
+		return 0, fmt.Errorf("curve %s does not match", curve)
+	}
+	point, _, err := readSSHString(blob)
+	if err != nil {
+		return 0, err
+	}
+	bits := ecdsaCurveBits[string(curve)]
+	if len(point) != 1+2*((bits+7)/8) || point[0] != 4 {
+		return 0, fmt.Errorf("invalid %s point", curve)
+	}
+	return bits, nil
+}
+
+// readSSHString reads one length prefixed string of the SSH wire format
+func readSSHString(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("truncated key")
+	}
+	length := binary.BigEndian.Uint32(data)
+	if uint64(length) > uint64(len(data)-4) {
+		return nil, nil, fmt.Errorf("truncated key")
+	}
+	return data[4 : 4+length], data[4+length:], nil
+}
+
+// parseUserKeys parses and checks the keys of a user, refusing RSA keys
+// shorter than minRSABits
+func parseUserKeys(name string, lines []string, minRSABits int) ([]*SSHPublicKey, error) {
+	var keys []*SSHPublicKey
+	for i, line := range lines {
+		key, err := ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: key %d: %v", name, i+1, err)
+		}
+		if key.Type == "ssh-rsa" && key.Bits < minRSABits {
+			return nil, fmt.Errorf("user %s: key %d: RSA key has %d bits, at least %d are required", name, i+1, key.Bits, minRSABits)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// checkAuthorizedKeys verifies that authorized_keys of a user holds exactly
+// the configured keys and lists their fingerprints
+func checkAuthorizedKeys(name string, lines []string) (string, error) {
+	data, err := readAuthorizedKeysFile(name)
+	if os.IsNotExist(err) && len(lines) == 0 {
+		return "no keys", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	installed := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, err := ParseAuthorizedKey(line); err == nil {
+			installed[string(key.Blob)] = true
+		}
+	}
+
+	var fingerprints, missing []string
+	for _, line := range lines {
+		key, err := ParseAuthorizedKey(line)
+		if err != nil {
+			return "", err
+		}
+		if !installed[string(key.Blob)] {
+			missing = append(missing, key.Fingerprint())
+			continue
+		}
+		delete(installed, string(key.Blob))
+		fingerprints = append(fingerprints, key.String())
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("authorized_keys of %s lacks %s", name, strings.Join(missing, ", "))
+	}
+	if len(installed) > 0 {
+		return "", fmt.Errorf("authorized_keys of %s holds %d key(s) not in the config", name, len(installed))
+	}
+	if len(fingerprints) == 0 {
+		return "no keys", nil
+	}
+	return strings.Join(fingerprints, ", "), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+const (
+	testEd25519Key  = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKJuZpvLC+NHutbhrjuL0aEb3R2eCIrEZx2sMXn7t37t test@ed25519"
+	testRSA2048Key  = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCVlaU22ekH2bcZOwsGSRehQkA9DXTXUMEaBLDjWKrHeyllzabmXv5VFyK9jeYSh9KwJygJVdnrvuV0y+CJuBMqg8ka5W7si/5Cr6/DAHHY6HdGP+cF0M/wFR8PeYhVNPuu4YX3dCnTFGl7GswLv0IDg6tj5xpPEPvWwROV9Ypc0ITnr64YMBBySJ5t3RkzDU0MArQPqSzsGWyEoZ2QFD0LOvs3VYkZR9gaNDlYpFH/W8+9rzy2PeN1oDx/zsCH5530O2yWM01QjxaG95pp0l+vqPeaD0OGzkTqERwFPQ6//Hp+L2m/1XgVWEU/X4JzmF7KG/a3CmwYBxjF92TNBHLv test@rsab2048"
+	testRSA3072Key  = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQC32VDft+xMBIcu+p1JtCz+kFI5J5j2cc2PvvUkmxyid+NQOpJQ2Vdwhk2HXXs1ZB89+/KbEx8DL2fEIVMzqZ89olGO8ysU/kTKys2RkXZTRT+7XpuyOjCndTRr+M6Biz5sH4Jm8CjVYi0S90JQzlc7E45lB8loSRBcx8XGdUhchhzP6ZwLIHAdhNjNYl+hQIUZfzmFmQvyOTaScY/17H+y/ub71XnYMxZoQtg465cFqWDtzBFoVVRcDhJyHbJGhb3ipBsZ04GWDoWkoFbUz2Hv9Ep/CsUpJGNcNPFe2Oyc1HWBrgpH+8vwYUKfOKgjOnNEN6zHIMEJ6CrH75lLppseR9TbEhLh/Afb7s5/2ZDig+tVgZRisoc+szG6y0dGcUnqBOH/bD2xuTn8WXkihGl9O6plzibax+HKWmmmJZ2sfj+OMB3UBlQxP2HbkIx1mHeJ0UgKQBUnc13LIdPJGyTr8/bBbJGw5XZykOR4Zd6yYXl/iy8MOW2XO77F1Vts57E= test@rsab3072"
+	testECDSA384Key = "ecdsa-sha2-nistp384 AAAAE2VjZHNhLXNoYTItbmlzdHAzODQAAAAIbmlzdHAzODQAAABhBIj0RNolV2aeOU8X6K7h6yLOkhv6VBkO/B+IM2X/8q5+y1M43Fk1qFRxJJS7yBss9Zz73bfUFSPYz/zl9uBtEWYSFGXpw+aGhp9uMHU79ybZbtrzG0WcyUpv7u8YsW2VAA== test@ecdsab384"
+)
+
+// sshBlob builds a key blob from wire format strings
+func sshBlob(parts ...[]byte) string {
+	var blob []byte
+	for _, part := range parts {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(part)))
+		blob = append(append(blob, length...), part...)
+	}
+	return base64.StdEncoding.EncodeToString(blob)
+}
+
+func TestParseAuthorizedKey(t *testing.T) {
+	skKey := "sk-ssh-ed25519@openssh.com " + sshBlob([]byte("sk-ssh-ed25519@openssh.com"), make([]byte, 32), []byte("ssh:")) + " yubikey"
+
+	tests := []struct {
+		line        string
+		fingerprint string
+		description string
+		options     string
+		wantErr     string
+	}{
+		{line: testEd25519Key, fingerprint: "SHA256:gGxXY499caAnwEMp0KZPIJ3zJQ6NeCuhySLvmggkkhc", description: "ED25519-256 test@ed25519"},
+		{line: testRSA3072Key, fingerprint: "SHA256:WbLXHkZiOh3ow1h6sdj6UrlzKnHvNQEujV1yDaxHRpo", description: "RSA-3072 test@rsab3072"},
+		{line: testECDSA384Key, fingerprint: "SHA256:dbwFNUey41Ir4NOogZtcon06+WZzn7mqHGdirYWUDJ4", description: "ECDSA-384 test@ecdsab384"},
+		{line: skKey, description: "ED25519-SK-256 yubikey"},
+		{
+			line:        `from="10.0.0.0/8,192.168.1.1",command="echo hi there",no-pty ` + testEd25519Key,
+			fingerprint: "SHA256:gGxXY499caAnwEMp0KZPIJ3zJQ6NeCuhySLvmggkkhc",
+			options:     `from="10.0.0.0/8,192.168.1.1",command="echo hi there",no-pty`,
+		},
+		{line: "REPLACE_WITH_YOUR_SSH_KEY", wantErr: "placeholder"},
+		{line: "ssh-dss AAAAB3NzaC1kc3MAAACBAP test", wantErr: "unsupported key type"},
+		{line: "ssh-ed25519 not-base64!", wantErr: "not valid base64"},
+		{line: "ssh-rsa " + strings.Fields(testEd25519Key)[1], wantErr: "blob holds a ssh-ed25519 key"},
+		{line: "ssh-ed25519 " + sshBlob([]byte("ssh-ed25519"), make([]byte, 31)), wantErr: "31 bytes"},
+		{line: "ssh-ed25519 " + sshBlob([]byte("ssh-ed25519"))[:12], wantErr: "truncated"},
+		{line: "", wantErr: "no key found"},
+	}
+	for _, tt := range tests {
+		key, err := ParseAuthorizedKey(tt.line)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseAuthorizedKey(%q) error = %v, want %q", tt.line, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseAuthorizedKey(%q) error = %v", tt.line, err)
+			continue
+		}
+		if tt.fingerprint != "" && key.Fingerprint() != tt.fingerprint {
+			t.Errorf("Fingerprint() = %s, want %s", key.Fingerprint(), tt.fingerprint)
+		}
+		if tt.description != "" && !strings.HasSuffix(key.String(), "("+tt.description+")") {
+			t.Errorf("String() = %s, want (%s)", key, tt.description)
+		}
+		if key.Options != tt.options {
+			t.Errorf("Options = %q, want %q", key.Options, tt.options)
+		}
+		if key.Line() != strings.TrimSpace(tt.line) {
+			t.Errorf("Line() = %q, want %q", key.Line(), tt.line)
+		}
+	}
+}
+
+func TestParseUserKeys(t *testing.T) {
+	if _, err := parseUserKeys("alice", []string{testEd25519Key, testRSA3072Key}, defaultMinRSABits); err != nil {
+		t.Errorf("parseUserKeys() error = %v", err)
+	}
+	_, err := parseUserKeys("alice", []string{testEd25519Key, testRSA2048Key}, defaultMinRSABits)
+	if err == nil || !strings.Contains(err.Error(), "key 2: RSA key has 2048 bits") {
+		t.Errorf("parseUserKeys() error = %v, want a refused 2048 bit key", err)
+	}
+	if _, err := parseUserKeys("alice", []string{testRSA2048Key}, 2048); err != nil {
+		t.Errorf("parseUserKeys() with min_rsa_bits 2048 error = %v", err)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"suite/suite/config"
+)
+
+// sshdConfigPath is the main sshd configuration
+var sshdConfigPath = "/etc/ssh/sshd_config"
+
+// sshdDropInPath holds SetupSuite's settings where sshd_config includes
+// sshd_config.d. sshd keeps the first value it reads, and the include sits at
+// the top of the main configuration, so these settings win.
+var sshdDropInPath = "/etc/ssh/sshd_config.d/10-setupsuite.conf"
+
+// legacySSHDHeader starts the sshd_config earlier versions wrote over the original
+const legacySSHDHeader = "# SetupSuite generated SSH configuration"
+
+// sftpServerPaths are the sftp-server locations of the supported distributions
+var sftpServerPaths = []string{
+	"/usr/lib/openssh/sftp-server",     // Debian, Ubuntu
+	"/usr/libexec/openssh/sftp-server", // RHEL, Fedora
+	"/usr/lib/ssh/sftp-server",         // Arch, Alpine, openSUSE
+	"/usr/lib64/misc/sftp-server",      // Gentoo
+	"/usr/libexec/sftp-server",         // Void
+}
+
+// sshCryptoProfile lists the algorithms of one crypto profile, strongest first
+type sshCryptoProfile struct {
+	Kex               []string
+	Ciphers           []string
+	MACs              []string
+	HostKeyAlgorithms []string
+}
+
+var intermediateCiphers = []string{
+	"chacha20-poly1305@openssh.com", "aes256-gcm@openssh.com", "aes128-gcm@openssh.com",
+	"aes256-ctr", "aes192-ctr", "aes128-ctr",
+}
+
+var intermediateKex = []string{
+	"sntrup761x25519-sha512@openssh.com", "curve25519-sha256", "curve25519-sha256@libssh.org",
+	"diffie-hellman-group16-sha512", "diffie-hellman-group18-sha512", "diffie-hellman-group-exchange-sha256",
+	"ecdh-sha2-nistp521", "ecdh-sha2-nistp384", "ecdh-sha2-nistp256",
+}
+
+var intermediateMACs = []string{
+	"hmac-sha2-512-etm@openssh.com", "hmac-sha2-256-etm@openssh.com", "umac-128-etm@openssh.com",
+	"hmac-sha2-512", "hmac-sha2-256",
+}
+
+var intermediateHostKeys = []string{
+	"ssh-ed25519", "ssh-ed25519-cert-v01@openssh.com",
+	"ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521",
+	"rsa-sha2-512", "rsa-sha2-512-cert-v01@openssh.com", "rsa-sha2-256", "rsa-sha2-256-cert-v01@openssh.com",
+}
+
+// sshCryptoProfiles are modern for OpenSSH 8+ clients only, intermediate for
+// most clients of the last decade, and legacy for old embedded clients
+var sshCryptoProfiles = map[string]sshCryptoProfile{
+	"modern": {
+		Kex:     []string{"sntrup761x25519-sha512@openssh.com", "curve25519-sha256", "curve25519-sha256@libssh.org"},
+		Ciphers: []string{"chacha20-poly1305@openssh.com", "aes256-gcm@openssh.com", "aes128-gcm@openssh.com"},
+		MACs:    []string{"hmac-sha2-512-etm@openssh.com", "hmac-sha2-256-etm@openssh.com"},
+		HostKeyAlgorithms: []string{
+			"ssh-ed25519", "ssh-ed25519-cert-v01@openssh.com",
+			"rsa-sha2-512", "rsa-sha2-512-cert-v01@openssh.com", "rsa-sha2-256", "rsa-sha2-256-cert-v01@openssh.com",
+		},
+	},
+	"intermediate": {
+		Kex:               intermediateKex,
+		Ciphers:           intermediateCiphers,
+		MACs:              intermediateMACs,
+		HostKeyAlgorithms: intermediateHostKeys,
+	},
+	"legacy": {
+		Kex:               append(append([]string(nil), intermediateKex...), "diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1"),
+		Ciphers:           intermediateCiphers,
+		MACs:              append(append([]string(nil), intermediateMACs...), "hmac-sha1"),
+		HostKeyAlgorithms: append(append([]string(nil), intermediateHostKeys...), "ssh-rsa"),
+	},
+}
+
+// configureSSHD writes SetupSuite's sshd settings, as a drop-in where
+// supported and as a managed block at the top of sshd_config elsewhere, and
+// restarts sshd if they changed and pass sshd -t
+func configureSSHD(cfg *config.SetupSecure, facts *Facts) error {
+	fmt.Printf("Configuring SSH daemon on %s\n", sshPortLabel(cfg.SSHPort))
+	VerboseLogger.LogInfo("Configuring SSH daemon on %s", sshPortLabel(cfg.SSHPort))
+
+	var directives []string
+	if cfg.SSH != nil && cfg.SSH.Crypto != "" {
+		var err error
+		if directives, err = sshCryptoLines(cfg.SSH.Crypto, sshQuery); err != nil {
+			return err
+		}
+	}
+	directives = append(directives, sshCADirectives(cfg.SSHCA)...)
+
+	migrateLegacySSHDConfig()
+	data, err := ioutil.ReadFile(sshdConfigPath)
+	if err != nil {
+		return err
+	}
+	main := string(data)
+
+	// A second Subsystem sftp line is an error, so only add one if missing
+	subsystem := ""
+	if !sshdHasSubsystem(removeManagedBlock(main, "sshd-settings")) {
+		subsystem = detectSFTPServer()
+	}
+	extraPorts := ""
+	if ActiveSafeApply != nil {
+		// Keep the old ports listening until a safe apply is confirmed
+		extraPorts = ActiveSafeApply.sshdPortsBlock()
+	}
+	globals, matches := renderSSHDSettings(cfg, extraPorts, subsystem, directives)
+
+	newMain := main
+	if cfg.SSHPort > 0 {
+		// Port lines add up instead of the first one winning
+		newMain = commentOutSSHDPorts(main)
+	}
+	files := map[string]string{}
+	if sshdSupportsDropIns(main) {
+		files[sshdDropInPath] = managedHeader + globals + matches
+		newMain = removeManagedBlock(removeManagedBlock(newMain, "sshd-settings"), "sshd-match")
+	} else {
+		newMain = prependManagedBlock(newMain, "sshd-settings", globals)
+		if matches != "" {
+			// Match blocks last, they last until the next Match or the end
+			newMain = setManagedBlock(newMain, "sshd-match", matches)
+		} else {
+			newMain = removeManagedBlock(newMain, "sshd-match")
+		}
+	}
+	files[sshdConfigPath] = newMain
+
+	previous := map[string][]byte{}
+	changed := false
+	for path, content := range files {
+		old, err := ioutil.ReadFile(path)
+		if err == nil && string(old) == content {
+			continue
+		}
+		previous[path] = old
+		if err := VerboseMkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := VerboseWriteFile(path, content); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if !changed {
+		fmt.Println("SSH configuration is up to date")
+		return nil
+	}
+
+	VerboseLogger.LogInfo("Testing SSH configuration")
+	if output, err := exec.Command("sshd", "-t").CombinedOutput(); err != nil {
+		fmt.Println("SSH configuration test failed, reverting")
+		VerboseLogger.LogError("SSH configuration test failed: %s", output)
+		for path, old := range previous {
+			if old == nil {
+				os.Remove(path)
+			} else {
+				VerboseWriteFile(path, string(old))
+			}
+		}
+		return fmt.Errorf("sshd -t rejected the configuration: %s", lastLine(string(output)))
+	}
+	VerboseLogger.LogInfo("SSH configuration test passed, restarting SSH service")
+	restartSSHD(facts)
+	return nil
+}
+
+// renderSSHDSettings returns the global settings and the Match blocks.
+// directives holds the crypto and certificate settings.
+func renderSSHDSettings(cfg *config.SetupSecure, extraPorts, subsystem string, directives []string) (string, string) {
+	ssh := cfg.SSH
+	if ssh == nil {
+		ssh = &config.SSH{}
+	}
+
+	var b strings.Builder
+	if cfg.SSHPort > 0 {
+		fmt.Fprintf(&b, "Port %d\n", cfg.SSHPort)
+	}
+	b.WriteString(extraPorts)
+	b.WriteString("PermitRootLogin no\n")
+	b.WriteString("PubkeyAuthentication yes\n")
+	b.WriteString("PasswordAuthentication no\n")
+	b.WriteString("PermitEmptyPasswords no\n")
+	b.WriteString("KbdInteractiveAuthentication no\n")
+	if ssh.X11Forwarding {
+		b.WriteString("X11Forwarding yes\n")
+	} else {
+		b.WriteString("X11Forwarding no\n")
+	}
+	if ssh.MaxAuthTries > 0 {
+		fmt.Fprintf(&b, "MaxAuthTries %d\n", ssh.MaxAuthTries)
+	}
+	if ssh.LoginGraceTime != "" {
+		fmt.Fprintf(&b, "LoginGraceTime %s\n", ssh.LoginGraceTime)
+	}
+	if len(ssh.AllowUsers) > 0 {
+		fmt.Fprintf(&b, "AllowUsers %s\n", strings.Join(ssh.AllowUsers, " "))
+	}
+	if len(ssh.AllowGroups) > 0 {
+		fmt.Fprintf(&b, "AllowGroups %s\n", strings.Join(ssh.AllowGroups, " "))
+	} else if len(ssh.AllowUsers) == 0 {
+		b.WriteString("AllowGroups sshuser\n")
+	}
+	for _, line := range directives {
+		b.WriteString(line + "\n")
+	}
+	if subsystem != "" {
+		fmt.Fprintf(&b, "Subsystem sftp %s\n", subsystem)
+	}
+
+	var m strings.Builder
+	for _, match := range ssh.Matches {
+		fmt.Fprintf(&m, "Match %s\n", match.Criteria)
+		for _, setting := range match.Settings {
+			fmt.Fprintf(&m, "    %s\n", setting)
+		}
+	}
+	return b.String(), m.String()
+}
+
+// sshCryptoLines renders a crypto profile, leaving out algorithms the
+// installed OpenSSH does not know, since sshd refuses to start on those
+func sshCryptoLines(profile string, query func(string) map[string]bool) ([]string, error) {
+	p, ok := sshCryptoProfiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown ssh crypto profile %q (use modern, intermediate or legacy)", profile)
+	}
+
+	var lines []string
+	for _, directive := range []struct {
+		name       string
+		query      string
+		algorithms []string
+	}{
+		{"KexAlgorithms", "kex", p.Kex},
+		{"Ciphers", "cipher", p.Ciphers},
+		{"MACs", "mac", p.MACs},
+		{"HostKeyAlgorithms", "HostKeyAlgorithms", p.HostKeyAlgorithms},
+	} {
+		algorithms := directive.algorithms
+		if supported := query(directive.query); len(supported) > 0 {
+			algorithms = nil
+			for _, algorithm := range directive.algorithms {
+				if supported[algorithm] {
+					algorithms = append(algorithms, algorithm)
+				}
+			}
+		}
+		if len(algorithms) == 0 {
+			fmt.Printf("Warning: OpenSSH supports none of the %s of the %s profile, keeping its defaults\n", directive.name, profile)
+			continue
+		}
+		lines = append(lines, directive.name+" "+strings.Join(algorithms, ","))
+	}
+	return lines, nil
+}
+
+// sshQuery returns the algorithms `ssh -Q` lists, or nothing if it cannot tell
+func sshQuery(name string) map[string]bool {
+	output, err := exec.Command("ssh", "-Q", name).Output()
+	if err != nil {
+		return nil
+	}
+	supported := make(map[string]bool)
+	for _, line := range strings.Fields(string(output)) {
+		supported[line] = true
+	}
+	return supported
+}
+
+// sshdSupportsDropIns reports whether the main configuration includes the
+// directory of sshdDropInPath
+func sshdSupportsDropIns(main string) bool {
+	dir := filepath.Dir(sshdDropInPath) + "/"
+	for _, line := range strings.Split(main, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.EqualFold(fields[0], "Include") && strings.HasPrefix(fields[1], dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// sshdSettingsPath is the file holding SetupSuite's sshd settings
+func sshdSettingsPath() string {
+	if data, err := ioutil.ReadFile(sshdConfigPath); err == nil && sshdSupportsDropIns(string(data)) {
+		return sshdDropInPath
+	}
+	return sshdConfigPath
+}
+
+func sshdHasSubsystem(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.EqualFold(fields[0], "Subsystem") && fields[1] == "sftp" {
+			return true
+		}
+	}
+	return false
+}
+
+// detectSFTPServer returns the installed sftp-server, or sshd's built-in one
+func detectSFTPServer() string {
+	for _, path := range sftpServerPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return "internal-sftp"
+}
+
+// commentOutSSHDPorts disables the Port lines outside SetupSuite's blocks
+func commentOutSSHDPorts(content string) string {
+	lines := strings.Split(content, "\n")
+	depth := 0
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "# BEGIN SetupSuite "):
+			depth++
+		case strings.HasPrefix(trimmed, "# END SetupSuite "):
+			depth--
+		case depth == 0:
+			fields := strings.Fields(trimmed)
+			if len(fields) == 2 && strings.EqualFold(fields[0], "Port") {
+				lines[i] = "#" + trimmed + " # replaced by SetupSuite"
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// migrateLegacySSHDConfig undoes the sshd_config overwrite of earlier
+// versions, which included the original from sshd_config.backup
+func migrateLegacySSHDConfig() {
+	data, err := ioutil.ReadFile(sshdConfigPath)
+	if err != nil || !strings.HasPrefix(string(data), legacySSHDHeader) {
+		return
+	}
+
+	backup, err := ioutil.ReadFile(sshdConfigPath + ".backup")
+	if err == nil && !strings.HasPrefix(string(backup), legacySSHDHeader) {
+		fmt.Println("Restoring the original sshd_config saved by an earlier SetupSuite version")
+		VerboseWriteFile(sshdConfigPath, string(backup))
+		return
+	}
+
+	// A second run of an earlier version overwrote the backup with itself
+	fmt.Println("Warning: The original sshd_config is lost, keeping the one an earlier SetupSuite version generated")
+	VerboseWriteFile(sshdConfigPath, strings.Replace(string(data), "Include "+sshdConfigPath+".backup\n", "", 1))
+}
+
+// restartSSHD restarts the SSH daemon under its distribution specific name,
+// ssh on Debian and Ubuntu and sshd elsewhere
+func restartSSHD(facts *Facts) {
+	serviceName := ResolveService(facts, "ssh")
+	sm, err := NewServiceManager()
+	if err != nil {
+		fmt.Printf("Warning: Could not restart %s: %v\n", serviceName, err)
+		return
+	}
+	if err := RestartAndVerify(sm, serviceName); err != nil {
+		VerboseLogger.LogError("SSH restart failed: %s", err)
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+// sshPortLabel formats the configured SSH port for messages
+func sshPortLabel(port int) string {
+	if port == 0 {
+		return "the current port"
+	}
+	return "port " + strconv.Itoa(port)
+}
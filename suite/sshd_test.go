@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"suite/suite/config"
+)
+
+func TestRenderSSHDSettings(t *testing.T) {
+	cfg := &config.SetupSecure{
+		SSHPort: 22022,
+		SSH: &config.SSH{
+			MaxAuthTries:   3,
+			LoginGraceTime: "30s",
+			AllowUsers:     []string{"deploy", "admin"},
+			Matches: []config.SSHMatch{
+				{Criteria: "Address 10.0.0.0/8", Settings: []string{"PasswordAuthentication yes"}},
+			},
+		},
+	}
+	globals, matches := renderSSHDSettings(cfg, "", "internal-sftp", []string{"Ciphers aes256-gcm@openssh.com"})
+
+	for _, want := range []string{
+		"Port 22022\n", "PasswordAuthentication no\n", "X11Forwarding no\n", "MaxAuthTries 3\n",
+		"LoginGraceTime 30s\n", "AllowUsers deploy admin\n", "Ciphers aes256-gcm@openssh.com\n", "Subsystem sftp internal-sftp\n",
+	} {
+		if !strings.Contains(globals, want) {
+			t.Errorf("globals missing %q:\n%s", want, globals)
+		}
+	}
+	if strings.Contains(globals, "AllowGroups") {
+		t.Errorf("AllowGroups sshuser must not be added next to AllowUsers:\n%s", globals)
+	}
+	if want := "Match Address 10.0.0.0/8\n    PasswordAuthentication yes\n"; matches != want {
+		t.Errorf("matches = %q, want %q", matches, want)
+	}
+
+	globals, matches = renderSSHDSettings(&config.SetupSecure{SSHPort: 22}, "", "", nil)
+	if !strings.Contains(globals, "AllowGroups sshuser\n") || strings.Contains(globals, "Subsystem") || matches != "" {
+		t.Errorf("default settings = %q, %q", globals, matches)
+	}
+}
+
+func TestSSHCryptoLines(t *testing.T) {
+	supported := map[string]map[string]bool{
+		"kex":    {"curve25519-sha256": true, "curve25519-sha256@libssh.org": true},
+		"cipher": {"aes128-gcm@openssh.com": true},
+		"mac":    {"hmac-sha1": true},
+	}
+	query := func(name string) map[string]bool { return supported[name] }
+
+	lines, err := sshCryptoLines("modern", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"KexAlgorithms curve25519-sha256,curve25519-sha256@libssh.org",
+		"Ciphers aes128-gcm@openssh.com",
+		// Unknown to ssh -Q, so left unfiltered
+		"HostKeyAlgorithms ssh-ed25519,ssh-ed25519-cert-v01@openssh.com,rsa-sha2-512,rsa-sha2-512-cert-v01@openssh.com,rsa-sha2-256,rsa-sha2-256-cert-v01@openssh.com",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("sshCryptoLines(modern) = %q, want %q", lines, want)
+	}
+
+	lines, _ = sshCryptoLines("legacy", query)
+	if lines[2] != "MACs hmac-sha1" {
+		t.Errorf("legacy MACs = %q, want hmac-sha1", lines[2])
+	}
+
+	if _, err := sshCryptoLines("paranoid", query); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
+
+func TestSSHDSupportsDropIns(t *testing.T) {
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{content: "Include /etc/ssh/sshd_config.d/*.conf\nPort 22\n", want: true},
+		{content: "include /etc/ssh/sshd_config.d/*.conf\n", want: true},
+		{content: "#Include /etc/ssh/sshd_config.d/*.conf\nPort 22\n", want: false},
+		{content: "Port 22\nSubsystem sftp internal-sftp\n", want: false},
+	}
+	for _, tt := range tests {
+		if got := sshdSupportsDropIns(tt.content); got != tt.want {
+			t.Errorf("sshdSupportsDropIns(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestCommentOutSSHDPorts(t *testing.T) {
+	content := "Port 22\n#Port 2222\n# BEGIN SetupSuite sshd-settings\nPort 22022\n# BEGIN SetupSuite safe-apply\nPort 22\n# END SetupSuite safe-apply\n# END SetupSuite sshd-settings\n"
+	want := "#Port 22 # replaced by SetupSuite\n#Port 2222\n# BEGIN SetupSuite sshd-settings\nPort 22022\n# BEGIN SetupSuite safe-apply\nPort 22\n# END SetupSuite safe-apply\n# END SetupSuite sshd-settings\n"
+	if got := commentOutSSHDPorts(content); got != want {
+		t.Errorf("commentOutSSHDPorts() = %q, want %q", got, want)
+	}
+	if got := commentOutSSHDPorts(want); got != want {
+		t.Errorf("commentOutSSHDPorts() is not idempotent: %q", got)
+	}
+}
+
+func TestPrependManagedBlock(t *testing.T) {
+	content := prependManagedBlock("Port 22\n", "sshd-settings", "Port 22022\n")
+	want := "# BEGIN SetupSuite sshd-settings\nPort 22022\n# END SetupSuite sshd-settings\nPort 22\n"
+	if content != want {
+		t.Errorf("prependManagedBlock() = %q, want %q", content, want)
+	}
+	content = prependManagedBlock(content, "sshd-settings", "Port 2222\n")
+	if want := strings.Replace(want, "22022", "2222", 1); content != want {
+		t.Errorf("prependManagedBlock() on existing block = %q, want %q", content, want)
+	}
+}
+
+func TestMigrateLegacySSHDConfig(t *testing.T) {
+	InitLogger(false)
+
+	dir, err := ioutil.TempDir("", "setupsuite-sshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldPath := sshdConfigPath
+	sshdConfigPath = filepath.Join(dir, "sshd_config")
+	defer func() { sshdConfigPath = oldPath }()
+
+	legacy := legacySSHDHeader + "\nPort 22022\nInclude " + sshdConfigPath + ".backup\n"
+	original := "Include /etc/ssh/sshd_config.d/*.conf\nPort 22\n"
+
+	ioutil.WriteFile(sshdConfigPath, []byte(legacy), 0644)
+	ioutil.WriteFile(sshdConfigPath+".backup", []byte(original), 0644)
+	migrateLegacySSHDConfig()
+	if data, _ := ioutil.ReadFile(sshdConfigPath); string(data) != original {
+		t.Errorf("migrated config = %q, want the backup %q", data, original)
+	}
+
+	// A second run of an earlier version left a generated backup
+	ioutil.WriteFile(sshdConfigPath, []byte(legacy), 0644)
+	ioutil.WriteFile(sshdConfigPath+".backup", []byte(legacy), 0644)
+	migrateLegacySSHDConfig()
+	if data, _ := ioutil.ReadFile(sshdConfigPath); strings.Contains(string(data), "Include") {
+		t.Errorf("migrated config still includes itself: %q", data)
+	}
+}
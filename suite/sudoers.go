@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"suite/suite/config"
+)
+
+// sudoersPath is the main sudoers file
+var sudoersPath = "/etc/sudoers"
+
+// sudoersDir holds one SetupSuite file per user with sudo rights. sudo skips
+// files with a dot in their name, so temporary files there are never read.
+var sudoersDir = "/etc/sudoers.d"
+
+// validateSudo rejects sudo policies that cannot be rendered safely
+func validateSudo(u config.User) error {
+	if len(u.SudoCommands) > 0 && (u.Sudo == "" || u.Sudo == "none") {
+		return fmt.Errorf("user %s: sudo_commands need sudo: password or nopasswd", u.Name)
+	}
+	for _, command := range u.SudoCommands {
+		if !strings.HasPrefix(command, "/") {
+			return fmt.Errorf("user %s: sudo command %q must be an absolute path", u.Name, command)
+		}
+		if strings.ContainsAny(command, "\n\r") {
+			return fmt.Errorf("user %s: sudo command %q spans several lines", u.Name, command)
+		}
+	}
+	for _, option := range u.SudoDefaults {
+		if option == "" || strings.ContainsAny(option, "\n\r,") {
+			return fmt.Errorf("user %s: invalid sudo default %q", u.Name, option)
+		}
+	}
+	return nil
+}
+
+// sudoersRule renders the sudo policy of a user, or nothing for none
+func sudoersRule(u config.User) string {
+	if u.Sudo != "password" && u.Sudo != "nopasswd" {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, option := range u.SudoDefaults {
+		fmt.Fprintf(&b, "Defaults:%s %s\n", u.Name, option)
+	}
+	commands := "ALL"
+	if len(u.SudoCommands) > 0 {
+		var escaped []string
+		for _, command := range u.SudoCommands {
+			escaped = append(escaped, sudoersEscape(command))
+		}
+		commands = strings.Join(escaped, ", ")
+	}
+	if u.Sudo == "nopasswd" {
+		commands = "NOPASSWD: " + commands
+	}
+	fmt.Fprintf(&b, "%s ALL=(ALL:ALL) %s\n", u.Name, commands)
+	return b.String()
+}
+
+// sudoersEscape escapes the characters sudoers gives a meaning inside a
+// command line
+func sudoersEscape(command string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, ",", `\,`, ":", `\:`, "=", `\=`)
+	return replacer.Replace(command)
+}
+
+// applySudoPolicy writes the sudoers.d file of a user, removing it for none
+func applySudoPolicy(u config.User) error {
+	rule := sudoersRule(u)
+	if rule == "" {
+		return removeSudoers(u.Name)
+	}
+
+	fmt.Printf("Configuring sudo for %s\n", u.Name)
+	path := filepath.Join(sudoersDir, "setupsuite-"+u.Name)
+	return writeSudoersFile(path, managedHeader+rule)
+}
+
+func removeSudoers(name string) error {
+	path := filepath.Join(sudoersDir, "setupsuite-"+name)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeSudoersFile writes a sudoers file next to path, checks it with
+// visudo -cf and only then moves it into place, so a broken rule never
+// locks anyone out of sudo
+func writeSudoersFile(path, content string) error {
+	if data, err := ioutil.ReadFile(path); err == nil && string(data) == content {
+		return nil
+	}
+	if _, err := exec.LookPath("visudo"); err != nil {
+		return fmt.Errorf("visudo not found, install sudo to grant sudo rights")
+	}
+	if err := VerboseMkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	tmp := path + ".setupsuite-new"
+	if err := VerboseWriteFile(tmp, content); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	// sudo refuses files others can write to
+	if err := os.Chmod(tmp, 0440); err != nil {
+		return err
+	}
+	if output, err := exec.Command("visudo", "-cf", tmp).CombinedOutput(); err != nil {
+		VerboseLogger.LogError("visudo rejected %s: %s", path, output)
+		return fmt.Errorf("visudo rejected %s: %s", path, lastLine(string(output)))
+	}
+	VerboseLogger.LogFileOperation("RENAME", path)
+	return os.Rename(tmp, path)
+}
+
+// prepareSudoers makes the main sudoers include sudoers.d and drops the
+// rules earlier versions appended to it for the managed users, which
+// would otherwise outlive a change of their sudo policy
+func prepareSudoers(users []config.User) error {
+	data, err := ioutil.ReadFile(sudoersPath)
+	if os.IsNotExist(err) {
+		// sudo is not installed, there is nothing to prepare
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, u := range users {
+		names = append(names, u.Name)
+	}
+	content := removeLegacySudoRules(string(data), names)
+	if !sudoersIncludesDir(content) {
+		if !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		content += "\n#includedir " + sudoersDir + "\n"
+	}
+	if content == string(data) {
+		return nil
+	}
+	fmt.Printf("Updating %s\n", sudoersPath)
+	return writeSudoersFile(sudoersPath, content)
+}
+
+// removeLegacySudoRules removes the `<user> ALL=(ALL:ALL) ALL` lines earlier
+// versions appended through visudo, including their duplicates
+func removeLegacySudoRules(content string, names []string) string {
+	legacy := make(map[string]bool)
+	for _, name := range names {
+		legacy[name+" ALL=(ALL:ALL) ALL"] = true
+	}
+
+	var kept []string
+	for _, line := range strings.Split(content, "\n") {
+		if !legacy[strings.TrimSpace(line)] {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// sudoersIncludesDir reports whether sudoers reads sudoersDir. Note that
+// "#includedir" is a directive while "# includedir" is a comment.
+func sudoersIncludesDir(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && (fields[0] == "#includedir" || fields[0] == "@includedir") && filepath.Clean(fields[1]) == filepath.Clean(sudoersDir) {
+			return true
+		}
+	}
+	return false
+}
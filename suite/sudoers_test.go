@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"suite/suite/config"
+)
+
+func TestValidateSudo(t *testing.T) {
+	tests := []struct {
+		user    config.User
+		wantErr bool
+	}{
+		{user: config.User{Name: "alice", Sudo: "password", SudoCommands: []string{"/usr/bin/apt-get update"}}},
+		{user: config.User{Name: "alice", Sudo: "password", SudoDefaults: []string{"use_pty", "logfile=/var/log/sudo.log"}}},
+		{user: config.User{Name: "alice", SudoCommands: []string{"/bin/true"}}, wantErr: true},
+		{user: config.User{Name: "alice", Sudo: "nopasswd", SudoCommands: []string{"systemctl"}}, wantErr: true},
+		{user: config.User{Name: "alice", Sudo: "nopasswd", SudoCommands: []string{"/bin/true\nalice ALL=(ALL) ALL"}}, wantErr: true},
+		{user: config.User{Name: "alice", Sudo: "password", SudoDefaults: []string{"use_pty, !authenticate"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateSudo(tt.user); (err != nil) != tt.wantErr {
+			t.Errorf("validateSudo(%+v) error = %v, wantErr %v", tt.user, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSudoersRule(t *testing.T) {
+	tests := []struct {
+		user config.User
+		want string
+	}{
+		{user: config.User{Name: "alice"}, want: ""},
+		{user: config.User{Name: "alice", Sudo: "none", SudoDefaults: []string{"use_pty"}}, want: ""},
+		{user: config.User{Name: "alice", Sudo: "password"}, want: "alice ALL=(ALL:ALL) ALL\n"},
+		{user: config.User{Name: "ci", Sudo: "nopasswd"}, want: "ci ALL=(ALL:ALL) NOPASSWD: ALL\n"},
+		{
+			user: config.User{Name: "ops", Sudo: "password", SudoCommands: []string{"/usr/bin/apt-get update"}},
+			want: "ops ALL=(ALL:ALL) /usr/bin/apt-get update\n",
+		},
+		{
+			user: config.User{Name: "deploy", Sudo: "nopasswd", SudoCommands: []string{"/usr/bin/systemctl restart app", "/usr/bin/journalctl -u app:*"}},
+			want: "deploy ALL=(ALL:ALL) NOPASSWD: /usr/bin/systemctl restart app, /usr/bin/journalctl -u app\\:*\n",
+		},
+		{
+			user: config.User{Name: "alice", Sudo: "password", SudoDefaults: []string{"use_pty", "logfile=/var/log/sudo-alice.log"}},
+			want: "Defaults:alice use_pty\nDefaults:alice logfile=/var/log/sudo-alice.log\nalice ALL=(ALL:ALL) ALL\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := sudoersRule(tt.user); got != tt.want {
+			t.Errorf("sudoersRule(%+v) = %q, want %q", tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestSudoersEscape(t *testing.T) {
+	if got := sudoersEscape(`/bin/sh -c a=b,c\d`); got != `/bin/sh -c a\=b\,c\\d` {
+		t.Errorf("sudoersEscape() = %q", got)
+	}
+}
+
+func TestRemoveLegacySudoRules(t *testing.T) {
+	content := "root ALL=(ALL:ALL) ALL\n#includedir /etc/sudoers.d\nwebadmin ALL=(ALL:ALL) ALL\nwebadmin ALL=(ALL:ALL) ALL\nother ALL=(ALL:ALL) ALL\n"
+	want := "root ALL=(ALL:ALL) ALL\n#includedir /etc/sudoers.d\nother ALL=(ALL:ALL) ALL\n"
+	if got := removeLegacySudoRules(content, []string{"webadmin"}); got != want {
+		t.Errorf("removeLegacySudoRules() = %q, want %q", got, want)
+	}
+}
+
+func TestSudoersIncludesDir(t *testing.T) {
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{content: "root ALL=(ALL:ALL) ALL\n#includedir /etc/sudoers.d\n", want: true},
+		{content: "@includedir /etc/sudoers.d/\n", want: true},
+		{content: "# includedir /etc/sudoers.d\n", want: false},
+		{content: "## Read drop-in files from /etc/sudoers.d\n# @includedir /etc/sudoers.d\n", want: false},
+	}
+	for _, tt := range tests {
+		if got := sudoersIncludesDir(tt.content); got != tt.want {
+			t.Errorf("sudoersIncludesDir(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
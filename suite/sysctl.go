@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"suite/suite/config"
+)
+
+// sysctlConfPath is read by systemd-sysctl and the procps and busybox
+// sysctl init scripts; 90- lets it override the distribution's defaults
+var sysctlConfPath = "/etc/sysctl.d/90-setupsuite.conf"
+
+// sysctlModulesPath loads the modules the bridge settings live in at boot
+var sysctlModulesPath = "/etc/modules-load.d/setupsuite-sysctl.conf"
+
+// procSysRoot holds the live kernel parameters
+var procSysRoot = "/proc/sys"
+
+// sysctlSetting is one kernel parameter
+type sysctlSetting struct {
+	Key   string
+	Value string
+}
+
+// sysctlProfiles are the built-in profiles, applied in the order listed
+var sysctlProfiles = map[string][]sysctlSetting{
+	"baseline-hardening": {
+		{"net.ipv4.conf.all.rp_filter", "1"},
+		{"net.ipv4.conf.default.rp_filter", "1"},
+		{"net.ipv4.tcp_syncookies", "1"},
+		{"net.ipv4.conf.all.accept_redirects", "0"},
+		{"net.ipv4.conf.default.accept_redirects", "0"},
+		{"net.ipv4.conf.all.secure_redirects", "0"},
+		{"net.ipv4.conf.default.secure_redirects", "0"},
+		{"net.ipv4.conf.all.send_redirects", "0"},
+		{"net.ipv4.conf.default.send_redirects", "0"},
+		{"net.ipv6.conf.all.accept_redirects", "0"},
+		{"net.ipv6.conf.default.accept_redirects", "0"},
+		{"net.ipv4.conf.all.accept_source_route", "0"},
+		{"net.ipv4.conf.all.log_martians", "1"},
+		{"net.ipv4.icmp_echo_ignore_broadcasts", "1"},
+		{"kernel.kptr_restrict", "2"},
+		{"kernel.dmesg_restrict", "1"},
+		{"fs.protected_hardlinks", "1"},
+		{"fs.protected_symlinks", "1"},
+	},
+	"docker-host": {
+		{"net.ipv4.ip_forward", "1"},
+		{"net.bridge.bridge-nf-call-iptables", "1"},
+		{"net.bridge.bridge-nf-call-ip6tables", "1"},
+	},
+	"high-connections": {
+		{"net.core.somaxconn", "65535"},
+		{"net.ipv4.tcp_max_syn_backlog", "65535"},
+		// Above the ports servers usually listen on
+		{"net.ipv4.ip_local_port_range", "10240 65535"},
+		{"fs.file-max", "2097152"},
+	},
+}
+
+// sysctlFloors are only ever raised. systemd sets fs.file-max to LONG_MAX
+// and the kernel scales its default with memory, both often above the
+// profile's value.
+var sysctlFloors = map[string]bool{
+	"fs.file-max": true,
+}
+
+// sysctlKeyPattern matches parameter names in dotted or slash form
+var sysctlKeyPattern = regexp.MustCompile(`^[a-z0-9_]+([./][a-zA-Z0-9_.\-]+)+$`)
+
+// sysctlProfilesFor returns the configured profiles, or those of the server
+// type: baseline-hardening everywhere, docker-host for docker and build
+// servers and high-connections for web and proxy servers
+func sysctlProfilesFor(s *config.Sysctl, serverType string) []string {
+	if len(s.Profiles) > 0 {
+		return s.Profiles
+	}
+	profiles := []string{"baseline-hardening"}
+	switch serverType {
+	case config.ServerTypeDocker, config.ServerTypeBuild:
+		profiles = append(profiles, "docker-host")
+	case config.ServerTypeWeb, config.ServerTypeProxy:
+		profiles = append(profiles, "high-connections")
+	}
+	return profiles
+}
+
+// sysctlSettings merges the profiles and the settings of the block. Later
+// profiles and the block's own settings win.
+func sysctlSettings(s *config.Sysctl, profiles []string) ([]sysctlSetting, error) {
+	var settings []sysctlSetting
+	index := make(map[string]int)
+	set := func(key, value string) {
+		if i, ok := index[key]; ok {
+			settings[i].Value = value
+			return
+		}
+		index[key] = len(settings)
+		settings = append(settings, sysctlSetting{key, value})
+	}
+
+	for _, name := range profiles {
+		profile, ok := sysctlProfiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown sysctl profile %q (use baseline-hardening, docker-host or high-connections)", name)
+		}
+		for _, setting := range profile {
+			set(setting.Key, setting.Value)
+		}
+	}
+
+	keys := make([]string, 0, len(s.Settings))
+	for key := range s.Settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := s.Settings[key]
+		if !sysctlKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid sysctl name %q", key)
+		}
+		if value == "" || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid value for sysctl %s", key)
+		}
+		set(key, value)
+	}
+	return settings, nil
+}
+
+// renderSysctlConf renders the sysctl.d file
+func renderSysctlConf(profiles []string, settings []sysctlSetting) string {
+	var b strings.Builder
+	b.WriteString(managedHeader)
+	fmt.Fprintf(&b, "# Profiles: %s\n", strings.Join(profiles, ", "))
+	for _, setting := range settings {
+		fmt.Fprintf(&b, "%s = %s\n", setting.Key, setting.Value)
+	}
+	return b.String()
+}
+
+// ApplySysctl writes the kernel parameters, loads them with sysctl --system
+// and reports those the kernel did not take
+func ApplySysctl(s *config.Sysctl, serverType string) error {
+	profiles := sysctlProfilesFor(s, serverType)
+	settings, err := sysctlSettings(s, profiles)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Applying sysctl profiles: %s\n", strings.Join(profiles, ", "))
+	VerboseLogger.LogInfo("Applying sysctl profiles: %s", strings.Join(profiles, ", "))
+
+	// The net.bridge parameters only exist once br_netfilter is loaded
+	for _, setting := range settings {
+		if strings.HasPrefix(setting.Key, "net.bridge.") {
+			if err := VerboseCommandRun("modprobe", "br_netfilter"); err != nil {
+				fmt.Printf("Warning: Could not load br_netfilter: %v\n", err)
+			}
+			if err := VerboseMkdirAll(filepath.Dir(sysctlModulesPath), 0755); err != nil {
+				return err
+			}
+			if err := VerboseWriteFile(sysctlModulesPath, managedHeader+"br_netfilter\n"); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	if err := VerboseMkdirAll(filepath.Dir(sysctlConfPath), 0755); err != nil {
+		return err
+	}
+	if err := VerboseWriteFile(sysctlConfPath, renderSysctlConf(profiles, raiseOnly(settings))); err != nil {
+		return err
+	}
+	if err := VerboseCommandRun("sysctl", "--system"); err != nil {
+		// busybox sysctl has no --system, and procps fails it on any
+		// parameter the kernel lacks
+		if err := VerboseCommandRun("sysctl", "-p", sysctlConfPath); err != nil {
+			fmt.Printf("Warning: sysctl reported errors: %v\n", err)
+		}
+	}
+
+	applied, mismatches, unavailable := compareSysctl(settings)
+	for _, mismatch := range mismatches {
+		fmt.Printf("Warning: sysctl %s\n", mismatch)
+		VerboseLogger.LogWarning("sysctl %s", mismatch)
+	}
+	for _, key := range unavailable {
+		fmt.Printf("Warning: sysctl %s is missing or read-only on this host\n", key)
+		VerboseLogger.LogWarning("sysctl %s is missing or read-only", key)
+	}
+	fmt.Printf("sysctl: %d of %d parameters applied\n", applied, len(settings))
+	return nil
+}
+
+// raiseOnly leaves out the floors the live value already meets, so the
+// file never lowers them
+func raiseOnly(settings []sysctlSetting) []sysctlSetting {
+	var kept []sysctlSetting
+	for _, setting := range settings {
+		if sysctlFloors[setting.Key] {
+			if live, err := liveSysctl(setting.Key); err == nil && sysctlAtLeast(live, setting.Value) {
+				VerboseLogger.LogInfo("sysctl %s is %s, keeping it above %s", setting.Key, live, setting.Value)
+				continue
+			}
+		}
+		kept = append(kept, setting)
+	}
+	return kept
+}
+
+// sysctlAtLeast reports whether the numeric value live is at least floor
+func sysctlAtLeast(live, floor string) bool {
+	l, err := strconv.ParseUint(live, 10, 64)
+	if err != nil {
+		return false
+	}
+	f, err := strconv.ParseUint(floor, 10, 64)
+	return err == nil && l >= f
+}
+
+// compareSysctl compares the settings with the live values. The keys of
+// parameters that containers and kernels without a module lack, or expose
+// read-only, are returned apart from the values that differ.
+func compareSysctl(settings []sysctlSetting) (applied int, mismatches, unavailable []string) {
+	for _, setting := range settings {
+		live, err := liveSysctl(setting.Key)
+		if err != nil {
+			VerboseLogger.LogInfo("sysctl %s: %v", setting.Key, err)
+			unavailable = append(unavailable, setting.Key)
+			continue
+		}
+		if sysctlFloors[setting.Key] && sysctlAtLeast(live, setting.Value) {
+			applied++
+			continue
+		}
+		if live != strings.Join(strings.Fields(setting.Value), " ") {
+			// Containers mount /proc/sys read-only
+			f, err := os.OpenFile(sysctlPath(setting.Key), os.O_WRONLY, 0)
+			if err != nil {
+				VerboseLogger.LogInfo("sysctl %s is %s and read-only: %v", setting.Key, live, err)
+				unavailable = append(unavailable, setting.Key)
+				continue
+			}
+			f.Close()
+			mismatches = append(mismatches, fmt.Sprintf("%s is %s, want %s", setting.Key, live, setting.Value))
+			continue
+		}
+		applied++
+	}
+	return applied, mismatches, unavailable
+}
+
+// liveSysctl reads a parameter from /proc/sys, normalizing whitespace
+func liveSysctl(key string) (string, error) {
+	data, err := ioutil.ReadFile(sysctlPath(key))
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(strings.Fields(string(data)), " "), nil
+}
+
+// sysctlPath returns the /proc/sys file of a parameter
+func sysctlPath(key string) string {
+	if !strings.Contains(key, "/") {
+		key = strings.Replace(key, ".", "/", -1)
+	}
+	return filepath.Join(procSysRoot, key)
+}
+
+// checkSysctl verifies that the live kernel parameters match the config.
+// Parameters the kernel lacks are listed but, as in ApplySysctl, not fatal.
+func checkSysctl(s *config.Sysctl, serverType string) (string, error) {
+	settings, err := sysctlSettings(s, sysctlProfilesFor(s, serverType))
+	if err != nil {
+		return "", err
+	}
+	applied, mismatches, unavailable := compareSysctl(settings)
+	if len(mismatches) > 0 {
+		return "", fmt.Errorf("%s", strings.Join(mismatches, "; "))
+	}
+	if len(unavailable) > 0 {
+		return fmt.Sprintf("%d parameters, not available: %s", applied, strings.Join(unavailable, ", ")), nil
+	}
+	return fmt.Sprintf("%d parameters", applied), nil
+}
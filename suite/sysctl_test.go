@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"suite/suite/config"
+)
+
+func TestSysctlProfilesFor(t *testing.T) {
+	tests := []struct {
+		sysctl     config.Sysctl
+		serverType string
+		want       string
+	}{
+		{serverType: "", want: "baseline-hardening"},
+		{serverType: config.ServerTypeDatabase, want: "baseline-hardening"},
+		{serverType: config.ServerTypeDocker, want: "baseline-hardening,docker-host"},
+		{serverType: config.ServerTypeBuild, want: "baseline-hardening,docker-host"},
+		{serverType: config.ServerTypeWeb, want: "baseline-hardening,high-connections"},
+		{sysctl: config.Sysctl{Profiles: []string{"high-connections"}}, serverType: config.ServerTypeDocker, want: "high-connections"},
+	}
+	for _, tt := range tests {
+		if got := sysctlProfilesFor(&tt.sysctl, tt.serverType); strings.Join(got, ",") != tt.want {
+			t.Errorf("sysctlProfilesFor(%q) = %v, want %s", tt.serverType, got, tt.want)
+		}
+	}
+}
+
+func TestSysctlSettings(t *testing.T) {
+	s := &config.Sysctl{Settings: map[string]string{
+		"vm.swappiness":      "10",
+		"net.core.somaxconn": "4096",
+	}}
+	settings, err := sysctlSettings(s, []string{"high-connections"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := renderSysctlConf([]string{"high-connections"}, settings)
+	want := `# Managed by SetupSuite. Changes are overwritten on the next run.
+# Profiles: high-connections
+net.core.somaxconn = 4096
+net.ipv4.tcp_max_syn_backlog = 65535
+net.ipv4.ip_local_port_range = 10240 65535
+fs.file-max = 2097152
+vm.swappiness = 10
+`
+	if got != want {
+		t.Errorf("renderSysctlConf() = %q, want %q", got, want)
+	}
+
+	errorCases := []struct {
+		profiles []string
+		settings map[string]string
+	}{
+		{profiles: []string{"paranoid"}},
+		{settings: map[string]string{"vm.swappiness; reboot": "1"}},
+		{settings: map[string]string{"swappiness": "1"}},
+		{settings: map[string]string{"vm.swappiness": "1\nkernel.panic = 1"}},
+	}
+	for _, tt := range errorCases {
+		if _, err := sysctlSettings(&config.Sysctl{Settings: tt.settings}, tt.profiles); err == nil {
+			t.Errorf("sysctlSettings(%v, %v) error = nil, want error", tt.profiles, tt.settings)
+		}
+	}
+}
+
+func TestCompareSysctl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setupsuite-sysctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldRoot := procSysRoot
+	procSysRoot = dir
+	defer func() { procSysRoot = oldRoot }()
+
+	os.MkdirAll(filepath.Join(dir, "net", "ipv4"), 0755)
+	os.MkdirAll(filepath.Join(dir, "kernel"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "net", "ipv4", "ip_local_port_range"), []byte("10240\t65535\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "kernel", "kptr_restrict"), []byte("0\n"), 0644)
+
+	settings := []sysctlSetting{
+		{"net.ipv4.ip_local_port_range", "10240 65535"},
+		{"kernel.kptr_restrict", "2"},
+		{"net.bridge.bridge-nf-call-iptables", "1"},
+	}
+	applied, mismatches, unavailable := compareSysctl(settings)
+	if applied != 1 || len(mismatches) != 1 || len(unavailable) != 1 {
+		t.Fatalf("compareSysctl() = %d, %v, %v", applied, mismatches, unavailable)
+	}
+	if mismatches[0] != "kernel.kptr_restrict is 0, want 2" || unavailable[0] != "net.bridge.bridge-nf-call-iptables" {
+		t.Errorf("compareSysctl() = %v, %v", mismatches, unavailable)
+	}
+
+	// fs.file-max is a floor, a larger live value stays
+	os.MkdirAll(filepath.Join(dir, "fs"), 0755)
+	floor := []sysctlSetting{{"fs.file-max", "2097152"}}
+	for _, tt := range []struct {
+		live    string
+		applied int
+		kept    int
+	}{
+		{"9223372036854775807", 1, 0},
+		{"2097152", 1, 0},
+		{"100000", 0, 1},
+	} {
+		ioutil.WriteFile(filepath.Join(dir, "fs", "file-max"), []byte(tt.live+"\n"), 0644)
+		applied, _, _ := compareSysctl(floor)
+		if kept := raiseOnly(floor); applied != tt.applied || len(kept) != tt.kept {
+			t.Errorf("fs.file-max %s: applied %d, kept %v", tt.live, applied, kept)
+		}
+	}
+
+	// A container without br_netfilter passes, a wrong value does not
+	docker := &config.Sysctl{Profiles: []string{"docker-host"}}
+	ioutil.WriteFile(filepath.Join(dir, "net", "ipv4", "ip_forward"), []byte("1\n"), 0644)
+	detail, err := checkSysctl(docker, "")
+	if err != nil || detail != "1 parameters, not available: net.bridge.bridge-nf-call-iptables, net.bridge.bridge-nf-call-ip6tables" {
+		t.Errorf("checkSysctl() = %q, %v", detail, err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "net", "ipv4", "ip_forward"), []byte("0\n"), 0644)
+	if _, err := checkSysctl(docker, ""); err == nil {
+		t.Error("checkSysctl() with ip_forward 0 error = nil")
+	}
+}
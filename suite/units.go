@@ -0,0 +1,438 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"suite/suite/config"
+)
+
+// systemdUnitDir holds the unit files SetupSuite installs
+var systemdUnitDir = "/etc/systemd/system"
+
+// openrcInitDir holds the OpenRC scripts SetupSuite installs
+var openrcInitDir = "/etc/init.d"
+
+var unitNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.@-]*$`)
+
+// shellSafePattern matches words that need no quoting in sh or systemd. The
+// executable must be one, since openrc-run evals it unquoted.
+var shellSafePattern = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// InstallUnits renders, validates and starts the custom daemons in .units{}
+func InstallUnits(units []config.Unit, initSystem string) error {
+	sm, err := NewServiceManager()
+	if err != nil {
+		return fmt.Errorf("could not detect service manager: %v", err)
+	}
+	if initSystem == "" || initSystem == "unknown" {
+		initSystem = sm.GetName()
+	}
+	if initSystem != "systemd" && initSystem != "openrc" {
+		return fmt.Errorf("custom units need systemd or OpenRC, this host uses %s", initSystem)
+	}
+
+	for _, unit := range units {
+		fmt.Printf("Installing %s unit %s...\n", initSystem, unit.Name)
+		if err := installUnit(sm, unit, initSystem); err != nil {
+			return fmt.Errorf("unit %s: %v", unit.Name, err)
+		}
+	}
+	return nil
+}
+
+// installUnit writes one unit and brings the service up. An unchanged unit
+// that is already running is left alone.
+func installUnit(sm ServiceManager, unit config.Unit, initSystem string) error {
+	if err := validateUnit(unit); err != nil {
+		return err
+	}
+
+	var path, content string
+	var mode os.FileMode
+	if initSystem == "systemd" {
+		path = filepath.Join(systemdUnitDir, unit.Name+".service")
+		content, mode = renderSystemdUnit(unit), 0644
+	} else {
+		for _, warning := range openrcUnsupportedOptions(unit) {
+			fmt.Printf("Warning: %s: %s\n", unit.Name, warning)
+		}
+		path = filepath.Join(openrcInitDir, unit.Name)
+		content, mode = renderOpenRCScript(unit), 0755
+	}
+
+	if err := verifyUnit(unit.Name, content, initSystem); err != nil {
+		return err
+	}
+
+	changed := false
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != content {
+		if err := VerboseWriteFile(path, content); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	if changed {
+		if err := sm.DaemonReload(); err != nil {
+			return fmt.Errorf("daemon reload failed: %v", err)
+		}
+		if sm.IsActive(unit.Name) {
+			return RestartAndVerify(sm, unit.Name)
+		}
+	} else if sm.IsEnabled(unit.Name) && sm.IsActive(unit.Name) {
+		fmt.Printf("%s is up to date\n", unit.Name)
+		return nil
+	}
+	return EnableAndStart(sm, unit.Name)
+}
+
+func validateUnit(unit config.Unit) error {
+	if !unitNamePattern.MatchString(unit.Name) {
+		return fmt.Errorf("invalid unit name %q", unit.Name)
+	}
+	args, err := splitExec(unit.Exec)
+	if err != nil {
+		return fmt.Errorf("exec %q: %v", unit.Exec, err)
+	}
+	if len(args) == 0 || !filepath.IsAbs(args[0]) {
+		return fmt.Errorf("exec must start with an absolute path, got %q", unit.Exec)
+	}
+	if !shellSafePattern.MatchString(args[0]) {
+		return fmt.Errorf("exec path %q contains characters that need quoting", args[0])
+	}
+	switch unit.Restart {
+	case "", "no", "on-failure", "always":
+	default:
+		return fmt.Errorf("unsupported restart policy %q (use no, on-failure or always)", unit.Restart)
+	}
+	for _, env := range unit.Environment {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || !envNamePattern.MatchString(parts[0]) {
+			return fmt.Errorf("environment entry %q is not KEY=value", env)
+		}
+	}
+
+	// The remaining fields are written verbatim, a newline would add
+	// directives and a space split a path list
+	if strings.IndexFunc(unit.Description, unicode.IsControl) >= 0 {
+		return fmt.Errorf("description contains control characters")
+	}
+	for field, name := range map[string]string{"user": unit.User, "group": unit.Group} {
+		if name != "" && !userNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid %s %q", field, name)
+		}
+	}
+	for _, after := range unit.After {
+		if !unitNamePattern.MatchString(after) {
+			return fmt.Errorf("invalid unit name %q in after", after)
+		}
+	}
+	paths := unit.ReadWritePaths
+	if unit.WorkingDirectory != "" {
+		paths = append([]string{unit.WorkingDirectory}, paths...)
+	}
+	for _, path := range paths {
+		if !filepath.IsAbs(path) || !shellSafePattern.MatchString(path) {
+			return fmt.Errorf("path %q must be absolute and contain no spaces, quotes or control characters", path)
+		}
+	}
+	for field, value := range map[string]string{"protect_system": unit.ProtectSystem, "protect_home": unit.ProtectHome} {
+		switch value {
+		case "", "true", "false", "full", "strict", "read-only", "tmpfs":
+		default:
+			return fmt.Errorf("unsupported %s %q", field, value)
+		}
+	}
+	return nil
+}
+
+// verifyUnit checks the rendered unit before it replaces the installed one
+func verifyUnit(name, content, initSystem string) error {
+	dir, err := ioutil.TempDir("", "setupsuite-unit")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if initSystem == "systemd" {
+		if _, err := exec.LookPath("systemd-analyze"); err != nil {
+			return nil
+		}
+		path := filepath.Join(dir, name+".service")
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+		if output, err := VerboseCommandOutput("systemd-analyze", "verify", path); err != nil {
+			return fmt.Errorf("systemd-analyze verify failed: %s", strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+		return err
+	}
+	if output, err := VerboseCommandOutput("sh", "-n", path); err != nil {
+		return fmt.Errorf("init script syntax check failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func renderSystemdUnit(unit config.Unit) string {
+	var b strings.Builder
+	b.WriteString(managedHeader + "[Unit]\n")
+	fmt.Fprintf(&b, "Description=%s\n", systemdEscape(unitDescription(unit), false))
+	after := append([]string{"network-online.target"}, unit.After...)
+	fmt.Fprintf(&b, "After=%s\n", strings.Join(after, " "))
+	b.WriteString("Wants=network-online.target\n")
+
+	b.WriteString("\n[Service]\nType=simple\n")
+	args, _ := splitExec(unit.Exec)
+	for i, arg := range args {
+		args[i] = systemdArg(arg)
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(args, " "))
+	if unit.User != "" {
+		fmt.Fprintf(&b, "User=%s\n", unit.User)
+	}
+	if unit.Group != "" {
+		fmt.Fprintf(&b, "Group=%s\n", unit.Group)
+	}
+	if unit.WorkingDirectory != "" {
+		fmt.Fprintf(&b, "WorkingDirectory=%s\n", unit.WorkingDirectory)
+	}
+	for _, env := range unit.Environment {
+		fmt.Fprintf(&b, "Environment=\"%s\"\n", systemdEscape(env, false))
+	}
+	fmt.Fprintf(&b, "Restart=%s\n", unitRestart(unit))
+	if unit.RestartSec > 0 {
+		fmt.Fprintf(&b, "RestartSec=%d\n", unit.RestartSec)
+	}
+
+	if unit.NoNewPrivileges {
+		b.WriteString("NoNewPrivileges=yes\n")
+	}
+	if unit.ProtectSystem != "" {
+		fmt.Fprintf(&b, "ProtectSystem=%s\n", systemdBool(unit.ProtectSystem))
+	}
+	if unit.ProtectHome != "" {
+		fmt.Fprintf(&b, "ProtectHome=%s\n", systemdBool(unit.ProtectHome))
+	}
+	if unit.PrivateTmp {
+		b.WriteString("PrivateTmp=yes\n")
+	}
+	if len(unit.ReadWritePaths) > 0 {
+		fmt.Fprintf(&b, "ReadWritePaths=%s\n", strings.Join(unit.ReadWritePaths, " "))
+	}
+
+	b.WriteString("\n[Install]\nWantedBy=multi-user.target\n")
+	return b.String()
+}
+
+func renderOpenRCScript(unit config.Unit) string {
+	args, _ := splitExec(unit.Exec)
+
+	var b strings.Builder
+	b.WriteString("#!/sbin/openrc-run\n" + managedHeader + "\n")
+	fmt.Fprintf(&b, "description=%s\n", shellQuote(unitDescription(unit)))
+	fmt.Fprintf(&b, "command=%s\n", shellQuote(args[0]))
+	if len(args) > 1 {
+		// openrc-run evals command_args, so every argument is quoted twice
+		words := make([]string, len(args)-1)
+		for i, arg := range args[1:] {
+			words[i] = shellWord(arg)
+		}
+		fmt.Fprintf(&b, "command_args=%s\n", shellQuote(strings.Join(words, " ")))
+	}
+	if unit.User != "" {
+		owner := unit.User
+		if unit.Group != "" {
+			owner += ":" + unit.Group
+		}
+		fmt.Fprintf(&b, "command_user=%s\n", shellQuote(owner))
+	}
+	if unit.WorkingDirectory != "" {
+		fmt.Fprintf(&b, "directory=%s\n", shellQuote(unit.WorkingDirectory))
+	}
+
+	if unitRestart(unit) == "no" {
+		b.WriteString("command_background=true\n")
+		b.WriteString("pidfile=\"/run/${RC_SVCNAME}.pid\"\n")
+	} else {
+		// supervise-daemon restarts the process when it exits
+		b.WriteString("supervisor=supervise-daemon\n")
+		b.WriteString("respawn_max=0\n")
+		if unit.RestartSec > 0 {
+			fmt.Fprintf(&b, "respawn_delay=%d\n", unit.RestartSec)
+		}
+	}
+	if unit.NoNewPrivileges {
+		b.WriteString("no_new_privs=yes\n")
+	}
+
+	if len(unit.Environment) > 0 {
+		b.WriteString("\n")
+		for _, env := range unit.Environment {
+			parts := strings.SplitN(env, "=", 2)
+			fmt.Fprintf(&b, "export %s=%s\n", parts[0], shellQuote(parts[1]))
+		}
+	}
+
+	b.WriteString("\ndepend() {\n\tneed net\n")
+	if len(unit.After) > 0 {
+		fmt.Fprintf(&b, "\tafter %s\n", strings.Join(unit.After, " "))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// openrcUnsupportedOptions lists hardening options OpenRC cannot apply
+func openrcUnsupportedOptions(unit config.Unit) []string {
+	var warnings []string
+	if unit.ProtectSystem != "" {
+		warnings = append(warnings, "protect_system is not supported by OpenRC and is ignored")
+	}
+	if unit.ProtectHome != "" {
+		warnings = append(warnings, "protect_home is not supported by OpenRC and is ignored")
+	}
+	if unit.PrivateTmp {
+		warnings = append(warnings, "private_tmp is not supported by OpenRC and is ignored")
+	}
+	if len(unit.ReadWritePaths) > 0 {
+		warnings = append(warnings, "read_write_paths is not supported by OpenRC and is ignored")
+	}
+	return warnings
+}
+
+func unitDescription(unit config.Unit) string {
+	if unit.Description != "" {
+		return unit.Description
+	}
+	return unit.Name
+}
+
+func unitRestart(unit config.Unit) string {
+	if unit.Restart == "" {
+		return "on-failure"
+	}
+	return unit.Restart
+}
+
+// systemdBool maps the config's true/false to systemd's yes/no and passes
+// other values like "strict" through
+func systemdBool(value string) string {
+	switch value {
+	case "true":
+		return "yes"
+	case "false":
+		return "no"
+	}
+	return value
+}
+
+// splitExec splits a command line into arguments the way sh does for
+// quotes: '...' is literal, "..." honours \" and \\, and a backslash outside
+// quotes escapes the next character. Variables are not expanded.
+func splitExec(command string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord, escaped := false, false
+	var quote rune
+	for _, r := range command {
+		switch {
+		case escaped:
+			// Inside double quotes only \" and \\ are escapes
+			if quote == '"' && r != '"' && r != '\\' {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else if r == '\\' {
+				escaped = true
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == '\\':
+			escaped, inWord = true, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// shellQuote quotes a value for sh. Nothing is expanded inside single
+// quotes; a single quote ends them, is escaped and reopens them.
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// shellWord leaves words that need no quoting bare
+func shellWord(value string) string {
+	if shellSafePattern.MatchString(value) {
+		return value
+	}
+	return shellQuote(value)
+}
+
+// systemdEscape escapes a value for systemd's double-quoted strings.
+// Specifiers are written as %%, and in command lines $ as $$ so systemd
+// does not substitute variables.
+func systemdEscape(value string, command bool) string {
+	pairs := []string{`\`, `\\`, `"`, `\"`, "\n", `\n`, "%", "%%"}
+	if command {
+		pairs = append(pairs, "$", "$$")
+	}
+	return strings.NewReplacer(pairs...).Replace(value)
+}
+
+// systemdArg renders one ExecStart argument
+func systemdArg(arg string) string {
+	switch {
+	case arg == ";":
+		// A lone ; separates commands
+		return `\;`
+	case shellSafePattern.MatchString(arg):
+		return systemdEscape(arg, true)
+	}
+	return `"` + systemdEscape(arg, true) + `"`
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"suite/suite/config"
+)
+
+func testUnit() config.Unit {
+	return config.Unit{
+		Name:             "metrics-agent",
+		Exec:             "/opt/metrics/agent --listen :9100",
+		User:             "metrics",
+		WorkingDirectory: "/opt/metrics",
+		Environment:      []string{"LOG_LEVEL=info"},
+		Restart:          "always",
+		RestartSec:       10,
+		ProtectSystem:    "strict",
+		ProtectHome:      "true",
+		NoNewPrivileges:  true,
+		ReadWritePaths:   []string{"/var/lib/metrics"},
+	}
+}
+
+func TestRenderSystemdUnit(t *testing.T) {
+	content := renderSystemdUnit(testUnit())
+
+	for _, want := range []string{
+		"Description=metrics-agent\n",
+		"After=network-online.target\n",
+		"ExecStart=/opt/metrics/agent --listen :9100\n",
+		"User=metrics\n",
+		"WorkingDirectory=/opt/metrics\n",
+		"Environment=\"LOG_LEVEL=info\"\n",
+		"Restart=always\n",
+		"RestartSec=10\n",
+		"NoNewPrivileges=yes\n",
+		"ProtectSystem=strict\n",
+		"ProtectHome=yes\n",
+		"ReadWritePaths=/var/lib/metrics\n",
+		"WantedBy=multi-user.target\n",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("renderSystemdUnit() missing %q in:\n%s", want, content)
+		}
+	}
+	if strings.Contains(content, "Group=") || strings.Contains(content, "PrivateTmp=") {
+		t.Errorf("renderSystemdUnit() rendered unset options:\n%s", content)
+	}
+}
+
+func TestRenderOpenRCScript(t *testing.T) {
+	content := renderOpenRCScript(testUnit())
+
+	for _, want := range []string{
+		"#!/sbin/openrc-run\n",
+		"command='/opt/metrics/agent'\n",
+		"command_args='--listen :9100'\n",
+		"command_user='metrics'\n",
+		"directory='/opt/metrics'\n",
+		"supervisor=supervise-daemon\n",
+		"respawn_delay=10\n",
+		"no_new_privs=yes\n",
+		"export LOG_LEVEL='info'\n",
+		"\tneed net\n",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("renderOpenRCScript() missing %q in:\n%s", want, content)
+		}
+	}
+
+	unit := testUnit()
+	unit.Restart = "no"
+	content = renderOpenRCScript(unit)
+	if strings.Contains(content, "supervise-daemon") || !strings.Contains(content, "command_background=true\n") {
+		t.Errorf("renderOpenRCScript() with restart no:\n%s", content)
+	}
+
+	if warnings := openrcUnsupportedOptions(testUnit()); len(warnings) != 3 {
+		t.Errorf("openrcUnsupportedOptions() = %v, want 3 warnings", warnings)
+	}
+}
+
+func TestUnitQuoting(t *testing.T) {
+	unit := testUnit()
+	unit.Exec = `/opt/metrics/agent --name "edge node" --label 'a"b' --cost $HOME%d ; \$(id)`
+	unit.Environment = []string{"GREETING=grüß $(reboot) `id` it's 50%"}
+
+	systemd := renderSystemdUnit(unit)
+	for _, want := range []string{
+		`ExecStart=/opt/metrics/agent --name "edge node" --label "a\"b" --cost "$$HOME%%d" \; "$$(id)"` + "\n",
+		"Environment=\"GREETING=grüß $(reboot) `id` it's 50%%\"\n",
+	} {
+		if !strings.Contains(systemd, want) {
+			t.Errorf("renderSystemdUnit() missing %q in:\n%s", want, systemd)
+		}
+	}
+
+	openrc := renderOpenRCScript(unit)
+	for _, want := range []string{
+		`command_args='--name '\''edge node'\'' --label '\''a"b'\'' --cost '\''$HOME%d'\'' '\'';'\'' '\''$(id)'\'''` + "\n",
+		"export GREETING='grüß $(reboot) `id` it'\\''s 50%'\n",
+	} {
+		if !strings.Contains(openrc, want) {
+			t.Errorf("renderOpenRCScript() missing %q in:\n%s", want, openrc)
+		}
+	}
+}
+
+func TestSplitExec(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+		wantErr bool
+	}{
+		{command: "/usr/bin/app  -v\t--port 80", want: []string{"/usr/bin/app", "-v", "--port", "80"}},
+		{command: `/usr/bin/app --name "a b" 'c "d"' e\ f`, want: []string{"/usr/bin/app", "--name", "a b", `c "d"`, "e f"}},
+		{command: `/usr/bin/app "say \"hi\" \n" ''`, want: []string{"/usr/bin/app", `say "hi" \n`, ""}},
+		{command: `/usr/bin/app "unterminated`, wantErr: true},
+		{command: `/usr/bin/app trailing\`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := splitExec(tt.command)
+		if (err != nil) != tt.wantErr || strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("splitExec(%q) = %q, %v", tt.command, got, err)
+		}
+	}
+}
+
+func TestValidateUnit(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*config.Unit)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(u *config.Unit) {}},
+		{name: "template name", modify: func(u *config.Unit) { u.Name = "worker@1" }},
+		{name: "name with slash", modify: func(u *config.Unit) { u.Name = "../etc/passwd" }, wantErr: true},
+		{name: "relative exec", modify: func(u *config.Unit) { u.Exec = "agent --listen :9100" }, wantErr: true},
+		{name: "empty exec", modify: func(u *config.Unit) { u.Exec = "" }, wantErr: true},
+		{name: "unknown restart", modify: func(u *config.Unit) { u.Restart = "sometimes" }, wantErr: true},
+		{name: "bad environment", modify: func(u *config.Unit) { u.Environment = []string{"LOG_LEVEL"} }, wantErr: true},
+		{name: "environment name with space", modify: func(u *config.Unit) { u.Environment = []string{"LOG LEVEL=info"} }, wantErr: true},
+		{name: "quoted args", modify: func(u *config.Unit) { u.Exec = `/opt/metrics/agent --name "edge node"` }},
+		{name: "unterminated quote", modify: func(u *config.Unit) { u.Exec = `/opt/metrics/agent --name "edge` }, wantErr: true},
+		{name: "exec path needs quoting", modify: func(u *config.Unit) { u.Exec = "/opt/$(id)/agent" }, wantErr: true},
+		{name: "user with newline", modify: func(u *config.Unit) { u.User = "metrics\nExecStartPre=/bin/sh" }, wantErr: true},
+		{name: "group with space", modify: func(u *config.Unit) { u.Group = "metrics root" }, wantErr: true},
+		{name: "relative working directory", modify: func(u *config.Unit) { u.WorkingDirectory = "opt/metrics" }, wantErr: true},
+		{name: "working directory with newline", modify: func(u *config.Unit) { u.WorkingDirectory = "/opt\nUser=root" }, wantErr: true},
+		{name: "after with newline", modify: func(u *config.Unit) { u.After = []string{"network.target\nExecStartPre=/bin/sh"} }, wantErr: true},
+		{name: "read write path with space", modify: func(u *config.Unit) { u.ReadWritePaths = []string{"/var/lib/metrics /etc"} }, wantErr: true},
+		{name: "description with newline", modify: func(u *config.Unit) { u.Description = "agent\nUser=root" }, wantErr: true},
+		{name: "unknown protect_system", modify: func(u *config.Unit) { u.ProtectSystem = "yes please" }, wantErr: true},
+		{name: "after units", modify: func(u *config.Unit) { u.After = []string{"postgresql.service", "redis"} }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unit := testUnit()
+			tt.modify(&unit)
+			err := validateUnit(unit)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateUnit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"suite/suite/config"
+)
+
+// UserManager creates and changes accounts with the tools of the distribution
+type UserManager interface {
+	GetName() string
+	// AddUser creates the account, with its own primary group and, unless it
+	// is a system user, a home directory
+	AddUser(u config.User) error
+	AddGroup(name string, gid int, system bool) error
+	// AddToGroups adds supplementary groups, keeping the existing ones
+	AddToGroups(name string, groups []string) error
+	SetShell(name, shell string) error
+	LockPassword(name string) error
+	DeleteUser(name string) error
+}
+
+// NewUserManager returns the user manager of the running system
+func NewUserManager() (UserManager, error) {
+	return selectUserManager(exec.LookPath)
+}
+
+// selectUserManager prefers the shadow tools, which Debian's adduser wraps
+// as well, and falls back to busybox on Alpine and other minimal systems
+func selectUserManager(lookPath func(string) (string, error)) (UserManager, error) {
+	if _, err := lookPath("useradd"); err == nil {
+		return &ShadowUserManager{}, nil
+	}
+	if _, err := lookPath("adduser"); err == nil {
+		return &BusyboxUserManager{}, nil
+	}
+	return nil, fmt.Errorf("neither useradd nor adduser found")
+}
+
+// defaultShell returns bash for login users where installed and nologin for
+// system users
+func defaultShell(system bool) string {
+	candidates := []string{"/bin/bash", "/bin/sh"}
+	if system {
+		candidates = []string{"/usr/sbin/nologin", "/sbin/nologin", "/bin/false"}
+	}
+	for _, shell := range candidates {
+		if _, err := os.Stat(shell); err == nil {
+			return shell
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// ShadowUserManager uses useradd, usermod, groupadd and userdel
+type ShadowUserManager struct{}
+
+func (um *ShadowUserManager) GetName() string { return "shadow" }
+
+func (um *ShadowUserManager) AddUser(u config.User) error {
+	return VerboseCommandRun("useradd", shadowUserAddArgs(u, defaultShell(u.System))...)
+}
+
+// shadowUserAddArgs returns the useradd arguments for a user. A pinned GID
+// names a primary group created beforehand under the user's name.
+func shadowUserAddArgs(u config.User, shell string) []string {
+	if u.Shell != "" {
+		shell = u.Shell
+	}
+	args := []string{"-s", shell}
+	if u.System {
+		args = append(args, "-r", "-M")
+	} else {
+		args = append(args, "-m")
+	}
+	if u.UID > 0 {
+		args = append(args, "-u", strconv.Itoa(u.UID))
+	}
+	if u.GID > 0 {
+		args = append(args, "-g", u.Name)
+	} else {
+		// openSUSE puts new users into "users" unless told otherwise
+		args = append(args, "-U")
+	}
+	return append(args, u.Name)
+}
+
+func (um *ShadowUserManager) AddGroup(name string, gid int, system bool) error {
+	var args []string
+	if gid > 0 {
+		args = append(args, "-g", strconv.Itoa(gid))
+	}
+	if system {
+		args = append(args, "-r")
+	}
+	return VerboseCommandRun("groupadd", append(args, name)...)
+}
+
+func (um *ShadowUserManager) AddToGroups(name string, groups []string) error {
+	return VerboseCommandRun("usermod", "-aG", strings.Join(groups, ","), name)
+}
+
+func (um *ShadowUserManager) SetShell(name, shell string) error {
+	return VerboseCommandRun("usermod", "-s", shell, name)
+}
+
+func (um *ShadowUserManager) LockPassword(name string) error {
+	return VerboseCommandRun("usermod", "-L", name)
+}
+
+func (um *ShadowUserManager) DeleteUser(name string) error {
+	return VerboseCommandRun("userdel", name)
+}
+
+// BusyboxUserManager uses busybox adduser, addgroup and deluser, which take
+// different flags than Debian's adduser and have no usermod
+type BusyboxUserManager struct{}
+
+func (um *BusyboxUserManager) GetName() string { return "busybox" }
+
+func (um *BusyboxUserManager) AddUser(u config.User) error {
+	return VerboseCommandRun("adduser", busyboxAddUserArgs(u, defaultShell(u.System))...)
+}
+
+// busyboxAddUserArgs returns the adduser arguments for a user. -D leaves the
+// password unset, -G picks the primary group.
+func busyboxAddUserArgs(u config.User, shell string) []string {
+	if u.Shell != "" {
+		shell = u.Shell
+	}
+	args := []string{"-D", "-s", shell}
+	if u.System {
+		args = append(args, "-S", "-H")
+	}
+	if u.UID > 0 {
+		args = append(args, "-u", strconv.Itoa(u.UID))
+	}
+	if u.GID > 0 {
+		args = append(args, "-G", u.Name)
+	}
+	return append(args, u.Name)
+}
+
+func (um *BusyboxUserManager) AddGroup(name string, gid int, system bool) error {
+	var args []string
+	if gid > 0 {
+		args = append(args, "-g", strconv.Itoa(gid))
+	}
+	if system {
+		args = append(args, "-S")
+	}
+	return VerboseCommandRun("addgroup", append(args, name)...)
+}
+
+func (um *BusyboxUserManager) AddToGroups(name string, groups []string) error {
+	for _, group := range groups {
+		if userInGroup(name, group) {
+			continue
+		}
+		if err := VerboseCommandRun("addgroup", name, group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetShell edits the passwd file, busybox has no usermod
+func (um *BusyboxUserManager) SetShell(name, shell string) error {
+	return updateFile(passwdPath, func(content string) string {
+		return setPasswdShell(content, name, shell)
+	})
+}
+
+func (um *BusyboxUserManager) LockPassword(name string) error {
+	return VerboseCommandRun("passwd", "-l", name)
+}
+
+func (um *BusyboxUserManager) DeleteUser(name string) error {
+	return VerboseCommandRun("deluser", name)
+}
+
+// setPasswdShell replaces the login shell of a user in passwd content
+func setPasswdShell(content, name, shell string) string {
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) == 7 && fields[0] == name {
+			fields[6] = shell
+			lines[i] = strings.Join(fields, ":")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// userInGroup reports whether a user is a supplementary member of a group
+func userInGroup(name, group string) bool {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return false
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return false
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, id := range ids {
+		if id == g.Gid {
+			return true
+		}
+	}
+	return false
+}
+
+// passwdShell returns the login shell of a user from the passwd file
+func passwdShell(name string) string {
+	data, err := ioutil.ReadFile(passwdPath)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) == 7 && fields[0] == name {
+			return fields[6]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"suite/suite/config"
+)
+
+func TestSelectUserManager(t *testing.T) {
+	tests := []struct {
+		tools []string
+		want  string
+	}{
+		{tools: []string{"useradd", "adduser"}, want: "shadow"},
+		{tools: []string{"useradd"}, want: "shadow"},
+		{tools: []string{"adduser"}, want: "busybox"},
+		{tools: nil, want: ""},
+	}
+	for _, tt := range tests {
+		lookPath := func(name string) (string, error) {
+			for _, tool := range tt.tools {
+				if tool == name {
+					return "/usr/sbin/" + name, nil
+				}
+			}
+			return "", fmt.Errorf("%s not found", name)
+		}
+		um, err := selectUserManager(lookPath)
+		got := ""
+		if err == nil {
+			got = um.GetName()
+		}
+		if got != tt.want {
+			t.Errorf("selectUserManager(%v) = %q, want %q", tt.tools, got, tt.want)
+		}
+	}
+}
+
+func TestUserAddArgs(t *testing.T) {
+	tests := []struct {
+		user    config.User
+		shadow  string
+		busybox string
+	}{
+		{
+			user:    config.User{Name: "alice"},
+			shadow:  "-s /bin/bash -m -U alice",
+			busybox: "-D -s /bin/bash alice",
+		},
+		{
+			user:    config.User{Name: "alice", Shell: "/bin/zsh", UID: 1500, GID: 1500},
+			shadow:  "-s /bin/zsh -m -u 1500 -g alice alice",
+			busybox: "-D -s /bin/zsh -u 1500 -G alice alice",
+		},
+		{
+			user:    config.User{Name: "backup", System: true},
+			shadow:  "-s /bin/bash -r -M -U backup",
+			busybox: "-D -s /bin/bash -S -H backup",
+		},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(shadowUserAddArgs(tt.user, "/bin/bash"), " "); got != tt.shadow {
+			t.Errorf("shadowUserAddArgs(%+v) = %q, want %q", tt.user, got, tt.shadow)
+		}
+		if got := strings.Join(busyboxAddUserArgs(tt.user, "/bin/bash"), " "); got != tt.busybox {
+			t.Errorf("busyboxAddUserArgs(%+v) = %q, want %q", tt.user, got, tt.busybox)
+		}
+	}
+}
+
+func TestSetPasswdShell(t *testing.T) {
+	content := "root:x:0:0:root:/root:/bin/ash\nalice:x:1000:1000:Linux User,,,:/home/alice:/bin/ash\n"
+	want := "root:x:0:0:root:/root:/bin/ash\nalice:x:1000:1000:Linux User,,,:/home/alice:/bin/zsh\n"
+	if got := setPasswdShell(content, "alice", "/bin/zsh"); got != want {
+		t.Errorf("setPasswdShell() = %q, want %q", got, want)
+	}
+}
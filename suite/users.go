@@ -0,0 +1,413 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"suite/suite/config"
+)
+
+// passwdPath is read for the login shell, which os/user does not expose
+var passwdPath = "/etc/passwd"
+
+// shadowPath is read to tell whether a password is locked
+var shadowPath = "/etc/shadow"
+
+// sshLoginGroup is the group sshd admits unless .ssh{} allows others
+const sshLoginGroup = "sshuser"
+
+// userNamePattern is the portable subset of user names useradd accepts
+var userNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// configuredUsers returns the .users block, with the single ssh_user of
+// .setup_secure{} added as a password sudoer unless it is declared there
+func configuredUsers(cfg *config.ServerConfig) []config.User {
+	users := cfg.Users
+	if cfg.SetupSecure == nil || cfg.SetupSecure.SSHUser == "" {
+		return users
+	}
+	for _, u := range users {
+		if u.Name == cfg.SetupSecure.SSHUser {
+			return users
+		}
+	}
+
+	legacy := config.User{Name: cfg.SetupSecure.SSHUser, Sudo: "password"}
+	if key := cfg.SetupSecure.UserSSHRSA; key != "" {
+		// The placeholder is kept, so the key check refuses it
+		legacy.Keys = []string{key}
+	}
+	return append([]config.User{legacy}, users...)
+}
+
+// validateUser rejects users SetupSuite cannot apply safely
+func validateUser(u config.User) error {
+	if !userNamePattern.MatchString(u.Name) {
+		return fmt.Errorf("invalid user name %q", u.Name)
+	}
+	switch u.State {
+	case "", "present":
+	case "absent":
+		if u.Name == "root" {
+			return fmt.Errorf("refusing to remove root")
+		}
+	default:
+		return fmt.Errorf("user %s: unknown state %q (use present or absent)", u.Name, u.State)
+	}
+	if u.UID < 0 || u.GID < 0 {
+		return fmt.Errorf("user %s: uid and gid must be positive", u.Name)
+	}
+	switch u.Sudo {
+	case "", "none", "password", "nopasswd":
+	default:
+		return fmt.Errorf("user %s: unknown sudo policy %q (use none, password or nopasswd)", u.Name, u.Sudo)
+	}
+	return validateSudo(u)
+}
+
+// sshMinRSABits returns the shortest RSA key the config accepts
+func sshMinRSABits(cfg *config.SetupSecure) int {
+	if cfg != nil && cfg.SSH != nil && cfg.SSH.MinRSABits > 0 {
+		return cfg.SSH.MinRSABits
+	}
+	return defaultMinRSABits
+}
+
+// ApplyUsers creates, updates and removes the configured users. Every key is
+// checked before the first account is touched.
+func ApplyUsers(users []config.User, minRSABits int) error {
+	keys := make(map[string][]*SSHPublicKey)
+	for _, u := range users {
+		if err := validateUser(u); err != nil {
+			return err
+		}
+		if u.State == "absent" {
+			continue
+		}
+		parsed, err := parseUserKeys(u.Name, u.Keys, minRSABits)
+		if err != nil {
+			return err
+		}
+		keys[u.Name] = parsed
+	}
+	um, err := NewUserManager()
+	if err != nil {
+		return fmt.Errorf("could not detect user manager: %v", err)
+	}
+	if err := prepareSudoers(users); err != nil {
+		return fmt.Errorf("could not prepare %s: %v", sudoersPath, err)
+	}
+
+	for _, u := range users {
+		if u.State == "absent" {
+			if err := removeUser(um, u); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ensureUser(um, u, keys[u.Name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureUser creates the user if missing and brings its shell, groups,
+// keys and sudo rights to the configured state
+func ensureUser(um UserManager, u config.User, keys []*SSHPublicKey) error {
+	if existing, err := user.Lookup(u.Name); err != nil {
+		if err := addUser(um, u); err != nil {
+			return err
+		}
+	} else {
+		// Changing the IDs of an existing user would orphan their files
+		if u.UID > 0 && existing.Uid != strconv.Itoa(u.UID) {
+			fmt.Printf("Warning: User %s has UID %s, not the configured %d\n", u.Name, existing.Uid, u.UID)
+		}
+		if u.GID > 0 && existing.Gid != strconv.Itoa(u.GID) {
+			fmt.Printf("Warning: User %s has GID %s, not the configured %d\n", u.Name, existing.Gid, u.GID)
+		}
+		if u.Shell != "" && passwdShell(u.Name) != u.Shell {
+			fmt.Printf("Changing shell of %s to %s\n", u.Name, u.Shell)
+			if err := um.SetShell(u.Name, u.Shell); err != nil {
+				return fmt.Errorf("could not change shell of %s: %v", u.Name, err)
+			}
+		}
+	}
+
+	if u.LockPassword && !passwordLocked(u.Name) {
+		fmt.Printf("Locking the password of %s\n", u.Name)
+		if err := um.LockPassword(u.Name); err != nil {
+			return fmt.Errorf("could not lock the password of %s: %v", u.Name, err)
+		}
+	}
+
+	groups := userGroups(u)
+	for _, group := range groups {
+		if _, err := user.LookupGroup(group); err != nil {
+			fmt.Printf("Adding group %s\n", group)
+			if err := um.AddGroup(group, 0, false); err != nil {
+				return fmt.Errorf("could not add group %s: %v", group, err)
+			}
+		}
+	}
+	// Groups are added, memberships granted outside SetupSuite stay
+	if len(groups) > 0 {
+		if err := um.AddToGroups(u.Name, groups); err != nil {
+			return fmt.Errorf("could not add %s to %s: %v", u.Name, strings.Join(groups, ", "), err)
+		}
+	}
+
+	// Without keys an existing authorized_keys is emptied, so removing the
+	// last key revokes it. A missing one grants nothing and is not created,
+	// system users often have no home directory.
+	authKeys := filepath.Join(userHome(u.Name), ".ssh", "authorized_keys")
+	if _, err := os.Lstat(authKeys); len(keys) > 0 || err == nil {
+		if err := writeAuthorizedKeys(u.Name, keys); err != nil {
+			return fmt.Errorf("could not write keys of %s: %v", u.Name, err)
+		}
+		if len(keys) == 0 {
+			fmt.Printf("Removed all SSH keys of %s\n", u.Name)
+		} else {
+			fmt.Printf("Installed %d SSH key(s) for %s:\n", len(keys), u.Name)
+		}
+		for _, key := range keys {
+			fmt.Printf("  %s\n", key)
+			VerboseLogger.LogInfo("SSH key of %s: %s", u.Name, key)
+		}
+	}
+	return applySudoPolicy(u)
+}
+
+// addUser creates a user, and its primary group first if the GID is pinned
+func addUser(um UserManager, u config.User) error {
+	fmt.Printf("Adding user %s\n", u.Name)
+	VerboseLogger.LogInfo("Creating user %s with %s", u.Name, um.GetName())
+
+	if u.GID > 0 {
+		group, err := user.LookupGroup(u.Name)
+		if err != nil {
+			if err := um.AddGroup(u.Name, u.GID, u.System); err != nil {
+				return fmt.Errorf("could not add group %s: %v", u.Name, err)
+			}
+		} else if group.Gid != strconv.Itoa(u.GID) {
+			return fmt.Errorf("group %s exists with GID %s, not the configured %d", u.Name, group.Gid, u.GID)
+		}
+	}
+	if err := um.AddUser(u); err != nil {
+		return fmt.Errorf("could not add user %s: %v", u.Name, err)
+	}
+	return nil
+}
+
+// userGroups returns the supplementary groups of a user, sshuser first
+// unless it is a system user, which never logs in over SSH
+func userGroups(u config.User) []string {
+	var groups []string
+	seen := make(map[string]bool)
+	if !u.System {
+		groups = append(groups, sshLoginGroup)
+		seen[sshLoginGroup] = true
+	}
+	for _, group := range u.Groups {
+		if !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// removeUser deletes the account and its sudo rights but keeps the home
+// directory, which may hold data someone still needs
+func removeUser(um UserManager, u config.User) error {
+	if err := removeSudoers(u.Name); err != nil {
+		return err
+	}
+	if _, err := user.Lookup(u.Name); err != nil {
+		return nil
+	}
+	fmt.Printf("Removing user %s\n", u.Name)
+	VerboseLogger.LogInfo("Removing user: %s", u.Name)
+	if err := um.DeleteUser(u.Name); err != nil {
+		return fmt.Errorf("could not remove user %s: %v", u.Name, err)
+	}
+	return nil
+}
+
+// userHome returns the home directory of a user from passwd
+func userHome(name string) string {
+	if u, err := user.Lookup(name); err == nil && u.HomeDir != "" {
+		return u.HomeDir
+	}
+	return "/home/" + name
+}
+
+// passwordLocked reports whether the shadow entry of a user is locked
+func passwordLocked(name string) bool {
+	data, err := ioutil.ReadFile(shadowPath)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) > 1 && fields[0] == name {
+			return strings.HasPrefix(fields[1], "!")
+		}
+	}
+	return false
+}
+
+// renderAuthorizedKeys returns authorized_keys holding exactly keys
+func renderAuthorizedKeys(keys []*SSHPublicKey) string {
+	var b strings.Builder
+	b.WriteString(managedHeader)
+	for _, key := range keys {
+		b.WriteString(key.Line() + "\n")
+	}
+	return b.String()
+}
+
+// writeAuthorizedKeys replaces the authorized_keys of a user, so keys
+// removed from the config lose access
+func writeAuthorizedKeys(name string, keys []*SSHPublicKey) error {
+	VerboseLogger.LogInfo("Setting up SSH keys for user: %s", name)
+	return writeAuthorizedKeysFile(name, renderAuthorizedKeys(keys))
+}
+
+// writeAuthorizedKeysFile replaces ~/.ssh/authorized_keys of a user with
+// content, owned by the user with mode 0600
+func writeAuthorizedKeysFile(name, content string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	return writeAuthorizedKeysAt(userHome(name), uid, gid, content)
+}
+
+// writeAuthorizedKeysAt writes authorized_keys below home. The user owns
+// .ssh and may have replaced it or the file with a symlink to /etc/shadow,
+// so nothing is followed: .ssh is opened with O_NOFOLLOW, the new file is
+// created exclusively next to the old one, chowned through its descriptor
+// and renamed over it.
+func writeAuthorizedKeysAt(home string, uid, gid int, content string) error {
+	path := filepath.Join(home, ".ssh", "authorized_keys")
+	VerboseLogger.LogFileOperation("WRITE_FILE", path)
+	VerboseLogger.LogFileContent(path, content)
+	if previous, err := readAuthorizedKeysAt(home); err != nil || string(previous) != content {
+		changedFiles[path] = true
+	}
+
+	dirFd, err := openSSHDir(home, true)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirFd)
+	// sshd ignores keys that others can write to
+	if err := syscall.Fchown(dirFd, uid, gid); err != nil {
+		return &os.PathError{Op: "chown", Path: filepath.Dir(path), Err: err}
+	}
+	if err := syscall.Fchmod(dirFd, 0700); err != nil {
+		return &os.PathError{Op: "chmod", Path: filepath.Dir(path), Err: err}
+	}
+
+	const tmpName = ".authorized_keys.setupsuite"
+	syscall.Unlinkat(dirFd, tmpName)
+	fd, err := syscall.Openat(dirFd, tmpName, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0600)
+	if err != nil {
+		return &os.PathError{Op: "create", Path: filepath.Join(filepath.Dir(path), tmpName), Err: err}
+	}
+	file := os.NewFile(uintptr(fd), filepath.Join(filepath.Dir(path), tmpName))
+	_, err = file.WriteString(content)
+	if err == nil {
+		err = file.Chown(uid, gid)
+	}
+	if err == nil {
+		err = file.Chmod(0600)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		syscall.Unlinkat(dirFd, tmpName)
+		return err
+	}
+	if err := syscall.Renameat(dirFd, tmpName, dirFd, "authorized_keys"); err != nil {
+		syscall.Unlinkat(dirFd, tmpName)
+		return &os.PathError{Op: "rename", Path: path, Err: err}
+	}
+	return nil
+}
+
+// readAuthorizedKeysFile reads ~/.ssh/authorized_keys of a user, refusing
+// symlinks and anything but a regular file
+func readAuthorizedKeysFile(name string) ([]byte, error) {
+	return readAuthorizedKeysAt(userHome(name))
+}
+
+func readAuthorizedKeysAt(home string) ([]byte, error) {
+	path := filepath.Join(home, ".ssh", "authorized_keys")
+	dirFd, err := openSSHDir(home, false)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirFd)
+
+	// O_NONBLOCK keeps a FIFO from blocking the open
+	fd, err := syscall.Openat(dirFd, "authorized_keys", syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err == syscall.ELOOP {
+		return nil, fmt.Errorf("%s is a symlink, refusing to follow it", path)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	file := os.NewFile(uintptr(fd), path)
+	defer file.Close()
+	if info, err := file.Stat(); err != nil || !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	return ioutil.ReadAll(file)
+}
+
+// openSSHDir opens home/.ssh without following a symlink, creating it if
+// create is set
+func openSSHDir(home string, create bool) (int, error) {
+	path := filepath.Join(home, ".ssh")
+	homeFd, err := syscall.Open(home, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: home, Err: err}
+	}
+	defer syscall.Close(homeFd)
+
+	const flags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	fd, err := syscall.Openat(homeFd, ".ssh", flags, 0)
+	if err == syscall.ENOENT && create {
+		VerboseLogger.LogFileOperation("MKDIR", path)
+		if err := syscall.Mkdirat(homeFd, ".ssh", 0700); err != nil && err != syscall.EEXIST {
+			return -1, &os.PathError{Op: "mkdir", Path: path, Err: err}
+		}
+		fd, err = syscall.Openat(homeFd, ".ssh", flags, 0)
+	}
+	if err == syscall.ELOOP || err == syscall.ENOTDIR {
+		return -1, fmt.Errorf("%s is a symlink or not a directory, refusing to follow it", path)
+	}
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return fd, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"suite/suite/config"
+)
+
+func TestConfiguredUsers(t *testing.T) {
+	cfg := &config.ServerConfig{
+		SetupSecure: &config.SetupSecure{SSHUser: "webadmin", UserSSHRSA: "ssh-ed25519 AAAA webadmin@laptop"},
+		Users:       []config.User{{Name: "alice"}},
+	}
+	users := configuredUsers(cfg)
+	if len(users) != 2 || users[0].Name != "webadmin" || users[0].Sudo != "password" || len(users[0].Keys) != 1 {
+		t.Errorf("configuredUsers() = %+v", users)
+	}
+
+	// A user declared in .users{} wins over ssh_user
+	cfg.Users = []config.User{{Name: "webadmin", Sudo: "nopasswd"}}
+	if users := configuredUsers(cfg); len(users) != 1 || users[0].Sudo != "nopasswd" {
+		t.Errorf("configuredUsers() = %+v", users)
+	}
+}
+
+func TestValidateUser(t *testing.T) {
+	tests := []struct {
+		user    config.User
+		wantErr bool
+	}{
+		{user: config.User{Name: "alice", Sudo: "password"}},
+		{user: config.User{Name: "deploy", Sudo: "nopasswd", SudoCommands: []string{"/usr/bin/systemctl restart app"}}},
+		{user: config.User{Name: "bob", State: "absent"}},
+		{user: config.User{Name: "Alice'; rm -rf /"}, wantErr: true},
+		{user: config.User{Name: "root", State: "absent"}, wantErr: true},
+		{user: config.User{Name: "alice", State: "gone"}, wantErr: true},
+		{user: config.User{Name: "alice", Sudo: "always"}, wantErr: true},
+		{user: config.User{Name: "alice", Sudo: "none", SudoCommands: []string{"/bin/true"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateUser(tt.user); (err != nil) != tt.wantErr {
+			t.Errorf("validateUser(%+v) error = %v, wantErr %v", tt.user, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRenderAuthorizedKeys(t *testing.T) {
+	keys, err := parseUserKeys("alice", []string{testEd25519Key, "  " + testECDSA384Key + " "}, defaultMinRSABits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := renderAuthorizedKeys(keys)
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "#") || lines[2] != testECDSA384Key {
+		t.Errorf("renderAuthorizedKeys() = %q", got)
+	}
+
+	// Without keys only the header is left, which authorizes nobody
+	if got := renderAuthorizedKeys(nil); strings.Count(got, "\n") != 1 || !strings.HasPrefix(got, "#") {
+		t.Errorf("renderAuthorizedKeys(nil) = %q", got)
+	}
+}
+
+func TestUserGroups(t *testing.T) {
+	got := userGroups(config.User{Groups: []string{"docker", "sshuser", "adm", "docker"}})
+	if strings.Join(got, ",") != "sshuser,docker,adm" {
+		t.Errorf("userGroups() = %v", got)
+	}
+	if got := userGroups(config.User{System: true, Groups: []string{"docker"}}); strings.Join(got, ",") != "docker" {
+		t.Errorf("userGroups() of a system user = %v", got)
+	}
+}
+
+func TestPasswdShell(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setupsuite-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldPath := passwdPath
+	passwdPath = filepath.Join(dir, "passwd")
+	defer func() { passwdPath = oldPath }()
+
+	ioutil.WriteFile(passwdPath, []byte("root:x:0:0:root:/root:/bin/bash\nalice:x:1000:1000::/home/alice:/bin/zsh\n"), 0644)
+	if got := passwdShell("alice"); got != "/bin/zsh" {
+		t.Errorf("passwdShell(alice) = %q, want /bin/zsh", got)
+	}
+	if got := passwdShell("bob"); got != "" {
+		t.Errorf("passwdShell(bob) = %q, want empty", got)
+	}
+}
+
+func TestPasswordLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setupsuite-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldPath := shadowPath
+	shadowPath = filepath.Join(dir, "shadow")
+	defer func() { shadowPath = oldPath }()
+
+	ioutil.WriteFile(shadowPath, []byte("alice:!$6$abc:19000:0:99999:7:::\nbob:$6$def:19000:0:99999:7:::\n"), 0600)
+	if !passwordLocked("alice") {
+		t.Error("passwordLocked(alice) = false, want true")
+	}
+	if passwordLocked("bob") || passwordLocked("carol") {
+		t.Error("passwordLocked() = true for an unlocked or missing user")
+	}
+}
+
+func TestWriteAuthorizedKeysRefusesSymlinks(t *testing.T) {
+	uid, gid := os.Getuid(), os.Getgid()
+	home := t.TempDir()
+	target := filepath.Join(t.TempDir(), "shadow")
+	if err := os.WriteFile(target, []byte("root:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A symlinked authorized_keys is replaced, its target left alone
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	authKeys := filepath.Join(home, ".ssh", "authorized_keys")
+	if err := os.Symlink(target, authKeys); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAuthorizedKeysAt(home); err == nil {
+		t.Error("readAuthorizedKeysAt() followed the symlink")
+	}
+	if err := writeAuthorizedKeysAt(home, uid, gid, "ssh-ed25519 AAAA alice\n"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(target); err != nil || string(data) != "root:secret\n" {
+		t.Errorf("symlink target = %q, %v", data, err)
+	}
+	info, err := os.Lstat(authKeys)
+	if err != nil || !info.Mode().IsRegular() || info.Mode().Perm() != 0600 {
+		t.Errorf("authorized_keys = %v, %v", info, err)
+	}
+	if data, err := readAuthorizedKeysAt(home); err != nil || string(data) != "ssh-ed25519 AAAA alice\n" {
+		t.Errorf("readAuthorizedKeysAt() = %q, %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(home, ".ssh")); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf(".ssh = %v, %v", info, err)
+	}
+
+	// A symlinked .ssh is refused
+	other := t.TempDir()
+	if err := os.Symlink(filepath.Dir(target), filepath.Join(other, ".ssh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAuthorizedKeysAt(other, uid, gid, "ssh-ed25519 AAAA alice\n"); err == nil {
+		t.Error("writeAuthorizedKeysAt() followed a symlinked .ssh")
+	}
+	if _, err := os.Lstat(filepath.Join(filepath.Dir(target), "authorized_keys")); !os.IsNotExist(err) {
+		t.Errorf("authorized_keys written through the symlink: %v", err)
+	}
+
+	// A missing .ssh is created
+	fresh := t.TempDir()
+	if _, err := readAuthorizedKeysAt(fresh); !os.IsNotExist(err) {
+		t.Errorf("readAuthorizedKeysAt() without .ssh error = %v", err)
+	}
+	if err := writeAuthorizedKeysAt(fresh, uid, gid, ""); err != nil {
+		t.Fatal(err)
+	}
+}